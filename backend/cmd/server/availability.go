@@ -0,0 +1,636 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxAvailabilityWindows    = 50
+	maxAvailabilityExceptions = 100
+	maxExceptionLength        = 14 * 24 * time.Hour
+	maxExceptionLead          = 365 * 24 * time.Hour
+	overlapDefaultDays        = 7
+	overlapMaxDays            = 28
+	overlapMaxUsers           = 10
+	overlapMaxFollowing       = 200
+	minutesPerDay             = 24 * 60
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// AvailabilityWindow is a weekly slot in its owner's time zone, stored as
+// minutes from local midnight. End may be 24:00.
+type AvailabilityWindow struct {
+	Weekday     int `json:"-" db:"weekday"`
+	StartMinute int `json:"-" db:"start_minute"`
+	EndMinute   int `json:"-" db:"end_minute"`
+}
+
+type availabilityWindowJSON struct {
+	Day   string `json:"day"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (a AvailabilityWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(availabilityWindowJSON{
+		Day:   strings.ToLower(time.Weekday(a.Weekday).String()),
+		Start: formatMinuteOfDay(a.StartMinute),
+		End:   formatMinuteOfDay(a.EndMinute),
+	})
+}
+
+func (a *AvailabilityWindow) UnmarshalJSON(data []byte) error {
+	var raw availabilityWindowJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	day, ok := weekdayNames[strings.ToLower(raw.Day)]
+	if !ok {
+		return fmt.Errorf("%q is not a day of the week", raw.Day)
+	}
+	start, err := parseMinuteOfDay(raw.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseMinuteOfDay(raw.End)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		return fmt.Errorf("window on %s must end after it starts; split windows that cross midnight", raw.Day)
+	}
+
+	a.Weekday, a.StartMinute, a.EndMinute = int(day), start, end
+	return nil
+}
+
+// parseMinuteOfDay reads "HH:MM" as minutes since midnight, allowing 24:00.
+func parseMinuteOfDay(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+func formatMinuteOfDay(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+// AvailabilityException is a one-off change to the weekly schedule: time
+// off, or extra time when Available is set.
+type AvailabilityException struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"-" db:"user_id"`
+	StartsAt  time.Time `json:"start" db:"starts_at"`
+	EndsAt    time.Time `json:"end" db:"ends_at"`
+	Available bool      `json:"available" db:"available"`
+}
+
+// timeInterval is a half-open span of time.
+type timeInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// normalizeIntervals sorts intervals and merges any that overlap or touch.
+func normalizeIntervals(intervals []timeInterval) []timeInterval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+
+	var merged []timeInterval
+	for _, in := range intervals {
+		if !in.Start.Before(in.End) {
+			continue
+		}
+		if n := len(merged); n > 0 && !in.Start.After(merged[n-1].End) {
+			if in.End.After(merged[n-1].End) {
+				merged[n-1].End = in.End
+			}
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// intersectIntervals returns the time covered by both normalized lists.
+func intersectIntervals(a, b []timeInterval) []timeInterval {
+	var out []timeInterval
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		start := a[i].Start
+		if b[j].Start.After(start) {
+			start = b[j].Start
+		}
+		end := a[i].End
+		if b[j].End.Before(end) {
+			end = b[j].End
+		}
+		if start.Before(end) {
+			out = append(out, timeInterval{start, end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+// subtractIntervals removes the time covered by b from normalized list a.
+func subtractIntervals(a, b []timeInterval) []timeInterval {
+	var out []timeInterval
+	for _, in := range a {
+		pieces := []timeInterval{in}
+		for _, cut := range b {
+			var next []timeInterval
+			for _, p := range pieces {
+				if !cut.Start.Before(p.End) || !cut.End.After(p.Start) {
+					next = append(next, p)
+					continue
+				}
+				if p.Start.Before(cut.Start) {
+					next = append(next, timeInterval{p.Start, cut.Start})
+				}
+				if cut.End.Before(p.End) {
+					next = append(next, timeInterval{cut.End, p.End})
+				}
+			}
+			pieces = next
+		}
+		out = append(out, pieces...)
+	}
+	return out
+}
+
+// userAvailability is one user's schedule, ready to expand.
+type userAvailability struct {
+	Username   string
+	Location   *time.Location
+	Windows    []AvailabilityWindow
+	Exceptions []AvailabilityException
+}
+
+// intervals expands the schedule into concrete times between from and to.
+// Windows are laid out on local calendar days, so a 18:00-22:00 slot stays
+// at 18:00 local across DST changes even though its UTC time moves.
+func (a *userAvailability) intervals(from, to time.Time) []timeInterval {
+	var out []timeInterval
+
+	// Start a day early to catch windows that began before from
+	local := from.In(a.Location)
+	day := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, a.Location)
+	for day.Before(to) {
+		for _, w := range a.Windows {
+			if int(day.Weekday()) != w.Weekday {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.StartMinute, 0, 0, a.Location)
+			end := time.Date(day.Year(), day.Month(), day.Day(), 0, w.EndMinute, 0, 0, a.Location)
+			out = append(out, timeInterval{start, end})
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, a.Location)
+	}
+
+	var extra, blocked []timeInterval
+	for _, e := range a.Exceptions {
+		if e.Available {
+			extra = append(extra, timeInterval{e.StartsAt, e.EndsAt})
+		} else {
+			blocked = append(blocked, timeInterval{e.StartsAt, e.EndsAt})
+		}
+	}
+
+	out = subtractIntervals(normalizeIntervals(out), blocked)
+	out = normalizeIntervals(append(out, extra...))
+	return intersectIntervals(out, []timeInterval{{from, to}})
+}
+
+// userLocation loads a profile time zone, falling back to UTC.
+func userLocation(timezone *string) *time.Location {
+	if timezone == nil || *timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// loadAvailability fetches the schedules of the given users.
+func loadAvailability(userIDs []int) (map[int]*userAvailability, error) {
+	var users []struct {
+		ID       int     `db:"id"`
+		Username string  `db:"username"`
+		Timezone *string `db:"timezone"`
+	}
+	err := db.Select(&users, "SELECT id, username, timezone FROM users WHERE id = ANY($1)", pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := make(map[int]*userAvailability, len(users))
+	for _, u := range users {
+		schedules[u.ID] = &userAvailability{Username: u.Username, Location: userLocation(u.Timezone)}
+	}
+
+	var windows []struct {
+		UserID int `db:"user_id"`
+		AvailabilityWindow
+	}
+	err = db.Select(&windows, `
+		SELECT user_id, weekday, start_minute, end_minute
+		FROM availability_windows WHERE user_id = ANY($1)
+	`, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		if s := schedules[w.UserID]; s != nil {
+			s.Windows = append(s.Windows, w.AvailabilityWindow)
+		}
+	}
+
+	var exceptions []AvailabilityException
+	err = db.Select(&exceptions, `
+		SELECT id, user_id, starts_at, ends_at, available
+		FROM availability_exceptions
+		WHERE user_id = ANY($1) AND ends_at > $2
+	`, pq.Array(userIDs), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exceptions {
+		if s := schedules[e.UserID]; s != nil {
+			e.StartsAt, e.EndsAt = e.StartsAt.UTC(), e.EndsAt.UTC()
+			s.Exceptions = append(s.Exceptions, e)
+		}
+	}
+
+	return schedules, nil
+}
+
+func getAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	schedules, err := loadAvailability([]int{userID})
+	if err != nil {
+		log.Printf("Error fetching availability: %v", err)
+		http.Error(w, `{"error":"Failed to fetch availability"}`, http.StatusInternalServerError)
+		return
+	}
+	schedule := schedules[userID]
+
+	response := map[string]interface{}{
+		"timezone":   schedule.Location.String(),
+		"windows":    []AvailabilityWindow{},
+		"exceptions": []AvailabilityException{},
+	}
+	if len(schedule.Windows) > 0 {
+		sort.Slice(schedule.Windows, func(i, j int) bool {
+			a, b := schedule.Windows[i], schedule.Windows[j]
+			return a.Weekday*minutesPerDay+a.StartMinute < b.Weekday*minutesPerDay+b.StartMinute
+		})
+		response["windows"] = schedule.Windows
+	}
+	if len(schedule.Exceptions) > 0 {
+		response["exceptions"] = schedule.Exceptions
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// putAvailabilityHandler replaces the user's weekly windows. Times are in
+// the time zone on their profile.
+func putAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Windows []AvailabilityWindow `json:"windows"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, "Invalid availability: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(req.Windows) > maxAvailabilityWindows {
+		http.Error(w, fmt.Sprintf(`{"error":"At most %d windows are allowed"}`, maxAvailabilityWindows), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM availability_windows WHERE user_id = $1", userID); err != nil {
+		log.Printf("Error clearing availability: %v", err)
+		http.Error(w, `{"error":"Error saving availability"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, window := range req.Windows {
+		_, err := tx.Exec(`
+			INSERT INTO availability_windows (user_id, weekday, start_minute, end_minute)
+			VALUES ($1, $2, $3, $4)
+		`, userID, window.Weekday, window.StartMinute, window.EndMinute)
+		if err != nil {
+			log.Printf("Error saving availability: %v", err)
+			http.Error(w, `{"error":"Error saving availability"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing availability update"}`, http.StatusInternalServerError)
+		return
+	}
+
+	getAvailabilityHandler(w, r)
+}
+
+func createAvailabilityExceptionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Start     time.Time `json:"start"`
+		End       time.Time `json:"end"`
+		Available bool      `json:"available"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if !req.End.After(req.Start) || req.End.Sub(req.Start) > maxExceptionLength {
+		http.Error(w, `{"error":"Exceptions must end after they start and last at most 14 days"}`, http.StatusBadRequest)
+		return
+	}
+	if !req.End.After(now) || req.Start.After(now.Add(maxExceptionLead)) {
+		http.Error(w, `{"error":"Exceptions must be in the coming year"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var upcoming int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM availability_exceptions WHERE user_id = $1 AND ends_at > $2
+	`, userID, now.UTC()).Scan(&upcoming)
+	if err != nil {
+		log.Printf("Error counting exceptions: %v", err)
+		http.Error(w, `{"error":"Error saving exception"}`, http.StatusInternalServerError)
+		return
+	}
+	if upcoming >= maxAvailabilityExceptions {
+		http.Error(w, fmt.Sprintf(`{"error":"At most %d upcoming exceptions are allowed"}`, maxAvailabilityExceptions), http.StatusBadRequest)
+		return
+	}
+
+	exception := AvailabilityException{StartsAt: req.Start.UTC(), EndsAt: req.End.UTC(), Available: req.Available}
+	err = db.QueryRow(`
+		INSERT INTO availability_exceptions (user_id, starts_at, ends_at, available)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, exception.StartsAt, exception.EndsAt, exception.Available).Scan(&exception.ID)
+	if err != nil {
+		log.Printf("Error saving exception: %v", err)
+		http.Error(w, `{"error":"Error saving exception"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(exception)
+}
+
+func deleteAvailabilityExceptionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	result, err := db.Exec(`
+		DELETE FROM availability_exceptions
+		WHERE id = $1 AND user_id = (SELECT id FROM users WHERE username = $2)
+	`, id, claims.Username)
+	if err != nil {
+		log.Printf("Error deleting exception: %v", err)
+		http.Error(w, `{"error":"Error deleting exception"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No exception of yours with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Exception deleted"})
+}
+
+type UserOverlap struct {
+	Username string         `json:"username"`
+	Windows  []timeInterval `json:"windows"`
+}
+
+// getAvailabilityOverlapHandler finds when the viewer and other players are
+// all free, reported in the viewer's time zone. With ?users=a,b it returns
+// the times everyone shares; with ?following=true it returns, for each
+// followed user, the times they share with the viewer.
+func getAvailabilityOverlapHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	query := r.URL.Query()
+
+	var viewer struct {
+		ID       int     `db:"id"`
+		Timezone *string `db:"timezone"`
+	}
+	if err := db.Get(&viewer, "SELECT id, timezone FROM users WHERE username = $1", claims.Username); err != nil {
+		http.Error(w, `{"error":"Failed to get user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	loc := userLocation(viewer.Timezone)
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil || tz == "Local" {
+			http.Error(w, `{"error":"tz must be an IANA time zone name"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	days := overlapDefaultDays
+	if d := query.Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days < 1 || days > overlapMaxDays {
+			http.Error(w, fmt.Sprintf(`{"error":"days must be between 1 and %d"}`, overlapMaxDays), http.StatusBadRequest)
+			return
+		}
+	}
+	minDuration := time.Duration(0)
+	if m := query.Get("minMinutes"); m != "" {
+		minutes, err := strconv.Atoi(m)
+		if err != nil || minutes < 0 {
+			http.Error(w, `{"error":"Invalid minMinutes"}`, http.StatusBadRequest)
+			return
+		}
+		minDuration = time.Duration(minutes) * time.Minute
+	}
+
+	// Only schedules the viewer could see on the profile take part
+	conditions := []string{notBlockedSQL("$1"), visibleToViewerSQL("$1"), "u.id <> $1"}
+	args := []interface{}{viewer.ID}
+	following := query.Get("following") == "true"
+	var usernames []string
+	if following {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM followers f WHERE f.follower_id = $1 AND f.following_id = u.id
+		)`)
+	} else {
+		// The viewer is always included, so naming them or anyone twice
+		// changes nothing
+		seen := map[string]bool{claims.Username: true}
+		for _, name := range strings.Split(query.Get("users"), ",") {
+			if name = strings.TrimSpace(name); name != "" && !seen[name] {
+				seen[name] = true
+				usernames = append(usernames, name)
+			}
+		}
+		if len(usernames) == 0 || len(usernames) > overlapMaxUsers {
+			http.Error(w, fmt.Sprintf(`{"error":"Pass between 1 and %d users, or following=true"}`, overlapMaxUsers), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "u.username = ANY($2)")
+		args = append(args, pq.Array(usernames))
+	}
+
+	var others []int
+	err := db.Select(&others, fmt.Sprintf(`
+		SELECT u.id FROM users u WHERE %s ORDER BY u.username LIMIT %d
+	`, strings.Join(conditions, " AND "), overlapMaxFollowing), args...)
+	if err != nil {
+		log.Printf("Error resolving overlap users: %v", err)
+		http.Error(w, `{"error":"Failed to compute overlap"}`, http.StatusInternalServerError)
+		return
+	}
+	if !following && len(others) < len(usernames) {
+		http.Error(w, `{"error":"Some of those users were not found"}`, http.StatusNotFound)
+		return
+	}
+
+	schedules, err := loadAvailability(append(others, viewer.ID))
+	if err != nil {
+		log.Printf("Error fetching availability: %v", err)
+		http.Error(w, `{"error":"Failed to compute overlap"}`, http.StatusInternalServerError)
+		return
+	}
+
+	from := time.Now().Truncate(time.Minute)
+	to := from.AddDate(0, 0, days)
+	mine := schedules[viewer.ID].intervals(from, to)
+
+	// present drops slots that are too short and shows the rest in the
+	// viewer's zone
+	present := func(intervals []timeInterval) []timeInterval {
+		out := []timeInterval{}
+		for _, in := range intervals {
+			if in.End.Sub(in.Start) >= minDuration {
+				out = append(out, timeInterval{in.Start.In(loc), in.End.In(loc)})
+			}
+		}
+		return out
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if following {
+		overlaps := []UserOverlap{}
+		for _, id := range others {
+			shared := present(intersectIntervals(mine, schedules[id].intervals(from, to)))
+			if len(shared) > 0 {
+				overlaps = append(overlaps, UserOverlap{Username: schedules[id].Username, Windows: shared})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"timezone": loc.String(),
+			"overlaps": overlaps,
+		})
+		return
+	}
+
+	shared := mine
+	usernames = []string{}
+	for _, id := range others {
+		shared = intersectIntervals(shared, schedules[id].intervals(from, to))
+		usernames = append(usernames, schedules[id].Username)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timezone": loc.String(),
+		"users":    usernames,
+		"windows":  present(shared),
+	})
+}
+
+// availableNowSQL is true for rows of users u whose schedule says they are
+// free right now, evaluated in each user's own time zone.
+const availableNowSQL = `(
+	EXISTS (
+		SELECT 1 FROM availability_exceptions ax
+		WHERE ax.user_id = u.id AND ax.available
+		AND (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') >= ax.starts_at
+		AND (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') < ax.ends_at
+	)
+	OR (
+		EXISTS (
+			SELECT 1 FROM availability_windows aw,
+			LATERAL (SELECT CURRENT_TIMESTAMP AT TIME ZONE COALESCE(NULLIF(u.timezone, ''), 'UTC') AS local_now) l
+			WHERE aw.user_id = u.id
+			AND aw.weekday = EXTRACT(DOW FROM l.local_now)
+			AND EXTRACT(HOUR FROM l.local_now) * 60 + EXTRACT(MINUTE FROM l.local_now) >= aw.start_minute
+			AND EXTRACT(HOUR FROM l.local_now) * 60 + EXTRACT(MINUTE FROM l.local_now) < aw.end_minute
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM availability_exceptions ax
+			WHERE ax.user_id = u.id AND NOT ax.available
+			AND (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') >= ax.starts_at
+			AND (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') < ax.ends_at
+		)
+	)
+)`
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type BlockedUser struct {
+	Username  string    `json:"username" db:"username"`
+	BlockedAt time.Time `json:"blockedAt" db:"created_at"`
+}
+
+// hasBlocked reports whether blockerID has blocked blockedID.
+func hasBlocked(blockerID, blockedID int) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_blocks
+			WHERE blocker_id = $1 AND blocked_id = $2
+		)
+	`, blockerID, blockedID).Scan(&blocked)
+	return blocked, err
+}
+
+// resolveRelationshipTarget looks up the authenticated user and the user named
+// in the URL, rejecting attempts to target yourself with selfError.
+func resolveRelationshipTarget(w http.ResponseWriter, r *http.Request, selfError string) (int, int, bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	targetUsername := mux.Vars(r)["username"]
+
+	if claims.Username == targetUsername {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, selfError), http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return 0, 0, false
+	}
+
+	targetID, err := getUserID(targetUsername)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error":"Failed to get target user"}`, http.StatusInternalServerError)
+		}
+		return 0, 0, false
+	}
+
+	return userID, targetID, true
+}
+
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	blockerID, targetID, ok := resolveRelationshipTarget(w, r, "Cannot block yourself")
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO user_blocks (blocker_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, blockerID, targetID)
+	if err != nil {
+		log.Printf("Error blocking user: %v", err)
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Remove follow relationships in both directions
+	_, err = tx.Exec(`
+		DELETE FROM followers
+		WHERE (follower_id = $1 AND following_id = $2)
+		OR (follower_id = $2 AND following_id = $1)
+	`, blockerID, targetID)
+	if err != nil {
+		log.Printf("Error removing follow relationships: %v", err)
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Cancel any follow requests between the two users
+	_, err = tx.Exec(`
+		DELETE FROM follow_requests
+		WHERE (requester_id = $1 AND target_id = $2)
+		OR (requester_id = $2 AND target_id = $1)
+	`, blockerID, targetID)
+	if err != nil {
+		log.Printf("Error cancelling follow requests: %v", err)
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// A block supersedes any removal that could otherwise be undone
+	_, err = tx.Exec(`
+		DELETE FROM removed_followers
+		WHERE (user_id = $1 AND follower_id = $2)
+		OR (user_id = $2 AND follower_id = $1)
+	`, blockerID, targetID)
+	if err != nil {
+		log.Printf("Error clearing removed followers: %v", err)
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing block action"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, blockerID, targetID, "User blocked")
+}
+
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	blockerID, targetID, ok := resolveRelationshipTarget(w, r, "Cannot block yourself")
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec(`
+		DELETE FROM user_blocks
+		WHERE blocker_id = $1 AND blocked_id = $2
+	`, blockerID, targetID)
+	if err != nil {
+		log.Printf("Error unblocking user: %v", err)
+		http.Error(w, `{"error":"Error unblocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, blockerID, targetID, "User unblocked")
+}
+
+func getBlockedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	blocked := []BlockedUser{}
+	err := db.Select(&blocked, `
+		SELECT u.username, b.created_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY b.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error fetching blocked users: %v", err)
+		http.Error(w, `{"error":"Failed to fetch blocked users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocked)
+}
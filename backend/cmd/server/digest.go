@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	digestSweepInterval = 15 * time.Minute
+	// Digests go out once a day or week, at the first sweep after this
+	// local hour that isn't in the user's quiet hours
+	digestHour     = 9
+	digestMaxItems = 20
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var (
+	digestTextTemplate = template.Must(template.ParseFS(templateFS, "templates/digest.txt.tmpl"))
+	digestHTMLTemplate = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/digest.html.tmpl"))
+)
+
+type digestItem struct {
+	Summary string
+	When    string
+}
+
+type digestData struct {
+	Username      string
+	Frequency     string
+	Period        string
+	Notifications []digestItem
+	More          int
+	URL           string
+}
+
+type digestRecipient struct {
+	ID              int        `db:"id"`
+	Username        string     `db:"username"`
+	Email           string     `db:"email"`
+	Timezone        *string    `db:"timezone"`
+	Frequency       string     `db:"digest_frequency"`
+	QuietHoursStart *int       `db:"quiet_hours_start"`
+	QuietHoursEnd   *int       `db:"quiet_hours_end"`
+	LastDigestAt    *time.Time `db:"last_digest_at"`
+}
+
+// digestPeriodStart is when the recipient's current day or week began, in
+// their time zone. Weeks start on Monday.
+func digestPeriodStart(frequency string, local time.Time) time.Time {
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	if frequency == DigestWeekly {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+// digestDue reports whether the recipient should get a digest at now.
+func (d *digestRecipient) digestDue(now time.Time) bool {
+	loc := userLocation(d.Timezone)
+	local := now.In(loc)
+	if local.Hour() < digestHour || inQuietHours(d.QuietHoursStart, d.QuietHoursEnd, loc, now) {
+		return false
+	}
+	return d.LastDigestAt == nil || d.LastDigestAt.Before(digestPeriodStart(d.Frequency, local))
+}
+
+// DigestStore is where the digest sweeper finds who to email and what to
+// tell them.
+type DigestStore interface {
+	// Recipients returns everyone with a confirmed email address and digests
+	// on
+	Recipients() ([]*digestRecipient, error)
+	// Unread returns up to limit of the user's unread notifications updated
+	// after since, leaving out types they've turned off for email, newest
+	// first. It also returns how many there are in all.
+	Unread(userID int, since time.Time, limit int) ([]Notification, int, error)
+	// Sent records that the user has had their digest for the period
+	Sent(userID int, at time.Time) error
+}
+
+type dbDigestStore struct{}
+
+func (dbDigestStore) Recipients() ([]*digestRecipient, error) {
+	var recipients []*digestRecipient
+	err := db.Select(&recipients, `
+		SELECT id, username, email, timezone, digest_frequency,
+			quiet_hours_start, quiet_hours_end, last_digest_at
+		FROM users
+		WHERE email IS NOT NULL AND email_verified_at IS NOT NULL AND digest_frequency <> $1
+	`, DigestOff)
+	return recipients, err
+}
+
+func (dbDigestStore) Unread(userID int, since time.Time, limit int) ([]Notification, int, error) {
+	var rows []struct {
+		Notification
+		Total int `db:"total"`
+	}
+	err := db.Select(&rows, `
+		SELECT *, cardinality(actors) AS actor_count, COUNT(*) OVER () AS total FROM (
+			SELECT `+notificationColumns+`
+			FROM notifications n
+			WHERE n.user_id = $1 AND n.read_at IS NULL AND n.updated_at > $2
+			AND `+notificationChannelEnabledSQL("n.user_id", "n.type", NotificationChannelEmail)+`
+		) visible
+		WHERE cardinality(actors) > 0
+		ORDER BY updated_at DESC, id DESC
+		LIMIT $3
+	`, userID, since.UTC(), limit)
+	if err != nil || len(rows) == 0 {
+		return nil, 0, err
+	}
+
+	notifications := make([]Notification, len(rows))
+	for i, row := range rows {
+		notifications[i] = row.Notification
+	}
+	return notifications, rows[0].Total, nil
+}
+
+func (dbDigestStore) Sent(userID int, at time.Time) error {
+	_, err := db.Exec(`UPDATE users SET last_digest_at = $2 WHERE id = $1`, userID, at.UTC())
+	return err
+}
+
+// renderDigest builds the recipient's digest email from their unread
+// notifications, or returns nil if there is nothing to tell them.
+func renderDigest(store DigestStore, d *digestRecipient, now time.Time) (*Email, error) {
+	since := now.AddDate(0, 0, -1)
+	period := "since yesterday"
+	if d.Frequency == DigestWeekly {
+		since = now.AddDate(0, 0, -7)
+		period = "this week"
+	}
+	if d.LastDigestAt != nil && d.LastDigestAt.After(since) {
+		since = *d.LastDigestAt
+	}
+
+	notifications, total, err := store.Unread(d.ID, since, digestMaxItems)
+	if err != nil {
+		return nil, err
+	}
+	if len(notifications) == 0 {
+		return nil, nil
+	}
+
+	loc := userLocation(d.Timezone)
+	data := digestData{
+		Username:  d.Username,
+		Frequency: d.Frequency,
+		Period:    period,
+		More:      total - len(notifications),
+	}
+	if appURL := os.Getenv("APP_URL"); appURL != "" {
+		data.URL = strings.TrimSuffix(appURL, "/") + "/notifications"
+	}
+	for i := range notifications {
+		n := &notifications[i]
+		n.summarize()
+		data.Notifications = append(data.Notifications, digestItem{
+			Summary: n.Summary,
+			When:    n.UpdatedAt.In(loc).Format("Mon Jan 2, 15:04"),
+		})
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	subject := "Your daily Pixel & Chill digest"
+	if d.Frequency == DigestWeekly {
+		subject = "Your weekly Pixel & Chill digest"
+	}
+	return &Email{To: d.Email, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
+
+// sendDigests emails every user whose digest is due. A user with nothing
+// unread is marked as done for the period without being sent anything; one
+// whose digest fails to send is tried again at the next sweep.
+func sendDigests(store DigestStore, m Mailer, now time.Time) (int, error) {
+	recipients, err := store.Recipients()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, d := range recipients {
+		if !d.digestDue(now) {
+			continue
+		}
+
+		email, err := renderDigest(store, d, now)
+		if err != nil {
+			log.Printf("Error rendering digest for %s: %v", d.Username, err)
+			continue
+		}
+		if email != nil {
+			if err := m.Send(*email); err != nil {
+				log.Printf("Error sending digest to %s: %v", d.Username, err)
+				continue
+			}
+			sent++
+		}
+
+		if err := store.Sent(d.ID, now); err != nil {
+			log.Printf("Error recording digest for %s: %v", d.Username, err)
+		}
+	}
+	return sent, nil
+}
+
+func runDigestSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sent, err := sendDigests(dbDigestStore{}, mailer, time.Now())
+		if err != nil {
+			log.Printf("Error sending digests: %v", err)
+			continue
+		}
+		if sent > 0 {
+			log.Printf("Sent %d notification digests", sent)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryDigestStore holds recipients and their unread notifications in
+// memory. Like the database store, it leaves out notifications whose type
+// the recipient has turned off for email.
+type memoryDigestStore struct {
+	recipients []*digestRecipient
+	// unread holds each user's unread notifications, newest first
+	unread   map[int][]Notification
+	emailOff map[int]map[string]bool
+	sent     map[int]time.Time
+}
+
+func newMemoryDigestStore() *memoryDigestStore {
+	return &memoryDigestStore{
+		unread:   map[int][]Notification{},
+		emailOff: map[int]map[string]bool{},
+		sent:     map[int]time.Time{},
+	}
+}
+
+func (s *memoryDigestStore) Recipients() ([]*digestRecipient, error) {
+	return s.recipients, nil
+}
+
+func (s *memoryDigestStore) Unread(userID int, since time.Time, limit int) ([]Notification, int, error) {
+	var matching []Notification
+	for _, n := range s.unread[userID] {
+		if n.UpdatedAt.After(since) && !s.emailOff[userID][n.Type] {
+			matching = append(matching, n)
+		}
+	}
+	total := len(matching)
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return matching, total, nil
+}
+
+func (s *memoryDigestStore) Sent(userID int, at time.Time) error {
+	s.sent[userID] = at
+	return nil
+}
+
+// addRecipient adds a daily digest recipient in UTC.
+func (s *memoryDigestStore) addRecipient(id int, username string) *digestRecipient {
+	d := &digestRecipient{ID: id, Username: username, Email: username + "@example.com", Frequency: DigestDaily}
+	s.recipients = append(s.recipients, d)
+	return d
+}
+
+func (s *memoryDigestStore) notify(userID int, typ string, at time.Time, actors ...string) {
+	s.unread[userID] = append(s.unread[userID], Notification{
+		ID:         len(s.unread[userID]) + 1,
+		Type:       typ,
+		Actors:     actors,
+		ActorCount: len(actors),
+		UpdatedAt:  at,
+	})
+}
+
+type sentDigest struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// readMail parses every message a FileMailer wrote to dir, ordered by
+// recipient.
+func readMail(t *testing.T, dir string) []sentDigest {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digests []sentDigest
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		message, err := mail.ReadMessage(f)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		digest := sentDigest{To: message.Header.Get("To"), Subject: subject}
+
+		mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("%s: content type %q", file, message.Header.Get("Content-Type"))
+		}
+		parts := multipart.NewReader(message.Body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			body, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			switch {
+			case strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"):
+				digest.Text = string(body)
+			case strings.HasPrefix(part.Header.Get("Content-Type"), "text/html"):
+				digest.HTML = string(body)
+			}
+		}
+		digests = append(digests, digest)
+	}
+
+	sort.Slice(digests, func(i, j int) bool { return digests[i].To < digests[j].To })
+	return digests
+}
+
+func newTestFileMailer(t *testing.T) (*FileMailer, string) {
+	t.Helper()
+	dir := t.TempDir()
+	m, err := NewFileMailer(dir, "Pixel & Chill <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, dir
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(Email) error { return errors.New("relay unavailable") }
+
+func TestDigestDue(t *testing.T) {
+	berlin := "Europe/Berlin"
+	// A Wednesday
+	now := time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)
+	hours := func(h int) *int { m := h * 60; return &m }
+	at := func(t time.Time) *time.Time { return &t }
+
+	tests := []struct {
+		name string
+		d    digestRecipient
+		now  time.Time
+		want bool
+	}{
+		{"never sent", digestRecipient{Frequency: DigestDaily}, now, true},
+		{"before the digest hour", digestRecipient{Frequency: DigestDaily}, now.Add(-2 * time.Hour), false},
+		{"digest hour in their time zone", digestRecipient{Frequency: DigestDaily, Timezone: &berlin}, now.Add(-2 * time.Hour), true},
+		{"sent today", digestRecipient{Frequency: DigestDaily, LastDigestAt: at(now.Add(-time.Hour))}, now, false},
+		{"sent yesterday", digestRecipient{Frequency: DigestDaily, LastDigestAt: at(now.Add(-24 * time.Hour))}, now, true},
+		{"weekly sent this week", digestRecipient{Frequency: DigestWeekly, LastDigestAt: at(now.AddDate(0, 0, -2))}, now, false},
+		{"weekly sent last week", digestRecipient{Frequency: DigestWeekly, LastDigestAt: at(now.AddDate(0, 0, -3))}, now, true},
+		{"in quiet hours", digestRecipient{Frequency: DigestDaily, QuietHoursStart: hours(8), QuietHoursEnd: hours(12)}, now, false},
+		{"after quiet hours", digestRecipient{Frequency: DigestDaily, QuietHoursStart: hours(8), QuietHoursEnd: hours(12)}, now.Add(2 * time.Hour), true},
+		{"in overnight quiet hours", digestRecipient{Frequency: DigestDaily, QuietHoursStart: hours(22), QuietHoursEnd: hours(11)}, now, false},
+	}
+	for _, tt := range tests {
+		if got := tt.d.digestDue(tt.now); got != tt.want {
+			t.Errorf("%s: digestDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendDigestsRendersUnreadNotifications(t *testing.T) {
+	t.Setenv("APP_URL", "https://pixelandchill.example/")
+	now := time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)
+	store := newMemoryDigestStore()
+	store.addRecipient(1, "ana")
+	store.notify(1, NotificationFollow, now.Add(-time.Hour), "ben", "<cara>")
+	store.notify(1, NotificationEndorsement, now.Add(-3*time.Hour), "dev")
+	// Older than the digest period
+	store.notify(1, NotificationMention, now.Add(-48*time.Hour), "eli")
+
+	m, dir := newTestFileMailer(t)
+	sent, err := sendDigests(store, m, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d digests, want 1", sent)
+	}
+
+	digests := readMail(t, dir)
+	if len(digests) != 1 {
+		t.Fatalf("wrote %d messages, want 1", len(digests))
+	}
+	digest := digests[0]
+	if digest.To != "ana@example.com" || digest.Subject != "Your daily Pixel & Chill digest" {
+		t.Errorf("sent %q to %s", digest.Subject, digest.To)
+	}
+
+	for _, want := range []string{
+		"Hi ana,",
+		"what you missed on Pixel & Chill since yesterday",
+		"- ben and <cara> followed you (Wed Mar 13, 09:00)",
+		"- dev endorsed you (Wed Mar 13, 07:00)",
+		"See them all: https://pixelandchill.example/notifications",
+		"this daily digest",
+	} {
+		if !strings.Contains(digest.Text, want) {
+			t.Errorf("text part is missing %q:\n%s", want, digest.Text)
+		}
+	}
+	if strings.Contains(digest.Text, "eli") {
+		t.Error("text part includes a notification from before the period")
+	}
+
+	for _, want := range []string{
+		"ben and &lt;cara&gt; followed you",
+		`<a href="https://pixelandchill.example/notifications"`,
+	} {
+		if !strings.Contains(digest.HTML, want) {
+			t.Errorf("HTML part is missing %q:\n%s", want, digest.HTML)
+		}
+	}
+	if strings.Contains(digest.HTML, "<cara>") {
+		t.Error("HTML part doesn't escape usernames")
+	}
+
+	if !store.sent[1].Equal(now) {
+		t.Errorf("digest recorded at %v, want %v", store.sent[1], now)
+	}
+}
+
+func TestSendDigestsSummarizesOverflow(t *testing.T) {
+	t.Setenv("APP_URL", "")
+	now := time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)
+	tokyo := "Asia/Tokyo"
+	store := newMemoryDigestStore()
+	d := store.addRecipient(1, "ana")
+	d.Frequency = DigestWeekly
+	d.Timezone = &tokyo
+	for i := 0; i < digestMaxItems+3; i++ {
+		store.notify(1, NotificationFollow, now.Add(-time.Duration(i+1)*time.Hour), fmt.Sprintf("fan%d", i))
+	}
+
+	m, dir := newTestFileMailer(t)
+	if _, err := sendDigests(store, m, now); err != nil {
+		t.Fatal(err)
+	}
+
+	digests := readMail(t, dir)
+	if len(digests) != 1 {
+		t.Fatalf("wrote %d messages, want 1", len(digests))
+	}
+	text := digests[0].Text
+	if digests[0].Subject != "Your weekly Pixel & Chill digest" || !strings.Contains(text, "Pixel & Chill this week") {
+		t.Errorf("weekly digest %q:\n%s", digests[0].Subject, text)
+	}
+	if got := strings.Count(text, "followed you"); got != digestMaxItems {
+		t.Errorf("listed %d notifications, want %d", got, digestMaxItems)
+	}
+	if !strings.Contains(text, "- and 3 more") {
+		t.Errorf("text part doesn't count the rest:\n%s", text)
+	}
+	// Times are shown in the recipient's time zone
+	if !strings.Contains(text, "- fan0 followed you (Wed Mar 13, 18:00)") {
+		t.Errorf("text part doesn't show local times:\n%s", text)
+	}
+	if strings.Contains(digests[0].HTML, "See them all") {
+		t.Error("HTML part links to the app without APP_URL")
+	}
+}
+
+func TestSendDigestsChoosesRecipients(t *testing.T) {
+	now := time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)
+	recent := now.Add(-time.Hour)
+	store := newMemoryDigestStore()
+
+	store.addRecipient(1, "due")
+	store.notify(1, NotificationFollow, recent, "ben")
+
+	quiet := store.addRecipient(2, "quiet")
+	start, end := 9*60, 11*60
+	quiet.QuietHoursStart, quiet.QuietHoursEnd = &start, &end
+	store.notify(2, NotificationFollow, recent, "ben")
+
+	early := store.addRecipient(3, "early")
+	losAngeles := "America/Los_Angeles"
+	early.Timezone = &losAngeles
+	store.notify(3, NotificationFollow, recent, "ben")
+
+	done := store.addRecipient(4, "done")
+	earlier := now.Add(-30 * time.Minute)
+	done.LastDigestAt = &earlier
+	store.notify(4, NotificationFollow, recent, "ben")
+
+	// Only wants mentions by email, and has only been followed
+	store.addRecipient(5, "mentions")
+	store.emailOff[5] = map[string]bool{NotificationFollow: true}
+	store.notify(5, NotificationFollow, recent, "ben")
+
+	store.addRecipient(6, "nothing")
+
+	// Turned follows off for email, but was also mentioned
+	store.addRecipient(7, "mixed")
+	store.emailOff[7] = map[string]bool{NotificationFollow: true}
+	store.notify(7, NotificationFollow, recent, "ben")
+	store.notify(7, NotificationMention, recent.Add(-time.Minute), "dev")
+
+	m, dir := newTestFileMailer(t)
+	sent, err := sendDigests(store, m, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digests := readMail(t, dir)
+	var to []string
+	for _, digest := range digests {
+		to = append(to, digest.To)
+	}
+	if want := []string{"due@example.com", "mixed@example.com"}; sent != len(want) || strings.Join(to, ",") != strings.Join(want, ",") {
+		t.Fatalf("sent %d digests to %v, want %v", sent, to, want)
+	}
+	if mixed := digests[1].Text; strings.Contains(mixed, "followed you") || !strings.Contains(mixed, "dev mentioned you") {
+		t.Errorf("digest ignores email preferences:\n%s", mixed)
+	}
+
+	// Those with nothing to send are done for the day; those not yet due
+	// are left for a later sweep
+	for id, want := range map[int]bool{1: true, 2: false, 3: false, 4: false, 5: true, 6: true, 7: true} {
+		if _, ok := store.sent[id]; ok != want {
+			t.Errorf("user %d marked sent = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestSendDigestsRetriesFailedSends(t *testing.T) {
+	now := time.Date(2024, 3, 13, 10, 0, 0, 0, time.UTC)
+	store := newMemoryDigestStore()
+	store.addRecipient(1, "ana")
+	store.notify(1, NotificationFollow, now.Add(-time.Hour), "ben")
+
+	sent, err := sendDigests(store, failingMailer{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 {
+		t.Errorf("counted %d digests as sent", sent)
+	}
+	if _, ok := store.sent[1]; ok {
+		t.Error("failed digest was marked sent")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory sort modes
+const (
+	DirectorySortNewest         = "newest"
+	DirectorySortMostFollowed   = "most_followed"
+	DirectorySortRecentlyActive = "recently_active"
+)
+
+const (
+	directoryDefaultLimit = 20
+	directoryMaxLimit     = 100
+	// Users seen within this window count as online in the directory. It
+	// outlasts lastActiveWriteInterval so active users don't flicker offline
+	// between writes.
+	onlineWindow    = lastActiveWriteInterval + 5*time.Minute
+	cursorTimeValue = "2006-01-02T15:04:05.999999"
+)
+
+// UserCard is the lightweight profile shown in directory listings.
+type UserCard struct {
+	ID              int         `json:"id" db:"id"`
+	Username        string      `json:"username" db:"username"`
+	DisplayName     *string     `json:"displayName,omitempty" db:"display_name"`
+	IsPrivate       bool        `json:"isPrivate" db:"is_private"`
+	TwitchUsername  *string     `json:"twitchUsername,omitempty" db:"twitch_username"`
+	DiscordUsername *string     `json:"discordUsername,omitempty" db:"discord_username"`
+	YoutubeChannel  *string     `json:"youtubeChannel,omitempty" db:"youtube_channel"`
+	ConnectedGames  StringArray `json:"connectedGames" db:"connected_games"`
+	Region          *string     `json:"region,omitempty" db:"region"`
+	Languages       StringArray `json:"languages" db:"languages"`
+	FollowersCount  int         `json:"followersCount" db:"followers_count"`
+	LastActiveAt    *time.Time  `json:"lastActiveAt,omitempty" db:"last_active_at"`
+	AvatarHash      *string     `json:"-" db:"avatar_hash"`
+	AvatarURL       string      `json:"avatarUrl,omitempty"`
+	Visible         bool        `json:"-" db:"visible"`
+}
+
+type DirectoryPage struct {
+	Users      []UserCard `json:"users"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// pageCursor marks the last row of a page. Value holds the sort key for
+// sort modes that don't order by ID alone.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"id"`
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// setAvatarURL fills in the small avatar shown on cards.
+func (c *UserCard) setAvatarURL() {
+	if c.AvatarHash != nil {
+		c.AvatarURL = "/media/" + mediaKey(avatarImage.Name, *c.AvatarHash, "128")
+	}
+}
+
+// redact strips everything but the basics from cards the viewer may not see.
+func (c *UserCard) redact() {
+	c.TwitchUsername = nil
+	c.DiscordUsername = nil
+	c.YoutubeChannel = nil
+	c.ConnectedGames = StringArray{}
+	c.Region = nil
+	c.Languages = StringArray{}
+	c.LastActiveAt = nil
+}
+
+// visibleToViewerSQL is true for rows of users u whose full profile the
+// viewer bound to viewerArg may see. Private profiles are only open to the
+// owner and their followers.
+func visibleToViewerSQL(viewerArg string) string {
+	return fmt.Sprintf(`(NOT u.is_private OR u.id = %[1]s OR EXISTS (
+		SELECT 1 FROM followers f WHERE f.follower_id = %[1]s AND f.following_id = u.id
+	))`, viewerArg)
+}
+
+// notBlockedSQL excludes rows of users u on either side of a block with the
+// viewer bound to viewerArg.
+func notBlockedSQL(viewerArg string) string {
+	return fmt.Sprintf(`NOT EXISTS (
+		SELECT 1 FROM user_blocks b
+		WHERE (b.blocker_id = u.id AND b.blocked_id = %[1]s)
+		OR (b.blocker_id = %[1]s AND b.blocked_id = u.id)
+	)`, viewerArg)
+}
+
+// writeWithETag encodes v, answering 304 when the client already has it.
+func writeWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	query := r.URL.Query()
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = DirectorySortNewest
+	}
+	if sort != DirectorySortNewest && sort != DirectorySortMostFollowed && sort != DirectorySortRecentlyActive {
+		http.Error(w, `{"error":"Invalid sort mode"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := directoryDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > directoryMaxLimit {
+			limit = directoryMaxLimit
+		}
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	viewerArg := arg(viewer)
+	visible := visibleToViewerSQL(viewerArg)
+
+	// Leave out anyone on either side of a block with the viewer, and anyone
+	// the viewer has muted
+	conditions := []string{
+		notBlockedSQL(viewerArg),
+		fmt.Sprintf(`NOT EXISTS (
+			SELECT 1 FROM user_mutes m
+			WHERE m.muter_id = %s AND m.muted_id = u.id
+		)`, viewerArg),
+	}
+
+	// Filtering on profile details would leak them for private accounts, so
+	// any filter limits results to profiles the viewer can see
+	filtered := false
+	if query.Get("hasTwitch") == "true" {
+		conditions = append(conditions, "COALESCE(u.twitch_username, '') <> ''")
+		filtered = true
+	}
+	if query.Get("hasYoutube") == "true" {
+		conditions = append(conditions, "COALESCE(u.youtube_channel, '') <> ''")
+		filtered = true
+	}
+	if game := strings.TrimSpace(query.Get("game")); game != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY(u.connected_games)", arg(game)))
+		filtered = true
+	}
+	if region := strings.TrimSpace(query.Get("region")); region != "" {
+		conditions = append(conditions, fmt.Sprintf("LOWER(u.region) = LOWER(%s)", arg(region)))
+		filtered = true
+	}
+	if language := strings.TrimSpace(query.Get("language")); language != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY(u.languages)", arg(strings.ToLower(language))))
+		filtered = true
+	}
+	if query.Get("online") == "true" {
+		window := fmt.Sprintf("%d seconds", int(onlineWindow.Seconds()))
+		conditions = append(conditions, fmt.Sprintf(
+			"u.last_active_at > CURRENT_TIMESTAMP - %s::interval", arg(window)))
+		filtered = true
+	}
+	if query.Get("availableNow") == "true" {
+		conditions = append(conditions, availableNowSQL)
+		filtered = true
+	}
+	if filtered {
+		conditions = append(conditions, visible)
+	}
+
+	var orderBy string
+	switch sort {
+	case DirectorySortNewest:
+		orderBy = "u.id DESC"
+	case DirectorySortMostFollowed:
+		orderBy = "u.followers_count DESC, u.id DESC"
+	case DirectorySortRecentlyActive:
+		orderBy = "COALESCE(u.last_active_at, 'epoch') DESC, u.id DESC"
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != sort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+
+		switch sort {
+		case DirectorySortNewest:
+			conditions = append(conditions, fmt.Sprintf("u.id < %s", arg(cursor.ID)))
+		case DirectorySortMostFollowed:
+			conditions = append(conditions, fmt.Sprintf(
+				"(u.followers_count, u.id) < (%s::int, %s)", arg(cursor.Value), arg(cursor.ID)))
+		case DirectorySortRecentlyActive:
+			conditions = append(conditions, fmt.Sprintf(
+				"(COALESCE(u.last_active_at, 'epoch'), u.id) < (%s::timestamp, %s)", arg(cursor.Value), arg(cursor.ID)))
+		}
+	}
+
+	// Fetch one extra row to know whether there is another page
+	users := []UserCard{}
+	err = db.Select(&users, fmt.Sprintf(`
+		SELECT u.id, u.username, u.display_name, u.is_private, u.twitch_username, u.discord_username,
+			   u.youtube_channel, u.connected_games, u.region, u.languages,
+			   u.followers_count, u.last_active_at, u.avatar_hash, %s as visible
+		FROM users u
+		WHERE %s
+		ORDER BY %s
+		LIMIT %d
+	`, visible, strings.Join(conditions, " AND "), orderBy, limit+1), args...)
+
+	if err != nil {
+		log.Printf("Error fetching users: %v", err)
+		http.Error(w, `{"error":"Failed to fetch users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	page := DirectoryPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		last := page.Users[limit-1]
+		next := pageCursor{Sort: sort, ID: last.ID}
+		switch sort {
+		case DirectorySortMostFollowed:
+			next.Value = strconv.Itoa(last.FollowersCount)
+		case DirectorySortRecentlyActive:
+			next.Value = time.Unix(0, 0).UTC().Format(cursorTimeValue)
+			if last.LastActiveAt != nil {
+				next.Value = last.LastActiveAt.Format(cursorTimeValue)
+			}
+		}
+		page.NextCursor = encodeCursor(next)
+	}
+
+	for i := range page.Users {
+		page.Users[i].setAvatarURL()
+		if !page.Users[i].Visible {
+			page.Users[i].redact()
+		}
+	}
+
+	writeWithETag(w, r, page)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Digest addresses have to be confirmed before anything is sent to them, so
+// nobody can point their digests at an inbox they don't own. Only a hash of
+// the confirmation token is stored.
+
+const emailConfirmationTTL = 24 * time.Hour
+
+var (
+	confirmEmailTextTemplate = template.Must(template.ParseFS(templateFS, "templates/confirm_email.txt.tmpl"))
+	confirmEmailHTMLTemplate = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/confirm_email.html.tmpl"))
+)
+
+type emailConfirmationData struct {
+	Username string
+	Token    string
+	URL      string
+	Hours    int
+}
+
+// newEmailConfirmationToken returns a token to mail out and the hash of it
+// to store.
+func newEmailConfirmationToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashEmailConfirmationToken(token), nil
+}
+
+func hashEmailConfirmationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// renderEmailConfirmation builds the message asking a user to confirm the
+// address they want digests sent to.
+func renderEmailConfirmation(username, address, token string) (*Email, error) {
+	data := emailConfirmationData{
+		Username: username,
+		Token:    token,
+		Hours:    int(emailConfirmationTTL.Hours()),
+	}
+	if appURL := os.Getenv("APP_URL"); appURL != "" {
+		data.URL = strings.TrimSuffix(appURL, "/") + "/confirm-email?token=" + url.QueryEscape(token)
+	}
+
+	var text, html bytes.Buffer
+	if err := confirmEmailTextTemplate.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := confirmEmailHTMLTemplate.Execute(&html, data); err != nil {
+		return nil, err
+	}
+	return &Email{
+		To:      address,
+		Subject: "Confirm your email for Pixel & Chill digests",
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+func sendEmailConfirmation(m Mailer, username, address, token string) error {
+	email, err := renderEmailConfirmation(username, address, token)
+	if err != nil {
+		return err
+	}
+	return m.Send(*email)
+}
+
+// confirmEmailHandler verifies the address a confirmation token was sent
+// to. Holding the token is the proof, so it works without logging in.
+func confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE users
+		SET email_verified_at = CURRENT_TIMESTAMP, email_token_hash = NULL, email_token_expires_at = NULL
+		WHERE email_token_hash = $1 AND email_token_expires_at > CURRENT_TIMESTAMP AND email IS NOT NULL
+	`, hashEmailConfirmationToken(req.Token))
+	if err != nil {
+		log.Printf("Error confirming email: %v", err)
+		http.Error(w, `{"error":"Error confirming email"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"This confirmation link is invalid or has expired"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email confirmed"})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmailConfirmationToken(t *testing.T) {
+	token, hash, err := newEmailConfirmationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashEmailConfirmationToken(token) {
+		t.Errorf("hash %q doesn't match token", hash)
+	}
+	if strings.Contains(hash, token) || len(hash) != 64 {
+		t.Errorf("hash %q should be a sha256 hex digest", hash)
+	}
+
+	other, _, err := newEmailConfirmationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token {
+		t.Error("tokens should differ")
+	}
+}
+
+func TestSendEmailConfirmation(t *testing.T) {
+	t.Setenv("APP_URL", "https://pixel.example.com/")
+	m, dir := newTestFileMailer(t)
+
+	if err := sendEmailConfirmation(m, "alice", "alice@example.com", "tok-en_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := readMail(t, dir)
+	if len(mail) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(mail))
+	}
+	link := "https://pixel.example.com/confirm-email?token=tok-en_1"
+	if mail[0].To != "alice@example.com" {
+		t.Errorf("sent to %q", mail[0].To)
+	}
+	if !strings.Contains(mail[0].Subject, "Confirm") {
+		t.Errorf("subject %q", mail[0].Subject)
+	}
+	if !strings.Contains(mail[0].Text, link) || !strings.Contains(mail[0].HTML, link) {
+		t.Errorf("confirmation link missing:\n%s\n%s", mail[0].Text, mail[0].HTML)
+	}
+}
+
+func TestSendEmailConfirmationWithoutAppURL(t *testing.T) {
+	t.Setenv("APP_URL", "")
+	m, dir := newTestFileMailer(t)
+
+	if err := sendEmailConfirmation(m, "bob", "bob@example.com", "tok-en_2"); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := readMail(t, dir)
+	if len(mail) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(mail))
+	}
+	if strings.Contains(mail[0].Text, "confirm-email") || !strings.Contains(mail[0].Text, "tok-en_2") {
+		t.Errorf("want the bare code without APP_URL:\n%s", mail[0].Text)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Endorsement kinds
+const (
+	EndorsementGoodTeammate = "good_teammate"
+	EndorsementShotcaller   = "shotcaller"
+	EndorsementFriendly     = "friendly"
+)
+
+// Negative feedback reasons
+const (
+	FeedbackToxic    = "toxic"
+	FeedbackGriefing = "griefing"
+	FeedbackNoShow   = "no_show"
+	FeedbackCheating = "cheating"
+	FeedbackOther    = "other"
+)
+
+var endorsementKinds = map[string]bool{
+	EndorsementGoodTeammate: true,
+	EndorsementShotcaller:   true,
+	EndorsementFriendly:     true,
+}
+
+var feedbackReasons = map[string]bool{
+	FeedbackToxic:    true,
+	FeedbackGriefing: true,
+	FeedbackNoShow:   true,
+	FeedbackCheating: true,
+	FeedbackOther:    true,
+}
+
+const (
+	// Teammates can endorse each other while the party is active and for
+	// this long after it disbands
+	endorsementWindow = 7 * 24 * time.Hour
+	// Limits on what one user can hand out per rolling day
+	maxEndorsementsPerDay = 20
+	maxFeedbackPerDay     = 10
+	maxFeedbackComment    = 500
+
+	// Accounts younger than this count for a fraction of an endorsement
+	newAccountAge         = 14 * 24 * time.Hour
+	newAccountEndorsement = 0.25
+	// Total endorsement weight at which the score reaches about 63
+	reputationScale = 25.0
+	// Endorsements of one kind it takes to earn its badge
+	badgeEndorsements = 10
+)
+
+// endorsementBadges are earned by collecting endorsements of a kind.
+var endorsementBadges = map[string]string{
+	EndorsementGoodTeammate: "trusted_teammate",
+	EndorsementShotcaller:   "field_general",
+	EndorsementFriendly:     "friendly_face",
+}
+
+type Reputation struct {
+	// Score runs from 0 to 100 and approaches 100 as weighted
+	// endorsements accumulate
+	Score        int            `json:"score"`
+	Endorsements map[string]int `json:"endorsements"`
+	Badges       []string       `json:"badges"`
+}
+
+type Feedback struct {
+	ID        int       `json:"id" db:"id"`
+	PartyID   int       `json:"partyId" db:"party_id"`
+	Reporter  string    `json:"reporter" db:"reporter"`
+	Subject   string    `json:"subject" db:"subject"`
+	Reason    string    `json:"reason" db:"reason"`
+	Comment   *string   `json:"comment,omitempty" db:"comment"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// loadReputation scores a user from the endorsements they've received. Each
+// further endorsement from the same person counts for less than the last
+// (1, 1/2, 1/3...), so a pair of friends can't farm each other, and
+// endorsements from brand-new accounts are discounted.
+func loadReputation(userID int) (*Reputation, error) {
+	rows, err := db.Query(`
+		SELECT e.kind, e.endorser_id, e.created_at, u.created_at
+		FROM endorsements e
+		JOIN users u ON u.id = e.endorser_id
+		WHERE e.endorsee_id = $1
+		ORDER BY e.endorser_id, e.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reputation := &Reputation{Endorsements: map[string]int{}}
+	var weight float64
+	fromEndorser := map[int]int{}
+	for rows.Next() {
+		var kind string
+		var endorserID int
+		var endorsedAt time.Time
+		var endorserCreatedAt sql.NullTime
+		if err := rows.Scan(&kind, &endorserID, &endorsedAt, &endorserCreatedAt); err != nil {
+			return nil, err
+		}
+
+		reputation.Endorsements[kind]++
+		fromEndorser[endorserID]++
+
+		w := 1 / float64(fromEndorser[endorserID])
+		// Accounts from before sign-up dates were recorded are established
+		if endorserCreatedAt.Valid && endorsedAt.Sub(endorserCreatedAt.Time) < newAccountAge {
+			w *= newAccountEndorsement
+		}
+		weight += w
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	reputation.Score = int(math.Round(100 * (1 - math.Exp(-weight/reputationScale))))
+
+	reputation.Badges = []string{}
+	err = db.Select(&reputation.Badges, `
+		SELECT badge FROM user_badges WHERE user_id = $1 ORDER BY earned_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return reputation, nil
+}
+
+// awardEndorsementBadge gives userID the badge for an endorsement kind once
+// they have enough endorsements of it, and tells their followers.
+func awardEndorsementBadge(tx *sql.Tx, userID int, kind string) error {
+	badge, ok := endorsementBadges[kind]
+	if !ok {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO user_badges (user_id, badge)
+		SELECT $1, $2
+		WHERE (SELECT COUNT(*) FROM endorsements WHERE endorsee_id = $1 AND kind = $3) >= $4
+		ON CONFLICT DO NOTHING
+	`, userID, badge, kind, badgeEndorsements)
+	if err != nil {
+		return err
+	}
+	if earned, _ := result.RowsAffected(); earned == 0 {
+		return nil
+	}
+	return recordActivity(tx, userID, ActivityEarnedBadge, nil, nil, badge)
+}
+
+// partyTeammate checks that both users belong to a party that is active or
+// disbanded within the endorsement window, returning the teammate's ID.
+func partyTeammate(w http.ResponseWriter, partyID, userID int, username string) (int, bool) {
+	var teammateID int
+	var disbandedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT u.id, p.disbanded_at
+		FROM parties p
+		JOIN party_members me ON me.party_id = p.id AND me.user_id = $2
+		JOIN party_members them ON them.party_id = p.id
+		JOIN users u ON u.id = them.user_id
+		WHERE p.id = $1 AND u.username = $3
+	`, partyID, userID, username).Scan(&teammateID, &disbandedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"No teammate with that username in this party"}`, http.StatusNotFound)
+			return 0, false
+		}
+		log.Printf("Error loading party teammate: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, false
+	}
+
+	if teammateID == userID {
+		http.Error(w, `{"error":"Cannot review yourself"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	if disbandedAt.Valid && time.Since(disbandedAt.Time) > endorsementWindow {
+		http.Error(w, `{"error":"Reviews for this session have closed"}`, http.StatusConflict)
+		return 0, false
+	}
+	return teammateID, true
+}
+
+// endorseTeammateHandler gives a teammate one endorsement for the session.
+func endorseTeammateHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Username string `json:"username"`
+		Kind     string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !endorsementKinds[req.Kind] {
+		http.Error(w, `{"error":"Kind must be good_teammate, shotcaller or friendly"}`, http.StatusBadRequest)
+		return
+	}
+
+	endorserID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	endorseeID, ok := partyTeammate(w, partyID, endorserID, req.Username)
+	if !ok {
+		return
+	}
+
+	blocked, err := hasBlocked(endorseeID, endorserID)
+	if err != nil {
+		log.Printf("Error checking block status: %v", err)
+		http.Error(w, `{"error":"Error endorsing teammate"}`, http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, `{"error":"No teammate with that username in this party"}`, http.StatusNotFound)
+		return
+	}
+
+	var given int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM endorsements
+		WHERE endorser_id = $1 AND created_at > $2
+	`, endorserID, time.Now().Add(-24*time.Hour).UTC()).Scan(&given)
+	if err != nil {
+		log.Printf("Error counting endorsements: %v", err)
+		http.Error(w, `{"error":"Error endorsing teammate"}`, http.StatusInternalServerError)
+		return
+	}
+	if given >= maxEndorsementsPerDay {
+		http.Error(w, `{"error":"You have given too many endorsements today"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO endorsements (party_id, endorser_id, endorsee_id, kind)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (party_id, endorser_id, endorsee_id) DO NOTHING
+	`, partyID, endorserID, endorseeID, req.Kind)
+	if err != nil {
+		log.Printf("Error saving endorsement: %v", err)
+		http.Error(w, `{"error":"Error endorsing teammate"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"You have already endorsed this teammate for this session"}`, http.StatusConflict)
+		return
+	}
+
+	if err := emitNotification(tx, endorseeID, endorserID, NotificationEndorsement); err != nil {
+		log.Printf("Error emitting notification: %v", err)
+		http.Error(w, `{"error":"Error endorsing teammate"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := awardEndorsementBadge(tx, endorseeID, req.Kind); err != nil {
+		log.Printf("Error awarding badge: %v", err)
+		http.Error(w, `{"error":"Error endorsing teammate"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing endorsement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Teammate endorsed"})
+}
+
+// reportTeammateHandler records negative feedback about a teammate. It is
+// never shown to the subject and doesn't affect their public score; only
+// moderators can read it.
+func reportTeammateHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Username string `json:"username"`
+		Reason   string `json:"reason"`
+		Comment  string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !feedbackReasons[req.Reason] {
+		http.Error(w, `{"error":"Reason must be toxic, griefing, no_show, cheating or other"}`, http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(comment) > maxFeedbackComment {
+		http.Error(w, fmt.Sprintf(`{"error":"Comment must be at most %d characters"}`, maxFeedbackComment), http.StatusBadRequest)
+		return
+	}
+
+	reporterID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	subjectID, ok := partyTeammate(w, partyID, reporterID, req.Username)
+	if !ok {
+		return
+	}
+
+	var given int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM player_feedback
+		WHERE reporter_id = $1 AND created_at > $2
+	`, reporterID, time.Now().Add(-24*time.Hour).UTC()).Scan(&given)
+	if err != nil {
+		log.Printf("Error counting feedback: %v", err)
+		http.Error(w, `{"error":"Error saving feedback"}`, http.StatusInternalServerError)
+		return
+	}
+	if given >= maxFeedbackPerDay {
+		http.Error(w, `{"error":"You have sent too much feedback today"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO player_feedback (party_id, reporter_id, subject_id, reason, comment)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (party_id, reporter_id, subject_id)
+		DO UPDATE SET reason = $4, comment = $5, created_at = CURRENT_TIMESTAMP
+	`, partyID, reporterID, subjectID, req.Reason, nullIfEmpty(comment))
+	if err != nil {
+		log.Printf("Error saving feedback: %v", err)
+		http.Error(w, `{"error":"Error saving feedback"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Feedback received"})
+}
+
+// getFeedbackHandler lists negative feedback for moderators, optionally for
+// a single user.
+func getFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT f.id, f.party_id, reporter.username as reporter, subject.username as subject,
+			f.reason, f.comment, f.created_at
+		FROM player_feedback f
+		JOIN users reporter ON reporter.id = f.reporter_id
+		JOIN users subject ON subject.id = f.subject_id`
+	var args []interface{}
+	if username := r.URL.Query().Get("username"); username != "" {
+		query += " WHERE subject.username = $1"
+		args = append(args, username)
+	}
+	query += " ORDER BY f.created_at DESC LIMIT 200"
+
+	feedback := []Feedback{}
+	if err := db.Select(&feedback, query, args...); err != nil {
+		log.Printf("Error fetching feedback: %v", err)
+		http.Error(w, `{"error":"Failed to fetch feedback"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// lockedOccurrence checks that the request names a future occurrence of a
+// recurring event the user hosts, locking the event. It writes the error
+// response and returns false otherwise.
+func lockedOccurrence(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx, userID int) (int, time.Time, time.Duration, bool) {
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	occurrence, err := time.Parse(icsTimeFormat, mux.Vars(r)["occurrence"])
+	if err != nil {
+		http.Error(w, `{"error":"Occurrences are named by their start, like 20261020T180000Z"}`, http.StatusBadRequest)
+		return 0, time.Time{}, 0, false
+	}
+
+	if !hostedEvent(w, tx, eventID, userID) {
+		return 0, time.Time{}, 0, false
+	}
+
+	var event Event
+	err = tx.Get(&event, `
+		SELECT id, starts_at, ends_at, rrule, time_zone FROM events WHERE id = $1
+	`, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, time.Time{}, 0, false
+	}
+
+	rec := event.recurrence()
+	if rec == nil || !rec.includes(event.StartsAt, event.location(), occurrence) {
+		http.Error(w, `{"error":"This event has no occurrence at that time"}`, http.StatusNotFound)
+		return 0, time.Time{}, 0, false
+	}
+
+	duration := event.EndsAt.Sub(event.StartsAt)
+	if !occurrence.Add(duration).After(time.Now()) {
+		http.Error(w, `{"error":"That occurrence is already over"}`, http.StatusConflict)
+		return 0, time.Time{}, 0, false
+	}
+	return eventID, occurrence, duration, true
+}
+
+// saveEventOverride records the change to one occurrence and bumps the
+// event's sequence so calendar clients pick it up.
+func saveEventOverride(tx *sqlx.Tx, eventID int, occurrence time.Time, startsAt, endsAt interface{}, cancelled bool) error {
+	_, err := tx.Exec(`
+		INSERT INTO event_overrides (event_id, occurrence_start, starts_at, ends_at, cancelled)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_id, occurrence_start)
+		DO UPDATE SET starts_at = $3, ends_at = $4, cancelled = $5, updated_at = CURRENT_TIMESTAMP
+	`, eventID, occurrence.UTC(), startsAt, endsAt, cancelled)
+	if err != nil {
+		return err
+	}
+
+	// A final occurrence moved later extends the series
+	_, err = tx.Exec(`
+		UPDATE events
+		SET sequence = sequence + 1, updated_at = CURRENT_TIMESTAMP,
+			series_ends_at = CASE
+				WHEN series_ends_at IS NULL THEN NULL
+				ELSE GREATEST(series_ends_at, $2::timestamp)
+			END
+		WHERE id = $1
+	`, eventID, endsAt)
+	return err
+}
+
+// rescheduleOccurrenceHandler moves one occurrence of a recurring event,
+// by at most a week either way.
+func rescheduleOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		StartsAt time.Time  `json:"startsAt"`
+		EndsAt   *time.Time `json:"endsAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	eventID, occurrence, duration, ok := lockedOccurrence(w, r, tx, userID)
+	if !ok {
+		return
+	}
+
+	endsAt := req.StartsAt.Add(duration)
+	if req.EndsAt != nil {
+		endsAt = *req.EndsAt
+	}
+	shift := req.StartsAt.Sub(occurrence)
+	if shift < -eventMaxOverrideShift || shift > eventMaxOverrideShift || !req.StartsAt.After(time.Now()) {
+		http.Error(w, `{"error":"startsAt must be in the future and within a week of the original time"}`, http.StatusBadRequest)
+		return
+	}
+	if !endsAt.After(req.StartsAt) || endsAt.Sub(req.StartsAt) > eventMaxDuration {
+		http.Error(w, `{"error":"endsAt must be after startsAt and at most 24 hours later"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := saveEventOverride(tx, eventID, occurrence, req.StartsAt.UTC(), endsAt.UTC(), false); err != nil {
+		log.Printf("Error rescheduling occurrence: %v", err)
+		http.Error(w, `{"error":"Error rescheduling occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := notifyEventAttendees(tx, eventID, userID, NotificationEventRescheduled, &occurrence); err != nil {
+		log.Printf("Error notifying attendees: %v", err)
+		http.Error(w, `{"error":"Error rescheduling occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing reschedule"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, userID, http.StatusOK)
+}
+
+// cancelOccurrenceHandler cancels one occurrence of a recurring event,
+// leaving the rest of the series in place.
+func cancelOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	eventID, occurrence, _, ok := lockedOccurrence(w, r, tx, userID)
+	if !ok {
+		return
+	}
+
+	if err := saveEventOverride(tx, eventID, occurrence, nil, nil, true); err != nil {
+		log.Printf("Error cancelling occurrence: %v", err)
+		http.Error(w, `{"error":"Error cancelling occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := notifyEventAttendees(tx, eventID, userID, NotificationEventOccurrenceCancelled, &occurrence); err != nil {
+		log.Printf("Error notifying attendees: %v", err)
+		http.Error(w, `{"error":"Error cancelling occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing cancellation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, userID, http.StatusOK)
+}
@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// RSVP responses. Invitees start out pending; a yes beyond the event's
+// capacity lands on the waitlist instead.
+const (
+	RSVPPending    = "pending"
+	RSVPYes        = "yes"
+	RSVPNo         = "no"
+	RSVPMaybe      = "maybe"
+	RSVPWaitlisted = "waitlisted"
+)
+
+const (
+	eventMaxTitleLength   = 100
+	eventMaxDescription   = 1000
+	eventDefaultDuration  = 2 * time.Hour
+	eventMaxDuration      = 24 * time.Hour
+	eventMaxLead          = 365 * 24 * time.Hour
+	eventMinCapacity      = 2
+	eventMaxCapacity      = 100
+	eventMaxInvitees      = 200
+	calendarFeedPast      = 30 * 24 * time.Hour
+	calendarFeedCacheTime = 15 * time.Minute
+	eventListDefaultSpan  = 30 * 24 * time.Hour
+	eventListMaxSpan      = 92 * 24 * time.Hour
+	eventListMaxResults   = 500
+	eventMaxOverrideShift = 7 * 24 * time.Hour
+)
+
+// Event is a scheduled session. RSVP is the viewer's own response. A
+// recurring event is a series: StartsAt and EndsAt are its first
+// occurrence, RSVPs apply to the whole series, and Overrides moves or
+// cancels single occurrences.
+type Event struct {
+	ID          int             `json:"id" db:"id"`
+	Host        string          `json:"host" db:"host"`
+	PartyID     *int            `json:"partyId,omitempty" db:"party_id"`
+	Game        string          `json:"game" db:"game"`
+	Title       string          `json:"title" db:"title"`
+	Description *string         `json:"description,omitempty" db:"description"`
+	StartsAt    time.Time       `json:"startsAt" db:"starts_at"`
+	EndsAt      time.Time       `json:"endsAt" db:"ends_at"`
+	Capacity    *int            `json:"capacity,omitempty" db:"capacity"`
+	Recurrence  *string         `json:"recurrence,omitempty" db:"rrule"`
+	TimeZone    string          `json:"timeZone" db:"time_zone"`
+	SeriesEnds  *time.Time      `json:"seriesEndsAt,omitempty" db:"series_ends_at"`
+	Going       int             `json:"going" db:"going"`
+	Maybe       int             `json:"maybe" db:"maybe"`
+	Waitlisted  int             `json:"waitlisted" db:"waitlisted"`
+	RSVP        string          `json:"rsvp" db:"rsvp"`
+	Sequence    int             `json:"-" db:"sequence"`
+	CreatedAt   time.Time       `json:"createdAt" db:"created_at"`
+	UpdatedAt   time.Time       `json:"updatedAt" db:"updated_at"`
+	CancelledAt *time.Time      `json:"cancelledAt,omitempty" db:"cancelled_at"`
+	Invitees    []EventInvitee  `json:"invitees,omitempty"`
+	Overrides   []EventOverride `json:"overrides,omitempty"`
+}
+
+// EventOverride moves or cancels one occurrence of a recurring event,
+// named by its original start.
+type EventOverride struct {
+	EventID      int        `json:"-" db:"event_id"`
+	OccurrenceID string     `json:"occurrenceId" db:"-"`
+	Occurrence   time.Time  `json:"occurrence" db:"occurrence_start"`
+	StartsAt     *time.Time `json:"startsAt,omitempty" db:"starts_at"`
+	EndsAt       *time.Time `json:"endsAt,omitempty" db:"ends_at"`
+	Cancelled    bool       `json:"cancelled" db:"cancelled"`
+}
+
+// EventOccurrence is one session of an event as it appears in a list. Its
+// times shadow the series' own.
+type EventOccurrence struct {
+	*Event
+	OccurrenceID string    `json:"occurrenceId,omitempty"`
+	StartsAt     time.Time `json:"startsAt"`
+	EndsAt       time.Time `json:"endsAt"`
+	Modified     bool      `json:"modified,omitempty"`
+}
+
+func (e *Event) location() *time.Location {
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// recurrence parses the stored rule, or returns nil for a one-off event.
+func (e *Event) recurrence() *Recurrence {
+	if e.Recurrence == nil {
+		return nil
+	}
+	rec, err := parseRecurrence(*e.Recurrence)
+	if err != nil {
+		log.Printf("Event %d has an invalid recurrence %q: %v", e.ID, *e.Recurrence, err)
+		return nil
+	}
+	return rec
+}
+
+// occurrences expands the event into the sessions overlapping [from, to),
+// applying overrides. Moved occurrences are found as long as they moved
+// less than eventMaxOverrideShift.
+func (e *Event) occurrences(from, to time.Time) []EventOccurrence {
+	rec := e.recurrence()
+	if rec == nil {
+		if e.EndsAt.After(from) && e.StartsAt.Before(to) {
+			return []EventOccurrence{{Event: e, StartsAt: e.StartsAt, EndsAt: e.EndsAt}}
+		}
+		return nil
+	}
+
+	overrides := make(map[string]EventOverride, len(e.Overrides))
+	for _, o := range e.Overrides {
+		overrides[o.OccurrenceID] = o
+	}
+
+	duration := e.EndsAt.Sub(e.StartsAt)
+	var out []EventOccurrence
+	starts := rec.between(e.StartsAt, e.location(), from.Add(-duration-eventMaxOverrideShift), to.Add(eventMaxOverrideShift))
+	for _, start := range starts {
+		occurrence := EventOccurrence{Event: e, OccurrenceID: occurrenceID(start), StartsAt: start, EndsAt: start.Add(duration)}
+		if o, ok := overrides[occurrence.OccurrenceID]; ok {
+			if o.Cancelled {
+				continue
+			}
+			occurrence.StartsAt, occurrence.EndsAt, occurrence.Modified = *o.StartsAt, *o.EndsAt, true
+		}
+		if occurrence.EndsAt.After(from) && occurrence.StartsAt.Before(to) {
+			out = append(out, occurrence)
+		}
+	}
+	return out
+}
+
+// loadEventOverrides fills in the overrides of recurring events.
+func loadEventOverrides(events []*Event) error {
+	byID := map[int]*Event{}
+	var ids []int
+	for _, e := range events {
+		if e.Recurrence != nil {
+			byID[e.ID] = e
+			ids = append(ids, e.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var overrides []EventOverride
+	err := db.Select(&overrides, `
+		SELECT event_id, occurrence_start, starts_at, ends_at, cancelled
+		FROM event_overrides
+		WHERE event_id = ANY($1)
+		ORDER BY occurrence_start
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	for _, o := range overrides {
+		o.OccurrenceID = occurrenceID(o.Occurrence)
+		e := byID[o.EventID]
+		e.Overrides = append(e.Overrides, o)
+	}
+	return nil
+}
+
+type EventInvitee struct {
+	Username    string     `json:"username" db:"username"`
+	RSVP        string     `json:"rsvp" db:"rsvp"`
+	RespondedAt *time.Time `json:"respondedAt,omitempty" db:"responded_at"`
+}
+
+// EventInvites picks who to invite: named users, everyone following the
+// host, and/or the active members of one of the host's parties.
+type EventInvites struct {
+	Usernames []string `json:"usernames"`
+	Followers bool     `json:"followers"`
+	PartyID   *int     `json:"partyId"`
+}
+
+type CreateEventRequest struct {
+	Game        string       `json:"game"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	StartsAt    time.Time    `json:"startsAt"`
+	EndsAt      *time.Time   `json:"endsAt"`
+	Capacity    *int         `json:"capacity"`
+	Recurrence  string       `json:"recurrence"`
+	TimeZone    string       `json:"timeZone"`
+	Invite      EventInvites `json:"invite"`
+}
+
+// eventColumns selects an Event from events e joined to its host h and the
+// viewer's invitation me.
+const eventColumns = `
+	e.id, h.username AS host, e.party_id, e.game, e.title, e.description,
+	e.starts_at, e.ends_at, e.capacity, e.rrule, e.time_zone, e.series_ends_at,
+	e.sequence, e.created_at, e.updated_at, e.cancelled_at, me.rsvp,
+	(SELECT COUNT(*) FROM event_invitees i WHERE i.event_id = e.id AND i.rsvp = 'yes') AS going,
+	(SELECT COUNT(*) FROM event_invitees i WHERE i.event_id = e.id AND i.rsvp = 'maybe') AS maybe,
+	(SELECT COUNT(*) FROM event_invitees i WHERE i.event_id = e.id AND i.rsvp = 'waitlisted') AS waitlisted`
+
+// eventFrom joins events to the rows eventColumns needs; the viewer's ID is $1.
+const eventFrom = `
+	FROM events e
+	JOIN users h ON h.id = e.host_id
+	JOIN event_invitees me ON me.event_id = e.id AND me.user_id = $1`
+
+// loadEvent returns an event with its invitee list, or ErrNoRows unless
+// the viewer was invited.
+func loadEvent(eventID, viewerID int) (*Event, error) {
+	var event Event
+	err := db.Get(&event, `SELECT `+eventColumns+eventFrom+` WHERE e.id = $2`, viewerID, eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadEventOverrides([]*Event{&event}); err != nil {
+		return nil, err
+	}
+
+	// Waitlisted invitees are listed in the order they'll be let in
+	event.Invitees = []EventInvitee{}
+	err = db.Select(&event.Invitees, `
+		SELECT u.username, i.rsvp, i.responded_at
+		FROM event_invitees i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.event_id = $1
+		ORDER BY i.user_id = $2 DESC,
+			CASE i.rsvp WHEN 'yes' THEN 0 WHEN 'maybe' THEN 1 WHEN 'waitlisted' THEN 2 WHEN 'pending' THEN 3 ELSE 4 END,
+			i.responded_at, u.username
+	`, eventID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func writeEvent(w http.ResponseWriter, eventID, viewerID, status int) {
+	event, err := loadEvent(eventID, viewerID)
+	if err != nil {
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Error loading event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(event)
+}
+
+var errNotPartyMember = errors.New("not an active member of that party")
+
+// inviteToEvent adds invitees chosen by invites, skipping anyone on either
+// side of a block with the host, and returns who was newly invited. Invites
+// stop at eventMaxInvitees.
+func inviteToEvent(tx *sqlx.Tx, eventID, hostID int, invites EventInvites) ([]int, error) {
+	var candidates []int
+
+	if len(invites.Usernames) > 0 {
+		var ids []int
+		err := tx.Select(&ids, `
+			SELECT u.id FROM users u WHERE u.username = ANY($2) AND `+notBlockedSQL("$1"),
+			hostID, pq.Array(invites.Usernames))
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, ids...)
+	}
+
+	if invites.Followers {
+		var ids []int
+		err := tx.Select(&ids, `
+			SELECT u.id FROM followers f
+			JOIN users u ON u.id = f.follower_id
+			WHERE f.following_id = $1 AND `+notBlockedSQL("$1"),
+			hostID)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, ids...)
+	}
+
+	if invites.PartyID != nil {
+		var isMember bool
+		err := tx.Get(&isMember, `
+			SELECT EXISTS (
+				SELECT 1 FROM party_members pm
+				JOIN parties p ON p.id = pm.party_id
+				WHERE pm.party_id = $1 AND pm.user_id = $2
+				AND pm.left_at IS NULL AND p.disbanded_at IS NULL
+			)
+		`, *invites.PartyID, hostID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, errNotPartyMember
+		}
+
+		var ids []int
+		err = tx.Select(&ids, `
+			SELECT u.id FROM party_members pm
+			JOIN users u ON u.id = pm.user_id
+			WHERE pm.party_id = $2 AND pm.left_at IS NULL AND `+notBlockedSQL("$1"),
+			hostID, *invites.PartyID)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, ids...)
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	var invited []int
+	err := tx.Select(&invited, `
+		INSERT INTO event_invitees (event_id, user_id)
+		SELECT $1, c.id FROM (SELECT DISTINCT unnest($2::int[]) AS id) c
+		WHERE NOT EXISTS (SELECT 1 FROM event_invitees WHERE event_id = $1 AND user_id = c.id)
+		ORDER BY c.id
+		LIMIT GREATEST($3 - (SELECT COUNT(*) FROM event_invitees WHERE event_id = $1), 0)
+		ON CONFLICT (event_id, user_id) DO NOTHING
+		RETURNING user_id
+	`, eventID, pq.Array(candidates), eventMaxInvitees)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userID := range invited {
+		if err := emitNotificationAbout(tx, userID, hostID, NotificationEventInvite, eventID); err != nil {
+			return nil, err
+		}
+	}
+	return invited, nil
+}
+
+func createEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req CreateEventRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	fieldErrors := map[string]string{}
+
+	game, ok := catalogGame(req.Game)
+	if !ok {
+		fieldErrors["game"] = "must be a game from the catalog"
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" || utf8.RuneCountInString(title) > eventMaxTitleLength {
+		fieldErrors["title"] = fmt.Sprintf("must be between 1 and %d characters", eventMaxTitleLength)
+	}
+
+	description := strings.TrimSpace(req.Description)
+	if utf8.RuneCountInString(description) > eventMaxDescription {
+		fieldErrors["description"] = fmt.Sprintf("must be at most %d characters", eventMaxDescription)
+	}
+
+	now := time.Now()
+	if !req.StartsAt.After(now) || req.StartsAt.After(now.Add(eventMaxLead)) {
+		fieldErrors["startsAt"] = "must be in the coming year"
+	}
+	endsAt := req.StartsAt.Add(eventDefaultDuration)
+	if req.EndsAt != nil {
+		endsAt = *req.EndsAt
+		if !endsAt.After(req.StartsAt) || endsAt.Sub(req.StartsAt) > eventMaxDuration {
+			fieldErrors["endsAt"] = "must be after startsAt and at most 24 hours later"
+		}
+	}
+
+	if req.Capacity != nil && (*req.Capacity < eventMinCapacity || *req.Capacity > eventMaxCapacity) {
+		fieldErrors["capacity"] = fmt.Sprintf("must be between %d and %d", eventMinCapacity, eventMaxCapacity)
+	}
+
+	var host struct {
+		ID       int     `db:"id"`
+		Timezone *string `db:"timezone"`
+	}
+	if err := db.Get(&host, "SELECT id, timezone FROM users WHERE username = $1", claims.Username); err != nil {
+		http.Error(w, `{"error":"Failed to get user"}`, http.StatusInternalServerError)
+		return
+	}
+	hostID := host.ID
+
+	// Recurring sessions keep their wall-clock time in this zone
+	loc := userLocation(host.Timezone)
+	if req.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(req.TimeZone); err != nil || req.TimeZone == "Local" {
+			fieldErrors["timeZone"] = "must be an IANA time zone name"
+			loc = time.UTC
+		}
+	}
+
+	var rrule *string
+	seriesEnds := &endsAt
+	if strings.TrimSpace(req.Recurrence) != "" {
+		rec, err := parseRecurrence(req.Recurrence)
+		switch {
+		case err != nil:
+			fieldErrors["recurrence"] = err.Error()
+		case !rec.includes(req.StartsAt, loc, req.StartsAt):
+			fieldErrors["recurrence"] = "startsAt must be on one of the rule's days"
+		case rec.Until != nil && rec.Until.Sub(req.StartsAt) > recurrenceMaxSpan:
+			fieldErrors["recurrence"] = "UNTIL must be within two years of startsAt"
+		default:
+			canonical := rec.String()
+			rrule = &canonical
+			seriesEnds = nil
+			if last := rec.last(req.StartsAt, loc); last != nil {
+				end := last.Add(endsAt.Sub(req.StartsAt))
+				seriesEnds = &end
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid event",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	var seriesEndsUTC interface{}
+	if seriesEnds != nil {
+		seriesEndsUTC = seriesEnds.UTC()
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var eventID int
+	err = tx.QueryRow(`
+		INSERT INTO events (
+			host_id, party_id, game, title, description, starts_at, ends_at,
+			capacity, rrule, time_zone, series_ends_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, hostID, req.Invite.PartyID, game, title, nullIfEmpty(description),
+		req.StartsAt.UTC(), endsAt.UTC(), req.Capacity, rrule, loc.String(),
+		seriesEndsUTC,
+	).Scan(&eventID)
+	if err != nil {
+		log.Printf("Error creating event: %v", err)
+		http.Error(w, `{"error":"Error creating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The host is always going and takes up one place
+	_, err = tx.Exec(`
+		INSERT INTO event_invitees (event_id, user_id, rsvp, responded_at)
+		VALUES ($1, $2, 'yes', CURRENT_TIMESTAMP)
+	`, eventID, hostID)
+	if err != nil {
+		log.Printf("Error adding event host: %v", err)
+		http.Error(w, `{"error":"Error creating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = inviteToEvent(tx, eventID, hostID, req.Invite)
+	if err == errNotPartyMember {
+		http.Error(w, `{"error":"You can only invite a party you're in"}`, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error inviting to event: %v", err)
+		http.Error(w, `{"error":"Error creating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing event creation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, hostID, http.StatusCreated)
+}
+
+// getMyEventsHandler lists the sessions the user hosts or was invited to
+// between ?from and ?to (RFC 3339, defaulting to the next 30 days), with
+// recurring events expanded into their occurrences, soonest first.
+func getMyEventsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	query := r.URL.Query()
+
+	from := time.Now()
+	if query.Get("past") == "true" {
+		from = from.Add(-eventListMaxSpan)
+	}
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, `{"error":"from must be an RFC 3339 time"}`, http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	to := from.Add(eventListDefaultSpan)
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, `{"error":"to must be an RFC 3339 time"}`, http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	if !to.After(from) || to.Sub(from) > eventListMaxSpan {
+		http.Error(w, `{"error":"to must be after from and at most 92 days later"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Series are matched loosely here and expanded exactly below
+	var events []*Event
+	err = db.Select(&events, `SELECT `+eventColumns+eventFrom+`
+		WHERE e.starts_at < $3 AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		ORDER BY e.starts_at, e.id
+	`, userID, from.Add(-eventMaxOverrideShift).UTC(), to.Add(eventMaxOverrideShift).UTC())
+	if err != nil {
+		log.Printf("Error fetching events: %v", err)
+		http.Error(w, `{"error":"Failed to fetch events"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := loadEventOverrides(events); err != nil {
+		log.Printf("Error fetching event overrides: %v", err)
+		http.Error(w, `{"error":"Failed to fetch events"}`, http.StatusInternalServerError)
+		return
+	}
+
+	occurrences := []EventOccurrence{}
+	for _, e := range events {
+		occurrences = append(occurrences, e.occurrences(from, to)...)
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartsAt.Before(occurrences[j].StartsAt)
+	})
+	if len(occurrences) > eventListMaxResults {
+		occurrences = occurrences[:eventListMaxResults]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(occurrences)
+}
+
+func getEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	event, err := loadEvent(eventID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Error loading event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+// hostedEvent locks an event the user hosts, writing the error response
+// and returning false if it isn't theirs or can no longer change.
+func hostedEvent(w http.ResponseWriter, tx *sqlx.Tx, eventID, userID int) bool {
+	var hostID int
+	var cancelled bool
+	var ended bool
+	err := tx.QueryRow(`
+		SELECT host_id, cancelled_at IS NOT NULL, COALESCE(series_ends_at <= CURRENT_TIMESTAMP, false)
+		FROM events WHERE id = $1
+		FOR UPDATE
+	`, eventID).Scan(&hostID, &cancelled, &ended)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return false
+	}
+	if hostID != userID {
+		http.Error(w, `{"error":"Only the host can do that"}`, http.StatusForbidden)
+		return false
+	}
+	if cancelled || ended {
+		http.Error(w, `{"error":"This event is over or cancelled"}`, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func inviteToEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req EventInvites
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !hostedEvent(w, tx, eventID, userID) {
+		return
+	}
+
+	_, err = inviteToEvent(tx, eventID, userID, req)
+	if err == errNotPartyMember {
+		http.Error(w, `{"error":"You can only invite a party you're in"}`, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error inviting to event: %v", err)
+		http.Error(w, `{"error":"Error sending invites"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing invites"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, userID, http.StatusOK)
+}
+
+// rsvpEventHandler records an invitee's response. A yes to a full event
+// joins the waitlist, and a place given up goes to whoever has waited
+// longest.
+func rsvpEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Response string `json:"response"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Response != RSVPYes && req.Response != RSVPNo && req.Response != RSVPMaybe {
+		http.Error(w, `{"error":"response must be yes, no or maybe"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the event serializes RSVPs so capacity can't be overrun
+	var event struct {
+		HostID    int    `db:"host_id"`
+		Capacity  *int   `db:"capacity"`
+		Cancelled bool   `db:"cancelled"`
+		Ended     bool   `db:"ended"`
+		Current   string `db:"rsvp"`
+	}
+	err = tx.Get(&event, `
+		SELECT e.host_id, e.capacity, e.cancelled_at IS NOT NULL AS cancelled,
+			COALESCE(e.series_ends_at <= CURRENT_TIMESTAMP, false) AS ended, i.rsvp
+		FROM events e
+		JOIN event_invitees i ON i.event_id = e.id AND i.user_id = $2
+		WHERE e.id = $1
+		FOR UPDATE OF e
+	`, eventID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if event.HostID == userID {
+		http.Error(w, `{"error":"Hosts always attend; cancel the event instead"}`, http.StatusBadRequest)
+		return
+	}
+	if event.Cancelled || event.Ended {
+		http.Error(w, `{"error":"This event is over or cancelled"}`, http.StatusConflict)
+		return
+	}
+
+	response := req.Response
+	if response == RSVPYes && event.Current != RSVPYes && event.Current != RSVPWaitlisted && event.Capacity != nil {
+		var going int
+		err := tx.Get(&going, "SELECT COUNT(*) FROM event_invitees WHERE event_id = $1 AND rsvp = 'yes'", eventID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if going >= *event.Capacity {
+			response = RSVPWaitlisted
+		}
+	}
+	if req.Response == RSVPYes && event.Current == RSVPWaitlisted {
+		response = RSVPWaitlisted
+	}
+
+	if response != event.Current {
+		_, err = tx.Exec(`
+			UPDATE event_invitees SET rsvp = $3, responded_at = CURRENT_TIMESTAMP
+			WHERE event_id = $1 AND user_id = $2
+		`, eventID, userID, response)
+		if err != nil {
+			log.Printf("Error saving RSVP: %v", err)
+			http.Error(w, `{"error":"Error saving RSVP"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if event.Current == RSVPYes && response != RSVPYes {
+		if err := promoteFromWaitlist(tx, eventID, event.HostID); err != nil {
+			log.Printf("Error promoting from waitlist: %v", err)
+			http.Error(w, `{"error":"Error saving RSVP"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing RSVP"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, userID, http.StatusOK)
+}
+
+// promoteFromWaitlist gives a freed place to the longest-waiting invitee.
+// The caller must hold the event's row lock.
+func promoteFromWaitlist(tx *sqlx.Tx, eventID, hostID int) error {
+	var promoted int
+	err := tx.QueryRow(`
+		UPDATE event_invitees SET rsvp = 'yes', responded_at = CURRENT_TIMESTAMP
+		WHERE event_id = $1 AND user_id = (
+			SELECT user_id FROM event_invitees
+			WHERE event_id = $1 AND rsvp = 'waitlisted'
+			ORDER BY responded_at, user_id
+			LIMIT 1
+		)
+		RETURNING user_id
+	`, eventID).Scan(&promoted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return emitNotificationAbout(tx, promoted, hostID, NotificationEventWaitlistPromoted, eventID)
+}
+
+// cancelEventHandler cancels an event. It stays listed, marked cancelled,
+// so calendar clients remove it on their next sync.
+func cancelEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !hostedEvent(w, tx, eventID, userID) {
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE events
+		SET cancelled_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP, sequence = sequence + 1
+		WHERE id = $1
+	`, eventID)
+	if err != nil {
+		log.Printf("Error cancelling event: %v", err)
+		http.Error(w, `{"error":"Error cancelling event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := notifyEventAttendees(tx, eventID, userID, NotificationEventCancelled, nil); err != nil {
+		log.Printf("Error notifying attendees: %v", err)
+		http.Error(w, `{"error":"Error cancelling event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing cancellation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEvent(w, eventID, userID, http.StatusOK)
+}
+
+// notifyEventAttendees notifies everyone other than the host who hasn't
+// declined, about the whole event or, given one, a single occurrence.
+func notifyEventAttendees(tx *sqlx.Tx, eventID, hostID int, notificationType string, occurrence *time.Time) error {
+	var attendees []int
+	err := tx.Select(&attendees, `
+		SELECT user_id FROM event_invitees
+		WHERE event_id = $1 AND user_id <> $2 AND rsvp IN ('yes', 'maybe', 'waitlisted')
+	`, eventID, hostID)
+	if err != nil {
+		return err
+	}
+	for _, attendee := range attendees {
+		var err error
+		if occurrence != nil {
+			err = emitOccurrenceNotification(tx, attendee, hostID, notificationType, eventID, *occurrence)
+		} else {
+			err = emitNotificationAbout(tx, attendee, hostID, notificationType, eventID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// icsEvents renders the event for calendar clients. A series is one VEVENT
+// with its RRULE and cancelled occurrences as EXDATEs, plus a VEVENT per
+// moved occurrence.
+func (e *Event) icsEvents() []icsEvent {
+	description := ""
+	if e.Description != nil {
+		description = *e.Description
+	}
+	master := icsEvent{
+		UID:         fmt.Sprintf("event-%d@%s", e.ID, icsUIDDomain),
+		Sequence:    e.Sequence,
+		Stamp:       e.UpdatedAt,
+		Start:       e.StartsAt,
+		End:         e.EndsAt,
+		Summary:     e.Title + " (" + e.Game + ")",
+		Description: description,
+		Organizer:   e.Host,
+		Cancelled:   e.CancelledAt != nil,
+	}
+	if e.Recurrence == nil {
+		return []icsEvent{master}
+	}
+
+	master.RRule = *e.Recurrence
+	master.TimeZone = e.location()
+	events := []icsEvent{master}
+	for _, o := range e.Overrides {
+		if o.Cancelled {
+			events[0].ExDates = append(events[0].ExDates, o.Occurrence)
+			continue
+		}
+		moved := master
+		moved.RRule = ""
+		moved.RecurrenceID = &o.Occurrence
+		moved.Start, moved.End = *o.StartsAt, *o.EndsAt
+		events = append(events, moved)
+	}
+	return events
+}
+
+func writeICS(w http.ResponseWriter, filename string, body []byte) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if filename != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	}
+	w.Write(body)
+}
+
+func getEventICSHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	eventID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var event Event
+	err = db.Get(&event, `SELECT `+eventColumns+eventFrom+` WHERE e.id = $2`, userID, eventID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Error loading event"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := loadEventOverrides([]*Event{&event}); err != nil {
+		log.Printf("Error loading event overrides: %v", err)
+		http.Error(w, `{"error":"Error loading event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeICS(w, fmt.Sprintf("event-%d.ics", eventID), icsCalendar("", event.icsEvents()))
+}
+
+func newCalendarToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func calendarFeedURL(token string) string {
+	return "/calendar/" + token + ".ics"
+}
+
+// getCalendarFeedHandler returns the user's private feed URL, creating the
+// token the first time.
+func getCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var token string
+	err := db.QueryRow(`
+		UPDATE users SET calendar_token = COALESCE(calendar_token, $2)
+		WHERE username = $1
+		RETURNING calendar_token
+	`, claims.Username, newCalendarToken()).Scan(&token)
+	if err != nil {
+		log.Printf("Error fetching calendar token: %v", err)
+		http.Error(w, `{"error":"Failed to fetch calendar feed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": calendarFeedURL(token)})
+}
+
+// resetCalendarFeedHandler replaces the feed token, so a leaked URL stops
+// working.
+func resetCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	token := newCalendarToken()
+	_, err := db.Exec("UPDATE users SET calendar_token = $2 WHERE username = $1", claims.Username, token)
+	if err != nil {
+		log.Printf("Error resetting calendar token: %v", err)
+		http.Error(w, `{"error":"Failed to reset calendar feed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": calendarFeedURL(token)})
+}
+
+// calendarFeedHandler serves the events a user hasn't declined to calendar
+// clients, which authenticate with the token in the URL alone.
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var user struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	err := db.Get(&user, "SELECT id, username FROM users WHERE calendar_token = $1", token)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var events []*Event
+	err = db.Select(&events, `SELECT `+eventColumns+eventFrom+`
+		WHERE me.rsvp <> 'no' AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		ORDER BY e.starts_at, e.id
+	`, user.ID, time.Now().Add(-calendarFeedPast).UTC())
+	if err == nil {
+		err = loadEventOverrides(events)
+	}
+	if err != nil {
+		log.Printf("Error fetching calendar feed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]icsEvent, 0, len(events))
+	for _, e := range events {
+		entries = append(entries, e.icsEvents()...)
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(calendarFeedCacheTime.Seconds())))
+	writeICS(w, "", icsCalendar(user.Username+" sessions", entries))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Follow states as seen from the viewer's side of the relationship.
+const (
+	FollowStateNotFollowing = "not_following"
+	FollowStateRequested    = "requested"
+	FollowStateFollowing    = "following"
+	FollowStateFollowedBy   = "followed_by"
+	FollowStateMutual       = "mutual"
+	FollowStateBlocked      = "blocked"
+	FollowStateSelf         = "self"
+)
+
+// resolveFollowState works out the single follow state between viewer and
+// target, along with the target's follower counts. A viewerID of 0 means the
+// request is anonymous.
+func resolveFollowState(viewerID, targetID int) (*FollowState, error) {
+	var viewerFollows, targetFollows, hasPendingRequest, viewerBlocked, viewerMuted bool
+	state := &FollowState{}
+
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM followers WHERE following_id = $2) as followers_count,
+			(SELECT COUNT(*) FROM followers WHERE follower_id = $2) as following_count,
+			EXISTS(SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = $2) as viewer_follows,
+			EXISTS(SELECT 1 FROM followers WHERE follower_id = $2 AND following_id = $1) as target_follows,
+			EXISTS(
+				SELECT 1 FROM follow_requests
+				WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
+			) as has_pending_request,
+			EXISTS(
+				SELECT 1 FROM user_blocks
+				WHERE blocker_id = $1 AND blocked_id = $2
+			) as viewer_blocked,
+			EXISTS(
+				SELECT 1 FROM user_mutes
+				WHERE muter_id = $1 AND muted_id = $2
+			) as viewer_muted
+	`, viewerID, targetID).Scan(
+		&state.FollowersCount, &state.FollowingCount,
+		&viewerFollows, &targetFollows, &hasPendingRequest, &viewerBlocked, &viewerMuted,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case viewerID == targetID:
+		state.FollowState = FollowStateSelf
+	case viewerBlocked:
+		state.FollowState = FollowStateBlocked
+	case viewerFollows && targetFollows:
+		state.FollowState = FollowStateMutual
+	case viewerFollows:
+		state.FollowState = FollowStateFollowing
+	case hasPendingRequest:
+		state.FollowState = FollowStateRequested
+	case targetFollows:
+		state.FollowState = FollowStateFollowedBy
+	default:
+		state.FollowState = FollowStateNotFollowing
+	}
+	state.IsFollowing = viewerFollows
+	// Only ever the viewer's own mute, so it is never revealed to the muted user
+	state.IsMuted = viewerMuted
+
+	return state, nil
+}
+
+// writeFollowActionResponse reports the follow state after a follow action,
+// together with a human readable message.
+func writeFollowActionResponse(w http.ResponseWriter, viewerID, targetID int, message string) {
+	state, err := resolveFollowState(viewerID, targetID)
+	if err != nil {
+		log.Printf("Error resolving follow state: %v", err)
+		http.Error(w, "Error checking follow status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*FollowState
+		Message string `json:"message"`
+	}{
+		FollowState: state,
+		Message:     message,
+	})
+}
+
+func getFollowStateHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	vars := mux.Vars(r)
+	targetUsername := vars["username"]
+
+	targetID, err := getUserID(targetUsername)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get target user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	followerID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, "Follower not found", http.StatusNotFound)
+		return
+	}
+
+	// Users who blocked the viewer are indistinguishable from missing ones
+	blocked, err := hasBlocked(targetID, followerID)
+	if err != nil {
+		http.Error(w, "Error checking follow status", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	state, err := resolveFollowState(followerID, targetID)
+	if err != nil {
+		log.Printf("Error resolving follow state: %v", err)
+		http.Error(w, "Error checking follow status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
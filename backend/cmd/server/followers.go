@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type RemovedFollower struct {
+	Username  string    `json:"username" db:"username"`
+	RemovedAt time.Time `json:"removedAt" db:"created_at"`
+}
+
+// removeFollowerHandler drops someone from the authenticated user's followers
+// without blocking them. The removal is remembered so it can be undone.
+func removeFollowerHandler(w http.ResponseWriter, r *http.Request) {
+	userID, followerID, ok := resolveRelationshipTarget(w, r, "Cannot remove yourself")
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM followers
+		WHERE follower_id = $1 AND following_id = $2
+	`, followerID, userID)
+	if err != nil {
+		log.Printf("Error removing follower: %v", err)
+		http.Error(w, `{"error":"Error removing follower"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"User is not following you"}`, http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO removed_followers (user_id, follower_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id, follower_id)
+		DO UPDATE SET created_at = CURRENT_TIMESTAMP
+	`, userID, followerID)
+	if err != nil {
+		log.Printf("Error recording removed follower: %v", err)
+		http.Error(w, `{"error":"Error removing follower"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing remove action"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, userID, followerID, "Follower removed")
+}
+
+// restoreFollowerHandler undoes a previous removal, putting the follower back.
+func restoreFollowerHandler(w http.ResponseWriter, r *http.Request) {
+	userID, followerID, ok := resolveRelationshipTarget(w, r, "Cannot restore yourself")
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM removed_followers
+		WHERE user_id = $1 AND follower_id = $2
+	`, userID, followerID)
+	if err != nil {
+		log.Printf("Error restoring follower: %v", err)
+		http.Error(w, `{"error":"Error restoring follower"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No removed follower to restore"}`, http.StatusNotFound)
+		return
+	}
+
+	// A block placed since the removal takes precedence
+	_, err = tx.Exec(`
+		INSERT INTO followers (follower_id, following_id)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2)
+			OR (blocker_id = $2 AND blocked_id = $1)
+		)
+		ON CONFLICT DO NOTHING
+	`, followerID, userID)
+	if err != nil {
+		log.Printf("Error restoring follower: %v", err)
+		http.Error(w, `{"error":"Error restoring follower"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing restore action"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, userID, followerID, "Follower restored")
+}
+
+func getRemovedFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	removed := []RemovedFollower{}
+	err := db.Select(&removed, `
+		SELECT u.username, rf.created_at
+		FROM removed_followers rf
+		JOIN users u ON u.id = rf.follower_id
+		WHERE rf.user_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY rf.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error fetching removed followers: %v", err)
+		http.Error(w, `{"error":"Failed to fetch removed followers"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(removed)
+}
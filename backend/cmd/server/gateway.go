@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway event types
+const (
+	GatewayEventReady         = "ready"
+	GatewayEventSubscriptions = "subscriptions"
+	GatewayEventPong          = "pong"
+	GatewayEventError         = "error"
+	GatewayEventFollower      = "follower.new"
+	GatewayEventFollowRequest = "follow_request.new"
+	GatewayEventMessage       = "message.new"
+	GatewayEventPresence      = "presence.update"
+	GatewayEventMatch         = "match"
+)
+
+// Gateway topics, which connections subscribe to rather than to each event
+// type
+const (
+	TopicFollows     = "follows"
+	TopicMessages    = "messages"
+	TopicPresence    = "presence"
+	TopicMatchmaking = "matchmaking"
+)
+
+var gatewayTopics = []string{TopicFollows, TopicMessages, TopicPresence, TopicMatchmaking}
+
+var gatewayEventTopics = map[string]string{
+	GatewayEventFollower:      TopicFollows,
+	GatewayEventFollowRequest: TopicFollows,
+	GatewayEventMessage:       TopicMessages,
+	GatewayEventPresence:      TopicPresence,
+	GatewayEventMatch:         TopicMatchmaking,
+}
+
+const (
+	gatewayPubSubTopic  = "gateway_events"
+	gatewaySendBuffer   = 64
+	gatewayPingInterval = 30 * time.Second
+	// Clients that answer neither pings nor send anything for this long
+	// are dropped
+	gatewayPongWait = 75 * time.Second
+
+	wsClosePolicyViolation = 1008
+)
+
+var gateway *Gateway
+
+// GatewayEvent is what clients receive.
+type GatewayEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// gatewayEnvelope carries an event through pub/sub to whichever instances
+// hold its recipients' connections.
+type gatewayEnvelope struct {
+	UserIDs []int           `json:"userIds"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// gatewayClient is one open socket. Writes go through a bounded queue
+// drained by the connection's own goroutine, so one slow client can't hold
+// up delivery to the rest; a client whose queue fills is disconnected.
+type gatewayClient struct {
+	userID int
+	conn   *wsConn
+	send   chan []byte
+	// raw clients get event data without the envelope, as the matchmaking
+	// socket always has
+	raw bool
+
+	mu       sync.Mutex
+	topics   map[string]bool
+	dropOnce sync.Once
+}
+
+func newGatewayClient(userID int, conn *wsConn, raw bool, topics []string) *gatewayClient {
+	client := &gatewayClient{
+		userID: userID,
+		conn:   conn,
+		send:   make(chan []byte, gatewaySendBuffer),
+		raw:    raw,
+		topics: map[string]bool{},
+	}
+	client.setTopics(topics, true)
+	return client
+}
+
+func (c *gatewayClient) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics[topic]
+}
+
+func (c *gatewayClient) setTopics(topics []string, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		if on {
+			c.topics[topic] = true
+		} else {
+			delete(c.topics, topic)
+		}
+	}
+}
+
+func (c *gatewayClient) topicList() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// enqueue queues a text message without blocking, dropping the client if
+// it has fallen too far behind.
+func (c *gatewayClient) enqueue(data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		c.dropOnce.Do(func() {
+			log.Printf("Dropping gateway client for user %d: send queue full", c.userID)
+			// Closing waits for any write in progress, which may be the
+			// stuck one
+			go c.conn.CloseWithCode(wsClosePolicyViolation, "Too slow to keep up")
+		})
+	}
+}
+
+func (c *gatewayClient) sendJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding gateway message: %v", err)
+		return
+	}
+	c.enqueue(data)
+}
+
+func (c *gatewayClient) sendEvent(eventType string, data interface{}) {
+	c.sendJSON(GatewayEvent{Type: eventType, Data: data})
+}
+
+func (c *gatewayClient) sendError(message string) {
+	c.sendEvent(GatewayEventError, map[string]string{"error": message})
+}
+
+// writeLoop drains the send queue and pings the client until done closes.
+func (c *gatewayClient) writeLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(gatewayPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-c.send:
+			if err := c.conn.WriteText(data); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.Ping(); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Gateway pushes events to users' open sockets. Events go out through
+// pub/sub, so they reach users connected to any server instance.
+type Gateway struct {
+	pubsub PubSub
+
+	mu      sync.RWMutex
+	clients map[int]map[*gatewayClient]bool
+}
+
+func NewGateway(pubsub PubSub) (*Gateway, error) {
+	g := &Gateway{pubsub: pubsub, clients: map[int]map[*gatewayClient]bool{}}
+	if err := pubsub.Subscribe(gatewayPubSubTopic, g.receive); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Gateway) register(client *gatewayClient) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.clients[client.userID] == nil {
+		g.clients[client.userID] = map[*gatewayClient]bool{}
+	}
+	g.clients[client.userID][client] = true
+}
+
+func (g *Gateway) unregister(client *gatewayClient) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.clients[client.userID], client)
+	if len(g.clients[client.userID]) == 0 {
+		delete(g.clients, client.userID)
+	}
+}
+
+// Publish sends an event to every connection the users have open. Delivery
+// is best effort: clients that miss events catch up over the REST API.
+func (g *Gateway) Publish(userIDs []int, eventType string, data interface{}) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	payload, err := json.Marshal(gatewayEnvelope{UserIDs: userIDs, Type: eventType, Data: encoded})
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	if err := g.pubsub.Publish(gatewayPubSubTopic, payload); err != nil {
+		log.Printf("Error publishing %s event: %v", eventType, err)
+	}
+}
+
+// receive hands an event from pub/sub to the local connections subscribed
+// to its topic.
+func (g *Gateway) receive(payload []byte) {
+	var envelope gatewayEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		log.Printf("Error decoding gateway event: %v", err)
+		return
+	}
+	topic := gatewayEventTopics[envelope.Type]
+
+	var framed []byte
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, userID := range envelope.UserIDs {
+		for client := range g.clients[userID] {
+			if !client.subscribed(topic) {
+				continue
+			}
+			if client.raw {
+				client.enqueue(envelope.Data)
+				continue
+			}
+			if framed == nil {
+				framed, _ = json.Marshal(GatewayEvent{Type: envelope.Type, Data: envelope.Data})
+			}
+			client.enqueue(framed)
+		}
+	}
+}
+
+// DeliverMatchEvent makes the gateway the matcher's MatchDelivery.
+func (g *Gateway) DeliverMatchEvent(userID int, event MatchEvent) {
+	g.Publish([]int{userID}, GatewayEventMatch, event)
+}
+
+// serve registers a client and runs its connection until it closes,
+// passing each text message to handle.
+func (g *Gateway) serve(client *gatewayClient, handle func(data []byte)) error {
+	g.register(client)
+	defer g.unregister(client)
+
+	done := make(chan struct{})
+	defer close(done)
+	go client.writeLoop(done)
+
+	conn := client.conn
+	conn.OnPong = func() { conn.SetReadDeadline(time.Now().Add(gatewayPongWait)) }
+	for {
+		conn.SetReadDeadline(time.Now().Add(gatewayPongWait))
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if opcode == wsOpText {
+			handle(data)
+		}
+	}
+}
+
+// socketUser authenticates a WebSocket handshake. Browsers can't set
+// headers on one, so the token may also come in the query string.
+func socketUser(w http.ResponseWriter, r *http.Request) (*Claims, int, bool) {
+	tokenString := r.URL.Query().Get("token")
+	if tokenString == "" {
+		tokenString = strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", 1)
+	}
+	claims, err := validateToken(tokenString)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to get user ID", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	return claims, userID, true
+}
+
+// parseGatewayTopics checks a list of topic names, returning the first
+// unknown one as an error.
+func parseGatewayTopics(topics []string) error {
+	for _, topic := range topics {
+		known := false
+		for _, t := range gatewayTopics {
+			if topic == t {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown topic %q", topic)
+		}
+	}
+	return nil
+}
+
+// gatewayHandler is the real-time event socket. It subscribes to every
+// topic unless ?topics= lists some. Clients send
+// {"op":"subscribe"|"unsubscribe","topics":[...]} to change that,
+// {"op":"idle"|"active"} as the user steps away and comes back, and
+// {"op":"ping"} for an application-level heartbeat, since browsers can't
+// send WebSocket pings. The user is online while they have a socket open.
+func gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	claims, userID, ok := socketUser(w, r)
+	if !ok {
+		return
+	}
+
+	topics := gatewayTopics
+	if t := r.URL.Query().Get("topics"); t != "" {
+		topics = strings.Split(t, ",")
+		if err := parseGatewayTopics(topics); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	connID, err := presenceConnect(userID)
+	if err != nil {
+		log.Printf("Error recording presence: %v", err)
+	}
+	if connID != 0 {
+		defer presenceDisconnect(connID, userID)
+	}
+
+	client := newGatewayClient(userID, conn, false, topics)
+	client.sendEvent(GatewayEventReady, map[string]interface{}{
+		"username": claims.Username,
+		"topics":   client.topicList(),
+	})
+
+	// Catch up on a match found while the socket was down
+	if client.subscribed(TopicMatchmaking) {
+		if _, pending := matcher.Status(userID); pending != nil {
+			client.sendEvent(GatewayEventMatch, pending)
+		}
+	}
+
+	err = gateway.serve(client, func(data []byte) {
+		var command struct {
+			Op     string   `json:"op"`
+			Topics []string `json:"topics"`
+		}
+		if err := json.Unmarshal(data, &command); err != nil {
+			client.sendError("Invalid JSON")
+			return
+		}
+
+		switch command.Op {
+		case "ping":
+			client.sendEvent(GatewayEventPong, nil)
+		case "idle", "active":
+			if connID == 0 {
+				return
+			}
+			if err := setPresenceIdle(connID, userID, command.Op == "idle"); err != nil {
+				log.Printf("Error updating presence: %v", err)
+			}
+		case "subscribe", "unsubscribe":
+			if err := parseGatewayTopics(command.Topics); err != nil {
+				client.sendError(err.Error())
+				return
+			}
+			client.setTopics(command.Topics, command.Op == "subscribe")
+			client.sendEvent(GatewayEventSubscriptions, map[string][]string{"topics": client.topicList()})
+		default:
+			client.sendError("Unknown op")
+		}
+	})
+	if err != nil && err != errWebSocketClosed && err != io.EOF {
+		log.Printf("Gateway socket for %s closed: %v", claims.Username, err)
+	}
+}
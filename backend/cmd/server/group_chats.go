@@ -0,0 +1,859 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Conversation member roles. Admins invite, kick, rename and pin; a party
+// chat's admin is the party leader.
+const (
+	ConversationRoleAdmin  = "admin"
+	ConversationRoleMember = "member"
+)
+
+const (
+	groupMaxMembers     = 50
+	groupMaxPins        = 50
+	groupTitleMaxLength = 100
+	mentionsPerMessage  = 10
+)
+
+// A mention is @username at the start of the text or after anything that
+// can't be part of a username or an email address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([\w.-]*\w)`)
+
+var errGroupFull = errors.New("group is full")
+
+type ConversationMember struct {
+	Username string    `json:"username" db:"username"`
+	Role     string    `json:"role" db:"role"`
+	Status   string    `json:"status" db:"status"`
+	JoinedAt time.Time `json:"joinedAt" db:"joined_at"`
+}
+
+// groupMember is the acting user's membership of a group, locked for the
+// rest of the transaction.
+type groupMember struct {
+	ConversationID int    `db:"id"`
+	PartyID        *int   `db:"party_id"`
+	Title          string `db:"title"`
+	Role           string `db:"role"`
+}
+
+// loadConversationMembers fills in the current members of a group, admins
+// first. People who turned down the invite aren't listed.
+func loadConversationMembers(conversation *Conversation) error {
+	conversation.Members = []ConversationMember{}
+	return db.Select(&conversation.Members, `
+		SELECT u.username, cm.role, cm.status, cm.joined_at
+		FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = $1 AND cm.left_at IS NULL AND cm.status <> 'rejected'
+		ORDER BY cm.role = 'admin' DESC, cm.joined_at, u.username
+	`, conversation.ID)
+}
+
+// mentionedUsernames returns the distinct usernames mentioned in a message,
+// up to mentionsPerMessage of them.
+func mentionedUsernames(body string) []string {
+	var usernames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		if seen[match[1]] {
+			continue
+		}
+		seen[match[1]] = true
+		usernames = append(usernames, match[1])
+		if len(usernames) == mentionsPerMessage {
+			break
+		}
+	}
+	return usernames
+}
+
+// notifyMentions notifies the group members a message mentions, skipping
+// anyone on either side of a block with the sender.
+func notifyMentions(tx *sqlx.Tx, conversationID, senderID int, body string) error {
+	usernames := mentionedUsernames(body)
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	var ids []int
+	err := tx.Select(&ids, `
+		SELECT u.id FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = $2 AND cm.left_at IS NULL AND cm.status = 'accepted'
+		AND u.username = ANY($3) AND u.id <> $1 AND `+notBlockedSQL("$1"),
+		senderID, conversationID, pq.Array(usernames))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := emitNotificationAbout(tx, id, senderID, NotificationMention, conversationID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postSystemMessage records a membership change or rename in the
+// conversation's history.
+func postSystemMessage(tx *sql.Tx, conversationID, actorID int, body string) error {
+	_, err := tx.Exec(`
+		WITH m AS (
+			INSERT INTO messages (conversation_id, sender_id, body, kind)
+			VALUES ($1, $2, $3, 'system')
+			RETURNING created_at
+		)
+		UPDATE conversations c SET last_message_at = m.created_at
+		FROM m WHERE c.id = $1
+	`, conversationID, actorID, body)
+	return err
+}
+
+// lockedGroup checks userID is in the group conversation named by the
+// request, locking it. It writes the error response and returns false if
+// they aren't, if it's a direct conversation, or if it's archived.
+func lockedGroup(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx, userID int) (*groupMember, bool) {
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var member struct {
+		groupMember
+		Kind     string `db:"kind"`
+		Archived bool   `db:"archived"`
+	}
+	err := tx.Get(&member, `
+		SELECT c.id, c.kind, c.party_id, COALESCE(c.title, '') AS title,
+			c.archived_at IS NOT NULL AS archived, me.role
+		FROM conversations c
+		JOIN conversation_members me ON me.conversation_id = c.id AND me.user_id = $1
+			AND me.left_at IS NULL AND me.status = 'accepted'
+		WHERE c.id = $2
+		FOR UPDATE OF c
+	`, userID, conversationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error checking conversation: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if member.Kind != ConversationGroup {
+		http.Error(w, `{"error":"Only group conversations can be managed"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	if member.Archived {
+		http.Error(w, `{"error":"This conversation is archived"}`, http.StatusConflict)
+		return nil, false
+	}
+	return &member.groupMember, true
+}
+
+// requireGroupAdmin writes a 403 and returns false unless member is an admin.
+func requireGroupAdmin(w http.ResponseWriter, member *groupMember) bool {
+	if member.Role != ConversationRoleAdmin {
+		http.Error(w, `{"error":"Only group admins can do that"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireNotPartyChat writes a 409 and returns false for party chats, whose
+// membership follows the party's.
+func requireNotPartyChat(w http.ResponseWriter, member *groupMember) bool {
+	if member.PartyID != nil {
+		http.Error(w, `{"error":"Party chat members change with the party"}`, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// addGroupMembers adds users to a group, bringing back members who left and
+// skipping anyone on either side of a block with the inviter. Like a DM, the
+// invite waits as a message request for private users the inviter doesn't
+// follow. It returns the usernames added.
+func addGroupMembers(tx *sqlx.Tx, conversationID, inviterID int, usernames []string) ([]string, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+
+	var added []struct {
+		UserID   int    `db:"user_id"`
+		Username string `db:"username"`
+		Status   string `db:"status"`
+	}
+	err := tx.Select(&added, `
+		WITH added AS (
+			INSERT INTO conversation_members (conversation_id, user_id, status, last_read_message_id)
+			SELECT $2, u.id,
+				CASE WHEN u.is_private AND NOT EXISTS (
+					SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = u.id
+				) THEN 'pending' ELSE 'accepted' END,
+				COALESCE((SELECT MAX(id) FROM messages WHERE conversation_id = $2), 0)
+			FROM users u
+			WHERE u.username = ANY($3) AND u.id <> $1 AND `+notBlockedSQL("$1")+`
+			ON CONFLICT (conversation_id, user_id) DO UPDATE
+			SET status = EXCLUDED.status, role = 'member', joined_at = CURRENT_TIMESTAMP,
+				left_at = NULL, last_read_message_id = EXCLUDED.last_read_message_id
+			WHERE conversation_members.left_at IS NOT NULL
+			RETURNING user_id, status
+		)
+		SELECT added.user_id, u.username, added.status
+		FROM added JOIN users u ON u.id = added.user_id
+		ORDER BY u.username
+	`, inviterID, conversationID, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+
+	var members int
+	err = tx.Get(&members, `
+		SELECT COUNT(*) FROM conversation_members
+		WHERE conversation_id = $1 AND left_at IS NULL AND status <> 'rejected'
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if members > groupMaxMembers {
+		return nil, errGroupFull
+	}
+
+	names := make([]string, len(added))
+	for i, a := range added {
+		names[i] = a.Username
+		if a.Status == MemberStatusPending {
+			if err := emitNotificationAbout(tx, a.UserID, inviterID, NotificationMessageRequest, conversationID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return names, nil
+}
+
+// removeGroupMember takes userID out of a group. If that leaves it without
+// an admin, the longest-standing member takes over.
+func removeGroupMember(tx *sql.Tx, conversationID, userID int) error {
+	_, err := tx.Exec(`
+		UPDATE conversation_members SET left_at = CURRENT_TIMESTAMP, role = 'member'
+		WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL
+	`, conversationID, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE conversation_members SET role = 'admin'
+		WHERE conversation_id = $1 AND user_id = (
+			SELECT user_id FROM conversation_members
+			WHERE conversation_id = $1 AND left_at IS NULL AND status = 'accepted'
+			ORDER BY joined_at, user_id
+			LIMIT 1
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM conversation_members
+			WHERE conversation_id = $1 AND left_at IS NULL AND role = 'admin'
+		)
+	`, conversationID)
+	return err
+}
+
+func validGroupTitle(title string) (string, bool) {
+	title = strings.TrimSpace(title)
+	return title, title != "" && utf8.RuneCountInString(title) <= groupTitleMaxLength
+}
+
+func writeConversation(w http.ResponseWriter, conversationID, userID, status int) {
+	conversation, err := loadConversation(conversationID, userID)
+	if err != nil {
+		log.Printf("Error loading conversation: %v", err)
+		http.Error(w, `{"error":"Error loading conversation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(conversation)
+}
+
+// createGroupConversationHandler starts a group chat with the creator as
+// its admin.
+func createGroupConversationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Title     string   `json:"title"`
+		Usernames []string `json:"usernames"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	title, ok := validGroupTitle(req.Title)
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"error":"Titles must be between 1 and %d characters"}`, groupTitleMaxLength), http.StatusBadRequest)
+		return
+	}
+	if len(req.Usernames) >= groupMaxMembers {
+		http.Error(w, fmt.Sprintf(`{"error":"Groups can have at most %d members"}`, groupMaxMembers), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var conversationID int
+	err = tx.Get(&conversationID, `
+		INSERT INTO conversations (kind, title, created_by)
+		VALUES ('group', $1, $2)
+		RETURNING id
+	`, title, userID)
+	if err != nil {
+		log.Printf("Error creating group: %v", err)
+		http.Error(w, `{"error":"Error creating group"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO conversation_members (conversation_id, user_id, role)
+		VALUES ($1, $2, 'admin')
+	`, conversationID, userID)
+	if err != nil {
+		log.Printf("Error creating group: %v", err)
+		http.Error(w, `{"error":"Error creating group"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := postSystemMessage(tx.Tx, conversationID, userID, claims.Username+" created the group"); err != nil {
+		log.Printf("Error creating group: %v", err)
+		http.Error(w, `{"error":"Error creating group"}`, http.StatusInternalServerError)
+		return
+	}
+
+	added, err := addGroupMembers(tx, conversationID, userID, req.Usernames)
+	if err != nil {
+		log.Printf("Error adding group members: %v", err)
+		http.Error(w, `{"error":"Error creating group"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(added) > 0 {
+		err := postSystemMessage(tx.Tx, conversationID, userID, claims.Username+" added "+strings.Join(added, ", "))
+		if err != nil {
+			log.Printf("Error creating group: %v", err)
+			http.Error(w, `{"error":"Error creating group"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing group creation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeConversation(w, conversationID, userID, http.StatusCreated)
+}
+
+// renameGroupHandler changes a group's title.
+func renameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Title string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	title, ok := validGroupTitle(req.Title)
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"error":"Titles must be between 1 and %d characters"}`, groupTitleMaxLength), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	member, ok := lockedGroup(w, r, tx, userID)
+	if !ok || !requireGroupAdmin(w, member) {
+		return
+	}
+
+	if title != member.Title {
+		_, err = tx.Exec(`UPDATE conversations SET title = $2 WHERE id = $1`, member.ConversationID, title)
+		if err == nil {
+			err = postSystemMessage(tx.Tx, member.ConversationID, userID, fmt.Sprintf("%s renamed the group to %q", claims.Username, title))
+		}
+		if err != nil {
+			log.Printf("Error renaming group: %v", err)
+			http.Error(w, `{"error":"Error renaming group"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing rename"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeConversation(w, member.ConversationID, userID, http.StatusOK)
+}
+
+// addGroupMembersHandler lets an admin invite more people.
+func addGroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Usernames []string `json:"usernames"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Usernames) == 0 || len(req.Usernames) >= groupMaxMembers {
+		http.Error(w, fmt.Sprintf(`{"error":"usernames must list between 1 and %d users"}`, groupMaxMembers-1), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	member, ok := lockedGroup(w, r, tx, userID)
+	if !ok || !requireGroupAdmin(w, member) || !requireNotPartyChat(w, member) {
+		return
+	}
+
+	added, err := addGroupMembers(tx, member.ConversationID, userID, req.Usernames)
+	if err == errGroupFull {
+		http.Error(w, fmt.Sprintf(`{"error":"Groups can have at most %d members"}`, groupMaxMembers), http.StatusConflict)
+		return
+	}
+	if err == nil && len(added) > 0 {
+		err = postSystemMessage(tx.Tx, member.ConversationID, userID, claims.Username+" added "+strings.Join(added, ", "))
+	}
+	if err != nil {
+		log.Printf("Error adding group members: %v", err)
+		http.Error(w, `{"error":"Error adding members"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeConversation(w, member.ConversationID, userID, http.StatusOK)
+}
+
+// removeGroupMemberHandler kicks a member, or leaves the group when the
+// username is the caller's own.
+func removeGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	targetUsername := mux.Vars(r)["username"]
+	leaving := targetUsername == claims.Username
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	member, ok := lockedGroup(w, r, tx, userID)
+	if !ok || !requireNotPartyChat(w, member) {
+		return
+	}
+	if !leaving && !requireGroupAdmin(w, member) {
+		return
+	}
+
+	targetID := userID
+	body := claims.Username + " left"
+	if !leaving {
+		err := tx.Get(&targetID, `
+			SELECT cm.user_id FROM conversation_members cm
+			JOIN users u ON u.id = cm.user_id
+			WHERE cm.conversation_id = $1 AND u.username = $2 AND cm.left_at IS NULL
+		`, member.ConversationID, targetUsername)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Member not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		body = claims.Username + " removed " + targetUsername
+	}
+
+	if err := removeGroupMember(tx.Tx, member.ConversationID, targetID); err != nil {
+		log.Printf("Error removing group member: %v", err)
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := postSystemMessage(tx.Tx, member.ConversationID, userID, body); err != nil {
+		log.Printf("Error removing group member: %v", err)
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing removal"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if leaving {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Left group"})
+		return
+	}
+	writeConversation(w, member.ConversationID, userID, http.StatusOK)
+}
+
+// setGroupMemberRoleHandler promotes a member to admin or demotes them. A
+// group always keeps at least one admin.
+func setGroupMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	targetUsername := mux.Vars(r)["username"]
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Role != ConversationRoleAdmin && req.Role != ConversationRoleMember {
+		http.Error(w, `{"error":"role must be admin or member"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	member, ok := lockedGroup(w, r, tx, userID)
+	if !ok || !requireGroupAdmin(w, member) {
+		return
+	}
+
+	var target struct {
+		UserID int    `db:"user_id"`
+		Role   string `db:"role"`
+	}
+	err = tx.Get(&target, `
+		SELECT cm.user_id, cm.role FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = $1 AND u.username = $2
+		AND cm.left_at IS NULL AND cm.status = 'accepted'
+	`, member.ConversationID, targetUsername)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Member not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if target.Role != req.Role {
+		if req.Role == ConversationRoleMember {
+			var admins int
+			err := tx.Get(&admins, `
+				SELECT COUNT(*) FROM conversation_members
+				WHERE conversation_id = $1 AND left_at IS NULL AND role = 'admin'
+			`, member.ConversationID)
+			if err != nil {
+				http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+				return
+			}
+			if admins <= 1 {
+				http.Error(w, `{"error":"A group needs at least one admin"}`, http.StatusConflict)
+				return
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE conversation_members SET role = $3
+			WHERE conversation_id = $1 AND user_id = $2
+		`, member.ConversationID, target.UserID, req.Role)
+		if err == nil {
+			body := claims.Username + " made " + targetUsername + " an admin"
+			if req.Role == ConversationRoleMember {
+				body = claims.Username + " removed " + targetUsername + " as an admin"
+			}
+			err = postSystemMessage(tx.Tx, member.ConversationID, userID, body)
+		}
+		if err != nil {
+			log.Printf("Error changing member role: %v", err)
+			http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing role change"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeConversation(w, member.ConversationID, userID, http.StatusOK)
+}
+
+func pinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	setMessagePinned(w, r, true)
+}
+
+func unpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	setMessagePinned(w, r, false)
+}
+
+// setMessagePinned pins or unpins a message in a group. Only admins can,
+// and system messages can't be pinned.
+func setMessagePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	messageID, _ := strconv.Atoi(mux.Vars(r)["messageId"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	member, ok := lockedGroup(w, r, tx, userID)
+	if !ok || !requireGroupAdmin(w, member) {
+		return
+	}
+
+	if pinned {
+		var pins int
+		err := tx.Get(&pins, `
+			SELECT COUNT(*) FROM messages WHERE conversation_id = $1 AND pinned_at IS NOT NULL
+		`, member.ConversationID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if pins >= groupMaxPins {
+			http.Error(w, fmt.Sprintf(`{"error":"Groups can have at most %d pinned messages"}`, groupMaxPins), http.StatusConflict)
+			return
+		}
+	}
+
+	var message Message
+	err = tx.Get(&message, `
+		WITH m AS (
+			UPDATE messages
+			SET pinned_at = CASE WHEN $3 THEN COALESCE(pinned_at, CURRENT_TIMESTAMP) END,
+				pinned_by = CASE WHEN $3 THEN COALESCE(pinned_by, $4) END
+			WHERE id = $2 AND conversation_id = $1 AND kind = 'user'
+			RETURNING id, conversation_id, kind, sender_id, body, created_at, pinned_at
+		)
+		SELECT `+messageColumns+` FROM m JOIN users s ON s.id = m.sender_id
+	`, member.ConversationID, messageID, pinned, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Message not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error pinning message: %v", err)
+		http.Error(w, `{"error":"Error pinning message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing pin"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeMessage(w, &message, http.StatusOK)
+}
+
+// getPinnedMessagesHandler lists a conversation's pinned messages, most
+// recently pinned first.
+func getPinnedMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := loadConversation(conversationID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error":"Failed to fetch pinned messages"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	messages := []Message{}
+	err = db.Select(&messages, `
+		SELECT `+messageColumns+`
+		FROM messages m
+		JOIN users s ON s.id = m.sender_id
+		WHERE m.conversation_id = $1 AND m.pinned_at IS NOT NULL
+		ORDER BY m.pinned_at DESC, m.id DESC
+	`, conversationID)
+	if err != nil {
+		log.Printf("Error fetching pinned messages: %v", err)
+		http.Error(w, `{"error":"Failed to fetch pinned messages"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// createPartyChat starts the group chat that goes with a new party.
+func createPartyChat(tx *sql.Tx, partyID int, game string) error {
+	_, err := tx.Exec(`
+		INSERT INTO conversations (kind, title, party_id)
+		VALUES ('group', $2, $1)
+	`, partyID, game+" party")
+	return err
+}
+
+// joinPartyChat adds a party member to the party's chat. The leader is its
+// admin. Parties from before party chats existed have none, which is fine.
+func joinPartyChat(tx *sql.Tx, partyID, userID int, partyRole string) error {
+	role := ConversationRoleMember
+	if partyRole == PartyRoleLeader {
+		role = ConversationRoleAdmin
+	}
+
+	var conversationID int
+	var username string
+	err := tx.QueryRow(`
+		INSERT INTO conversation_members (conversation_id, user_id, role, last_read_message_id)
+		SELECT c.id, $2, $3, COALESCE((SELECT MAX(id) FROM messages WHERE conversation_id = c.id), 0)
+		FROM conversations c WHERE c.party_id = $1
+		ON CONFLICT (conversation_id, user_id) DO UPDATE
+		SET role = $3, status = 'accepted', joined_at = CURRENT_TIMESTAMP, left_at = NULL,
+			last_read_message_id = EXCLUDED.last_read_message_id
+		RETURNING conversation_id, (SELECT username FROM users WHERE id = $2)
+	`, partyID, userID, role).Scan(&conversationID, &username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return postSystemMessage(tx, conversationID, userID, username+" joined the party")
+}
+
+// leavePartyChat takes someone who left a party out of its chat.
+func leavePartyChat(tx *sql.Tx, partyID, userID int) error {
+	var conversationID int
+	var username string
+	err := tx.QueryRow(`
+		SELECT c.id, u.username FROM conversations c, users u
+		WHERE c.party_id = $1 AND u.id = $2
+	`, partyID, userID).Scan(&conversationID, &username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := removeGroupMember(tx, conversationID, userID); err != nil {
+		return err
+	}
+	return postSystemMessage(tx, conversationID, userID, username+" left the party")
+}
+
+// archivePartyChat makes a disbanded party's chat read-only. Members keep
+// it so they can look back over it. It must run before the party's
+// memberships end, so the leader can be credited.
+func archivePartyChat(tx *sql.Tx, partyID int) error {
+	var conversationID, leaderID int
+	err := tx.QueryRow(`
+		SELECT c.id, pm.user_id FROM conversations c
+		JOIN party_members pm ON pm.party_id = c.party_id AND pm.role = 'leader' AND pm.left_at IS NULL
+		WHERE c.party_id = $1 AND c.archived_at IS NULL
+	`, partyID).Scan(&conversationID, &leaderID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := postSystemMessage(tx, conversationID, leaderID, "The party disbanded"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE conversations SET archived_at = CURRENT_TIMESTAMP WHERE id = $1`, conversationID)
+	return err
+}
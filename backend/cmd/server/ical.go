@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icsProductID       = "-//pixel-and-chill//Sessions//EN"
+	icsUIDDomain       = "pixel-and-chill"
+	icsMaxLineBytes    = 75
+	icsTimeFormat      = "20060102T150405Z"
+	icsLocalTimeFormat = "20060102T150405"
+	icsDateFormat      = "20060102"
+)
+
+// icsEvent is one VEVENT. Times are written in UTC unless TimeZone is set,
+// which recurring events need so their occurrences follow local DST rules.
+// An event with RecurrenceID set overrides that occurrence of the series
+// sharing its UID.
+type icsEvent struct {
+	UID          string
+	Sequence     int
+	Stamp        time.Time
+	Start        time.Time
+	End          time.Time
+	TimeZone     *time.Location
+	RRule        string
+	ExDates      []time.Time
+	RecurrenceID *time.Time
+	Summary      string
+	Description  string
+	Organizer    string
+	Cancelled    bool
+}
+
+// icsTime renders a date-time property, in UTC or local to loc.
+func icsTime(property string, loc *time.Location, times ...time.Time) string {
+	values := make([]string, len(times))
+	if loc == nil || loc == time.UTC {
+		for i, t := range times {
+			values[i] = t.UTC().Format(icsTimeFormat)
+		}
+		return property + ":" + strings.Join(values, ",")
+	}
+	for i, t := range times {
+		values[i] = t.In(loc).Format(icsLocalTimeFormat)
+	}
+	return property + ";TZID=" + loc.String() + ":" + strings.Join(values, ",")
+}
+
+// icsCalendar renders events as an RFC 5545 VCALENDAR. name is shown by
+// clients that subscribe to the calendar and may be empty.
+func icsCalendar(name string, events []icsEvent) []byte {
+	var buf bytes.Buffer
+	line := func(s string) { writeICSLine(&buf, s) }
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:" + icsProductID)
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	if name != "" {
+		line("X-WR-CALNAME:" + icsEscape(name))
+	}
+
+	for _, zone := range icsTimeZones(events) {
+		writeICSTimeZone(line, zone.loc, zone.from, zone.to)
+	}
+
+	for _, e := range events {
+		line("BEGIN:VEVENT")
+		line("UID:" + e.UID)
+		line(fmt.Sprintf("SEQUENCE:%d", e.Sequence))
+		line("DTSTAMP:" + e.Stamp.UTC().Format(icsTimeFormat))
+		if e.RecurrenceID != nil {
+			line(icsTime("RECURRENCE-ID", e.TimeZone, *e.RecurrenceID))
+		}
+		line(icsTime("DTSTART", e.TimeZone, e.Start))
+		line(icsTime("DTEND", e.TimeZone, e.End))
+		if e.RRule != "" {
+			line("RRULE:" + e.RRule)
+		}
+		if len(e.ExDates) > 0 {
+			line(icsTime("EXDATE", e.TimeZone, e.ExDates...))
+		}
+		line("SUMMARY:" + icsEscape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:" + icsEscape(e.Description))
+		}
+		if e.Organizer != "" {
+			line("ORGANIZER;CN=" + icsParam(e.Organizer) + ":invalid:nomail")
+		}
+		if e.Cancelled {
+			line("STATUS:CANCELLED")
+		} else {
+			line("STATUS:CONFIRMED")
+		}
+		line("END:VEVENT")
+	}
+
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+type icsZoneRange struct {
+	loc      *time.Location
+	from, to time.Time
+}
+
+// icsTimeZones lists the zones events are written in, each with the span
+// its VTIMEZONE must cover. Open-ended series get the next two years.
+func icsTimeZones(events []icsEvent) []icsZoneRange {
+	var zones []icsZoneRange
+	index := map[string]int{}
+	for _, e := range events {
+		if e.TimeZone == nil || e.TimeZone == time.UTC {
+			continue
+		}
+		from, to := e.Start, e.End
+		if e.RecurrenceID != nil && e.RecurrenceID.Before(from) {
+			from = *e.RecurrenceID
+		}
+		if e.RRule != "" {
+			to = to.Add(recurrenceMaxSpan)
+		}
+
+		i, ok := index[e.TimeZone.String()]
+		if !ok {
+			index[e.TimeZone.String()] = len(zones)
+			zones = append(zones, icsZoneRange{e.TimeZone, from, to})
+			continue
+		}
+		if from.Before(zones[i].from) {
+			zones[i].from = from
+		}
+		if to.After(zones[i].to) {
+			zones[i].to = to
+		}
+	}
+	return zones
+}
+
+// writeICSTimeZone writes a VTIMEZONE for loc listing each UTC offset change
+// between from and to, found by scanning Go's zone database.
+func writeICSTimeZone(line func(string), loc *time.Location, from, to time.Time) {
+	observance := func(t time.Time, offsetFrom int) {
+		name, offset := t.In(loc).Zone()
+		kind := "STANDARD"
+		if t.In(loc).IsDST() {
+			kind = "DAYLIGHT"
+		}
+		line("BEGIN:" + kind)
+		// DTSTART is the local time just before the change
+		line("DTSTART:" + t.In(time.FixedZone("", offsetFrom)).Format(icsLocalTimeFormat))
+		line("TZOFFSETFROM:" + icsOffset(offsetFrom))
+		line("TZOFFSETTO:" + icsOffset(offset))
+		if name != "" {
+			line("TZNAME:" + icsEscape(name))
+		}
+		line("END:" + kind)
+	}
+
+	line("BEGIN:VTIMEZONE")
+	line("TZID:" + loc.String())
+
+	from = from.Add(-24 * time.Hour).Truncate(time.Hour)
+	_, offset := from.In(loc).Zone()
+	observance(from, offset)
+
+	for day := from; day.Before(to); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		_, nextOffset := next.In(loc).Zone()
+		if nextOffset == offset {
+			continue
+		}
+		// Narrow down to the second the offset changed
+		lo, hi := day, next
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, o := mid.In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		observance(hi, offset)
+		offset = nextOffset
+	}
+
+	line("END:VTIMEZONE")
+}
+
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+	if seconds%60 != 0 {
+		s += fmt.Sprintf("%02d", seconds%60)
+	}
+	return s
+}
+
+// icsEscape escapes a TEXT value.
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// icsParam quotes a parameter value, which may not contain quotes.
+func icsParam(s string) string {
+	return `"` + strings.NewReplacer(`"`, "'", "\r", " ", "\n", " ").Replace(s) + `"`
+}
+
+// writeICSLine writes a content line, folding it so no line is longer than
+// 75 octets without splitting a UTF-8 sequence.
+func writeICSLine(buf *bytes.Buffer, s string) {
+	limit := icsMaxLineBytes
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		buf.WriteString(s[:cut])
+		buf.WriteString("\r\n ")
+		s = s[cut:]
+		// Continuation lines lose an octet to the leading space
+		limit = icsMaxLineBytes - 1
+	}
+	buf.WriteString(s)
+	buf.WriteString("\r\n")
+}
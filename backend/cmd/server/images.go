@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// Reject images whose decoded pixels would use an unreasonable amount of
+	// memory, whatever their file size
+	maxImagePixels = 40_000_000
+	jpegQuality    = 85
+)
+
+var errUnsupportedImage = errors.New("unsupported image")
+
+// imageVariant describes one resized output of an upload. Variants are
+// cropped to their aspect ratio unless Fit is set, in which case the whole
+// image is scaled to fit within Width x Height.
+type imageVariant struct {
+	Name   string
+	Width  int
+	Height int
+	Fit    bool
+}
+
+// processImage decodes an upload, applies its EXIF orientation, crops it to the
+// aspect ratio of the variants and encodes each variant as a JPEG. Encoding
+// from decoded pixels drops all metadata, EXIF included.
+func processImage(data []byte, variants []imageVariant) (map[string][]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d are too large", config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	img := normalizeImage(src, jpegOrientation(data))
+
+	outputs := make(map[string][]byte, len(variants))
+	for _, variant := range variants {
+		crop := centerCrop(img.Bounds(), variant.Width, variant.Height)
+		width, height := variant.Width, variant.Height
+		if variant.Fit {
+			crop = img.Bounds()
+			width, height = fitWithin(crop.Dx(), crop.Dy(), variant.Width, variant.Height)
+		}
+
+		// Never upscale; small sources keep their own size at the right aspect
+		if crop.Dx() < width {
+			width = crop.Dx()
+			height = crop.Dy()
+		}
+
+		resized := resizeArea(img, crop, width, height)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		outputs[variant.Name] = buf.Bytes()
+	}
+
+	return outputs, nil
+}
+
+// normalizeImage copies src into an RGBA image with the EXIF orientation
+// applied and any transparency flattened onto white, since JPEG has no alpha.
+func normalizeImage(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 && orientation <= 8 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, a := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// Composite over white
+			r = r + (0xffff - a)
+			g = g + (0xffff - a)
+			bl = bl + (0xffff - a)
+
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+
+			dst.SetRGBA(dx, dy, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8), 0xff})
+		}
+	}
+	return dst
+}
+
+// centerCrop returns the largest rectangle centred in bounds with the aspect
+// ratio width:height.
+func centerCrop(bounds image.Rectangle, width, height int) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w*height > h*width {
+		cropW := h * width / height
+		x0 := bounds.Min.X + (w-cropW)/2
+		return image.Rect(x0, bounds.Min.Y, x0+cropW, bounds.Max.Y)
+	}
+	cropH := w * height / width
+	y0 := bounds.Min.Y + (h-cropH)/2
+	return image.Rect(bounds.Min.X, y0, bounds.Max.X, y0+cropH)
+}
+
+// fitWithin scales w x h down to fit within maxW x maxH, keeping its aspect
+// ratio and never going below one pixel.
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// resizeArea scales the crop of src to width x height by averaging every
+// source pixel that falls under each destination pixel. That is slower than
+// bilinear filtering but does not alias on large reductions.
+func resizeArea(src *image.RGBA, crop image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	cw, ch := crop.Dx(), crop.Dy()
+
+	for y := 0; y < height; y++ {
+		sy0 := crop.Min.Y + y*ch/height
+		sy1 := crop.Min.Y + (y+1)*ch/height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			sx0 := crop.Min.X + x*cw/width
+			sx1 := crop.Min.X + (x+1)*cw/width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[src.PixOffset(sx0, sy):]
+				for i := 0; i < (sx1-sx0)*4; i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					n++
+				}
+			}
+
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(b / n)
+			dst.Pix[off+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag from a JPEG, returning 1
+// (upright) when there is none or the data is not a JPEG.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// Start of scan: image data follows, no more metadata
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds tag 0x0112 in the first IFD of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// LFG post statuses
+const (
+	LFGStatusOpen    = "open"
+	LFGStatusClosed  = "closed"
+	LFGStatusExpired = "expired"
+)
+
+const (
+	lfgDefaultExpiry     = 2 * time.Hour
+	lfgMinExpiry         = 5 * time.Minute
+	lfgMaxExpiry         = 7 * 24 * time.Hour
+	lfgMaxSlots          = 10
+	lfgMaxModeLength     = 64
+	lfgMaxDescription    = 500
+	lfgDefaultLimit      = 20
+	lfgMaxLimit          = 100
+	lfgSweepInterval     = time.Minute
+	lfgCursorSort        = "lfg"
+	lfgMaxRankNameLength = 64
+	lfgMaxRating         = 4000
+)
+
+// gameRankTiers orders the named ranks of games that have them, lowest
+// first, so rank ranges can be compared. Games without an entry take free
+// text ranks, which only match exactly.
+var gameRankTiers = map[string][]string{
+	"Valorant":          {"Iron", "Bronze", "Silver", "Gold", "Platinum", "Diamond", "Ascendant", "Immortal", "Radiant"},
+	"League of Legends": {"Iron", "Bronze", "Silver", "Gold", "Platinum", "Emerald", "Diamond", "Master", "Grandmaster", "Challenger"},
+	"Apex Legends":      {"Rookie", "Bronze", "Silver", "Gold", "Platinum", "Diamond", "Master", "Apex Predator"},
+	"Overwatch 2":       {"Bronze", "Silver", "Gold", "Platinum", "Diamond", "Master", "Grandmaster", "Champion", "Top 500"},
+	"Rainbow Six Siege": {"Copper", "Bronze", "Silver", "Gold", "Platinum", "Emerald", "Diamond", "Champion"},
+	"Rocket League":     {"Bronze", "Silver", "Gold", "Platinum", "Diamond", "Champion", "Grand Champion", "Supersonic Legend"},
+	"Dota 2":            {"Herald", "Guardian", "Crusader", "Archon", "Legend", "Ancient", "Divine", "Immortal"},
+}
+
+// rankOrder returns the catalog spelling and position of rank within game's
+// tiers. ok is false when the game has tiers but rank isn't one of them.
+func rankOrder(game, rank string) (name string, order *int, ok bool) {
+	tiers, ranked := gameRankTiers[game]
+	if !ranked {
+		return rank, nil, true
+	}
+	for i, tier := range tiers {
+		if strings.EqualFold(tier, rank) {
+			i := i
+			return tier, &i, true
+		}
+	}
+	return "", nil, false
+}
+
+type LFGPost struct {
+	ID            int        `json:"id" db:"id"`
+	Owner         string     `json:"owner" db:"owner"`
+	Game          string     `json:"game" db:"game"`
+	Mode          *string    `json:"mode,omitempty" db:"mode"`
+	RankMin       *string    `json:"rankMin,omitempty" db:"rank_min"`
+	RankMax       *string    `json:"rankMax,omitempty" db:"rank_max"`
+	RatingMin     *int       `json:"ratingMin,omitempty" db:"rating_min"`
+	RatingMax     *int       `json:"ratingMax,omitempty" db:"rating_max"`
+	Region        *string    `json:"region,omitempty" db:"region"`
+	Language      *string    `json:"language,omitempty" db:"language"`
+	Slots         int        `json:"slots" db:"slots"`
+	VoiceRequired bool       `json:"voiceRequired" db:"voice_required"`
+	Description   *string    `json:"description,omitempty" db:"description"`
+	Status        string     `json:"status" db:"status"`
+	ExpiresAt     time.Time  `json:"expiresAt" db:"expires_at"`
+	CreatedAt     time.Time  `json:"createdAt" db:"created_at"`
+	ClosedAt      *time.Time `json:"closedAt,omitempty" db:"closed_at"`
+}
+
+type CreateLFGPostRequest struct {
+	Game          string     `json:"game"`
+	Mode          string     `json:"mode"`
+	RankMin       string     `json:"rankMin"`
+	RankMax       string     `json:"rankMax"`
+	RatingMin     *int       `json:"ratingMin"`
+	RatingMax     *int       `json:"ratingMax"`
+	Region        string     `json:"region"`
+	Language      string     `json:"language"`
+	Slots         int        `json:"slots"`
+	VoiceRequired bool       `json:"voiceRequired"`
+	Description   string     `json:"description"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+}
+
+// lfgPostColumns selects an LFGPost from lfg_posts p joined to its owner o.
+const lfgPostColumns = `
+	p.id, o.username as owner, p.game, p.mode, p.rank_min, p.rank_max,
+	p.rating_min, p.rating_max, p.region, p.language, p.slots, p.voice_required, p.description,
+	p.status, p.expires_at, p.created_at, p.closed_at`
+
+// nullIfEmpty turns empty strings into NULLs for optional columns.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func createLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req CreateLFGPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	fieldErrors := map[string]string{}
+
+	game, ok := catalogGame(req.Game)
+	if !ok {
+		fieldErrors["game"] = "must be a game from the catalog"
+	}
+
+	mode := strings.TrimSpace(req.Mode)
+	if utf8.RuneCountInString(mode) > lfgMaxModeLength {
+		fieldErrors["mode"] = fmt.Sprintf("must be at most %d characters", lfgMaxModeLength)
+	}
+
+	var rankMinOrder, rankMaxOrder *int
+	rankMin, rankMax := strings.TrimSpace(req.RankMin), strings.TrimSpace(req.RankMax)
+	if rankMin != "" {
+		if rankMin, rankMinOrder, ok = rankOrder(game, rankMin); !ok || len(rankMin) > lfgMaxRankNameLength {
+			fieldErrors["rankMin"] = "is not a rank in this game"
+		}
+	}
+	if rankMax != "" {
+		if rankMax, rankMaxOrder, ok = rankOrder(game, rankMax); !ok || len(rankMax) > lfgMaxRankNameLength {
+			fieldErrors["rankMax"] = "is not a rank in this game"
+		}
+	}
+	if rankMinOrder != nil && rankMaxOrder != nil && *rankMinOrder > *rankMaxOrder {
+		fieldErrors["rankMax"] = "must not be below rankMin"
+	}
+
+	if req.RatingMin != nil && (*req.RatingMin < 0 || *req.RatingMin > lfgMaxRating) {
+		fieldErrors["ratingMin"] = fmt.Sprintf("must be between 0 and %d", lfgMaxRating)
+	}
+	if req.RatingMax != nil && (*req.RatingMax < 0 || *req.RatingMax > lfgMaxRating) {
+		fieldErrors["ratingMax"] = fmt.Sprintf("must be between 0 and %d", lfgMaxRating)
+	}
+	if req.RatingMin != nil && req.RatingMax != nil && *req.RatingMin > *req.RatingMax {
+		fieldErrors["ratingMax"] = "must not be below ratingMin"
+	}
+
+	region := strings.TrimSpace(req.Region)
+	if utf8.RuneCountInString(region) > maxRegionLength {
+		fieldErrors["region"] = fmt.Sprintf("must be at most %d characters", maxRegionLength)
+	}
+
+	language := strings.ToLower(strings.TrimSpace(req.Language))
+	if language != "" && !languageCode.MatchString(language) {
+		fieldErrors["language"] = "must be an ISO 639 language code"
+	}
+
+	if req.Slots < 1 || req.Slots > lfgMaxSlots {
+		fieldErrors["slots"] = fmt.Sprintf("must be between 1 and %d", lfgMaxSlots)
+	}
+
+	description := stripMarkdown(strings.TrimSpace(req.Description))
+	if utf8.RuneCountInString(description) > lfgMaxDescription {
+		fieldErrors["description"] = fmt.Sprintf("must be at most %d characters", lfgMaxDescription)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(lfgDefaultExpiry)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+		if expiresAt.Before(now.Add(lfgMinExpiry)) || expiresAt.After(now.Add(lfgMaxExpiry)) {
+			fieldErrors["expiresAt"] = "must be between 5 minutes and 7 days from now"
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid LFG post",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	ownerID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var postID int
+	err = db.QueryRow(`
+		INSERT INTO lfg_posts (
+			owner_id, game, mode, rank_min, rank_max, rank_min_order, rank_max_order,
+			rating_min, rating_max, region, language, slots, voice_required,
+			description, expires_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id
+	`, ownerID, game, nullIfEmpty(mode), nullIfEmpty(rankMin), nullIfEmpty(rankMax),
+		rankMinOrder, rankMaxOrder, req.RatingMin, req.RatingMax, nullIfEmpty(region),
+		nullIfEmpty(language), req.Slots, req.VoiceRequired, nullIfEmpty(description),
+		expiresAt.UTC(),
+	).Scan(&postID)
+	if err != nil {
+		log.Printf("Error creating LFG post: %v", err)
+		http.Error(w, `{"error":"Error creating LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The post stands even if followers' timelines miss it
+	if err := recordActivity(db, ownerID, ActivityLFGPost, nil, postID, game); err != nil {
+		log.Printf("Error recording activity: %v", err)
+	}
+
+	post, err := getLFGPost(postID)
+	if err != nil {
+		log.Printf("Error loading LFG post: %v", err)
+		http.Error(w, `{"error":"Error loading LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(post)
+}
+
+func getLFGPost(id int) (*LFGPost, error) {
+	var post LFGPost
+	err := db.Get(&post, `
+		SELECT `+lfgPostColumns+`
+		FROM lfg_posts p
+		JOIN users o ON o.id = p.owner_id
+		WHERE p.id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+func getLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	var post LFGPost
+	err = db.Get(&post, `
+		SELECT `+lfgPostColumns+`
+		FROM lfg_posts p
+		JOIN users o ON o.id = p.owner_id
+		WHERE p.id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = p.owner_id AND b.blocked_id = $2)
+			OR (b.blocker_id = $2 AND b.blocked_id = p.owner_id)
+		)
+	`, id, viewer)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"LFG post not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching LFG post: %v", err)
+		http.Error(w, `{"error":"Failed to fetch LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post)
+}
+
+// listLFGPostsHandler searches open posts, newest first.
+func listLFGPostsHandler(w http.ResponseWriter, r *http.Request) {
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	query := r.URL.Query()
+
+	limit := lfgDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > lfgMaxLimit {
+			limit = lfgMaxLimit
+		}
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	viewerArg := arg(viewer)
+	conditions := []string{
+		fmt.Sprintf("p.status = %s", arg(LFGStatusOpen)),
+		"p.expires_at > CURRENT_TIMESTAMP",
+		fmt.Sprintf(`NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = p.owner_id AND b.blocked_id = %[1]s)
+			OR (b.blocker_id = %[1]s AND b.blocked_id = p.owner_id)
+		)`, viewerArg),
+		fmt.Sprintf(`NOT EXISTS (
+			SELECT 1 FROM user_mutes m
+			WHERE m.muter_id = %s AND m.muted_id = p.owner_id
+		)`, viewerArg),
+	}
+
+	game := ""
+	if g := query.Get("game"); g != "" {
+		var ok bool
+		if game, ok = catalogGame(g); !ok {
+			http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("p.game = %s", arg(game)))
+	}
+	if mode := strings.TrimSpace(query.Get("mode")); mode != "" {
+		conditions = append(conditions, fmt.Sprintf("LOWER(p.mode) = LOWER(%s)", arg(mode)))
+	}
+	if region := strings.TrimSpace(query.Get("region")); region != "" {
+		conditions = append(conditions, fmt.Sprintf("LOWER(p.region) = LOWER(%s)", arg(region)))
+	}
+	if language := strings.TrimSpace(query.Get("language")); language != "" {
+		conditions = append(conditions, fmt.Sprintf("p.language = %s", arg(strings.ToLower(language))))
+	}
+	if voice := query.Get("voice"); voice != "" {
+		conditions = append(conditions, fmt.Sprintf("p.voice_required = %s", arg(voice == "true")))
+	}
+	if owner := strings.TrimSpace(query.Get("owner")); owner != "" {
+		conditions = append(conditions, fmt.Sprintf("o.username = %s", arg(owner)))
+	}
+
+	// A rank matches posts whose range includes it; open ends match anything
+	if rank := strings.TrimSpace(query.Get("rank")); rank != "" {
+		if game == "" {
+			http.Error(w, `{"error":"Filtering by rank requires a game"}`, http.StatusBadRequest)
+			return
+		}
+		name, order, ok := rankOrder(game, rank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown rank for this game"}`, http.StatusBadRequest)
+			return
+		}
+		if order != nil {
+			orderArg := arg(*order)
+			conditions = append(conditions, fmt.Sprintf(
+				"(p.rank_min_order IS NULL OR p.rank_min_order <= %[1]s) AND (p.rank_max_order IS NULL OR p.rank_max_order >= %[1]s)",
+				orderArg))
+		} else {
+			nameArg := arg(name)
+			conditions = append(conditions, fmt.Sprintf(
+				"(p.rank_min IS NULL OR LOWER(p.rank_min) = LOWER(%[1]s) OR LOWER(p.rank_max) = LOWER(%[1]s))",
+				nameArg))
+		}
+	}
+
+	// A rating matches posts whose rating range includes it
+	if rating := query.Get("rating"); rating != "" {
+		value, err := strconv.Atoi(rating)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid rating"}`, http.StatusBadRequest)
+			return
+		}
+		ratingArg := arg(value)
+		conditions = append(conditions, fmt.Sprintf(
+			"(p.rating_min IS NULL OR p.rating_min <= %[1]s) AND (p.rating_max IS NULL OR p.rating_max >= %[1]s)",
+			ratingArg))
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != lfgCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("p.id < %s", arg(cursor.ID)))
+	}
+
+	posts := []LFGPost{}
+	err = db.Select(&posts, fmt.Sprintf(`
+		SELECT %s
+		FROM lfg_posts p
+		JOIN users o ON o.id = p.owner_id
+		WHERE %s
+		ORDER BY p.id DESC
+		LIMIT %d
+	`, lfgPostColumns, strings.Join(conditions, " AND "), limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching LFG posts: %v", err)
+		http.Error(w, `{"error":"Failed to fetch LFG posts"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"posts": posts}
+	if len(posts) > limit {
+		response["posts"] = posts[:limit]
+		response["nextCursor"] = encodeCursor(pageCursor{Sort: lfgCursorSort, ID: posts[limit-1].ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func closeLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	result, err := db.Exec(`
+		UPDATE lfg_posts
+		SET status = $1, closed_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = $3
+		AND owner_id = (SELECT id FROM users WHERE username = $4)
+	`, LFGStatusClosed, id, LFGStatusOpen, claims.Username)
+	if err != nil {
+		log.Printf("Error closing LFG post: %v", err)
+		http.Error(w, `{"error":"Error closing LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No open LFG post of yours with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	post, err := getLFGPost(id)
+	if err != nil {
+		log.Printf("Error loading LFG post: %v", err)
+		http.Error(w, `{"error":"Error loading LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post)
+}
+
+// expireLFGPosts marks open posts past their expiry time as expired.
+func expireLFGPosts() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE lfg_posts
+		SET status = $1, closed_at = expires_at
+		WHERE status = $2 AND expires_at <= CURRENT_TIMESTAMP
+	`, LFGStatusExpired, LFGStatusOpen)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// runLFGSweeper expires stale posts in the background. Listings already hide
+// expired posts, so the sweep only has to keep statuses tidy.
+func runLFGSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := expireLFGPosts()
+		if err != nil {
+			log.Printf("Error expiring LFG posts: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d LFG posts", expired)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// LFG application statuses
+const (
+	ApplicationStatusPending   = "pending"
+	ApplicationStatusAccepted  = "accepted"
+	ApplicationStatusDeclined  = "declined"
+	ApplicationStatusWithdrawn = "withdrawn"
+)
+
+const lfgMaxApplicationMessage = 300
+
+type LFGApplication struct {
+	ID        int        `json:"id" db:"id"`
+	PostID    int        `json:"postId" db:"post_id"`
+	Game      string     `json:"game" db:"game"`
+	Applicant string     `json:"applicant" db:"applicant"`
+	Message   *string    `json:"message,omitempty" db:"message"`
+	Status    string     `json:"status" db:"status"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty" db:"decided_at"`
+}
+
+// lfgApplicationColumns selects an LFGApplication from lfg_applications a
+// joined to its post p and applicant u.
+const lfgApplicationColumns = `
+	a.id, a.post_id, p.game, u.username as applicant, a.message,
+	a.status, a.created_at, a.decided_at`
+
+func applyToLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	message := strings.TrimSpace(req.Message)
+	if utf8.RuneCountInString(message) > lfgMaxApplicationMessage {
+		http.Error(w, fmt.Sprintf(`{"error":"Message must be at most %d characters"}`, lfgMaxApplicationMessage), http.StatusBadRequest)
+		return
+	}
+
+	applicantID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Blocks in either direction hide the post entirely
+	var ownerID int
+	var game string
+	var ratingMin, ratingMax sql.NullInt64
+	err = db.QueryRow(`
+		SELECT owner_id, game, rating_min, rating_max FROM lfg_posts p
+		WHERE id = $1 AND status = $2 AND expires_at > CURRENT_TIMESTAMP
+		AND NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = p.owner_id AND b.blocked_id = $3)
+			OR (b.blocker_id = $3 AND b.blocked_id = p.owner_id)
+		)
+	`, postID, LFGStatusOpen, applicantID).Scan(&ownerID, &game, &ratingMin, &ratingMax)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"No open LFG post with that ID"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching LFG post: %v", err)
+		http.Error(w, `{"error":"Error applying to LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if ownerID == applicantID {
+		http.Error(w, `{"error":"Cannot apply to your own post"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Provisional ratings say too little to turn anyone away
+	if ratingMin.Valid || ratingMax.Valid {
+		rating, err := establishedRating(applicantID, game)
+		if err != nil {
+			log.Printf("Error fetching rating: %v", err)
+			http.Error(w, `{"error":"Error applying to LFG post"}`, http.StatusInternalServerError)
+			return
+		}
+		if rating != nil && ((ratingMin.Valid && *rating < float64(ratingMin.Int64)) ||
+			(ratingMax.Valid && *rating > float64(ratingMax.Int64))) {
+			http.Error(w, `{"error":"Your rating for this game is outside this post's range"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Withdrawn and declined applicants may try again; pending and accepted
+	// applications stand
+	var applicationID int
+	err = tx.QueryRow(`
+		INSERT INTO lfg_applications (post_id, applicant_id, message)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (post_id, applicant_id)
+		DO UPDATE SET message = $3, status = 'pending',
+			created_at = CURRENT_TIMESTAMP, decided_at = NULL
+		WHERE lfg_applications.status IN ('declined', 'withdrawn')
+		RETURNING id
+	`, postID, applicantID, nullIfEmpty(message)).Scan(&applicationID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"You have already applied to this post"}`, http.StatusConflict)
+			return
+		}
+		log.Printf("Error applying to LFG post: %v", err)
+		http.Error(w, `{"error":"Error applying to LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := emitNotificationAbout(tx, ownerID, applicantID, NotificationLFGApplication, postID); err != nil {
+		log.Printf("Error emitting notification: %v", err)
+		http.Error(w, `{"error":"Error applying to LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeLFGApplication(w, applicationID, http.StatusCreated)
+}
+
+func writeLFGApplication(w http.ResponseWriter, applicationID, status int) {
+	var application LFGApplication
+	err := db.Get(&application, `
+		SELECT `+lfgApplicationColumns+`
+		FROM lfg_applications a
+		JOIN lfg_posts p ON p.id = a.post_id
+		JOIN users u ON u.id = a.applicant_id
+		WHERE a.id = $1
+	`, applicationID)
+	if err != nil {
+		log.Printf("Error loading LFG application: %v", err)
+		http.Error(w, `{"error":"Error loading application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(application)
+}
+
+// getLFGPostApplicationsHandler lists applications to one of the
+// authenticated user's posts.
+func getLFGPostApplicationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var isOwner bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM lfg_posts
+			WHERE id = $1 AND owner_id = (SELECT id FROM users WHERE username = $2)
+		)
+	`, postID, claims.Username).Scan(&isOwner)
+	if err != nil {
+		log.Printf("Error checking LFG post owner: %v", err)
+		http.Error(w, `{"error":"Failed to fetch applications"}`, http.StatusInternalServerError)
+		return
+	}
+	if !isOwner {
+		http.Error(w, `{"error":"No LFG post of yours with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	applications := []LFGApplication{}
+	err = db.Select(&applications, `
+		SELECT `+lfgApplicationColumns+`
+		FROM lfg_applications a
+		JOIN lfg_posts p ON p.id = a.post_id
+		JOIN users u ON u.id = a.applicant_id
+		WHERE a.post_id = $1 AND a.status <> $2
+		ORDER BY a.created_at
+	`, postID, ApplicationStatusWithdrawn)
+	if err != nil {
+		log.Printf("Error fetching LFG applications: %v", err)
+		http.Error(w, `{"error":"Failed to fetch applications"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(applications)
+}
+
+func getMyLFGApplicationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	applications := []LFGApplication{}
+	err := db.Select(&applications, `
+		SELECT `+lfgApplicationColumns+`
+		FROM lfg_applications a
+		JOIN lfg_posts p ON p.id = a.post_id
+		JOIN users u ON u.id = a.applicant_id
+		WHERE u.username = $1
+		ORDER BY a.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error fetching LFG applications: %v", err)
+		http.Error(w, `{"error":"Failed to fetch applications"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(applications)
+}
+
+// pendingApplication is a pending application locked for a decision by the
+// post owner.
+type pendingApplication struct {
+	ID          int
+	PostID      int
+	ApplicantID int
+	OwnerID     int
+	Game        string
+	Slots       int
+	PostStatus  string
+}
+
+// lockPendingApplication loads a pending application on one of ownerName's
+// posts, locking the post so concurrent decisions serialize. Open posts past
+// their expiry count as expired before the sweeper gets to them.
+func lockPendingApplication(tx *sql.Tx, applicationID int, ownerName string) (*pendingApplication, error) {
+	var app pendingApplication
+	err := tx.QueryRow(`
+		SELECT a.id, a.post_id, a.applicant_id, p.owner_id, p.game, p.slots,
+			CASE WHEN p.status = $4 AND p.expires_at <= CURRENT_TIMESTAMP THEN $5 ELSE p.status END
+		FROM lfg_applications a
+		JOIN lfg_posts p ON p.id = a.post_id
+		WHERE a.id = $1 AND a.status = $2
+		AND p.owner_id = (SELECT id FROM users WHERE username = $3)
+		FOR UPDATE OF a, p
+	`, applicationID, ApplicationStatusPending, ownerName, LFGStatusOpen, LFGStatusExpired).Scan(
+		&app.ID, &app.PostID, &app.ApplicantID, &app.OwnerID, &app.Game, &app.Slots, &app.PostStatus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// acceptLFGApplicationHandler adds the applicant to the post's party. Once
+// every slot is filled the post closes and remaining applications are
+// declined.
+func acceptLFGApplicationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	applicationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	app, err := lockPendingApplication(tx, applicationID, claims.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"No pending application on your posts with that ID"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading LFG application: %v", err)
+		http.Error(w, `{"error":"Error accepting application"}`, http.StatusInternalServerError)
+		return
+	}
+	if app.PostStatus != LFGStatusOpen {
+		http.Error(w, `{"error":"This LFG post is no longer open"}`, http.StatusConflict)
+		return
+	}
+
+	partyID, err := ensurePartyForPost(tx, app.PostID, app.OwnerID, app.Game)
+	if err == nil {
+		err = addPartyMember(tx, partyID, app.ApplicantID, PartyRoleMember)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE lfg_applications SET status = $1, decided_at = CURRENT_TIMESTAMP
+			WHERE id = $2
+		`, ApplicationStatusAccepted, app.ID)
+	}
+	if err == nil {
+		err = emitNotification(tx, app.ApplicantID, app.OwnerID, NotificationLFGApplicationAccepted)
+	}
+	if err != nil {
+		log.Printf("Error accepting LFG application: %v", err)
+		http.Error(w, `{"error":"Error accepting application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Close the post once the party has filled every slot
+	var members int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM party_members
+		WHERE party_id = $1 AND role = $2 AND left_at IS NULL
+	`, partyID, PartyRoleMember).Scan(&members)
+	if err == nil && members >= app.Slots {
+		err = closeFullLFGPost(tx, app.PostID)
+	}
+	if err != nil {
+		log.Printf("Error closing full LFG post: %v", err)
+		http.Error(w, `{"error":"Error accepting application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing acceptance"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeLFGApplication(w, app.ID, http.StatusOK)
+}
+
+// closeFullLFGPost closes a post whose party is full and declines everyone
+// still waiting.
+func closeFullLFGPost(tx *sql.Tx, postID int) error {
+	_, err := tx.Exec(`
+		UPDATE lfg_posts SET status = $1, closed_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, LFGStatusClosed, postID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		UPDATE lfg_applications SET status = $1, decided_at = CURRENT_TIMESTAMP
+		WHERE post_id = $2 AND status = $3
+		RETURNING applicant_id, (SELECT owner_id FROM lfg_posts WHERE id = $2)
+	`, ApplicationStatusDeclined, postID, ApplicationStatusPending)
+	if err != nil {
+		return err
+	}
+
+	type declined struct{ applicantID, ownerID int }
+	var declinedApplicants []declined
+	for rows.Next() {
+		var d declined
+		if err := rows.Scan(&d.applicantID, &d.ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		declinedApplicants = append(declinedApplicants, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range declinedApplicants {
+		if err := emitNotification(tx, d.applicantID, d.ownerID, NotificationLFGApplicationDeclined); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func declineLFGApplicationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	applicationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	app, err := lockPendingApplication(tx, applicationID, claims.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"No pending application on your posts with that ID"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading LFG application: %v", err)
+		http.Error(w, `{"error":"Error declining application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE lfg_applications SET status = $1, decided_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, ApplicationStatusDeclined, app.ID)
+	if err == nil {
+		err = emitNotification(tx, app.ApplicantID, app.OwnerID, NotificationLFGApplicationDeclined)
+	}
+	if err != nil {
+		log.Printf("Error declining LFG application: %v", err)
+		http.Error(w, `{"error":"Error declining application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing decline"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeLFGApplication(w, app.ID, http.StatusOK)
+}
+
+func withdrawLFGApplicationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	applicationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	result, err := db.Exec(`
+		UPDATE lfg_applications SET status = $1, decided_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = $3
+		AND applicant_id = (SELECT id FROM users WHERE username = $4)
+	`, ApplicationStatusWithdrawn, applicationID, ApplicationStatusPending, claims.Username)
+	if err != nil {
+		log.Printf("Error withdrawing LFG application: %v", err)
+		http.Error(w, `{"error":"Error withdrawing application"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No pending application of yours with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	writeLFGApplication(w, applicationID, http.StatusOK)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is a message with plain text and HTML bodies, which mail clients
+// choose between.
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(email Email) error
+}
+
+var mailer Mailer
+
+// newMailerFromEnv picks the mailer named by MAILER, defaulting to writing
+// messages into MAIL_DIR, where they can be inspected instead of sent.
+func newMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Pixel & Chill <no-reply@pixelandchill.local>"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "", "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir, from)
+	case "smtp":
+		m := &SMTPMailer{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+		if m.Addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR is required for the smtp mailer")
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+// FileMailer writes each message to its own .eml file in a directory.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(email Email) error {
+	message, err := buildEmail(m.from, email, time.Now())
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b) + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), message, 0o644)
+}
+
+// SMTPMailer sends through an SMTP relay, authenticating when a username
+// is set.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(email Email) error {
+	message, err := buildEmail(m.From, email, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := strings.Cut(m.Addr, ":")
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	sender := m.From
+	if address, err := mailAddress(m.From); err == nil {
+		sender = address
+	}
+	return smtp.SendMail(m.Addr, auth, sender, []string{email.To}, message)
+}
+
+func mailAddress(from string) (string, error) {
+	if start := strings.LastIndex(from, "<"); start >= 0 && strings.HasSuffix(from, ">") {
+		return from[start+1 : len(from)-1], nil
+	}
+	if strings.Contains(from, "@") {
+		return from, nil
+	}
+	return "", fmt.Errorf("invalid address %q", from)
+}
+
+// buildEmail renders a multipart/alternative MIME message.
+func buildEmail(from string, email Email, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", email.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
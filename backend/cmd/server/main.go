@@ -36,7 +36,17 @@ type User struct {
 	FavoriteGames   *string     `json:"favoriteGames,omitempty" db:"favorite_games"`
 	ConnectedGames  StringArray `json:"connectedGames" db:"connected_games"`
 	IsPrivate       bool        `json:"isPrivate" db:"is_private"`
-	FollowersCount  int         `json:"followersCount"`
+	DisplayName     *string     `json:"displayName,omitempty" db:"display_name"`
+	Bio             *string     `json:"bio,omitempty" db:"bio"`
+	Pronouns        *string     `json:"pronouns,omitempty" db:"pronouns"`
+	Country         *string     `json:"country,omitempty" db:"country"`
+	Region          *string     `json:"region,omitempty" db:"region"`
+	Languages       StringArray `json:"languages" db:"languages"`
+	Timezone        *string     `json:"timezone,omitempty" db:"timezone"`
+	AvatarHash      *string     `json:"-" db:"avatar_hash"`
+	BannerHash      *string     `json:"-" db:"banner_hash"`
+	LastActiveAt    *time.Time  `json:"lastActiveAt,omitempty" db:"last_active_at"`
+	FollowersCount  int         `json:"followersCount" db:"followers_count"`
 	FollowingCount  int         `json:"followingCount"`
 	IsFollowing     bool        `json:"isFollowing"`
 }
@@ -177,6 +187,734 @@ func initDatabase() error {
 		return err
 	}
 
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER REFERENCES users(id),
+		blocked_id INTEGER REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS removed_followers (
+		user_id INTEGER REFERENCES users(id),
+		follower_id INTEGER REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, follower_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_mutes (
+		muter_id INTEGER REFERENCES users(id),
+		muted_id INTEGER REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (muter_id, muted_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id),
+		actor_id INTEGER REFERENCES users(id),
+		type VARCHAR(50) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS region VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS languages TEXT[] DEFAULT '{}',
+		ADD COLUMN IF NOT EXISTS last_active_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS followers_count INTEGER NOT NULL DEFAULT 0;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS users_followers_count_idx ON users (followers_count DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS users_last_active_idx ON users (last_active_at DESC NULLS LAST, id DESC);
+	CREATE INDEX IF NOT EXISTS users_connected_games_idx ON users USING GIN (connected_games);
+	CREATE INDEX IF NOT EXISTS users_languages_idx ON users USING GIN (languages);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Keep users.followers_count in step with the followers table so the
+	// directory can sort on it without counting
+	_, err = db.Exec(`
+	CREATE OR REPLACE FUNCTION update_followers_count() RETURNS TRIGGER AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' THEN
+			UPDATE users SET followers_count = followers_count + 1 WHERE id = NEW.following_id;
+		ELSIF TG_OP = 'DELETE' THEN
+			UPDATE users SET followers_count = GREATEST(followers_count - 1, 0) WHERE id = OLD.following_id;
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS followers_count_trigger ON followers;
+	CREATE TRIGGER followers_count_trigger
+		AFTER INSERT OR DELETE ON followers
+		FOR EACH ROW EXECUTE FUNCTION update_followers_count();
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Backfill counts for rows that predate the trigger
+	_, err = db.Exec(`
+	UPDATE users u
+	SET followers_count = counts.total
+	FROM (
+		SELECT users.id, COUNT(f.follower_id) as total
+		FROM users
+		LEFT JOIN followers f ON f.following_id = users.id
+		GROUP BY users.id
+	) counts
+	WHERE counts.id = u.id AND u.followers_count <> counts.total;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(64);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', COALESCE(username, '')), 'A') ||
+			setweight(to_tsvector('simple', COALESCE(display_name, '')), 'A') ||
+			setweight(to_tsvector('simple',
+				COALESCE(twitch_username, '') || ' ' ||
+				COALESCE(youtube_channel, '') || ' ' ||
+				COALESCE(discord_username, '') || ' ' ||
+				COALESCE(instagram_handle, '')
+			), 'B')
+		) STORED;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS users_search_vector_idx ON users USING GIN (search_vector);
+	CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN (username gin_trgm_ops);
+	CREATE INDEX IF NOT EXISTS users_display_name_trgm_idx ON users USING GIN (display_name gin_trgm_ops);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS bio TEXT,
+		ADD COLUMN IF NOT EXISTS pronouns VARCHAR(32),
+		ADD COLUMN IF NOT EXISTS country VARCHAR(2),
+		ADD COLUMN IF NOT EXISTS timezone VARCHAR(64);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS avatar_hash VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS banner_hash VARCHAR(64);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS lfg_posts (
+		id SERIAL PRIMARY KEY,
+		owner_id INTEGER REFERENCES users(id),
+		game VARCHAR(255) NOT NULL,
+		mode VARCHAR(64),
+		rank_min VARCHAR(64),
+		rank_max VARCHAR(64),
+		rank_min_order INTEGER,
+		rank_max_order INTEGER,
+		region VARCHAR(64),
+		language VARCHAR(3),
+		slots INTEGER NOT NULL,
+		voice_required BOOLEAN DEFAULT false,
+		description TEXT,
+		status VARCHAR(20) DEFAULT 'open',
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		closed_at TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS lfg_posts_open_idx ON lfg_posts (game, expires_at) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS lfg_posts_owner_idx ON lfg_posts (owner_id, created_at DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS lfg_applications (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER REFERENCES lfg_posts(id),
+		applicant_id INTEGER REFERENCES users(id),
+		message TEXT,
+		status VARCHAR(20) DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		decided_at TIMESTAMP,
+		UNIQUE(post_id, applicant_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS parties (
+		id SERIAL PRIMARY KEY,
+		lfg_post_id INTEGER UNIQUE REFERENCES lfg_posts(id),
+		game VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		disbanded_at TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS party_members (
+		party_id INTEGER REFERENCES parties(id),
+		user_id INTEGER REFERENCES users(id),
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		left_at TIMESTAMP,
+		PRIMARY KEY (party_id, user_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS player_ratings (
+		user_id INTEGER REFERENCES users(id),
+		game VARCHAR(255) NOT NULL,
+		rating DOUBLE PRECISION NOT NULL DEFAULT 1500,
+		deviation DOUBLE PRECISION NOT NULL DEFAULT 350,
+		volatility DOUBLE PRECISION NOT NULL DEFAULT 0.06,
+		sessions_played INTEGER NOT NULL DEFAULT 0,
+		rated_at TIMESTAMP,
+		PRIMARY KEY (user_id, game)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS party_reports (
+		party_id INTEGER REFERENCES parties(id),
+		reporter_id INTEGER REFERENCES users(id),
+		outcome VARCHAR(10),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (party_id, reporter_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS party_peer_ratings (
+		party_id INTEGER REFERENCES parties(id),
+		rater_id INTEGER REFERENCES users(id),
+		ratee_id INTEGER REFERENCES users(id),
+		score SMALLINT NOT NULL CHECK (score BETWEEN 1 AND 5),
+		PRIMARY KEY (party_id, rater_id, ratee_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE parties ADD COLUMN IF NOT EXISTS rated_at TIMESTAMP;
+	ALTER TABLE lfg_posts
+		ADD COLUMN IF NOT EXISTS rating_min INTEGER,
+		ADD COLUMN IF NOT EXISTS rating_max INTEGER;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS created_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS is_moderator BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ALTER COLUMN created_at SET DEFAULT CURRENT_TIMESTAMP;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS endorsements (
+		id SERIAL PRIMARY KEY,
+		party_id INTEGER REFERENCES parties(id),
+		endorser_id INTEGER REFERENCES users(id),
+		endorsee_id INTEGER REFERENCES users(id),
+		kind VARCHAR(32) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(party_id, endorser_id, endorsee_id)
+	);
+	CREATE INDEX IF NOT EXISTS endorsements_endorsee_idx ON endorsements (endorsee_id);
+	CREATE INDEX IF NOT EXISTS endorsements_endorser_idx ON endorsements (endorser_id, created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS player_feedback (
+		id SERIAL PRIMARY KEY,
+		party_id INTEGER REFERENCES parties(id),
+		reporter_id INTEGER REFERENCES users(id),
+		subject_id INTEGER REFERENCES users(id),
+		reason VARCHAR(32) NOT NULL,
+		comment TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(party_id, reporter_id, subject_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Weekly windows are in the owner's time zone, minutes from local
+	// midnight with Sunday as day 0; exceptions are absolute UTC times
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS availability_windows (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		weekday SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+		start_minute INTEGER NOT NULL CHECK (start_minute >= 0),
+		end_minute INTEGER NOT NULL CHECK (end_minute <= 1440),
+		CHECK (start_minute < end_minute)
+	);
+	CREATE INDEX IF NOT EXISTS idx_availability_windows_user ON availability_windows (user_id);
+
+	CREATE TABLE IF NOT EXISTS availability_exceptions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		starts_at TIMESTAMP NOT NULL,
+		ends_at TIMESTAMP NOT NULL,
+		available BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (starts_at < ends_at)
+	);
+	CREATE INDEX IF NOT EXISTS idx_availability_exceptions_user ON availability_exceptions (user_id, ends_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The host is an invitee who always answered yes. sequence is the
+	// iCalendar SEQUENCE, bumped whenever calendar clients need to update
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS events (
+		id SERIAL PRIMARY KEY,
+		host_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		party_id INTEGER REFERENCES parties(id) ON DELETE SET NULL,
+		game VARCHAR(100) NOT NULL,
+		title VARCHAR(100) NOT NULL,
+		description TEXT,
+		starts_at TIMESTAMP NOT NULL,
+		ends_at TIMESTAMP NOT NULL,
+		capacity INTEGER,
+		sequence INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		cancelled_at TIMESTAMP,
+		CHECK (starts_at < ends_at)
+	);
+
+	CREATE TABLE IF NOT EXISTS event_invitees (
+		event_id INTEGER REFERENCES events(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		rsvp VARCHAR(16) NOT NULL DEFAULT 'pending',
+		invited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		responded_at TIMESTAMP,
+		PRIMARY KEY (event_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_event_invitees_user ON event_invitees (user_id);
+
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS calendar_token VARCHAR(64) UNIQUE;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Recurring events store an RRULE expanded in time_zone. series_ends_at
+	// is when the last occurrence ends, NULL for series that never do.
+	// Notifications about a single occurrence name it by its original start
+	_, err = db.Exec(`
+	ALTER TABLE events
+		ADD COLUMN IF NOT EXISTS rrule TEXT,
+		ADD COLUMN IF NOT EXISTS time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+		ADD COLUMN IF NOT EXISTS series_ends_at TIMESTAMP;
+
+	UPDATE events SET series_ends_at = ends_at
+	WHERE rrule IS NULL AND series_ends_at IS NULL;
+
+	CREATE INDEX IF NOT EXISTS idx_events_series ON events (starts_at, series_ends_at);
+
+	CREATE TABLE IF NOT EXISTS event_overrides (
+		event_id INTEGER REFERENCES events(id) ON DELETE CASCADE,
+		occurrence_start TIMESTAMP NOT NULL,
+		starts_at TIMESTAMP,
+		ends_at TIMESTAMP,
+		cancelled BOOLEAN NOT NULL DEFAULT false,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, occurrence_start)
+	);
+
+	ALTER TABLE notifications ADD COLUMN IF NOT EXISTS occurrence_start TIMESTAMP;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// A direct conversation's direct_key is its two member IDs, lowest
+	// first, so each pair of users has one. Members whose status is pending
+	// see the conversation as a message request
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS conversations (
+		id SERIAL PRIMARY KEY,
+		kind VARCHAR(16) NOT NULL DEFAULT 'direct',
+		direct_key VARCHAR(32) UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_message_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation_id INTEGER REFERENCES conversations(id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		status VARCHAR(16) NOT NULL DEFAULT 'accepted',
+		last_read_message_id INTEGER NOT NULL DEFAULT 0,
+		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		left_at TIMESTAMP,
+		PRIMARY KEY (conversation_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_conversation_members_user ON conversation_members (user_id, status);
+
+	CREATE TABLE IF NOT EXISTS messages (
+		id SERIAL PRIMARY KEY,
+		conversation_id INTEGER REFERENCES conversations(id) ON DELETE CASCADE,
+		sender_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages (conversation_id, id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Group conversations. A party's chat has its party_id and is archived
+	// when the party disbands; parties that predate party chats get one
+	_, err = db.Exec(`
+	ALTER TABLE conversations
+		ADD COLUMN IF NOT EXISTS title VARCHAR(100),
+		ADD COLUMN IF NOT EXISTS party_id INTEGER UNIQUE REFERENCES parties(id) ON DELETE SET NULL,
+		ADD COLUMN IF NOT EXISTS created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+
+	ALTER TABLE conversation_members
+		ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'member';
+
+	ALTER TABLE messages
+		ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'user',
+		ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS pinned_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+	CREATE INDEX IF NOT EXISTS idx_messages_pinned ON messages (conversation_id, pinned_at)
+		WHERE pinned_at IS NOT NULL;
+
+	INSERT INTO conversations (kind, title, party_id)
+	SELECT 'group', p.game || ' party', p.id FROM parties p
+	WHERE p.disbanded_at IS NULL
+	ON CONFLICT (party_id) DO NOTHING;
+
+	INSERT INTO conversation_members (conversation_id, user_id, role)
+	SELECT c.id, pm.user_id, CASE WHEN pm.role = 'leader' THEN 'admin' ELSE 'member' END
+	FROM conversations c
+	JOIN party_members pm ON pm.party_id = c.party_id AND pm.left_at IS NULL
+	WHERE c.archived_at IS NULL
+	ON CONFLICT (conversation_id, user_id) DO NOTHING;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Pub/sub messages too big for a Postgres NOTIFY payload, kept briefly
+	// for listeners to fetch
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS pubsub_payloads (
+		id SERIAL PRIMARY KEY,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Presence. Each open gateway socket has a presence_connections row,
+	// kept fresh by the instance holding it; user_presence caches the
+	// resulting status along with what the user is playing
+	_, err = db.Exec(`
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS presence_visibility VARCHAR(16) NOT NULL DEFAULT 'followers';
+
+	CREATE TABLE IF NOT EXISTS presence_connections (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		idle BOOLEAN NOT NULL DEFAULT false,
+		connected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		heartbeat_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_presence_connections_user ON presence_connections (user_id);
+
+	CREATE TABLE IF NOT EXISTS user_presence (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		status VARCHAR(16) NOT NULL DEFAULT 'offline',
+		last_seen_at TIMESTAMP,
+		playing_game VARCHAR(100),
+		lobby_joinable BOOLEAN NOT NULL DEFAULT false,
+		playing_since TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Notification center. Grouped notifications collect their actors in
+	// actor_ids, latest last, and sort by their latest activity
+	_, err = db.Exec(`
+	ALTER TABLE notifications
+		ADD COLUMN IF NOT EXISTS actor_ids INTEGER[] NOT NULL DEFAULT '{}',
+		ADD COLUMN IF NOT EXISTS subject_id INTEGER,
+		ADD COLUMN IF NOT EXISTS group_key VARCHAR(100),
+		ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+	UPDATE notifications SET actor_ids = ARRAY[actor_id]
+	WHERE actor_ids = '{}' AND actor_id IS NOT NULL;
+	UPDATE notifications SET updated_at = created_at WHERE updated_at > created_at AND group_key IS NULL;
+
+	CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, updated_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications (user_id, group_key)
+		WHERE read_at IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Notification preferences. Channels are on unless a row turns them
+	// off; quiet hours are minutes after midnight in the user's time zone.
+	// Digests only go to an email address once it's been confirmed
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(50) NOT NULL,
+		channel VARCHAR(16) NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, type, channel)
+	);
+
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS email VARCHAR(254),
+		ADD COLUMN IF NOT EXISTS quiet_hours_start SMALLINT,
+		ADD COLUMN IF NOT EXISTS quiet_hours_end SMALLINT,
+		ADD COLUMN IF NOT EXISTS digest_frequency VARCHAR(16) NOT NULL DEFAULT 'weekly',
+		ADD COLUMN IF NOT EXISTS last_digest_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS email_token_hash VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS email_token_expires_at TIMESTAMP;
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_token ON users (email_token_hash)
+		WHERE email_token_hash IS NOT NULL;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Web Push. The VAPID key is generated once and shared by every
+	// instance unless VAPID_PRIVATE_KEY overrides it
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS vapid_keys (
+		id SMALLINT PRIMARY KEY CHECK (id = 1),
+		private_key TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS push_subscriptions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		endpoint TEXT UNIQUE NOT NULL,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user ON push_subscriptions (user_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Home timelines. Activities are copied into followers' timelines when
+	// recorded, except those of big accounts, which stay fanned_out = false
+	// and are pulled in when timelines are read
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS activities (
+		id SERIAL PRIMARY KEY,
+		actor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		verb VARCHAR(32) NOT NULL,
+		target_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		subject_id INTEGER,
+		detail VARCHAR(255),
+		fanned_out BOOLEAN NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_activities_pulled ON activities (actor_id, created_at DESC, id DESC)
+		WHERE NOT fanned_out;
+	CREATE INDEX IF NOT EXISTS idx_activities_created ON activities (created_at);
+
+	CREATE TABLE IF NOT EXISTS timeline_entries (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		activity_id INTEGER NOT NULL REFERENCES activities(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, activity_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_timeline_entries_user ON timeline_entries (user_id, created_at DESC, activity_id DESC);
+
+	CREATE TABLE IF NOT EXISTS user_badges (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		badge VARCHAR(50) NOT NULL,
+		earned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, badge)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Posts, their images, reactions and comments, with edit history
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS posts (
+		id SERIAL PRIMARY KEY,
+		author_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL DEFAULT '',
+		audience VARCHAR(16) NOT NULL DEFAULT 'public',
+		party_id INTEGER REFERENCES parties(id) ON DELETE SET NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		edited_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_posts_author ON posts (author_id, created_at DESC, id DESC);
+
+	CREATE TABLE IF NOT EXISTS post_revisions (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_post_revisions_post ON post_revisions (post_id);
+
+	CREATE TABLE IF NOT EXISTS post_attachments (
+		id SERIAL PRIMARY KEY,
+		owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		post_id INTEGER REFERENCES posts(id) ON DELETE CASCADE,
+		position INTEGER,
+		hash VARCHAR(64) NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_post_attachments_post ON post_attachments (post_id, position);
+	CREATE INDEX IF NOT EXISTS idx_post_attachments_hash ON post_attachments (hash);
+
+	CREATE TABLE IF NOT EXISTS post_reactions (
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		emoji VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (post_id, user_id, emoji)
+	);
+
+	CREATE TABLE IF NOT EXISTS post_comments (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		author_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		parent_id INTEGER REFERENCES post_comments(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		edited_at TIMESTAMP,
+		deleted_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_post_comments_post ON post_comments (post_id, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_post_comments_parent ON post_comments (parent_id, created_at, id);
+
+	CREATE TABLE IF NOT EXISTS comment_revisions (
+		id SERIAL PRIMARY KEY,
+		comment_id INTEGER NOT NULL REFERENCES post_comments(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_comment_revisions_comment ON comment_revisions (comment_id);
+	`)
+	if err != nil {
+		return err
+	}
+
 	return err
 }
 
@@ -220,6 +958,41 @@ func main() {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
+	blobStore, err = newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Error initializing blob store: %v", err)
+	}
+
+	go runLFGSweeper(lfgSweepInterval)
+
+	mailer, err = newMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Error initializing mailer: %v", err)
+	}
+	webPush, err = NewWebPushSender()
+	if err != nil {
+		log.Fatalf("Error initializing web push: %v", err)
+	}
+
+	pubsub, err := newPubSubFromEnv(dbURL)
+	if err != nil {
+		log.Fatalf("Error initializing pub/sub: %v", err)
+	}
+	defer pubsub.Close()
+	gateway, err = NewGateway(pubsub)
+	if err != nil {
+		log.Fatalf("Error initializing gateway: %v", err)
+	}
+
+	matcher = newMatcher()
+	go matcher.Run(matchmakingTickInterval)
+	go runRatingSweeper(ratingSweepInterval)
+	go runPresenceSweeper(presenceSweepInterval)
+	go runNotificationSweeper(notificationSweepInterval)
+	go runDigestSweeper(digestSweepInterval)
+	go runTimelineSweeper(timelineSweepInterval)
+	go runAttachmentSweeper(attachmentSweepInterval)
+
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS followers (
 				follower_id INTEGER REFERENCES users(id),
@@ -237,7 +1010,7 @@ func main() {
 	// Update CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Accept", "Authorization", "Origin"},
 		ExposedHeaders:   []string{"Authorization"},
 		AllowCredentials: true,
@@ -247,8 +1020,8 @@ func main() {
 	// Add routes
 	router.HandleFunc("/register", registerHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/login", loginHandler).Methods("POST", "OPTIONS")
-	router.HandleFunc("/users", getAllUsersHandler).Methods("GET")
-	router.HandleFunc("/profile/{username}", getUserProfileHandler).Methods("GET")
+	router.HandleFunc("/users", optionalAuthMiddleware(getAllUsersHandler)).Methods("GET")
+	router.HandleFunc("/profile/{username}", optionalAuthMiddleware(getUserProfileHandler)).Methods("GET")
 	router.HandleFunc("/games/search", searchGamesHandler).Methods("GET", "OPTIONS")
 	router.HandleFunc("/follow/{username}", authMiddleware(followUserHandler)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/unfollow/{username}", authMiddleware(unfollowUserHandler)).Methods("POST", "OPTIONS")
@@ -265,6 +1038,112 @@ func main() {
 	router.HandleFunc("/api/follow/state/{username}", authMiddleware(getFollowStateHandler)).Methods("GET")
 	router.HandleFunc("/api/follow/accept/{username}", authMiddleware(acceptFollowRequestHandler)).Methods("POST")
 	router.HandleFunc("/api/follow/reject/{username}", authMiddleware(rejectFollowRequestHandler)).Methods("POST")
+	router.HandleFunc("/block/{username}", authMiddleware(blockUserHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/block/{username}", authMiddleware(unblockUserHandler)).Methods("DELETE")
+	router.HandleFunc("/blocks", authMiddleware(getBlockedUsersHandler)).Methods("GET")
+	router.HandleFunc("/followers/removed", authMiddleware(getRemovedFollowersHandler)).Methods("GET")
+	router.HandleFunc("/followers/{username}", authMiddleware(removeFollowerHandler)).Methods("DELETE")
+	router.HandleFunc("/followers/{username}", authMiddleware(restoreFollowerHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/mute/{username}", authMiddleware(muteUserHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/mute/{username}", authMiddleware(unmuteUserHandler)).Methods("DELETE")
+	router.HandleFunc("/mutes", authMiddleware(getMutedUsersHandler)).Methods("GET")
+	router.HandleFunc("/search/users", optionalAuthMiddleware(searchUsersHandler)).Methods("GET")
+	router.HandleFunc("/profile", authMiddleware(patchProfileHandler)).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/profile/avatar", authMiddleware(uploadAvatarHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/profile/avatar", authMiddleware(deleteAvatarHandler)).Methods("DELETE")
+	router.HandleFunc("/profile/banner", authMiddleware(uploadBannerHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/profile/banner", authMiddleware(deleteBannerHandler)).Methods("DELETE")
+	router.HandleFunc("/media/{key:.+}", serveMediaHandler).Methods("GET")
+	router.HandleFunc("/lfg", authMiddleware(createLFGPostHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/lfg", optionalAuthMiddleware(listLFGPostsHandler)).Methods("GET")
+	router.HandleFunc("/lfg/{id:[0-9]+}", optionalAuthMiddleware(getLFGPostHandler)).Methods("GET")
+	router.HandleFunc("/lfg/{id:[0-9]+}/close", authMiddleware(closeLFGPostHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/lfg/{id:[0-9]+}/apply", authMiddleware(applyToLFGPostHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/lfg/{id:[0-9]+}/applications", authMiddleware(getLFGPostApplicationsHandler)).Methods("GET")
+	router.HandleFunc("/lfg/applications", authMiddleware(getMyLFGApplicationsHandler)).Methods("GET")
+	router.HandleFunc("/lfg/applications/{id:[0-9]+}/accept", authMiddleware(acceptLFGApplicationHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/lfg/applications/{id:[0-9]+}/decline", authMiddleware(declineLFGApplicationHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/lfg/applications/{id:[0-9]+}", authMiddleware(withdrawLFGApplicationHandler)).Methods("DELETE")
+	router.HandleFunc("/parties", authMiddleware(getMyPartiesHandler)).Methods("GET")
+	router.HandleFunc("/parties/{id:[0-9]+}", authMiddleware(getPartyHandler)).Methods("GET")
+	router.HandleFunc("/parties/{id:[0-9]+}/leave", authMiddleware(leavePartyHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/parties/{id:[0-9]+}/disband", authMiddleware(disbandPartyHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/parties/{id:[0-9]+}/report", authMiddleware(reportPartySessionHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/parties/{id:[0-9]+}/endorsements", authMiddleware(endorseTeammateHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/parties/{id:[0-9]+}/feedback", authMiddleware(reportTeammateHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/moderation/feedback", moderatorMiddleware(getFeedbackHandler)).Methods("GET")
+	router.HandleFunc("/matchmaking/queue", authMiddleware(enqueueHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/matchmaking/queue", authMiddleware(leaveQueueHandler)).Methods("DELETE")
+	router.HandleFunc("/matchmaking/queue", authMiddleware(getQueueStatusHandler)).Methods("GET")
+	router.HandleFunc("/matchmaking/matches/{id:[0-9a-f]+}/accept", authMiddleware(acceptMatchHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/matchmaking/matches/{id:[0-9a-f]+}/decline", authMiddleware(declineMatchHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/matchmaking/ws", matchSocketHandler).Methods("GET")
+	router.HandleFunc("/ws", gatewayHandler).Methods("GET")
+	router.HandleFunc("/timeline", authMiddleware(getTimelineHandler)).Methods("GET")
+	router.HandleFunc("/posts", authMiddleware(createPostHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/posts/attachments", authMiddleware(uploadPostAttachmentHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/posts/{id:[0-9]+}", optionalAuthMiddleware(getPostHandler)).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}", authMiddleware(updatePostHandler)).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/posts/{id:[0-9]+}", authMiddleware(deletePostHandler)).Methods("DELETE")
+	router.HandleFunc("/posts/{id:[0-9]+}/history", optionalAuthMiddleware(getPostHistoryHandler)).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}/reactions/{emoji}", authMiddleware(addReactionHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/posts/{id:[0-9]+}/reactions/{emoji}", authMiddleware(removeReactionHandler)).Methods("DELETE")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments", optionalAuthMiddleware(getPostCommentsHandler)).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments", authMiddleware(createCommentHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments/{commentId:[0-9]+}", authMiddleware(updateCommentHandler)).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments/{commentId:[0-9]+}", authMiddleware(deleteCommentHandler)).Methods("DELETE")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments/{commentId:[0-9]+}/replies", optionalAuthMiddleware(getCommentRepliesHandler)).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments/{commentId:[0-9]+}/history", optionalAuthMiddleware(getCommentHistoryHandler)).Methods("GET")
+	router.HandleFunc("/users/{username}/posts", optionalAuthMiddleware(getUserPostsHandler)).Methods("GET")
+	router.HandleFunc("/notifications", authMiddleware(getNotificationsHandler)).Methods("GET")
+	router.HandleFunc("/notifications/unread", authMiddleware(getUnreadNotificationCountHandler)).Methods("GET")
+	router.HandleFunc("/notifications/preferences", authMiddleware(getNotificationPreferencesHandler)).Methods("GET")
+	router.HandleFunc("/notifications/preferences", authMiddleware(updateNotificationPreferencesHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/notifications/preferences/email/confirm", confirmEmailHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/notifications/read", authMiddleware(markAllNotificationsReadHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/notifications/{id:[0-9]+}/read", authMiddleware(markNotificationReadHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/push/vapid-public-key", getVAPIDPublicKeyHandler).Methods("GET")
+	router.HandleFunc("/push/subscriptions", authMiddleware(registerPushSubscriptionHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/push/subscriptions", authMiddleware(deletePushSubscriptionHandler)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/presence/friends", authMiddleware(getFriendsPresenceHandler)).Methods("GET")
+	router.HandleFunc("/presence/playing", authMiddleware(setPlayingHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/presence/playing", authMiddleware(clearPlayingHandler)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/presence/settings", authMiddleware(updatePresenceSettingsHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/users/{username}/presence", authMiddleware(getUserPresenceHandler)).Methods("GET")
+	router.HandleFunc("/availability", authMiddleware(getAvailabilityHandler)).Methods("GET")
+	router.HandleFunc("/availability", authMiddleware(putAvailabilityHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/availability/exceptions", authMiddleware(createAvailabilityExceptionHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/availability/exceptions/{id:[0-9]+}", authMiddleware(deleteAvailabilityExceptionHandler)).Methods("DELETE")
+	router.HandleFunc("/availability/overlap", authMiddleware(getAvailabilityOverlapHandler)).Methods("GET")
+	router.HandleFunc("/events", authMiddleware(createEventHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/events", authMiddleware(getMyEventsHandler)).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}", authMiddleware(getEventHandler)).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}", authMiddleware(cancelEventHandler)).Methods("DELETE")
+	router.HandleFunc("/events/{id:[0-9]+}.ics", authMiddleware(getEventICSHandler)).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}/invites", authMiddleware(inviteToEventHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/events/{id:[0-9]+}/rsvp", authMiddleware(rsvpEventHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences/{occurrence}", authMiddleware(rescheduleOccurrenceHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences/{occurrence}", authMiddleware(cancelOccurrenceHandler)).Methods("DELETE")
+	router.HandleFunc("/calendar/feed", authMiddleware(getCalendarFeedHandler)).Methods("GET")
+	router.HandleFunc("/calendar/feed/reset", authMiddleware(resetCalendarFeedHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/calendar/{token:[0-9a-f]{64}}.ics", calendarFeedHandler).Methods("GET")
+	router.HandleFunc("/conversations", authMiddleware(getConversationsHandler)).Methods("GET")
+	router.HandleFunc("/conversations/unread", authMiddleware(getUnreadMessagesHandler)).Methods("GET")
+	router.HandleFunc("/conversations/direct/{username}", authMiddleware(sendDirectMessageHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/groups", authMiddleware(createGroupConversationHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}", authMiddleware(renameGroupHandler)).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/members", authMiddleware(addGroupMembersHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/members/{username}", authMiddleware(removeGroupMemberHandler)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/members/{username}/role", authMiddleware(setGroupMemberRoleHandler)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/pins", authMiddleware(getPinnedMessagesHandler)).Methods("GET")
+	router.HandleFunc("/conversations/{id:[0-9]+}/messages/{messageId:[0-9]+}/pin", authMiddleware(pinMessageHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/messages/{messageId:[0-9]+}/pin", authMiddleware(unpinMessageHandler)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}", authMiddleware(getConversationHandler)).Methods("GET")
+	router.HandleFunc("/conversations/{id:[0-9]+}/messages", authMiddleware(getMessagesHandler)).Methods("GET")
+	router.HandleFunc("/conversations/{id:[0-9]+}/messages", authMiddleware(sendMessageHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/read", authMiddleware(markConversationReadHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/accept", authMiddleware(acceptMessageRequestHandler)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/conversations/{id:[0-9]+}/reject", authMiddleware(rejectMessageRequestHandler)).Methods("POST", "OPTIONS")
 
 	// Wrap router with CORS handler
 	handler := c.Handler(router)
@@ -418,6 +1297,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	touchLastActive(user.Username)
+
 	response := map[string]string{
 		"token":    tokenString,
 		"username": user.Username,
@@ -448,20 +1329,92 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Extract token
+		// Extract token
+		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
+		claims, err := validateToken(tokenString)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		touchLastActive(claims.Username)
+
+		// Add claims to context
+		ctx := context.WithValue(r.Context(), userClaimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// optionalAuthMiddleware attaches claims to the context when a valid token is
+// present, but lets anonymous requests through untouched.
+func optionalAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
 		claims, err := validateToken(tokenString)
 		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Add claims to context
 		ctx := context.WithValue(r.Context(), userClaimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// moderatorMiddleware is authMiddleware restricted to moderator accounts.
+func moderatorMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		claims := r.Context().Value(userClaimsKey).(*Claims)
+
+		var isModerator bool
+		err := db.QueryRow("SELECT is_moderator FROM users WHERE username = $1", claims.Username).Scan(&isModerator)
+		if err != nil || !isModerator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// viewerID returns the ID of the authenticated user, or 0 for anonymous requests.
+func viewerID(r *http.Request) (int, error) {
+	claims, ok := r.Context().Value(userClaimsKey).(*Claims)
+	if !ok || claims == nil {
+		return 0, nil
+	}
+	return getUserID(claims.Username)
+}
+
+func getUserID(username string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&id)
+	return id, err
+}
+
+// lastActiveWriteInterval throttles touchLastActive so busy clients don't
+// turn every request into an UPDATE.
+const lastActiveWriteInterval = 5 * time.Minute
+
+// touchLastActive records that a user was just seen, unless that was
+// already recorded within lastActiveWriteInterval.
+func touchLastActive(username string) {
+	_, err := db.Exec(`
+		UPDATE users SET last_active_at = CURRENT_TIMESTAMP
+		WHERE username = $1
+		AND (last_active_at IS NULL OR last_active_at < CURRENT_TIMESTAMP - $2 * INTERVAL '1 second')
+	`, username, lastActiveWriteInterval.Seconds())
+	if err != nil {
+		log.Printf("Error updating last active time: %v", err)
+	}
+}
+
 func profileHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	log.Printf("=== Profile Handler Start ===")
@@ -571,6 +1524,34 @@ func connectYoutubeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "YouTube channel connected successfully"})
 }
 
+// gameCatalog lists the games players can search for and post about
+var gameCatalog = []string{
+	"Valorant",
+	"BGMI",
+	"Counter-Strike 2",
+	"League of Legends",
+	"Dota 2",
+	"Apex Legends",
+	"Fortnite",
+	"Call of Duty: Warzone",
+	"PUBG: BATTLEGROUNDS",
+	"Minecraft",
+	"GTA V",
+	"Overwatch 2",
+	"Rainbow Six Siege",
+	"Rocket League",
+}
+
+// catalogGame returns the catalog spelling of name, matched case-insensitively.
+func catalogGame(name string) (string, bool) {
+	for _, game := range gameCatalog {
+		if strings.EqualFold(game, strings.TrimSpace(name)) {
+			return game, true
+		}
+	}
+	return "", false
+}
+
 func searchGamesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -581,27 +1562,9 @@ func searchGamesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// List of popular games
-	popularGames := []string{
-		"Valorant",
-		"BGMI",
-		"Counter-Strike 2",
-		"League of Legends",
-		"Dota 2",
-		"Apex Legends",
-		"Fortnite",
-		"Call of Duty: Warzone",
-		"PUBG: BATTLEGROUNDS",
-		"Minecraft",
-		"GTA V",
-		"Overwatch 2",
-		"Rainbow Six Siege",
-		"Rocket League",
-	}
-
 	// Filter games based on search query
 	var results []string
-	for _, game := range popularGames {
+	for _, game := range gameCatalog {
 		if strings.Contains(strings.ToLower(game), query) {
 			results = append(results, game)
 		}
@@ -679,7 +1642,7 @@ func connectGameHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update connected_games array in users table
-	_, err = tx.Exec(`
+	result, err := tx.Exec(`
 		UPDATE users 
 		SET connected_games = array_append(COALESCE(connected_games, ARRAY[]::text[]), $1)
 		WHERE id = $2 AND NOT ($1 = ANY(COALESCE(connected_games, ARRAY[]::text[])))
@@ -689,6 +1652,15 @@ func connectGameHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only a game new to the profile is news to followers
+	if added, _ := result.RowsAffected(); added > 0 {
+		if err := recordActivity(tx, userId, ActivityConnectedGame, nil, nil, requestBody.GameName); err != nil {
+			log.Printf("Error recording activity: %v", err)
+			http.Error(w, "Failed to connect game", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
@@ -701,26 +1673,6 @@ func connectGameHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-	var users []User
-	err := db.Select(&users, `
-		SELECT id, username, twitch_username, discord_username, 
-			   instagram_handle, youtube_channel, favorite_games, 
-			   connected_games, is_private 
-		FROM users 
-		ORDER BY id DESC
-	`)
-
-	if err != nil {
-		log.Printf("Error fetching users: %v", err)
-		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
-}
-
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -735,16 +1687,28 @@ type GameConnection struct {
 }
 
 type UserProfileResponse struct {
-	Username        string           `json:"username"`
-	TwitchUsername  string           `json:"twitchUsername,omitempty"`
-	DiscordUsername string           `json:"discordUsername,omitempty"`
-	InstagramHandle string           `json:"instagramHandle,omitempty"`
-	YoutubeChannel  string           `json:"youtubeChannel,omitempty"`
-	ConnectedGames  []GameConnection `json:"connectedGames"`
-	IsPrivate       bool             `json:"isPrivate"`
-	FollowersCount  int              `json:"followersCount"`
-	FollowingCount  int              `json:"followingCount"`
-	IsFollowing     bool             `json:"isFollowing"`
+	Username        string            `json:"username"`
+	DisplayName     string            `json:"displayName,omitempty"`
+	Bio             string            `json:"bio,omitempty"`
+	Pronouns        string            `json:"pronouns,omitempty"`
+	Country         string            `json:"country,omitempty"`
+	Region          string            `json:"region,omitempty"`
+	Languages       []string          `json:"languages"`
+	Timezone        string            `json:"timezone,omitempty"`
+	AvatarURLs      map[string]string `json:"avatarUrls,omitempty"`
+	BannerURLs      map[string]string `json:"bannerUrls,omitempty"`
+	TwitchUsername  string            `json:"twitchUsername,omitempty"`
+	DiscordUsername string            `json:"discordUsername,omitempty"`
+	InstagramHandle string            `json:"instagramHandle,omitempty"`
+	YoutubeChannel  string            `json:"youtubeChannel,omitempty"`
+	ConnectedGames  []GameConnection  `json:"connectedGames"`
+	IsPrivate       bool              `json:"isPrivate"`
+	FollowersCount  int               `json:"followersCount"`
+	FollowingCount  int               `json:"followingCount"`
+	IsFollowing     bool              `json:"isFollowing"`
+	FollowState     string            `json:"followState"`
+	Ratings         []GameRating      `json:"ratings"`
+	Reputation      *Reputation       `json:"reputation"`
 }
 
 func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
@@ -762,6 +1726,15 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		InstagramHandle sql.NullString `db:"instagram_handle"`
 		YoutubeChannel  sql.NullString `db:"youtube_channel"`
 		IsPrivate       bool           `db:"is_private"`
+		DisplayName     sql.NullString `db:"display_name"`
+		Bio             sql.NullString `db:"bio"`
+		Pronouns        sql.NullString `db:"pronouns"`
+		Country         sql.NullString `db:"country"`
+		Region          sql.NullString `db:"region"`
+		Languages       StringArray    `db:"languages"`
+		Timezone        sql.NullString `db:"timezone"`
+		AvatarHash      *string        `db:"avatar_hash"`
+		BannerHash      *string        `db:"banner_hash"`
 	}
 
 	// Update the SQL query with correct column aliases
@@ -773,7 +1746,16 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 			discord_username,
 			instagram_handle,
 			youtube_channel,
-			is_private
+			is_private,
+			display_name,
+			bio,
+			pronouns,
+			country,
+			region,
+			languages,
+			timezone,
+			avatar_hash,
+			banner_hash
 		FROM users 
 		WHERE username = $1`,
 		username)
@@ -788,6 +1770,26 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Resolve the relationship between the viewer and this profile
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	// Hide the profile from users it has blocked
+	if viewer != 0 {
+		blocked, err := hasBlocked(user.ID, viewer)
+		if err != nil {
+			log.Printf("Error checking block status: %v", err)
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+	}
+
 	// Get connected games with their details
 	var games []GameConnection
 	rows, err := db.Query(`
@@ -820,18 +1822,47 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	state, err := resolveFollowState(viewer, user.ID)
+	if err != nil {
+		log.Printf("Error resolving follow state: %v", err)
+		state = &FollowState{FollowState: FollowStateNotFollowing}
+	}
+
+	ratings, err := loadGameRatings(user.ID)
+	if err != nil {
+		log.Printf("Error fetching ratings: %v", err)
+		ratings = []GameRating{}
+	}
+
+	reputation, err := loadReputation(user.ID)
+	if err != nil {
+		log.Printf("Error fetching reputation: %v", err)
+	}
+
 	// Create the response
 	response := UserProfileResponse{
 		Username:        user.Username,
+		DisplayName:     user.DisplayName.String,
+		Bio:             user.Bio.String,
+		Pronouns:        user.Pronouns.String,
+		Country:         user.Country.String,
+		Region:          user.Region.String,
+		Languages:       user.Languages,
+		Timezone:        user.Timezone.String,
+		AvatarURLs:      avatarImage.imageURLs(user.AvatarHash),
+		BannerURLs:      bannerImage.imageURLs(user.BannerHash),
 		TwitchUsername:  user.TwitchUsername.String,
 		DiscordUsername: user.DiscordUsername.String,
 		InstagramHandle: user.InstagramHandle.String,
 		YoutubeChannel:  user.YoutubeChannel.String,
 		ConnectedGames:  games,
 		IsPrivate:       user.IsPrivate,
-		FollowersCount:  0, // Add follower count logic if needed
-		FollowingCount:  0, // Add following count logic if needed 
-		IsFollowing:     false,
+		FollowersCount:  state.FollowersCount,
+		FollowingCount:  state.FollowingCount,
+		IsFollowing:     state.IsFollowing,
+		FollowState:     state.FollowState,
+		Ratings:         ratings,
+		Reputation:      reputation,
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -840,6 +1871,13 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Options for pending follow requests when an account is made public
+const (
+	PendingRequestsKeep   = "keep"
+	PendingRequestsAccept = "accept"
+)
+
 func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	if claims == nil {
@@ -847,7 +1885,8 @@ func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var requestBody struct {
-		IsPrivate bool `json:"isPrivate"`
+		IsPrivate       bool   `json:"isPrivate"`
+		PendingRequests string `json:"pendingRequests"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -856,36 +1895,74 @@ func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch requestBody.PendingRequests {
+	case "":
+		requestBody.PendingRequests = PendingRequestsKeep
+	case PendingRequestsKeep, PendingRequestsAccept:
+	default:
+		http.Error(w, `{"error": "pendingRequests must be 'keep' or 'accept'"}`, http.StatusBadRequest)
+		return
+	}
+
 	log.Printf("Updating privacy settings for user %s to %v", claims.Username, requestBody.IsPrivate)
 
-	result, err := db.Exec(
-		"UPDATE users SET is_private = $1 WHERE username = $2",
-		requestBody.IsPrivate, claims.Username,
-	)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
+	// Lock the row so concurrent follow requests see a consistent setting
+	var userID int
+	var wasPrivate bool
+	err = tx.QueryRow(
+		"SELECT id, is_private FROM users WHERE username = $1 FOR UPDATE",
+		claims.Username,
+	).Scan(&userID, &wasPrivate)
 	if err != nil {
-		log.Printf("Error updating privacy settings: %v", err)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading privacy settings: %v", err)
 		http.Error(w, `{"error": "Error updating privacy settings"}`, http.StatusInternalServerError)
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	_, err = tx.Exec(
+		"UPDATE users SET is_private = $1 WHERE id = $2",
+		requestBody.IsPrivate, userID,
+	)
 	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
+		log.Printf("Error updating privacy settings: %v", err)
 		http.Error(w, `{"error": "Error updating privacy settings"}`, http.StatusInternalServerError)
 		return
 	}
 
-	if rowsAffected == 0 {
-		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+	// Going public can accept everything still waiting in the queue
+	var accepted []int
+	if wasPrivate && !requestBody.IsPrivate && requestBody.PendingRequests == PendingRequestsAccept {
+		accepted, err = acceptPendingFollowRequests(tx, userID)
+		if err != nil {
+			log.Printf("Error accepting pending follow requests: %v", err)
+			http.Error(w, `{"error": "Error accepting pending follow requests"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing privacy settings: %v", err)
+		http.Error(w, `{"error": "Error updating privacy settings"}`, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	response := map[string]interface{}{
-		"message":   "Privacy settings updated",
-		"isPrivate": requestBody.IsPrivate,
+		"message":          "Privacy settings updated",
+		"isPrivate":        requestBody.IsPrivate,
+		"acceptedRequests": len(accepted),
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -895,6 +1972,54 @@ func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// acceptPendingFollowRequests turns every pending request to targetID into a
+// follower and notifies each requester. It returns the accepted requester IDs.
+func acceptPendingFollowRequests(tx *sql.Tx, targetID int) ([]int, error) {
+	rows, err := tx.Query(`
+		UPDATE follow_requests
+		SET status = 'accepted'
+		WHERE target_id = $1 AND status = 'pending'
+		RETURNING requester_id
+	`, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var requesterIDs []int
+	for rows.Next() {
+		var requesterID int
+		if err := rows.Scan(&requesterID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		requesterIDs = append(requesterIDs, requesterID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, requesterID := range requesterIDs {
+		_, err = tx.Exec(`
+			INSERT INTO followers (follower_id, following_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, requesterID, targetID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := recordActivity(tx, requesterID, ActivityFollowed, targetID, nil, ""); err != nil {
+			return nil, err
+		}
+		if err := emitNotification(tx, requesterID, targetID, NotificationFollowRequestAccepted); err != nil {
+			return nil, err
+		}
+	}
+
+	return requesterIDs, nil
+}
+
 func disconnectInstagramHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 
@@ -1016,6 +2141,26 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Blocked users can neither follow nor request to follow the blocker
+	blockedByTarget, err := hasBlocked(targetID, followerID)
+	if err != nil {
+		http.Error(w, "Failed to check block status", http.StatusInternalServerError)
+		return
+	}
+	if blockedByTarget {
+		http.Error(w, "Target user not found", http.StatusNotFound)
+		return
+	}
+	blockedTarget, err := hasBlocked(followerID, targetID)
+	if err != nil {
+		http.Error(w, "Failed to check block status", http.StatusInternalServerError)
+		return
+	}
+	if blockedTarget {
+		http.Error(w, "Unblock this user before following them", http.StatusConflict)
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -1024,48 +2169,81 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	var result sql.Result
 	if isPrivate {
 		// Create follow request for private accounts
-		_, err = tx.Exec(`
+		result, err = tx.Exec(`
 			INSERT INTO follow_requests (requester_id, target_id, status)
-			VALUES ($1, $2, 'pending')
+			SELECT $1, $2, 'pending'
+			WHERE NOT EXISTS (
+				SELECT 1 FROM followers
+				WHERE follower_id = $1 AND following_id = $2
+			)
 			ON CONFLICT (requester_id, target_id) 
-			DO UPDATE SET status = 'pending'
-			WHERE follow_requests.status = 'rejected'
+			DO UPDATE SET status = 'pending', created_at = CURRENT_TIMESTAMP
+			WHERE follow_requests.status <> 'pending'
 		`, followerID, targetID)
 	} else {
 		// Direct follow for public accounts
-		_, err = tx.Exec(`
+		result, err = tx.Exec(`
 			INSERT INTO followers (follower_id, following_id)
 			VALUES ($1, $2)
 			ON CONFLICT DO NOTHING
 		`, followerID, targetID)
 	}
 
+	// Following again supersedes an earlier removal by the target
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM removed_followers
+			WHERE user_id = $1 AND follower_id = $2
+		`, targetID, followerID)
+	}
+
 	if err != nil {
 		http.Error(w, "Error processing follow action", http.StatusInternalServerError)
 		return
 	}
 
+	// Only a new follow or request is news to the target
+	created, _ := result.RowsAffected()
+	if created > 0 {
+		notificationType := NotificationFollow
+		if isPrivate {
+			notificationType = NotificationFollowRequest
+		}
+		if err := emitNotification(tx, targetID, followerID, notificationType); err != nil {
+			log.Printf("Error emitting notification: %v", err)
+			http.Error(w, "Error processing follow action", http.StatusInternalServerError)
+			return
+		}
+	}
+	if created > 0 && !isPrivate {
+		if err := recordActivity(tx, followerID, ActivityFollowed, targetID, nil, ""); err != nil {
+			log.Printf("Error recording activity: %v", err)
+			http.Error(w, "Error processing follow action", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Error completing follow action", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	var followState string
-	var message string
+	if created > 0 {
+		eventType := GatewayEventFollower
+		if isPrivate {
+			eventType = GatewayEventFollowRequest
+		}
+		gateway.Publish([]int{targetID}, eventType, map[string]string{"username": claims.Username})
+	}
+
+	message := "Successfully followed user"
 	if isPrivate {
-		followState = "requested"
 		message = "Follow request sent"
-	} else {
-		followState = "following"
-		message = "Successfully followed user"
 	}
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"followState": followState,
-		"message":     message,
-	})
+	writeFollowActionResponse(w, followerID, targetID, message)
 }
 
 func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -1073,6 +2251,22 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	targetUsername := vars["username"]
 
+	followerID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to get follower ID", http.StatusInternalServerError)
+		return
+	}
+
+	targetID, err := getUserID(targetUsername)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Target user not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get target user", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -1082,15 +2276,9 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Delete from both followers and follow_requests tables
 	_, err = tx.Exec(`
-		WITH ids AS (
-			SELECT u1.id as follower_id, u2.id as target_id
-			FROM users u1, users u2
-			WHERE u1.username = $1 AND u2.username = $2
-		)
 		DELETE FROM followers 
-		WHERE follower_id = (SELECT follower_id FROM ids)
-		AND following_id = (SELECT target_id FROM ids)
-	`, claims.Username, targetUsername)
+		WHERE follower_id = $1 AND following_id = $2
+	`, followerID, targetID)
 
 	if err != nil {
 		http.Error(w, "Error removing follow relationship", http.StatusInternalServerError)
@@ -1099,15 +2287,9 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Also remove any pending follow requests
 	_, err = tx.Exec(`
-		WITH ids AS (
-			SELECT u1.id as follower_id, u2.id as target_id
-			FROM users u1, users u2
-			WHERE u1.username = $1 AND u2.username = $2
-		)
 		DELETE FROM follow_requests
-		WHERE requester_id = (SELECT follower_id FROM ids)
-		AND target_id = (SELECT target_id FROM ids)
-	`, claims.Username, targetUsername)
+		WHERE requester_id = $1 AND target_id = $2
+	`, followerID, targetID)
 
 	if err != nil {
 		http.Error(w, "Error removing follow request", http.StatusInternalServerError)
@@ -1119,11 +2301,7 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"followState": "not_following",
-		"message":     "Successfully unfollowed user",
-	})
+	writeFollowActionResponse(w, followerID, targetID, "Successfully unfollowed user")
 }
 
 func getProfileHandler(w http.ResponseWriter, r *http.Request) {
@@ -1132,7 +2310,12 @@ func getProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 	var user User
 	err := db.Get(&user, `
-		SELECT * FROM users WHERE username = $1
+		SELECT id, username, twitch_username, discord_username, 
+			   instagram_handle, youtube_channel, favorite_games, 
+			   connected_games, is_private, display_name, bio, pronouns,
+			   country, region, languages, timezone, avatar_hash, banner_hash,
+			   last_active_at
+		FROM users WHERE username = $1
 	`, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1145,26 +2328,41 @@ func getProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get follower and following counts
-	var followersCount, followingCount int
-	err = db.QueryRow(`
-		SELECT 
-			(SELECT COUNT(*) FROM followers WHERE following_id = u.id) as followers_count,
-			(SELECT COUNT(*) FROM followers WHERE follower_id = u.id) as following_count
-		FROM users u
-		WHERE u.username = $1
-	`, username).Scan(&followersCount, &followingCount)
+	state, err := resolveFollowState(user.ID, user.ID)
 	if err != nil {
 		log.Printf("Error getting follow counts: %v", err)
+		state = &FollowState{FollowState: FollowStateSelf}
+	}
+
+	ratings, err := loadGameRatings(user.ID)
+	if err != nil {
+		log.Printf("Error fetching ratings: %v", err)
+		ratings = []GameRating{}
+	}
+
+	reputation, err := loadReputation(user.ID)
+	if err != nil {
+		log.Printf("Error fetching reputation: %v", err)
 	}
 
 	response := struct {
 		User
-		FollowersCount int `json:"followersCount"`
-		FollowingCount int `json:"followingCount"`
+		AvatarURLs     map[string]string `json:"avatarUrls,omitempty"`
+		BannerURLs     map[string]string `json:"bannerUrls,omitempty"`
+		FollowersCount int               `json:"followersCount"`
+		FollowingCount int               `json:"followingCount"`
+		FollowState    string            `json:"followState"`
+		Ratings        []GameRating      `json:"ratings"`
+		Reputation     *Reputation       `json:"reputation"`
 	}{
 		User:           user,
-		FollowersCount: followersCount,
-		FollowingCount: followingCount,
+		AvatarURLs:     avatarImage.imageURLs(user.AvatarHash),
+		BannerURLs:     bannerImage.imageURLs(user.BannerHash),
+		FollowersCount: state.FollowersCount,
+		FollowingCount: state.FollowingCount,
+		FollowState:    state.FollowState,
+		Ratings:        ratings,
+		Reputation:     reputation,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1175,6 +2373,8 @@ type FollowState struct {
 	IsFollowing    bool   `json:"isFollowing"`
 	FollowState    string `json:"followState"`
 	FollowersCount int    `json:"followersCount"`
+	FollowingCount int    `json:"followingCount"`
+	IsMuted        bool   `json:"isMuted,omitempty"`
 }
 
 type FollowRequest struct {
@@ -1185,105 +2385,20 @@ type FollowRequest struct {
 	CreatedAt   time.Time `db:"created_at"`
 }
 
-func getFollowStateHandler(w http.ResponseWriter, r *http.Request) {
-	claims := r.Context().Value(userClaimsKey).(*Claims)
-	vars := mux.Vars(r)
-	targetUsername := vars["username"]
-
-	// Don't allow self-following check
-	if claims.Username == targetUsername {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"followState":    "self",
-			"followersCount": 0,
-		})
-		return
-	}
-
-	var followerID, targetID int
-	var followersCount int
-	var isPrivate bool
-
-	// Get target user's details
-	err := db.QueryRow(`
-		SELECT id, is_private,
-		(SELECT COUNT(*) FROM followers WHERE following_id = users.id) as followers_count
-		FROM users WHERE username = $1
-	`, targetUsername).Scan(&targetID, &isPrivate, &followersCount)
-
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	// Get follower's ID
-	err = db.QueryRow("SELECT id FROM users WHERE username = $1", claims.Username).Scan(&followerID)
-	if err != nil {
-		http.Error(w, "Follower not found", http.StatusNotFound)
-		return
-	}
-
-	// Check current follow state
-	var isFollowing bool
-	err = db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM followers 
-			WHERE follower_id = $1 AND following_id = $2
-		)
-	`, followerID, targetID).Scan(&isFollowing)
-
-	if err != nil {
-		http.Error(w, "Error checking follow status", http.StatusInternalServerError)
-		return
-	}
-
-	// Check for pending request if not following and account is private
-	var hasPendingRequest bool
-	if !isFollowing && isPrivate {
-		err = db.QueryRow(`
-			SELECT EXISTS(
-				SELECT 1 FROM follow_requests 
-				WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
-			)
-		`, followerID, targetID).Scan(&hasPendingRequest)
-
-		if err != nil {
-			http.Error(w, "Error checking request status", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Determine follow state
-	var followState string
-	var message string
-	if isPrivate {
-		followState = "requested"
-		message = "Follow request sent"
-	} else {
-		followState = "following"
-		message = "Successfully followed user"
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"followState": followState,
-		"message":     message,
-	})
-}
-
 func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	vars := mux.Vars(r)
-	targetUsername := vars["username"]
+	requesterUsername := vars["username"]
 
-	var followerID, targetID int
+	// The authenticated user is the target of the request being answered
+	var requesterID, targetID int
 	err := db.QueryRow(`
 		SELECT 
-			(SELECT id FROM users WHERE username = $1) as follower_id,
-			u.id as target_id
+			u.id as requester_id,
+			(SELECT id FROM users WHERE username = $1) as target_id
 		FROM users u
 		WHERE u.username = $2
-	`, claims.Username, targetUsername).Scan(&followerID, &targetID)
+	`, claims.Username, requesterUsername).Scan(&requesterID, &targetID)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
@@ -1299,12 +2414,34 @@ func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Accept follow request
-	_, err = tx.Exec(`
+	result, err := tx.Exec(`
 		UPDATE follow_requests 
 		SET status = 'accepted'
-		WHERE requester_id = $1 AND target_id = $2
-	`, followerID, targetID)
+		WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
+	`, requesterID, targetID)
+
+	if err != nil {
+		http.Error(w, "Error accepting follow request", http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, "Follow request not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO followers (follower_id, following_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, requesterID, targetID)
 
+	if err == nil {
+		err = emitNotification(tx, requesterID, targetID, NotificationFollowRequestAccepted)
+	}
+	if err == nil {
+		err = recordActivity(tx, requesterID, ActivityFollowed, targetID, nil, "")
+	}
 	if err != nil {
 		http.Error(w, "Error accepting follow request", http.StatusInternalServerError)
 		return
@@ -1316,25 +2453,23 @@ func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Follow request accepted",
-	})
+	writeFollowActionResponse(w, targetID, requesterID, "Follow request accepted")
 }
 
 func rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	vars := mux.Vars(r)
-	targetUsername := vars["username"]
+	requesterUsername := vars["username"]
 
-	var followerID, targetID int
+	// The authenticated user is the target of the request being answered
+	var requesterID, targetID int
 	err := db.QueryRow(`
 		SELECT 
-			(SELECT id FROM users WHERE username = $1) as follower_id,
-			u.id as target_id
+			u.id as requester_id,
+			(SELECT id FROM users WHERE username = $1) as target_id
 		FROM users u
 		WHERE u.username = $2
-	`, claims.Username, targetUsername).Scan(&followerID, &targetID)
+	`, claims.Username, requesterUsername).Scan(&requesterID, &targetID)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
@@ -1350,25 +2485,27 @@ func rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Reject follow request
-	_, err = tx.Exec(`
+	result, err := tx.Exec(`
 		UPDATE follow_requests 
 		SET status = 'rejected'
-		WHERE requester_id = $1 AND target_id = $2
-	`, followerID, targetID)
+		WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
+	`, requesterID, targetID)
 
 	if err != nil {
 		http.Error(w, "Error rejecting follow request", http.StatusInternalServerError)
 		return
 	}
 
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, "Follow request not found", http.StatusNotFound)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Error completing follow request", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Follow request rejected",
-	})
+	writeFollowActionResponse(w, targetID, requesterID, "Follow request rejected")
 }
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The matchmaking queue lives in memory on the instance that serves it.
+// Tickets and pending matches don't survive a restart; players simply queue
+// again.
+
+const (
+	matchmakingTickInterval = 2 * time.Second
+	matchAcceptTimeout      = 20 * time.Second
+	matchMinGroupSize       = 2
+	matchMaxGroupSize       = 10
+	matchDefaultGroupSize   = 5
+
+	// Rank tolerance starts at one tier either way and grows a tier every
+	// matchRankWidenEvery, up to matchMaxRankSpread. Rating tolerance widens
+	// on the same schedule.
+	matchRankWidenEvery   = 30 * time.Second
+	matchMaxRankSpread    = 4
+	matchBaseRatingSpread = 150.0
+	matchRatingSpreadStep = 75.0
+	matchMaxRatingSpread  = 450.0
+	// Region and language only stop mattering after a long wait
+	matchLanguageRelaxAfter = 90 * time.Second
+	matchRegionRelaxAfter   = 2 * time.Minute
+)
+
+// Match event types
+const (
+	MatchEventFound     = "match_found"
+	MatchEventConfirmed = "match_confirmed"
+	MatchEventCancelled = "match_cancelled"
+)
+
+// Reasons a pending match is cancelled
+const (
+	MatchCancelDeclined = "declined"
+	MatchCancelTimeout  = "timeout"
+	MatchCancelFailed   = "failed"
+)
+
+var (
+	errAlreadyInMatch = errors.New("already in a pending match")
+	errMatchNotFound  = errors.New("match not found")
+)
+
+// Clock is the matcher's time source, so tests can drive it with a fake.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// QueueTicket is one player waiting in the queue.
+type QueueTicket struct {
+	UserID    int    `json:"-"`
+	Username  string `json:"username"`
+	Game      string `json:"game"`
+	GroupSize int    `json:"groupSize"`
+	Rank      string `json:"rank,omitempty"`
+	RankOrder *int   `json:"-"`
+	// Rating is the player's established rating in the game. Players who
+	// have one are matched on it instead of their self-reported rank.
+	Rating     *float64  `json:"-"`
+	Region     string    `json:"region,omitempty"`
+	Languages  []string  `json:"languages,omitempty"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	// Blocked holds everyone this player has blocked or been blocked by
+	Blocked map[int]bool `json:"-"`
+}
+
+// QueueStore holds the tickets waiting to be matched.
+type QueueStore interface {
+	// Put adds a ticket, replacing any the user already has
+	Put(ticket QueueTicket)
+	Remove(userID int) (QueueTicket, bool)
+	Get(userID int) (QueueTicket, bool)
+	// List returns every ticket, longest waiting first
+	List() []QueueTicket
+}
+
+type memoryQueueStore struct {
+	mu      sync.Mutex
+	tickets map[int]QueueTicket
+}
+
+func newMemoryQueueStore() *memoryQueueStore {
+	return &memoryQueueStore{tickets: map[int]QueueTicket{}}
+}
+
+func (s *memoryQueueStore) Put(ticket QueueTicket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[ticket.UserID] = ticket
+}
+
+func (s *memoryQueueStore) Remove(userID int) (QueueTicket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket, ok := s.tickets[userID]
+	delete(s.tickets, userID)
+	return ticket, ok
+}
+
+func (s *memoryQueueStore) Get(userID int) (QueueTicket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket, ok := s.tickets[userID]
+	return ticket, ok
+}
+
+func (s *memoryQueueStore) List() []QueueTicket {
+	s.mu.Lock()
+	tickets := make([]QueueTicket, 0, len(s.tickets))
+	for _, ticket := range s.tickets {
+		tickets = append(tickets, ticket)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(tickets, func(i, j int) bool {
+		if !tickets[i].EnqueuedAt.Equal(tickets[j].EnqueuedAt) {
+			return tickets[i].EnqueuedAt.Before(tickets[j].EnqueuedAt)
+		}
+		return tickets[i].UserID < tickets[j].UserID
+	})
+	return tickets
+}
+
+// MatchConstraints is how choosy a ticket still is after waiting.
+type MatchConstraints struct {
+	RankSpread   int     `json:"rankSpread"`
+	RatingSpread float64 `json:"ratingSpread"`
+	AnyRegion    bool    `json:"anyRegion"`
+	AnyLanguage  bool    `json:"anyLanguage"`
+}
+
+func constraintsAfter(wait time.Duration) MatchConstraints {
+	steps := int(wait / matchRankWidenEvery)
+	spread := 1 + steps
+	if spread > matchMaxRankSpread {
+		spread = matchMaxRankSpread
+	}
+	ratingSpread := math.Min(matchBaseRatingSpread+float64(steps)*matchRatingSpreadStep, matchMaxRatingSpread)
+	return MatchConstraints{
+		RankSpread:   spread,
+		RatingSpread: ratingSpread,
+		AnyRegion:    wait >= matchRegionRelaxAfter,
+		AnyLanguage:  wait >= matchLanguageRelaxAfter,
+	}
+}
+
+// Match is a group of tickets waiting for every player to accept.
+type Match struct {
+	ID       string
+	Game     string
+	Tickets  []QueueTicket
+	Deadline time.Time
+	accepted map[int]bool
+}
+
+// MatchEvent is what players are told about their match.
+type MatchEvent struct {
+	Type     string     `json:"type"`
+	MatchID  string     `json:"matchId"`
+	Game     string     `json:"game,omitempty"`
+	Players  []string   `json:"players,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+	PartyID  int        `json:"partyId,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Requeued bool       `json:"requeued,omitempty"`
+}
+
+// MatchDelivery pushes match events to a player wherever they're connected.
+type MatchDelivery interface {
+	DeliverMatchEvent(userID int, event MatchEvent)
+}
+
+type outgoingMatchEvent struct {
+	userID int
+	event  MatchEvent
+}
+
+// Matcher groups queued tickets into matches and runs the accept phase.
+type Matcher struct {
+	clock         Clock
+	store         QueueStore
+	delivery      MatchDelivery
+	acceptTimeout time.Duration
+	// OnConfirmed turns a match everyone accepted into a party and returns
+	// its ID. Without it, confirmed matches carry no party.
+	OnConfirmed func(match *Match) (int, error)
+
+	mu      sync.Mutex
+	matches map[string]*Match
+	matchOf map[int]string
+}
+
+func NewMatcher(clock Clock, store QueueStore, delivery MatchDelivery) *Matcher {
+	return &Matcher{
+		clock:         clock,
+		store:         store,
+		delivery:      delivery,
+		acceptTimeout: matchAcceptTimeout,
+		matches:       map[string]*Match{},
+		matchOf:       map[int]string{},
+	}
+}
+
+// Enqueue queues a ticket. Requeueing for the same game updates preferences
+// without losing your place.
+func (m *Matcher) Enqueue(ticket QueueTicket) (QueueTicket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.matchOf[ticket.UserID]; ok {
+		return QueueTicket{}, errAlreadyInMatch
+	}
+
+	ticket.EnqueuedAt = m.clock.Now()
+	if existing, ok := m.store.Get(ticket.UserID); ok && existing.Game == ticket.Game {
+		ticket.EnqueuedAt = existing.EnqueuedAt
+	}
+	m.store.Put(ticket)
+	return ticket, nil
+}
+
+// Leave takes a user out of the queue, declining their pending match if they
+// have one. It reports whether they were queued at all.
+func (m *Matcher) Leave(userID int) bool {
+	m.mu.Lock()
+	if matchID, ok := m.matchOf[userID]; ok {
+		outgoing := m.cancel(m.matches[matchID], map[int]bool{userID: true}, MatchCancelDeclined)
+		m.mu.Unlock()
+		m.deliver(outgoing)
+		return true
+	}
+
+	_, ok := m.store.Remove(userID)
+	m.mu.Unlock()
+	return ok
+}
+
+// Status returns the user's queued ticket or their pending match, if any.
+func (m *Matcher) Status(userID int) (*QueueTicket, *MatchEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if matchID, ok := m.matchOf[userID]; ok {
+		event := matchFoundEvent(m.matches[matchID])
+		return nil, &event
+	}
+	if ticket, ok := m.store.Get(userID); ok {
+		return &ticket, nil
+	}
+	return nil, nil
+}
+
+// Constraints reports how far a ticket's constraints have widened.
+func (m *Matcher) Constraints(ticket QueueTicket) MatchConstraints {
+	return constraintsAfter(m.clock.Now().Sub(ticket.EnqueuedAt))
+}
+
+// Respond records a player accepting or declining their pending match. A
+// decline cancels the match and requeues everyone else.
+func (m *Matcher) Respond(userID int, matchID string, accept bool) error {
+	m.mu.Lock()
+	match, ok := m.matches[matchID]
+	if !ok || m.matchOf[userID] != matchID {
+		m.mu.Unlock()
+		return errMatchNotFound
+	}
+
+	if !accept {
+		outgoing := m.cancel(match, map[int]bool{userID: true}, MatchCancelDeclined)
+		m.mu.Unlock()
+		m.deliver(outgoing)
+		return nil
+	}
+
+	match.accepted[userID] = true
+	if len(match.accepted) < len(match.Tickets) {
+		m.mu.Unlock()
+		return nil
+	}
+
+	// Everyone accepted: the match leaves the matcher before the party is
+	// created so a slow database can't hold the lock
+	m.release(match)
+	m.mu.Unlock()
+
+	m.confirm(match)
+	return nil
+}
+
+func (m *Matcher) confirm(match *Match) {
+	partyID := 0
+	if m.OnConfirmed != nil {
+		var err error
+		if partyID, err = m.OnConfirmed(match); err != nil {
+			m.mu.Lock()
+			outgoing := m.requeue(match, nil, MatchCancelFailed)
+			m.mu.Unlock()
+			m.deliver(outgoing)
+			return
+		}
+	}
+
+	var outgoing []outgoingMatchEvent
+	for _, ticket := range match.Tickets {
+		outgoing = append(outgoing, outgoingMatchEvent{ticket.UserID, MatchEvent{
+			Type:    MatchEventConfirmed,
+			MatchID: match.ID,
+			Game:    match.Game,
+			Players: matchPlayers(match),
+			PartyID: partyID,
+		}})
+	}
+	m.deliver(outgoing)
+}
+
+// Tick expires matches that ran out of time to accept and forms new ones.
+func (m *Matcher) Tick() {
+	m.mu.Lock()
+	now := m.clock.Now()
+
+	var outgoing []outgoingMatchEvent
+	for _, match := range m.matches {
+		if now.Before(match.Deadline) {
+			continue
+		}
+		// Players who never answered are dropped; those who accepted go back
+		// in the queue
+		dropped := map[int]bool{}
+		for _, ticket := range match.Tickets {
+			if !match.accepted[ticket.UserID] {
+				dropped[ticket.UserID] = true
+			}
+		}
+		outgoing = append(outgoing, m.cancel(match, dropped, MatchCancelTimeout)...)
+	}
+
+	outgoing = append(outgoing, m.formMatches(now)...)
+	m.mu.Unlock()
+
+	m.deliver(outgoing)
+}
+
+// Run ticks the matcher every interval, forever.
+func (m *Matcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.Tick()
+	}
+}
+
+// formMatches greedily builds groups around the longest-waiting tickets.
+// Callers hold m.mu.
+func (m *Matcher) formMatches(now time.Time) []outgoingMatchEvent {
+	tickets := m.store.List()
+	used := map[int]bool{}
+
+	var outgoing []outgoingMatchEvent
+	for i, anchor := range tickets {
+		if used[anchor.UserID] {
+			continue
+		}
+
+		group := []QueueTicket{anchor}
+		for _, candidate := range tickets[i+1:] {
+			if len(group) == anchor.GroupSize {
+				break
+			}
+			if used[candidate.UserID] || candidate.Game != anchor.Game || candidate.GroupSize != anchor.GroupSize {
+				continue
+			}
+			if fitsGroup(group, candidate, now) {
+				group = append(group, candidate)
+			}
+		}
+		if len(group) < anchor.GroupSize {
+			continue
+		}
+
+		match := &Match{
+			ID:       newMatchID(),
+			Game:     anchor.Game,
+			Tickets:  group,
+			Deadline: now.Add(m.acceptTimeout),
+			accepted: map[int]bool{},
+		}
+		m.matches[match.ID] = match
+		for _, ticket := range group {
+			used[ticket.UserID] = true
+			m.store.Remove(ticket.UserID)
+			m.matchOf[ticket.UserID] = match.ID
+			outgoing = append(outgoing, outgoingMatchEvent{ticket.UserID, matchFoundEvent(match)})
+		}
+	}
+	return outgoing
+}
+
+// fitsGroup reports whether candidate can join group, judging every pair by
+// the stricter of the two tickets' current constraints.
+func fitsGroup(group []QueueTicket, candidate QueueTicket, now time.Time) bool {
+	candidateConstraints := constraintsAfter(now.Sub(candidate.EnqueuedAt))
+	spread := candidateConstraints.RankSpread
+	ratingSpread := candidateConstraints.RatingSpread
+	lowest, highest := candidate.RankOrder, candidate.RankOrder
+	lowestRating, highestRating := candidate.Rating, candidate.Rating
+
+	for _, member := range group {
+		if member.Blocked[candidate.UserID] || candidate.Blocked[member.UserID] {
+			return false
+		}
+
+		memberConstraints := constraintsAfter(now.Sub(member.EnqueuedAt))
+		if member.Region != "" && candidate.Region != "" && member.Region != candidate.Region &&
+			!(memberConstraints.AnyRegion && candidateConstraints.AnyRegion) {
+			return false
+		}
+		if !sharesLanguage(member.Languages, candidate.Languages) &&
+			!(memberConstraints.AnyLanguage && candidateConstraints.AnyLanguage) {
+			return false
+		}
+
+		if memberConstraints.RankSpread < spread {
+			spread = memberConstraints.RankSpread
+		}
+		if memberConstraints.RatingSpread < ratingSpread {
+			ratingSpread = memberConstraints.RatingSpread
+		}
+		if member.Rating != nil {
+			if lowestRating == nil || *member.Rating < *lowestRating {
+				lowestRating = member.Rating
+			}
+			if highestRating == nil || *member.Rating > *highestRating {
+				highestRating = member.Rating
+			}
+		}
+		if member.RankOrder != nil {
+			if lowest == nil || *member.RankOrder < *lowest {
+				lowest = member.RankOrder
+			}
+			if highest == nil || *member.RankOrder > *highest {
+				highest = member.RankOrder
+			}
+		}
+	}
+
+	if lowestRating != nil && *highestRating-*lowestRating > ratingSpread {
+		return false
+	}
+	// Unranked tickets fit any rank
+	return lowest == nil || *highest-*lowest <= spread
+}
+
+// sharesLanguage reports whether two players have a language in common.
+// Players who list no languages match anyone.
+func sharesLanguage(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cancel ends a pending match, dropping the given players and requeueing the
+// rest. Callers hold m.mu.
+func (m *Matcher) cancel(match *Match, dropped map[int]bool, reason string) []outgoingMatchEvent {
+	m.release(match)
+	return m.requeue(match, dropped, reason)
+}
+
+// requeue puts a released match's players back in the queue with their
+// original wait time, apart from those dropped. Callers hold m.mu.
+func (m *Matcher) requeue(match *Match, dropped map[int]bool, reason string) []outgoingMatchEvent {
+	var outgoing []outgoingMatchEvent
+	for _, ticket := range match.Tickets {
+		requeued := !dropped[ticket.UserID]
+		if requeued {
+			m.store.Put(ticket)
+		}
+		outgoing = append(outgoing, outgoingMatchEvent{ticket.UserID, MatchEvent{
+			Type:     MatchEventCancelled,
+			MatchID:  match.ID,
+			Reason:   reason,
+			Requeued: requeued,
+		}})
+	}
+	return outgoing
+}
+
+// release forgets a pending match. Callers hold m.mu.
+func (m *Matcher) release(match *Match) {
+	delete(m.matches, match.ID)
+	for _, ticket := range match.Tickets {
+		delete(m.matchOf, ticket.UserID)
+	}
+}
+
+func (m *Matcher) deliver(outgoing []outgoingMatchEvent) {
+	if m.delivery == nil {
+		return
+	}
+	for _, o := range outgoing {
+		m.delivery.DeliverMatchEvent(o.userID, o.event)
+	}
+}
+
+func matchFoundEvent(match *Match) MatchEvent {
+	deadline := match.Deadline
+	return MatchEvent{
+		Type:     MatchEventFound,
+		MatchID:  match.ID,
+		Game:     match.Game,
+		Players:  matchPlayers(match),
+		Deadline: &deadline,
+	}
+}
+
+func matchPlayers(match *Match) []string {
+	players := make([]string, len(match.Tickets))
+	for i, ticket := range match.Tickets {
+		players[i] = ticket.Username
+	}
+	return players
+}
+
+func newMatchID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
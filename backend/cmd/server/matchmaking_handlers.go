@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var matcher *Matcher
+
+type EnqueueRequest struct {
+	Game      string   `json:"game"`
+	GroupSize int      `json:"groupSize"`
+	Rank      string   `json:"rank"`
+	Region    *string  `json:"region"`
+	Languages []string `json:"languages"`
+}
+
+type QueueStatus struct {
+	Queued      bool              `json:"queued"`
+	Ticket      *QueueTicket      `json:"ticket,omitempty"`
+	Constraints *MatchConstraints `json:"constraints,omitempty"`
+	Match       *MatchEvent       `json:"match,omitempty"`
+}
+
+// newMatcher wires the matcher to the database and the gateway.
+func newMatcher() *Matcher {
+	m := NewMatcher(systemClock{}, newMemoryQueueStore(), matchPushDelivery{gateway})
+	m.OnConfirmed = createMatchParty
+	return m
+}
+
+// createMatchParty forms a party from a confirmed match, led by whoever
+// waited longest.
+func createMatchParty(match *Match) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	partyID, err := createParty(tx, nil, match.Game, match.Tickets[0].UserID)
+	if err != nil {
+		return 0, err
+	}
+	for _, ticket := range match.Tickets[1:] {
+		if err := addPartyMember(tx, partyID, ticket.UserID, PartyRoleMember); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return partyID, nil
+}
+
+func writeQueueStatus(w http.ResponseWriter, userID, status int) {
+	ticket, match := matcher.Status(userID)
+
+	response := QueueStatus{Queued: ticket != nil || match != nil, Ticket: ticket, Match: match}
+	if ticket != nil {
+		constraints := matcher.Constraints(*ticket)
+		response.Constraints = &constraints
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// enqueueHandler queues the authenticated user. Region and languages default
+// to the user's profile.
+func enqueueHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req EnqueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var user struct {
+		ID        int         `db:"id"`
+		Region    *string     `db:"region"`
+		Languages StringArray `db:"languages"`
+	}
+	err := db.Get(&user, "SELECT id, region, languages FROM users WHERE username = $1", claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	fieldErrors := map[string]string{}
+
+	game, ok := catalogGame(req.Game)
+	if !ok {
+		fieldErrors["game"] = "must be a game from the catalog"
+	}
+
+	groupSize := req.GroupSize
+	if groupSize == 0 {
+		groupSize = matchDefaultGroupSize
+	}
+	if groupSize < matchMinGroupSize || groupSize > matchMaxGroupSize {
+		fieldErrors["groupSize"] = fmt.Sprintf("must be between %d and %d", matchMinGroupSize, matchMaxGroupSize)
+	}
+
+	var rankOrderValue *int
+	rank := strings.TrimSpace(req.Rank)
+	if rank != "" {
+		if rank, rankOrderValue, ok = rankOrder(game, rank); !ok || len(rank) > lfgMaxRankNameLength {
+			fieldErrors["rank"] = "is not a rank in this game"
+		}
+	}
+
+	region := ""
+	if req.Region != nil {
+		region = strings.TrimSpace(*req.Region)
+	} else if user.Region != nil {
+		region = *user.Region
+	}
+	if utf8.RuneCountInString(region) > maxRegionLength {
+		fieldErrors["region"] = fmt.Sprintf("must be at most %d characters", maxRegionLength)
+	}
+
+	languages := []string(user.Languages)
+	if req.Languages != nil {
+		raw, _ := json.Marshal(req.Languages)
+		validated, err := validateLanguages(raw)
+		if err != nil {
+			fieldErrors["languages"] = err.Error()
+		} else {
+			languages = validated.(StringArray)
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid queue request",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	// An established rating replaces the self-reported rank for matching
+	rating, err := establishedRating(user.ID, game)
+	if err != nil {
+		log.Printf("Error fetching rating: %v", err)
+		http.Error(w, `{"error":"Error joining queue"}`, http.StatusInternalServerError)
+		return
+	}
+	if rating != nil {
+		rankOrderValue = nil
+	}
+
+	blocked, err := blockedEitherWay(user.ID)
+	if err != nil {
+		log.Printf("Error fetching blocks: %v", err)
+		http.Error(w, `{"error":"Error joining queue"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = matcher.Enqueue(QueueTicket{
+		UserID:    user.ID,
+		Username:  claims.Username,
+		Game:      game,
+		GroupSize: groupSize,
+		Rank:      rank,
+		RankOrder: rankOrderValue,
+		Rating:    rating,
+		Region:    region,
+		Languages: languages,
+		Blocked:   blocked,
+	})
+	if err == errAlreadyInMatch {
+		http.Error(w, `{"error":"You have a match waiting to be accepted"}`, http.StatusConflict)
+		return
+	}
+
+	writeQueueStatus(w, user.ID, http.StatusCreated)
+}
+
+// blockedEitherWay returns everyone userID has blocked or been blocked by.
+func blockedEitherWay(userID int) (map[int]bool, error) {
+	var ids []int
+	err := db.Select(&ids, `
+		SELECT blocked_id FROM user_blocks WHERE blocker_id = $1
+		UNION
+		SELECT blocker_id FROM user_blocks WHERE blocked_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		blocked[id] = true
+	}
+	return blocked, nil
+}
+
+func leaveQueueHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if !matcher.Leave(userID) {
+		http.Error(w, `{"error":"You are not in the queue"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Left the queue"})
+}
+
+func getQueueStatusHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeQueueStatus(w, userID, http.StatusOK)
+}
+
+func acceptMatchHandler(w http.ResponseWriter, r *http.Request) {
+	respondToMatch(w, r, true)
+}
+
+func declineMatchHandler(w http.ResponseWriter, r *http.Request) {
+	respondToMatch(w, r, false)
+}
+
+func respondToMatch(w http.ResponseWriter, r *http.Request, accept bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := matcher.Respond(userID, mux.Vars(r)["id"], accept); err != nil {
+		http.Error(w, `{"error":"No pending match of yours with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	writeQueueStatus(w, userID, http.StatusOK)
+}
+
+// matchSocketHandler streams match events to the authenticated user. It
+// predates the gateway and sends match events without the gateway's
+// envelope. Clients can accept or decline over the socket with
+// {"type":"accept"|"decline","matchId":...}.
+func matchSocketHandler(w http.ResponseWriter, r *http.Request) {
+	claims, userID, ok := socketUser(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := newGatewayClient(userID, conn, true, []string{TopicMatchmaking})
+
+	// Catch up on a match found while the socket was down
+	if _, pending := matcher.Status(userID); pending != nil {
+		client.sendJSON(pending)
+	}
+
+	err = gateway.serve(client, func(data []byte) {
+		var message struct {
+			Type    string `json:"type"`
+			MatchID string `json:"matchId"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil || (message.Type != "accept" && message.Type != "decline") {
+			client.sendJSON(map[string]string{"type": "error", "error": "Unknown message"})
+			return
+		}
+		if err := matcher.Respond(userID, message.MatchID, message.Type == "accept"); err != nil {
+			client.sendJSON(map[string]string{"type": "error", "error": "No pending match of yours with that ID"})
+		}
+	})
+	if err != nil && err != errWebSocketClosed && err != io.EOF {
+		log.Printf("Matchmaking socket for %s closed: %v", claims.Username, err)
+	}
+}
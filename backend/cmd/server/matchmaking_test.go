@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// recordedDelivery keeps every match event sent to each player.
+type recordedDelivery struct {
+	mu     sync.Mutex
+	events map[int][]MatchEvent
+}
+
+func (d *recordedDelivery) DeliverMatchEvent(userID int, event MatchEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events[userID] = append(d.events[userID], event)
+}
+
+// last returns the latest event sent to a player, if any.
+func (d *recordedDelivery) last(userID int) (MatchEvent, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	events := d.events[userID]
+	if len(events) == 0 {
+		return MatchEvent{}, false
+	}
+	return events[len(events)-1], true
+}
+
+func newTestMatcher() (*Matcher, *fakeClock, *recordedDelivery) {
+	clock := newFakeClock()
+	delivery := &recordedDelivery{events: map[int][]MatchEvent{}}
+	return NewMatcher(clock, newMemoryQueueStore(), delivery), clock, delivery
+}
+
+func enqueue(t *testing.T, m *Matcher, ticket QueueTicket) {
+	t.Helper()
+	if ticket.Game == "" {
+		ticket.Game = "valorant"
+	}
+	if ticket.GroupSize == 0 {
+		ticket.GroupSize = 2
+	}
+	if _, err := m.Enqueue(ticket); err != nil {
+		t.Fatalf("enqueue user %d: %v", ticket.UserID, err)
+	}
+}
+
+// matchFor returns the pending match a player was told about.
+func matchFor(t *testing.T, delivery *recordedDelivery, userID int) MatchEvent {
+	t.Helper()
+	event, ok := delivery.last(userID)
+	if !ok || event.Type != MatchEventFound {
+		t.Fatalf("user %d: last event %+v, want %s", userID, event, MatchEventFound)
+	}
+	return event
+}
+
+func intPtr(n int) *int { return &n }
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestConstraintsWidenWithWait(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want MatchConstraints
+	}{
+		{0, MatchConstraints{RankSpread: 1, RatingSpread: 150}},
+		{29 * time.Second, MatchConstraints{RankSpread: 1, RatingSpread: 150}},
+		{30 * time.Second, MatchConstraints{RankSpread: 2, RatingSpread: 225}},
+		{90 * time.Second, MatchConstraints{RankSpread: 4, RatingSpread: 375, AnyLanguage: true}},
+		{2 * time.Minute, MatchConstraints{RankSpread: 4, RatingSpread: 450, AnyRegion: true, AnyLanguage: true}},
+		{10 * time.Minute, MatchConstraints{RankSpread: 4, RatingSpread: 450, AnyRegion: true, AnyLanguage: true}},
+	}
+	for _, tt := range tests {
+		if got := constraintsAfter(tt.wait); got != tt.want {
+			t.Errorf("constraintsAfter(%v) = %+v, want %+v", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func TestMatcherWidensRatingWindow(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana", Rating: floatPtr(1000)})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben", Rating: floatPtr(1200)})
+
+	m.Tick()
+	if _, ok := delivery.last(1); ok {
+		t.Fatal("matched players 200 rating apart straight away")
+	}
+
+	clock.Advance(matchRankWidenEvery)
+	m.Tick()
+	if matchFor(t, delivery, 1).MatchID != matchFor(t, delivery, 2).MatchID {
+		t.Error("players were put in different matches")
+	}
+}
+
+func TestMatcherWidensRankWindow(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana", RankOrder: intPtr(2)})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben", RankOrder: intPtr(5)})
+
+	// Three tiers apart needs two widening steps
+	clock.Advance(matchRankWidenEvery)
+	m.Tick()
+	if _, ok := delivery.last(1); ok {
+		t.Fatal("matched players three tiers apart after one step")
+	}
+
+	clock.Advance(matchRankWidenEvery)
+	m.Tick()
+	matchFor(t, delivery, 1)
+	matchFor(t, delivery, 2)
+}
+
+func TestMatcherWidensByStricterTicket(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana", RankOrder: intPtr(1)})
+	clock.Advance(5 * time.Minute)
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben", RankOrder: intPtr(4)})
+
+	// The newcomer hasn't waited, so the long wait of the first player
+	// doesn't let them match
+	m.Tick()
+	if _, ok := delivery.last(2); ok {
+		t.Fatal("newcomer matched outside their own rank window")
+	}
+
+	clock.Advance(2 * matchRankWidenEvery)
+	m.Tick()
+	matchFor(t, delivery, 2)
+}
+
+func TestMatcherRelaxesRegionAfterWaiting(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana", Region: "eu"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben", Region: "na"})
+
+	clock.Advance(matchRegionRelaxAfter - time.Second)
+	m.Tick()
+	if _, ok := delivery.last(1); ok {
+		t.Fatal("matched across regions too early")
+	}
+
+	clock.Advance(time.Second)
+	m.Tick()
+	matchFor(t, delivery, 1)
+}
+
+func TestMatcherNeverMatchesBlockedPlayers(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana", Blocked: map[int]bool{2: true}})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+
+	clock.Advance(10 * time.Minute)
+	m.Tick()
+	if _, ok := delivery.last(1); ok {
+		t.Fatal("matched a player with someone they blocked")
+	}
+}
+
+func TestMatcherFormsGroupsOfRequestedSize(t *testing.T) {
+	m, _, delivery := newTestMatcher()
+	for id := 1; id <= 4; id++ {
+		enqueue(t, m, QueueTicket{UserID: id, Username: "trio", GroupSize: 3})
+	}
+	enqueue(t, m, QueueTicket{UserID: 5, Username: "duo", GroupSize: 2})
+	enqueue(t, m, QueueTicket{UserID: 6, Username: "duo", GroupSize: 2})
+	enqueue(t, m, QueueTicket{UserID: 7, Username: "other", GroupSize: 2, Game: "dota2"})
+
+	m.Tick()
+
+	trio := matchFor(t, delivery, 1)
+	if len(trio.Players) != 3 {
+		t.Errorf("trio match has %d players, want 3", len(trio.Players))
+	}
+	for _, id := range []int{2, 3} {
+		if matchFor(t, delivery, id).MatchID != trio.MatchID {
+			t.Errorf("user %d not in the trio match", id)
+		}
+	}
+	duo := matchFor(t, delivery, 5)
+	if len(duo.Players) != 2 || matchFor(t, delivery, 6).MatchID != duo.MatchID {
+		t.Errorf("duo match %+v, want users 5 and 6", duo)
+	}
+
+	// The fourth trio player and the lone dota2 player keep waiting
+	for _, id := range []int{4, 7} {
+		if _, ok := delivery.last(id); ok {
+			t.Errorf("user %d was matched without enough players", id)
+		}
+		if ticket, _ := m.Status(id); ticket == nil {
+			t.Errorf("user %d is no longer queued", id)
+		}
+	}
+}
+
+func TestMatcherConfirmsWhenEveryoneAccepts(t *testing.T) {
+	m, _, delivery := newTestMatcher()
+	var confirmed *Match
+	m.OnConfirmed = func(match *Match) (int, error) {
+		confirmed = match
+		return 42, nil
+	}
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+	m.Tick()
+	matchID := matchFor(t, delivery, 1).MatchID
+
+	if err := m.Respond(1, matchID, true); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed != nil {
+		t.Fatal("confirmed before everyone accepted")
+	}
+	if err := m.Respond(2, matchID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if confirmed == nil || confirmed.ID != matchID {
+		t.Fatalf("confirmed %+v, want match %s", confirmed, matchID)
+	}
+	for _, id := range []int{1, 2} {
+		event, _ := delivery.last(id)
+		if event.Type != MatchEventConfirmed || event.PartyID != 42 {
+			t.Errorf("user %d: last event %+v, want confirmed with party 42", id, event)
+		}
+		if ticket, match := m.Status(id); ticket != nil || match != nil {
+			t.Errorf("user %d still queued or pending after confirmation", id)
+		}
+	}
+}
+
+func TestMatcherRequeuesWhenPartyCreationFails(t *testing.T) {
+	m, _, delivery := newTestMatcher()
+	m.OnConfirmed = func(match *Match) (int, error) {
+		return 0, errors.New("database unavailable")
+	}
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+	m.Tick()
+	matchID := matchFor(t, delivery, 1).MatchID
+
+	m.Respond(1, matchID, true)
+	m.Respond(2, matchID, true)
+
+	for _, id := range []int{1, 2} {
+		event, _ := delivery.last(id)
+		if event.Type != MatchEventCancelled || event.Reason != MatchCancelFailed || !event.Requeued {
+			t.Errorf("user %d: last event %+v, want requeued after failure", id, event)
+		}
+	}
+}
+
+func TestMatcherDeclineRequeuesOthers(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+	queuedAt := clock.Now()
+	clock.Advance(time.Minute)
+	m.Tick()
+	matchID := matchFor(t, delivery, 1).MatchID
+
+	if err := m.Respond(2, matchID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	event, _ := delivery.last(1)
+	if event.Type != MatchEventCancelled || event.Reason != MatchCancelDeclined || !event.Requeued {
+		t.Errorf("accepting player got %+v, want requeued after decline", event)
+	}
+	event, _ = delivery.last(2)
+	if event.Requeued {
+		t.Error("declining player was requeued")
+	}
+	ticket, _ := m.Status(1)
+	if ticket == nil || !ticket.EnqueuedAt.Equal(queuedAt) {
+		t.Errorf("requeued ticket %+v lost its place in the queue", ticket)
+	}
+	if err := m.Respond(1, matchID, true); err != errMatchNotFound {
+		t.Errorf("responding to a cancelled match: %v, want %v", err, errMatchNotFound)
+	}
+}
+
+func TestMatcherTimesOutUnansweredMatches(t *testing.T) {
+	m, clock, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+	m.Tick()
+	matchID := matchFor(t, delivery, 1).MatchID
+
+	if _, err := m.Enqueue(QueueTicket{UserID: 1, Game: "valorant", GroupSize: 2}); err != errAlreadyInMatch {
+		t.Errorf("requeueing during a pending match: %v, want %v", err, errAlreadyInMatch)
+	}
+	m.Respond(1, matchID, true)
+
+	clock.Advance(matchAcceptTimeout - time.Second)
+	m.Tick()
+	if event, _ := delivery.last(1); event.Type != MatchEventFound {
+		t.Fatalf("match ended before its deadline: %+v", event)
+	}
+
+	clock.Advance(time.Second)
+	m.Tick()
+
+	event, _ := delivery.last(1)
+	if event.Type != MatchEventCancelled || event.Reason != MatchCancelTimeout || !event.Requeued {
+		t.Errorf("accepting player got %+v, want requeued after timeout", event)
+	}
+	event, _ = delivery.last(2)
+	if event.Type != MatchEventCancelled || event.Reason != MatchCancelTimeout || event.Requeued {
+		t.Errorf("silent player got %+v, want dropped after timeout", event)
+	}
+	if ticket, _ := m.Status(1); ticket == nil {
+		t.Error("accepting player is no longer queued")
+	}
+	if ticket, match := m.Status(2); ticket != nil || match != nil {
+		t.Error("silent player is still queued")
+	}
+}
+
+func TestMatcherLeaveDeclinesPendingMatch(t *testing.T) {
+	m, _, delivery := newTestMatcher()
+	enqueue(t, m, QueueTicket{UserID: 1, Username: "ana"})
+	enqueue(t, m, QueueTicket{UserID: 2, Username: "ben"})
+	m.Tick()
+	matchFor(t, delivery, 1)
+
+	if !m.Leave(1) {
+		t.Fatal("Leave reported the player wasn't queued")
+	}
+	event, _ := delivery.last(2)
+	if event.Type != MatchEventCancelled || !event.Requeued {
+		t.Errorf("remaining player got %+v, want requeued", event)
+	}
+	if m.Leave(1) {
+		t.Error("Leave reported a player who already left as queued")
+	}
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Conversation kinds
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// Message kinds. System messages record membership changes and renames,
+// with the member who made the change as sender.
+const (
+	MessageKindUser   = "user"
+	MessageKindSystem = "system"
+)
+
+// Conversation member statuses, mirroring follow requests: a DM from
+// someone a private user hasn't let follow them waits as a pending message
+// request until they accept or reject it.
+const (
+	MemberStatusAccepted = "accepted"
+	MemberStatusPending  = "pending"
+	MemberStatusRejected = "rejected"
+)
+
+// Conversation folders
+const (
+	FolderInbox    = "inbox"
+	FolderRequests = "requests"
+)
+
+const (
+	messageMaxLength         = 2000
+	messageDefaultLimit      = 50
+	messageMaxLimit          = 100
+	conversationDefaultLimit = 20
+	conversationMaxLimit     = 50
+	messageRequestsPerDay    = 20
+	conversationCursorSort   = "conversations"
+	messageCursorSort        = "messages"
+)
+
+type Message struct {
+	ID             int        `json:"id" db:"id"`
+	ConversationID int        `json:"conversationId" db:"conversation_id"`
+	Kind           string     `json:"kind" db:"kind"`
+	Sender         string     `json:"sender" db:"sender"`
+	Body           string     `json:"body" db:"body"`
+	CreatedAt      time.Time  `json:"createdAt" db:"created_at"`
+	PinnedAt       *time.Time `json:"pinnedAt,omitempty" db:"pinned_at"`
+}
+
+// Conversation is a conversation as one member sees it. With is the other
+// member of a direct conversation; groups have a title, and the viewer's
+// role in them. An archived conversation is read-only.
+type Conversation struct {
+	ID            int                  `json:"id" db:"id"`
+	Kind          string               `json:"kind" db:"kind"`
+	With          *string              `json:"with,omitempty" db:"with_username"`
+	Title         *string              `json:"title,omitempty" db:"title"`
+	PartyID       *int                 `json:"partyId,omitempty" db:"party_id"`
+	Role          string               `json:"role" db:"role"`
+	Status        string               `json:"status" db:"status"`
+	UnreadCount   int                  `json:"unreadCount" db:"unread_count"`
+	LastMessageAt time.Time            `json:"lastMessageAt" db:"last_message_at"`
+	ArchivedAt    *time.Time           `json:"archivedAt,omitempty" db:"archived_at"`
+	LastMessage   *Message             `json:"lastMessage,omitempty"`
+	Members       []ConversationMember `json:"members,omitempty"`
+}
+
+// conversationColumns selects a Conversation from conversations c joined
+// to the viewer's membership me, with the viewer's ID in $1.
+const conversationColumns = `
+	c.id, c.kind, c.title, c.party_id, c.last_message_at, c.archived_at, me.role, me.status,
+	(SELECT u.username FROM conversation_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.conversation_id = c.id AND om.user_id <> $1 AND c.kind = 'direct'
+		LIMIT 1) AS with_username,
+	(SELECT COUNT(*) FROM messages m
+		WHERE m.conversation_id = c.id AND m.id > me.last_read_message_id AND m.sender_id <> $1
+	) AS unread_count`
+
+// conversationFrom joins a conversation to the viewer's membership, hiding
+// direct conversations with anyone on either side of a block.
+const conversationFrom = `
+	FROM conversations c
+	JOIN conversation_members me ON me.conversation_id = c.id AND me.user_id = $1 AND me.left_at IS NULL`
+
+const conversationNotBlocked = `(c.kind <> 'direct' OR NOT EXISTS (
+		SELECT 1 FROM conversation_members om
+		JOIN user_blocks b ON (b.blocker_id = om.user_id AND b.blocked_id = $1)
+			OR (b.blocker_id = $1 AND b.blocked_id = om.user_id)
+		WHERE om.conversation_id = c.id AND om.user_id <> $1
+	))`
+
+// messageColumns selects a Message from messages m joined to its sender s.
+const messageColumns = `m.id, m.conversation_id, m.kind, s.username AS sender, m.body, m.created_at, m.pinned_at`
+
+// loadConversation returns a conversation as userID sees it, or ErrNoRows
+// if they aren't in it.
+func loadConversation(conversationID, userID int) (*Conversation, error) {
+	var conversation Conversation
+	err := db.Get(&conversation, `SELECT `+conversationColumns+conversationFrom+`
+		WHERE c.id = $2 AND `+conversationNotBlocked, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadLastMessages([]*Conversation{&conversation}); err != nil {
+		return nil, err
+	}
+	if conversation.Kind == ConversationGroup {
+		if err := loadConversationMembers(&conversation); err != nil {
+			return nil, err
+		}
+	}
+	return &conversation, nil
+}
+
+// loadLastMessages fills in the latest message of each conversation.
+func loadLastMessages(conversations []*Conversation) error {
+	if len(conversations) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Conversation, len(conversations))
+	ids := make([]int, 0, len(conversations))
+	for _, c := range conversations {
+		byID[c.ID] = c
+		ids = append(ids, c.ID)
+	}
+
+	var messages []Message
+	err := db.Select(&messages, `
+		SELECT DISTINCT ON (m.conversation_id) `+messageColumns+`
+		FROM messages m
+		JOIN users s ON s.id = m.sender_id
+		WHERE m.conversation_id = ANY($1)
+		ORDER BY m.conversation_id, m.id DESC
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		byID[messages[i].ConversationID].LastMessage = &messages[i]
+	}
+	return nil
+}
+
+// validMessageBody trims a message body, returning false if it's empty or
+// too long.
+func validMessageBody(body string) (string, bool) {
+	body = strings.TrimSpace(body)
+	return body, body != "" && utf8.RuneCountInString(body) <= messageMaxLength
+}
+
+// postMessage adds a message to a conversation, moving it to the top of
+// everyone's list and marking it read for the sender.
+func postMessage(tx *sqlx.Tx, conversationID, senderID int, body string) (*Message, error) {
+	var message Message
+	err := tx.Get(&message, `
+		WITH m AS (
+			INSERT INTO messages (conversation_id, sender_id, body)
+			VALUES ($1, $2, $3)
+			RETURNING id, conversation_id, kind, sender_id, body, created_at, pinned_at
+		)
+		SELECT `+messageColumns+` FROM m JOIN users s ON s.id = m.sender_id
+	`, conversationID, senderID, body)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE conversations SET last_message_at = $2 WHERE id = $1
+	`, conversationID, message.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE conversation_members SET last_read_message_id = $3
+		WHERE conversation_id = $1 AND user_id = $2
+	`, conversationID, senderID, message.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// directConversation returns the conversation between two users, starting
+// it if needed. A new conversation lands in the recipient's requests when
+// they're private and the sender isn't one of their followers.
+func directConversation(tx *sqlx.Tx, senderID, recipientID int) (int, bool, error) {
+	low, high := senderID, recipientID
+	if low > high {
+		low, high = high, low
+	}
+
+	var conversationID int
+	var created bool
+	err := tx.QueryRow(`
+		INSERT INTO conversations (kind, direct_key)
+		VALUES ('direct', $1)
+		ON CONFLICT (direct_key) DO UPDATE SET direct_key = EXCLUDED.direct_key
+		RETURNING id, xmax = 0
+	`, fmt.Sprintf("%d:%d", low, high)).Scan(&conversationID, &created)
+	if err != nil {
+		return 0, false, err
+	}
+	if !created {
+		return conversationID, false, nil
+	}
+
+	var needsApproval bool
+	err = tx.Get(&needsApproval, `
+		SELECT u.is_private AND NOT EXISTS (
+			SELECT 1 FROM followers WHERE follower_id = $2 AND following_id = u.id
+		)
+		FROM users u WHERE u.id = $1
+	`, recipientID, senderID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	recipientStatus := MemberStatusAccepted
+	if needsApproval {
+		recipientStatus = MemberStatusPending
+	}
+	_, err = tx.Exec(`
+		INSERT INTO conversation_members (conversation_id, user_id, status)
+		VALUES ($1, $2, 'accepted'), ($1, $3, $4)
+	`, conversationID, senderID, recipientID, recipientStatus)
+	if err != nil {
+		return 0, false, err
+	}
+	return conversationID, needsApproval, nil
+}
+
+// publishMessage pushes a new message to the conversation's members,
+// including the sender's other sessions.
+func publishMessage(message *Message) {
+	var memberIDs []int
+	err := db.Select(&memberIDs, `
+		SELECT user_id FROM conversation_members
+		WHERE conversation_id = $1 AND left_at IS NULL AND status <> 'rejected'
+	`, message.ConversationID)
+	if err != nil {
+		log.Printf("Error fetching conversation members: %v", err)
+		return
+	}
+	gateway.Publish(memberIDs, GatewayEventMessage, message)
+}
+
+func writeMessage(w http.ResponseWriter, message *Message, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(message)
+}
+
+// sendDirectMessageHandler messages a user, starting a conversation with
+// them the first time.
+func sendDirectMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, ok := validMessageBody(req.Body)
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"error":"Messages must be between 1 and %d characters"}`, messageMaxLength), http.StatusBadRequest)
+		return
+	}
+
+	senderID, recipientID, ok := resolveRelationshipTarget(w, r, "You cannot message yourself")
+	if !ok {
+		return
+	}
+
+	blocked, err := blockedEitherWay(senderID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if blocked[recipientID] {
+		http.Error(w, `{"error":"You can't message this user"}`, http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	conversationID, isRequest, err := directConversation(tx, senderID, recipientID)
+	if err != nil {
+		log.Printf("Error starting conversation: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if isRequest {
+		var sentToday int
+		err := tx.Get(&sentToday, `
+			SELECT COUNT(*) FROM conversation_members theirs
+			JOIN conversation_members mine ON mine.conversation_id = theirs.conversation_id
+			JOIN conversations c ON c.id = theirs.conversation_id
+			WHERE mine.user_id = $1 AND theirs.user_id <> $1 AND theirs.status = 'pending'
+			AND c.created_at > CURRENT_TIMESTAMP - INTERVAL '1 day'
+		`, senderID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		// The new request is included in the count
+		if sentToday > messageRequestsPerDay {
+			http.Error(w, `{"error":"You've sent too many message requests today"}`, http.StatusTooManyRequests)
+			return
+		}
+		if err := emitNotificationAbout(tx, recipientID, senderID, NotificationMessageRequest, conversationID); err != nil {
+			log.Printf("Error creating notification: %v", err)
+			http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	message, ok := sendToConversation(w, tx, conversationID, senderID, body)
+	if !ok {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	publishMessage(message)
+	writeMessage(w, message, http.StatusCreated)
+}
+
+// sendToConversation checks the sender may post and posts the message,
+// writing the error response and returning false if not. Replying to a
+// message request accepts it, and a rejected request can't be followed up.
+func sendToConversation(w http.ResponseWriter, tx *sqlx.Tx, conversationID, senderID int, body string) (*Message, bool) {
+	var member struct {
+		Kind        string  `db:"kind"`
+		Archived    bool    `db:"archived"`
+		Status      string  `db:"status"`
+		OtherStatus *string `db:"other_status"`
+	}
+	err := tx.Get(&member, `
+		SELECT c.kind, c.archived_at IS NOT NULL AS archived, me.status,
+			(SELECT om.status FROM conversation_members om
+				WHERE om.conversation_id = c.id AND om.user_id <> $1 AND c.kind = 'direct'
+				LIMIT 1) AS other_status
+		FROM conversations c
+		JOIN conversation_members me ON me.conversation_id = c.id AND me.user_id = $1 AND me.left_at IS NULL
+		WHERE c.id = $2 AND `+conversationNotBlocked+`
+		FOR UPDATE OF me
+	`, senderID, conversationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error checking conversation: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if member.Archived {
+		http.Error(w, `{"error":"This conversation is archived"}`, http.StatusConflict)
+		return nil, false
+	}
+	if member.OtherStatus != nil && *member.OtherStatus == MemberStatusRejected {
+		http.Error(w, `{"error":"This user declined your message request"}`, http.StatusForbidden)
+		return nil, false
+	}
+	if member.Status != MemberStatusAccepted {
+		_, err := tx.Exec(`
+			UPDATE conversation_members SET status = 'accepted'
+			WHERE conversation_id = $1 AND user_id = $2
+		`, conversationID, senderID)
+		if err != nil {
+			http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+
+	message, err := postMessage(tx, conversationID, senderID, body)
+	if err != nil {
+		log.Printf("Error sending message: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if member.Kind == ConversationGroup {
+		if err := notifyMentions(tx, conversationID, senderID, body); err != nil {
+			log.Printf("Error notifying mentions: %v", err)
+			http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	return message, true
+}
+
+func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, ok := validMessageBody(req.Body)
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"error":"Messages must be between 1 and %d characters"}`, messageMaxLength), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	message, ok := sendToConversation(w, tx, conversationID, userID, body)
+	if !ok {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	publishMessage(message)
+	writeMessage(w, message, http.StatusCreated)
+}
+
+// getConversationsHandler lists the user's conversations, most recently
+// active first. ?folder=requests lists pending message requests instead of
+// the inbox.
+func getConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	query := r.URL.Query()
+
+	status := MemberStatusAccepted
+	switch query.Get("folder") {
+	case "", FolderInbox:
+	case FolderRequests:
+		status = MemberStatusPending
+	default:
+		http.Error(w, `{"error":"folder must be inbox or requests"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := conversationDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > conversationMaxLimit {
+			limit = conversationMaxLimit
+		}
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conditions := []string{"me.status = $2", conversationNotBlocked}
+	args := []interface{}{userID, status}
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != conversationCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		args = append(args, cursor.Value, cursor.ID)
+		conditions = append(conditions, "(c.last_message_at, c.id) < ($3::timestamp, $4)")
+	}
+
+	var conversations []*Conversation
+	err = db.Select(&conversations, fmt.Sprintf(`
+		SELECT %s %s
+		WHERE %s
+		ORDER BY c.last_message_at DESC, c.id DESC
+		LIMIT %d
+	`, conversationColumns, conversationFrom, strings.Join(conditions, " AND "), limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching conversations: %v", err)
+		http.Error(w, `{"error":"Failed to fetch conversations"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		last := conversations[limit-1]
+		response["nextCursor"] = encodeCursor(pageCursor{
+			Sort:  conversationCursorSort,
+			Value: last.LastMessageAt.Format(cursorTimeValue),
+			ID:    last.ID,
+		})
+	}
+	if err := loadLastMessages(conversations); err != nil {
+		log.Printf("Error fetching last messages: %v", err)
+		http.Error(w, `{"error":"Failed to fetch conversations"}`, http.StatusInternalServerError)
+		return
+	}
+	if conversations == nil {
+		conversations = []*Conversation{}
+	}
+	response["conversations"] = conversations
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func getConversationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conversation, err := loadConversation(conversationID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading conversation: %v", err)
+		http.Error(w, `{"error":"Error loading conversation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversation)
+}
+
+// getMessagesHandler pages back through a conversation's history, newest
+// first.
+func getMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	query := r.URL.Query()
+
+	limit := messageDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > messageMaxLimit {
+			limit = messageMaxLimit
+		}
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := loadConversation(conversationID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error":"Failed to fetch messages"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	before := 0
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != messageCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = cursor.ID
+	}
+
+	messages := []Message{}
+	err = db.Select(&messages, fmt.Sprintf(`
+		SELECT %s
+		FROM messages m
+		JOIN users s ON s.id = m.sender_id
+		WHERE m.conversation_id = $1 AND ($2 = 0 OR m.id < $2)
+		ORDER BY m.id DESC
+		LIMIT %d
+	`, messageColumns, limit+1), conversationID, before)
+	if err != nil {
+		log.Printf("Error fetching messages: %v", err)
+		http.Error(w, `{"error":"Failed to fetch messages"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"messages": messages}
+	if len(messages) > limit {
+		response["messages"] = messages[:limit]
+		response["nextCursor"] = encodeCursor(pageCursor{Sort: messageCursorSort, ID: messages[limit-1].ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// markConversationReadHandler marks messages read up to messageId, or the
+// latest message if none is given.
+func markConversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		MessageID *int `json:"messageId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Read markers only move forward
+	result, err := db.Exec(`
+		UPDATE conversation_members me
+		SET last_read_message_id = GREATEST(me.last_read_message_id, COALESCE(
+			(SELECT MAX(id) FROM messages WHERE conversation_id = $1 AND ($3::int IS NULL OR id <= $3)), 0))
+		WHERE me.conversation_id = $1 AND me.user_id = $2 AND me.left_at IS NULL
+	`, conversationID, userID, req.MessageID)
+	if err != nil {
+		log.Printf("Error marking conversation read: %v", err)
+		http.Error(w, `{"error":"Error marking conversation read"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	conversation, err := loadConversation(conversationID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversation)
+}
+
+func acceptMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	answerMessageRequest(w, r, MemberStatusAccepted)
+}
+
+func rejectMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	answerMessageRequest(w, r, MemberStatusRejected)
+}
+
+// answerMessageRequest moves a pending request into the inbox or rejects
+// it, which hides it and stops the sender writing again.
+func answerMessageRequest(w http.ResponseWriter, r *http.Request, status string) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	conversationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE conversation_members SET status = $3
+		WHERE conversation_id = $1 AND user_id = $2 AND status = 'pending'
+	`, conversationID, userID, status)
+	if err != nil {
+		log.Printf("Error answering message request: %v", err)
+		http.Error(w, `{"error":"Error answering message request"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Message request not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if status == MemberStatusRejected {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Message request rejected"})
+		return
+	}
+
+	conversation, err := loadConversation(conversationID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversation)
+}
+
+// getUnreadMessagesHandler counts unread messages in the inbox and pending
+// message requests, for badges.
+func getUnreadMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var counts struct {
+		Unread        int `json:"unread" db:"unread"`
+		Conversations int `json:"conversations" db:"conversations"`
+		Requests      int `json:"requests" db:"requests"`
+	}
+	err = db.Get(&counts, `
+		SELECT
+			COALESCE(SUM(unread_count) FILTER (WHERE status = 'accepted'), 0) AS unread,
+			COUNT(*) FILTER (WHERE status = 'accepted' AND unread_count > 0) AS conversations,
+			COUNT(*) FILTER (WHERE status = 'pending') AS requests
+		FROM (
+			SELECT `+conversationColumns+conversationFrom+`
+			WHERE `+conversationNotBlocked+`
+		) mine
+	`, userID)
+	if err != nil {
+		log.Printf("Error counting unread messages: %v", err)
+		http.Error(w, `{"error":"Failed to count unread messages"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
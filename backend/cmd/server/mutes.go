@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type MutedUser struct {
+	Username string    `json:"username" db:"username"`
+	MutedAt  time.Time `json:"mutedAt" db:"created_at"`
+}
+
+func muteUserHandler(w http.ResponseWriter, r *http.Request) {
+	muterID, targetID, ok := resolveRelationshipTarget(w, r, "Cannot mute yourself")
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO user_mutes (muter_id, muted_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, muterID, targetID)
+	if err != nil {
+		log.Printf("Error muting user: %v", err)
+		http.Error(w, `{"error":"Error muting user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, muterID, targetID, "User muted")
+}
+
+func unmuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	muterID, targetID, ok := resolveRelationshipTarget(w, r, "Cannot mute yourself")
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec(`
+		DELETE FROM user_mutes
+		WHERE muter_id = $1 AND muted_id = $2
+	`, muterID, targetID)
+	if err != nil {
+		log.Printf("Error unmuting user: %v", err)
+		http.Error(w, `{"error":"Error unmuting user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeFollowActionResponse(w, muterID, targetID, "User unmuted")
+}
+
+func getMutedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	muted := []MutedUser{}
+	err := db.Select(&muted, `
+		SELECT u.username, m.created_at
+		FROM user_mutes m
+		JOIN users u ON u.id = m.muted_id
+		WHERE m.muter_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY m.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error fetching muted users: %v", err)
+		http.Error(w, `{"error":"Failed to fetch muted users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(muted)
+}
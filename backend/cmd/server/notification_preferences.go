@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notification channels
+const (
+	NotificationChannelInApp = "in_app"
+	NotificationChannelEmail = "email"
+	NotificationChannelPush  = "push"
+)
+
+// Digest frequencies
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+const maxEmailLength = 254
+
+// notificationChannelEnabledSQL is true unless the user has turned the
+// channel off for the notification type. Every channel is on by default,
+// so only the ones turned off need a row.
+func notificationChannelEnabledSQL(userExpr, typeExpr, channel string) string {
+	return fmt.Sprintf(`NOT EXISTS (
+		SELECT 1 FROM notification_preferences np
+		WHERE np.user_id = %s AND np.type = %s AND np.channel = '%s' AND NOT np.enabled
+	)`, userExpr, typeExpr, channel)
+}
+
+// notificationTypes lists every notification type, in a stable order.
+func notificationTypes() []string {
+	types := make([]string, 0, len(notificationPhrases)+len(pushOnlyNotificationTypes))
+	for t := range notificationPhrases {
+		types = append(types, t)
+	}
+	types = append(types, pushOnlyNotificationTypes...)
+	sort.Strings(types)
+	return types
+}
+
+func knownNotificationType(t string) bool {
+	if _, ok := notificationPhrases[t]; ok {
+		return true
+	}
+	for _, pushOnly := range pushOnlyNotificationTypes {
+		if t == pushOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// ChannelPreferences says where one type of notification is delivered.
+type ChannelPreferences struct {
+	InApp bool `json:"inApp"`
+	Email bool `json:"email"`
+	Push  bool `json:"push"`
+}
+
+// QuietHours is a daily window, in the user's time zone, during which
+// nothing is emailed or pushed to them. It may run past midnight.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type NotificationPreferences struct {
+	Email         *string                       `json:"email"`
+	EmailVerified bool                          `json:"emailVerified"`
+	Types         map[string]ChannelPreferences `json:"types"`
+	QuietHours    *QuietHours                   `json:"quietHours"`
+	Digest        string                        `json:"digest"`
+}
+
+// inQuietHours reports whether t falls in the quiet hours running from
+// start to end, given in minutes after midnight in loc. Users without quiet
+// hours have nil bounds.
+func inQuietHours(start, end *int, loc *time.Location, t time.Time) bool {
+	if start == nil || end == nil {
+		return false
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if *start <= *end {
+		return minute >= *start && minute < *end
+	}
+	return minute >= *start || minute < *end
+}
+
+func loadNotificationPreferences(userID int) (*NotificationPreferences, error) {
+	var user struct {
+		Email           *string `db:"email"`
+		EmailVerified   bool    `db:"email_verified"`
+		QuietHoursStart *int    `db:"quiet_hours_start"`
+		QuietHoursEnd   *int    `db:"quiet_hours_end"`
+		Digest          string  `db:"digest_frequency"`
+	}
+	err := db.Get(&user, `
+		SELECT email, email_verified_at IS NOT NULL AS email_verified,
+			quiet_hours_start, quiet_hours_end, digest_frequency
+		FROM users WHERE id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var disabled []struct {
+		Type    string `db:"type"`
+		Channel string `db:"channel"`
+	}
+	err = db.Select(&disabled, `
+		SELECT type, channel FROM notification_preferences
+		WHERE user_id = $1 AND NOT enabled
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := &NotificationPreferences{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Types:         map[string]ChannelPreferences{},
+		Digest:        user.Digest,
+	}
+	for _, t := range notificationTypes() {
+		prefs.Types[t] = ChannelPreferences{InApp: true, Email: true, Push: true}
+	}
+	for _, d := range disabled {
+		channels, ok := prefs.Types[d.Type]
+		if !ok {
+			continue
+		}
+		switch d.Channel {
+		case NotificationChannelInApp:
+			channels.InApp = false
+		case NotificationChannelEmail:
+			channels.Email = false
+		case NotificationChannelPush:
+			channels.Push = false
+		}
+		prefs.Types[d.Type] = channels
+	}
+	if user.QuietHoursStart != nil && user.QuietHoursEnd != nil {
+		prefs.QuietHours = &QuietHours{
+			Start: formatMinuteOfDay(*user.QuietHoursStart),
+			End:   formatMinuteOfDay(*user.QuietHoursEnd),
+		}
+	}
+	return prefs, nil
+}
+
+func getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		log.Printf("Error fetching notification preferences: %v", err)
+		http.Error(w, `{"error":"Failed to fetch notification preferences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// updateNotificationPreferencesHandler changes only what the request names:
+// any of the channels of any types, the digest email address and
+// frequency, and the quiet hours. A null email or quietHours clears it. A
+// new email address is sent a confirmation token and gets no digests until
+// it's confirmed.
+func updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Email json.RawMessage `json:"email"`
+		Types map[string]struct {
+			InApp *bool `json:"inApp"`
+			Email *bool `json:"email"`
+			Push  *bool `json:"push"`
+		} `json:"types"`
+		QuietHours json.RawMessage `json:"quietHours"`
+		Digest     *string         `json:"digest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	fieldErrors := map[string]string{}
+
+	var assignments []string
+	var args []interface{}
+	assign := func(column string, value interface{}) {
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	var newEmail *string
+	if len(req.Email) > 0 {
+		var email *string
+		if err := json.Unmarshal(req.Email, &email); err != nil {
+			fieldErrors["email"] = "must be a string"
+		} else if email == nil || strings.TrimSpace(*email) == "" {
+			assign("email", nil)
+			assign("email_verified_at", nil)
+			assign("email_token_hash", nil)
+			assign("email_token_expires_at", nil)
+		} else {
+			value := strings.TrimSpace(*email)
+			address, err := mail.ParseAddress(value)
+			if err != nil || address.Address != value || len(value) > maxEmailLength {
+				fieldErrors["email"] = "must be an email address"
+			} else {
+				newEmail = &value
+			}
+		}
+	}
+
+	if len(req.QuietHours) > 0 {
+		var quiet *QuietHours
+		if err := json.Unmarshal(req.QuietHours, &quiet); err != nil {
+			fieldErrors["quietHours"] = "must be an object with start and end"
+		} else if quiet == nil {
+			assign("quiet_hours_start", nil)
+			assign("quiet_hours_end", nil)
+		} else {
+			start, startErr := parseMinuteOfDay(quiet.Start)
+			end, endErr := parseMinuteOfDay(quiet.End)
+			// 24:00 is midnight, which the window wraps around anyway
+			start, end = start%minutesPerDay, end%minutesPerDay
+			switch {
+			case startErr != nil:
+				fieldErrors["quietHours.start"] = startErr.Error()
+			case endErr != nil:
+				fieldErrors["quietHours.end"] = endErr.Error()
+			case start == end:
+				fieldErrors["quietHours"] = "start and end must differ"
+			default:
+				assign("quiet_hours_start", start)
+				assign("quiet_hours_end", end)
+			}
+		}
+	}
+
+	if req.Digest != nil {
+		switch *req.Digest {
+		case DigestOff, DigestDaily, DigestWeekly:
+			assign("digest_frequency", *req.Digest)
+		default:
+			fieldErrors["digest"] = "must be off, daily or weekly"
+		}
+	}
+
+	type channelSetting struct {
+		notificationType string
+		channel          string
+		enabled          bool
+	}
+	var settings []channelSetting
+	for t, channels := range req.Types {
+		if !knownNotificationType(t) {
+			fieldErrors["types."+t] = "unknown notification type"
+			continue
+		}
+		for channel, enabled := range map[string]*bool{
+			NotificationChannelInApp: channels.InApp,
+			NotificationChannelEmail: channels.Email,
+			NotificationChannelPush:  channels.Push,
+		} {
+			if enabled != nil {
+				settings = append(settings, channelSetting{t, channel, *enabled})
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid notification preferences",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A changed or still unconfirmed address gets a fresh token to confirm
+	var confirmationToken string
+	if newEmail != nil {
+		var current *string
+		var verified bool
+		err := tx.QueryRow(`
+			SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = $1 FOR UPDATE
+		`, userID).Scan(&current, &verified)
+		if err != nil {
+			log.Printf("Error updating notification preferences: %v", err)
+			http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+			return
+		}
+		if current == nil || *current != *newEmail || !verified {
+			token, hash, err := newEmailConfirmationToken()
+			if err != nil {
+				log.Printf("Error creating email confirmation token: %v", err)
+				http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+				return
+			}
+			assign("email", *newEmail)
+			assign("email_verified_at", nil)
+			assign("email_token_hash", hash)
+			assign("email_token_expires_at", time.Now().UTC().Add(emailConfirmationTTL))
+			confirmationToken = token
+		}
+	}
+
+	if len(assignments) > 0 {
+		args = append(args, userID)
+		_, err := tx.Exec(fmt.Sprintf(
+			"UPDATE users SET %s WHERE id = $%d",
+			strings.Join(assignments, ", "), len(args),
+		), args...)
+		if err != nil {
+			log.Printf("Error updating notification preferences: %v", err)
+			http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, s := range settings {
+		_, err := tx.Exec(`
+			INSERT INTO notification_preferences (user_id, type, channel, enabled)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, type, channel) DO UPDATE SET enabled = EXCLUDED.enabled
+		`, userID, s.notificationType, s.channel, s.enabled)
+		if err != nil {
+			log.Printf("Error updating notification preferences: %v", err)
+			http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating notification preferences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if confirmationToken != "" {
+		if err := sendEmailConfirmation(mailer, claims.Username, *newEmail, confirmationToken); err != nil {
+			log.Printf("Error sending email confirmation to %s: %v", claims.Username, err)
+		}
+	}
+
+	getNotificationPreferencesHandler(w, r)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Notification types
+const (
+	NotificationFollow                   = "follow"
+	NotificationFollowRequest            = "follow_request"
+	NotificationFollowRequestAccepted    = "follow_request_accepted"
+	NotificationLFGApplication           = "lfg_application"
+	NotificationLFGApplicationAccepted   = "lfg_application_accepted"
+	NotificationLFGApplicationDeclined   = "lfg_application_declined"
+	NotificationEndorsement              = "endorsement"
+	NotificationEventInvite              = "event_invite"
+	NotificationEventWaitlistPromoted    = "event_waitlist_promoted"
+	NotificationEventCancelled           = "event_cancelled"
+	NotificationEventOccurrenceCancelled = "event_occurrence_cancelled"
+	NotificationEventRescheduled         = "event_rescheduled"
+	NotificationMessageRequest           = "message_request"
+	NotificationMention                  = "mention"
+	NotificationMatchFound               = "match_found"
+	NotificationFriendLive               = "friend_live"
+	NotificationPostReaction             = "post_reaction"
+	NotificationPostComment              = "post_comment"
+	NotificationCommentReply             = "comment_reply"
+)
+
+// pushOnlyNotificationTypes are sent to phones as they happen and never
+// kept in the notification center.
+var pushOnlyNotificationTypes = []string{NotificationMatchFound, NotificationFriendLive}
+
+// postNotificationTypes are about a post, and go when it does.
+var postNotificationTypes = []string{NotificationPostReaction, NotificationPostComment, NotificationCommentReply}
+
+// notificationPhrases says what the actors did, for summaries like "alice
+// and 4 others followed you".
+var notificationPhrases = map[string]string{
+	NotificationFollow:                   "followed you",
+	NotificationFollowRequest:            "asked to follow you",
+	NotificationFollowRequestAccepted:    "accepted your follow request",
+	NotificationLFGApplication:           "applied to your LFG post",
+	NotificationLFGApplicationAccepted:   "accepted your LFG application",
+	NotificationLFGApplicationDeclined:   "declined your LFG application",
+	NotificationEndorsement:              "endorsed you",
+	NotificationEventInvite:              "invited you to a session",
+	NotificationEventWaitlistPromoted:    "moved you off a session's waitlist",
+	NotificationEventCancelled:           "cancelled a session you're going to",
+	NotificationEventOccurrenceCancelled: "cancelled one session of a series you're going to",
+	NotificationEventRescheduled:         "rescheduled a session you're going to",
+	NotificationMessageRequest:           "sent you a message request",
+	NotificationMention:                  "mentioned you",
+	NotificationPostReaction:             "reacted to your post",
+	NotificationPostComment:              "commented on your post",
+	NotificationCommentReply:             "replied to your comment",
+}
+
+// groupedNotificationTypes fold into one unread notification per subject
+// while more actors pile in, instead of one each.
+var groupedNotificationTypes = map[string]bool{
+	NotificationFollow:         true,
+	NotificationFollowRequest:  true,
+	NotificationEndorsement:    true,
+	NotificationLFGApplication: true,
+	NotificationMention:        true,
+	NotificationPostReaction:   true,
+	NotificationPostComment:    true,
+	NotificationCommentReply:   true,
+}
+
+const (
+	notificationGroupWindow   = 24 * time.Hour
+	notificationDefaultLimit  = 20
+	notificationMaxLimit      = 50
+	notificationShownActors   = 3
+	notificationCursorSort    = "notifications"
+	notificationSweepInterval = time.Hour
+	// Read notifications are kept for a month and unread ones for three
+	notificationReadRetention   = 30 * 24 * time.Hour
+	notificationUnreadRetention = 90 * 24 * time.Hour
+)
+
+// Notification is one entry in the notification center. Grouped
+// notifications name the latest few actors and count them all. SubjectID
+// is what the notification is about: an event for event notifications, a
+// conversation for messages and mentions, an LFG post for applications.
+// OccurrenceStart picks out one occurrence of a recurring event by its
+// original start.
+type Notification struct {
+	ID              int            `json:"id" db:"id"`
+	Type            string         `json:"type" db:"type"`
+	Actors          pq.StringArray `json:"actors" db:"actors"`
+	ActorCount      int            `json:"actorCount" db:"actor_count"`
+	Summary         string         `json:"summary" db:"-"`
+	SubjectID       *int           `json:"subjectId,omitempty" db:"subject_id"`
+	OccurrenceStart *time.Time     `json:"occurrenceStart,omitempty" db:"occurrence_start"`
+	CreatedAt       time.Time      `json:"createdAt" db:"created_at"`
+	UpdatedAt       time.Time      `json:"updatedAt" db:"updated_at"`
+	ReadAt          *time.Time     `json:"readAt,omitempty" db:"read_at"`
+}
+
+// notificationColumns selects a Notification from notifications n for the
+// user bound to $1, leaving out actors on either side of a block with them
+// and actors they've muted. Notifications left without actors aren't shown.
+var notificationColumns = `
+	n.id, n.type, n.subject_id, n.occurrence_start, n.created_at, n.updated_at, n.read_at,
+	ARRAY(
+		SELECT u.username FROM unnest(n.actor_ids) WITH ORDINALITY a(id, ord)
+		JOIN users u ON u.id = a.id
+		WHERE ` + notBlockedSQL("$1") + `
+		AND NOT EXISTS (SELECT 1 FROM user_mutes m WHERE m.muter_id = $1 AND m.muted_id = u.id)
+		ORDER BY a.ord DESC
+	) AS actors`
+
+// execer is satisfied by both the database handle and transactions, so
+// notifications can be emitted as part of the action that caused them.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// emitNotification records a notification for userID about something actorID did.
+func emitNotification(ex execer, userID, actorID int, notificationType string) error {
+	return emitNotificationAbout(ex, userID, actorID, notificationType, nil)
+}
+
+// emitNotificationAbout records a notification about a subject, such as the
+// event someone was invited to. Grouped types join an unread notification
+// of the same type and subject from the last day if there is one. Nothing
+// is recorded if the user has muted the actor or turned off every channel
+// for the type.
+func emitNotificationAbout(ex execer, userID, actorID int, notificationType string, subjectID interface{}) error {
+	return insertNotification(ex, userID, actorID, notificationType, subjectID, nil)
+}
+
+// emitOccurrenceNotification records a notification about one occurrence
+// of a recurring event.
+func emitOccurrenceNotification(ex execer, userID, actorID int, notificationType string, eventID int, occurrence time.Time) error {
+	return insertNotification(ex, userID, actorID, notificationType, eventID, occurrence.UTC())
+}
+
+func insertNotification(ex execer, userID, actorID int, notificationType string, subjectID, occurrenceStart interface{}) error {
+	var groupKey interface{}
+	if groupedNotificationTypes[notificationType] {
+		key := notificationType
+		if subjectID != nil {
+			key = fmt.Sprintf("%s:%v", notificationType, subjectID)
+		}
+		groupKey = key
+	}
+
+	_, err := ex.Exec(fmt.Sprintf(`
+		WITH muted AS (
+			SELECT 1 FROM user_mutes WHERE muter_id = $1 AND muted_id = $2
+		), grouped AS (
+			UPDATE notifications
+			SET actor_id = $2, actor_ids = array_append(array_remove(actor_ids, $2), $2),
+				updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND group_key = $5 AND read_at IS NULL
+			AND created_at > CURRENT_TIMESTAMP - $6 * INTERVAL '1 second'
+			AND NOT EXISTS (SELECT 1 FROM muted)
+			RETURNING id
+		)
+		INSERT INTO notifications (user_id, actor_id, actor_ids, type, subject_id, group_key, occurrence_start)
+		SELECT $1, $2, ARRAY[$2::int], $3, $4, $5, $7
+		WHERE NOT EXISTS (SELECT 1 FROM grouped) AND NOT EXISTS (SELECT 1 FROM muted)
+		AND (%s OR %s OR %s)
+	`,
+		notificationChannelEnabledSQL("$1", "$3", NotificationChannelInApp),
+		notificationChannelEnabledSQL("$1", "$3", NotificationChannelEmail),
+		notificationChannelEnabledSQL("$1", "$3", NotificationChannelPush),
+	), userID, actorID, notificationType, subjectID, groupKey, notificationGroupWindow.Seconds(), occurrenceStart)
+	return err
+}
+
+// summarize fills in a notification's summary from its actors.
+func (n *Notification) summarize() {
+	phrase := notificationPhrases[n.Type]
+	if phrase == "" {
+		phrase = strings.ReplaceAll(n.Type, "_", " ")
+	}
+
+	switch len(n.Actors) {
+	case 0:
+		n.Summary = "Someone " + phrase
+	case 1:
+		n.Summary = n.Actors[0] + " " + phrase
+	case 2:
+		n.Summary = n.Actors[0] + " and " + n.Actors[1] + " " + phrase
+	default:
+		n.Summary = fmt.Sprintf("%s and %d others %s", n.Actors[0], n.ActorCount-1, phrase)
+	}
+
+	if len(n.Actors) > notificationShownActors {
+		n.Actors = n.Actors[:notificationShownActors]
+	}
+}
+
+// getNotificationsHandler lists the user's notifications, most recently
+// active first. ?unread=true lists only unread ones. Types the user has
+// turned off in the app are left out.
+func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	query := r.URL.Query()
+
+	limit := notificationDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > notificationMaxLimit {
+			limit = notificationMaxLimit
+		}
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conditions := []string{"n.user_id = $1", notificationChannelEnabledSQL("n.user_id", "n.type", NotificationChannelInApp)}
+	args := []interface{}{userID}
+	if query.Get("unread") == "true" {
+		conditions = append(conditions, "n.read_at IS NULL")
+	}
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != notificationCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		args = append(args, cursor.Value, cursor.ID)
+		conditions = append(conditions, "(n.updated_at, n.id) < ($2::timestamp, $3)")
+	}
+
+	// Notifications whose every actor is blocked drop out of the list
+	var notifications []*Notification
+	err = db.Select(&notifications, fmt.Sprintf(`
+		SELECT *, cardinality(actors) AS actor_count FROM (
+			SELECT %s
+			FROM notifications n
+			WHERE %s
+		) visible
+		WHERE cardinality(actors) > 0
+		ORDER BY updated_at DESC, id DESC
+		LIMIT %d
+	`, notificationColumns, strings.Join(conditions, " AND "), limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching notifications: %v", err)
+		http.Error(w, `{"error":"Failed to fetch notifications"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		last := notifications[limit-1]
+		response["nextCursor"] = encodeCursor(pageCursor{
+			Sort:  notificationCursorSort,
+			Value: last.UpdatedAt.Format(cursorTimeValue),
+			ID:    last.ID,
+		})
+	}
+	for _, n := range notifications {
+		n.summarize()
+	}
+	if notifications == nil {
+		notifications = []*Notification{}
+	}
+	response["notifications"] = notifications
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getUnreadNotificationCountHandler counts unread notifications, for badges.
+// It counts only those the list would show.
+func getUnreadNotificationCountHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var count int
+	err = db.Get(&count, `
+		SELECT COUNT(*) FROM (
+			SELECT `+notificationColumns+`
+			FROM notifications n
+			WHERE n.user_id = $1 AND n.read_at IS NULL
+			AND `+notificationChannelEnabledSQL("n.user_id", "n.type", NotificationChannelInApp)+`
+		) visible
+		WHERE cardinality(actors) > 0
+	`, userID)
+	if err != nil {
+		log.Printf("Error counting notifications: %v", err)
+		http.Error(w, `{"error":"Failed to count notifications"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": count})
+}
+
+func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	notificationID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	result, err := db.Exec(`
+		UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND user_id = (SELECT id FROM users WHERE username = $2)
+	`, notificationID, claims.Username)
+	if err != nil {
+		log.Printf("Error marking notification read: %v", err)
+		http.Error(w, `{"error":"Error marking notification read"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Notification not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Notification marked read"})
+}
+
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	result, err := db.Exec(`
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = (SELECT id FROM users WHERE username = $1) AND read_at IS NULL
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+		http.Error(w, `{"error":"Error marking notifications read"}`, http.StatusInternalServerError)
+		return
+	}
+	marked, _ := result.RowsAffected()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"marked": marked})
+}
+
+// expireNotifications deletes notifications past their retention.
+func expireNotifications() (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM notifications
+		WHERE (read_at IS NOT NULL AND updated_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second')
+		OR updated_at < CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+	`, notificationReadRetention.Seconds(), notificationUnreadRetention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func runNotificationSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := expireNotifications()
+		if err != nil {
+			log.Printf("Error expiring notifications: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d notifications", expired)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Party member roles
+const (
+	PartyRoleLeader = "leader"
+	PartyRoleMember = "member"
+)
+
+type Party struct {
+	ID          int           `json:"id" db:"id"`
+	LFGPostID   *int          `json:"lfgPostId,omitempty" db:"lfg_post_id"`
+	Game        string        `json:"game" db:"game"`
+	CreatedAt   time.Time     `json:"createdAt" db:"created_at"`
+	DisbandedAt *time.Time    `json:"disbandedAt,omitempty" db:"disbanded_at"`
+	Members     []PartyMember `json:"members,omitempty"`
+}
+
+// PartyMember carries the member's Discord handle whatever their privacy
+// settings, since coordinating is the point of the party. It is only filled
+// in while the party is active.
+type PartyMember struct {
+	UserID          int       `json:"-" db:"user_id"`
+	Username        string    `json:"username" db:"username"`
+	Role            string    `json:"role" db:"role"`
+	JoinedAt        time.Time `json:"joinedAt" db:"joined_at"`
+	DiscordUsername *string   `json:"discordUsername,omitempty" db:"discord_username"`
+}
+
+// ensurePartyForPost returns the party formed from an LFG post, creating it
+// with the post owner as leader the first time someone is accepted.
+func ensurePartyForPost(tx *sql.Tx, postID, ownerID int, game string) (int, error) {
+	var partyID int
+	err := tx.QueryRow("SELECT id FROM parties WHERE lfg_post_id = $1", postID).Scan(&partyID)
+	if err == nil {
+		return partyID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	return createParty(tx, postID, game, ownerID)
+}
+
+// createParty starts a party led by leaderID, along with its group chat.
+// lfgPostID is nil for parties that didn't come from an LFG post.
+func createParty(tx *sql.Tx, lfgPostID interface{}, game string, leaderID int) (int, error) {
+	var partyID int
+	err := tx.QueryRow(`
+		INSERT INTO parties (lfg_post_id, game)
+		VALUES ($1, $2)
+		RETURNING id
+	`, lfgPostID, game).Scan(&partyID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := createPartyChat(tx, partyID, game); err != nil {
+		return 0, err
+	}
+
+	if err := addPartyMember(tx, partyID, leaderID, PartyRoleLeader); err != nil {
+		return 0, err
+	}
+	return partyID, nil
+}
+
+// addPartyMember adds userID to a party, bringing back members who left.
+func addPartyMember(tx *sql.Tx, partyID, userID int, role string) error {
+	_, err := tx.Exec(`
+		INSERT INTO party_members (party_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (party_id, user_id)
+		DO UPDATE SET role = $3, joined_at = CURRENT_TIMESTAMP, left_at = NULL
+	`, partyID, userID, role)
+	if err != nil {
+		return err
+	}
+	return joinPartyChat(tx, partyID, userID, role)
+}
+
+// disbandParty ends a party and everyone's membership in it, archiving its
+// chat.
+func disbandParty(tx *sql.Tx, partyID int) error {
+	if err := archivePartyChat(tx, partyID); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		UPDATE parties SET disbanded_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND disbanded_at IS NULL
+	`, partyID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE party_members SET left_at = CURRENT_TIMESTAMP
+		WHERE party_id = $1 AND left_at IS NULL
+	`, partyID)
+	return err
+}
+
+// loadParty fetches a party and its current members as seen by viewerID. It
+// returns sql.ErrNoRows unless the viewer is an active member.
+func loadParty(partyID, viewerID int) (*Party, error) {
+	var party Party
+	err := db.Get(&party, `
+		SELECT p.id, p.lfg_post_id, p.game, p.created_at, p.disbanded_at
+		FROM parties p
+		JOIN party_members pm ON pm.party_id = p.id
+		WHERE p.id = $1 AND pm.user_id = $2 AND pm.left_at IS NULL
+	`, partyID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	party.Members = []PartyMember{}
+	err = db.Select(&party.Members, `
+		SELECT pm.user_id, u.username, pm.role, pm.joined_at, u.discord_username
+		FROM party_members pm
+		JOIN users u ON u.id = pm.user_id
+		WHERE pm.party_id = $1 AND pm.left_at IS NULL
+		ORDER BY pm.role = 'leader' DESC, pm.joined_at
+	`, partyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &party, nil
+}
+
+func getMyPartiesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	parties := []Party{}
+	err := db.Select(&parties, `
+		SELECT p.id, p.lfg_post_id, p.game, p.created_at, p.disbanded_at
+		FROM parties p
+		JOIN party_members pm ON pm.party_id = p.id
+		WHERE pm.user_id = (SELECT id FROM users WHERE username = $1)
+		AND pm.left_at IS NULL AND p.disbanded_at IS NULL
+		ORDER BY p.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error fetching parties: %v", err)
+		http.Error(w, `{"error":"Failed to fetch parties"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(parties)
+}
+
+func getPartyHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	party, err := loadParty(partyID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Party not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching party: %v", err)
+		http.Error(w, `{"error":"Failed to fetch party"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(party)
+}
+
+// leavePartyHandler removes the authenticated user from a party. A leader
+// leaving disbands it.
+func leavePartyHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow(`
+		SELECT pm.role FROM party_members pm
+		JOIN parties p ON p.id = pm.party_id
+		WHERE pm.party_id = $1 AND pm.user_id = $2
+		AND pm.left_at IS NULL AND p.disbanded_at IS NULL
+		FOR UPDATE
+	`, partyID, userID).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Party not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error leaving party: %v", err)
+		http.Error(w, `{"error":"Error leaving party"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if role == PartyRoleLeader {
+		err = disbandParty(tx, partyID)
+	} else {
+		err = removePartyMember(tx, partyID, userID)
+	}
+	if err != nil {
+		log.Printf("Error leaving party: %v", err)
+		http.Error(w, `{"error":"Error leaving party"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing leave action"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Left party"})
+}
+
+// removePartyMember ends userID's membership without touching the party.
+func removePartyMember(tx *sql.Tx, partyID, userID int) error {
+	_, err := tx.Exec(`
+		UPDATE party_members SET left_at = CURRENT_TIMESTAMP
+		WHERE party_id = $1 AND user_id = $2 AND left_at IS NULL
+	`, partyID, userID)
+	if err != nil {
+		return err
+	}
+	return leavePartyChat(tx, partyID, userID)
+}
+
+func disbandPartyHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var isLeader bool
+	err = tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM party_members pm
+			JOIN parties p ON p.id = pm.party_id
+			WHERE pm.party_id = $1 AND pm.role = $2 AND pm.left_at IS NULL
+			AND p.disbanded_at IS NULL
+			AND pm.user_id = (SELECT id FROM users WHERE username = $3)
+		)
+	`, partyID, PartyRoleLeader, claims.Username).Scan(&isLeader)
+	if err != nil {
+		log.Printf("Error disbanding party: %v", err)
+		http.Error(w, `{"error":"Error disbanding party"}`, http.StatusInternalServerError)
+		return
+	}
+	if !isLeader {
+		http.Error(w, `{"error":"Only the party leader can disband the party"}`, http.StatusForbidden)
+		return
+	}
+
+	if err := disbandParty(tx, partyID); err != nil {
+		log.Printf("Error disbanding party: %v", err)
+		http.Error(w, `{"error":"Error disbanding party"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing disband action"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Party disbanded"})
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	commentDefaultLimit   = 20
+	commentMaxLimit       = 50
+	commentPreviewReplies = 3
+	commentCursorSort     = "comments"
+	replyCursorSort       = "replies"
+)
+
+// PostComment is a comment on a post, or a reply to one. Replies are one
+// level deep. A deleted comment is kept, without its author and text, only
+// while replies hang off it.
+type PostComment struct {
+	ID         int            `json:"id" db:"id"`
+	PostID     int            `json:"postId" db:"post_id"`
+	ParentID   *int           `json:"parentId,omitempty" db:"parent_id"`
+	AuthorID   int            `json:"-" db:"author_id"`
+	Author     *string        `json:"author" db:"author"`
+	Body       *string        `json:"body" db:"body"`
+	Deleted    bool           `json:"deleted" db:"deleted"`
+	ReplyCount int            `json:"replyCount" db:"reply_count"`
+	Replies    []*PostComment `json:"replies,omitempty" db:"-"`
+	CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+	EditedAt   *time.Time     `json:"editedAt,omitempty" db:"edited_at"`
+}
+
+const commentColumns = `c.id, c.post_id, c.parent_id, c.author_id,
+	CASE WHEN c.deleted_at IS NULL THEN u.username END AS author,
+	CASE WHEN c.deleted_at IS NULL THEN c.body END AS body,
+	c.deleted_at IS NOT NULL AS deleted,
+	(SELECT COUNT(*) FROM post_comments rc WHERE rc.parent_id = c.id) AS reply_count,
+	c.created_at, c.edited_at`
+
+// fetchComment loads a comment on postID the viewer may see.
+func fetchComment(viewer, postID, commentID int) (*PostComment, error) {
+	var comment PostComment
+	err := db.Get(&comment, `
+		SELECT `+commentColumns+`
+		FROM post_comments c
+		JOIN users u ON u.id = c.author_id
+		WHERE c.id = $1 AND c.post_id = $2 AND `+notBlockedSQL("$3"),
+		commentID, postID, viewer)
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// commentPageParams reads the limit and cursor of a page of comments,
+// writing the error response and returning false if either is invalid.
+func commentPageParams(w http.ResponseWriter, r *http.Request, sort string) (int, *pageCursor, bool) {
+	query := r.URL.Query()
+
+	limit := commentDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return 0, nil, false
+		}
+		if limit > commentMaxLimit {
+			limit = commentMaxLimit
+		}
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != sort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return 0, nil, false
+		}
+		return limit, &cursor, true
+	}
+	return limit, nil, true
+}
+
+// writeCommentPage writes a page of comments fetched one past limit, with
+// the cursor to the next page if there is one.
+func writeCommentPage(w http.ResponseWriter, comments []*PostComment, limit int, sort string) {
+	response := map[string]interface{}{}
+	if len(comments) > limit {
+		comments = comments[:limit]
+		last := comments[limit-1]
+		response["nextCursor"] = encodeCursor(pageCursor{
+			Sort:  sort,
+			Value: last.CreatedAt.Format(cursorTimeValue),
+			ID:    last.ID,
+		})
+	}
+	if comments == nil {
+		comments = []*PostComment{}
+	}
+	response["comments"] = comments
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getPostCommentsHandler lists a post's comments, oldest first, each with
+// its first few replies.
+func getPostCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	limit, cursor, ok := commentPageParams(w, r, commentCursorSort)
+	if !ok {
+		return
+	}
+	if post := visiblePost(w, viewer, postID); post == nil {
+		return
+	}
+
+	args := []interface{}{postID, viewer}
+	cursorCondition := "true"
+	if cursor != nil {
+		args = append(args, cursor.Value, cursor.ID)
+		cursorCondition = "(c.created_at, c.id) > ($3::timestamp, $4)"
+	}
+
+	var comments []*PostComment
+	err = db.Select(&comments, fmt.Sprintf(`
+		SELECT %s
+		FROM post_comments c
+		JOIN users u ON u.id = c.author_id
+		WHERE c.post_id = $1 AND c.parent_id IS NULL AND %s AND %s
+		ORDER BY c.created_at, c.id
+		LIMIT %d
+	`, commentColumns, notBlockedSQL("$2"), cursorCondition, limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching comments: %v", err)
+		http.Error(w, `{"error":"Failed to fetch comments"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var parentIDs []int
+	byID := map[int]*PostComment{}
+	for _, comment := range comments {
+		if comment.ReplyCount > 0 {
+			parentIDs = append(parentIDs, comment.ID)
+		}
+		byID[comment.ID] = comment
+	}
+	if len(parentIDs) > 0 {
+		var replies []*PostComment
+		err = db.Select(&replies, `
+			SELECT replies.* FROM unnest($1::int[]) AS parent(id)
+			CROSS JOIN LATERAL (
+				SELECT `+commentColumns+`
+				FROM post_comments c
+				JOIN users u ON u.id = c.author_id
+				WHERE c.parent_id = parent.id AND `+notBlockedSQL("$2")+`
+				ORDER BY c.created_at, c.id
+				LIMIT $3
+			) replies
+			ORDER BY replies.parent_id, replies.created_at, replies.id
+		`, pq.Array(parentIDs), viewer, commentPreviewReplies)
+		if err != nil {
+			log.Printf("Error fetching replies: %v", err)
+			http.Error(w, `{"error":"Failed to fetch comments"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, reply := range replies {
+			parent := byID[*reply.ParentID]
+			parent.Replies = append(parent.Replies, reply)
+		}
+	}
+
+	writeCommentPage(w, comments, limit, commentCursorSort)
+}
+
+// getCommentRepliesHandler lists the replies to a comment, oldest first.
+func getCommentRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+	commentID, _ := strconv.Atoi(vars["commentId"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	limit, cursor, ok := commentPageParams(w, r, replyCursorSort)
+	if !ok {
+		return
+	}
+	if post := visiblePost(w, viewer, postID); post == nil {
+		return
+	}
+
+	args := []interface{}{commentID, postID, viewer}
+	cursorCondition := "true"
+	if cursor != nil {
+		args = append(args, cursor.Value, cursor.ID)
+		cursorCondition = "(c.created_at, c.id) > ($4::timestamp, $5)"
+	}
+
+	var replies []*PostComment
+	err = db.Select(&replies, fmt.Sprintf(`
+		SELECT %s
+		FROM post_comments c
+		JOIN users u ON u.id = c.author_id
+		WHERE c.parent_id = $1 AND c.post_id = $2 AND %s AND %s
+		ORDER BY c.created_at, c.id
+		LIMIT %d
+	`, commentColumns, notBlockedSQL("$3"), cursorCondition, limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching replies: %v", err)
+		http.Error(w, `{"error":"Failed to fetch replies"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeCommentPage(w, replies, limit, replyCursorSort)
+}
+
+// createCommentHandler comments on a post, or replies to a comment with
+// parentId. Replies to replies join the thread they're in. The post's
+// author and the author of the comment replied to are notified.
+func createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Body     string `json:"body"`
+		ParentID *int   `json:"parentId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, bodyErr := validPostBody(req.Body)
+	if bodyErr == "" && body == "" {
+		bodyErr = "is required"
+	}
+	if bodyErr != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid comment",
+			"fields": map[string]string{"body": bodyErr},
+		})
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	post := visiblePost(w, userID, postID)
+	if post == nil {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error adding comment"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var threadID interface{}
+	repliedToID := 0
+	if req.ParentID != nil {
+		var parent struct {
+			ID       int  `db:"id"`
+			ParentID *int `db:"parent_id"`
+			AuthorID int  `db:"author_id"`
+		}
+		err := tx.Get(&parent, `
+			SELECT c.id, c.parent_id, c.author_id
+			FROM post_comments c
+			JOIN users u ON u.id = c.author_id
+			WHERE c.id = $1 AND c.post_id = $2 AND c.deleted_at IS NULL AND `+notBlockedSQL("$3")+`
+			FOR UPDATE OF c
+		`, *req.ParentID, postID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching comment: %v", err)
+			http.Error(w, `{"error":"Error adding comment"}`, http.StatusInternalServerError)
+			return
+		}
+		threadID = parent.ID
+		if parent.ParentID != nil {
+			threadID = *parent.ParentID
+		}
+		repliedToID = parent.AuthorID
+	}
+
+	var commentID int
+	err = tx.Get(&commentID, `
+		INSERT INTO post_comments (post_id, author_id, parent_id, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, postID, userID, threadID, body)
+	if err != nil {
+		log.Printf("Error adding comment: %v", err)
+		http.Error(w, `{"error":"Error adding comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if repliedToID != 0 && repliedToID != userID {
+		err = emitNotificationAbout(tx, repliedToID, userID, NotificationCommentReply, postID)
+	}
+	if err == nil && post.AuthorID != userID && post.AuthorID != repliedToID {
+		err = emitNotificationAbout(tx, post.AuthorID, userID, NotificationPostComment, postID)
+	}
+	if err != nil {
+		log.Printf("Error creating notification: %v", err)
+		http.Error(w, `{"error":"Error adding comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error adding comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := fetchComment(userID, postID, commentID)
+	if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, `{"error":"Failed to fetch comment"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// updateCommentHandler edits the user's comment, keeping the text it
+// replaces in the comment's history.
+func updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+	commentID, _ := strconv.Atoi(vars["commentId"])
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, bodyErr := validPostBody(req.Body)
+	if bodyErr == "" && body == "" {
+		bodyErr = "is required"
+	}
+	if bodyErr != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid comment",
+			"fields": map[string]string{"body": bodyErr},
+		})
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error editing comment"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.Get(&current, `
+		SELECT body FROM post_comments
+		WHERE id = $1 AND post_id = $2 AND author_id = $3 AND deleted_at IS NULL
+		FOR UPDATE
+	`, commentID, postID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, `{"error":"Error editing comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if body != current {
+		_, err = tx.Exec(`
+			INSERT INTO comment_revisions (comment_id, body, created_at)
+			SELECT id, body, COALESCE(edited_at, created_at) FROM post_comments WHERE id = $1
+		`, commentID)
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE post_comments SET body = $2, edited_at = CURRENT_TIMESTAMP WHERE id = $1
+			`, commentID, body)
+		}
+		if err != nil {
+			log.Printf("Error editing comment: %v", err)
+			http.Error(w, `{"error":"Error editing comment"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error editing comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	comment, err := fetchComment(userID, postID, commentID)
+	if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, `{"error":"Failed to fetch comment"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+// deleteCommentHandler deletes a comment, by its author or the post's. A
+// comment with replies is blanked out instead so the thread survives, and
+// goes for good once its last reply does.
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+	commentID, _ := strconv.Atoi(vars["commentId"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error deleting comment"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var comment struct {
+		ParentID     *int `db:"parent_id"`
+		AuthorID     int  `db:"author_id"`
+		PostAuthorID int  `db:"post_author_id"`
+		HasReplies   bool `db:"has_replies"`
+	}
+	err = tx.Get(&comment, `
+		SELECT c.parent_id, c.author_id, p.author_id AS post_author_id,
+			EXISTS (SELECT 1 FROM post_comments rc WHERE rc.parent_id = c.id) AS has_replies
+		FROM post_comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.id = $1 AND c.post_id = $2 AND c.deleted_at IS NULL
+		FOR UPDATE OF c
+	`, commentID, postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, `{"error":"Error deleting comment"}`, http.StatusInternalServerError)
+		return
+	}
+	if comment.AuthorID != userID && comment.PostAuthorID != userID {
+		http.Error(w, `{"error":"You can only delete your own comments or comments on your posts"}`, http.StatusForbidden)
+		return
+	}
+
+	if comment.HasReplies {
+		_, err = tx.Exec(`
+			UPDATE post_comments SET body = '', deleted_at = CURRENT_TIMESTAMP WHERE id = $1
+		`, commentID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM comment_revisions WHERE comment_id = $1`, commentID)
+		}
+	} else {
+		_, err = tx.Exec(`DELETE FROM post_comments WHERE id = $1`, commentID)
+		if err == nil && comment.ParentID != nil {
+			_, err = tx.Exec(`
+				DELETE FROM post_comments
+				WHERE id = $1 AND deleted_at IS NOT NULL
+				AND NOT EXISTS (SELECT 1 FROM post_comments rc WHERE rc.parent_id = $1)
+			`, *comment.ParentID)
+		}
+	}
+	if err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		http.Error(w, `{"error":"Error deleting comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error deleting comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted"})
+}
+
+// getCommentHistoryHandler lists the earlier versions of an edited
+// comment, newest first.
+func getCommentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+	commentID, _ := strconv.Atoi(vars["commentId"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+	if post := visiblePost(w, viewer, postID); post == nil {
+		return
+	}
+
+	comment, err := fetchComment(viewer, postID, commentID)
+	if err == nil && comment.Deleted {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, `{"error":"Failed to fetch comment history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	revisions := []Revision{}
+	err = db.Select(&revisions, `
+		SELECT body, created_at FROM comment_revisions
+		WHERE comment_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, commentID)
+	if err != nil {
+		log.Printf("Error fetching comment history: %v", err)
+		http.Error(w, `{"error":"Failed to fetch comment history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revisions": revisions})
+}
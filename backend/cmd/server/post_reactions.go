@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	reactionsPerPost = 5
+	// Long enough for family and tag-flag sequences
+	reactionMaxRunes = 10
+)
+
+// validEmoji reports whether s is a single emoji: a pictograph followed by
+// any variation selectors, skin tones, joined pictographs and tags, or a
+// flag or keycap sequence.
+func validEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > reactionMaxRunes {
+		return false
+	}
+	runes := []rune(s)
+	last := runes[len(runes)-1]
+
+	if len(runes) == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]) {
+		return true
+	}
+	if last == 0x20E3 {
+		keycap := runes[0] == '#' || runes[0] == '*' || (runes[0] >= '0' && runes[0] <= '9')
+		return keycap && (len(runes) == 2 || (len(runes) == 3 && runes[1] == 0xFE0F))
+	}
+
+	if !unicode.Is(unicode.So, runes[0]) {
+		return false
+	}
+	for i, r := range runes[1:] {
+		previous := runes[i]
+		switch {
+		case r == 0xFE0F, r == 0x200D:
+		case r >= 0x1F3FB && r <= 0x1F3FF:
+		case r >= 0xE0020 && r <= 0xE007F:
+		case previous == 0x200D && unicode.Is(unicode.So, r):
+		default:
+			return false
+		}
+	}
+	return last != 0x200D
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// addReactionHandler reacts to a post with an emoji. Reacting again with
+// the same emoji does nothing; each user has a few distinct reactions per
+// post.
+func addReactionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+	emoji := vars["emoji"]
+
+	if !validEmoji(emoji) {
+		http.Error(w, `{"error":"Reactions must be a single emoji"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	post := visiblePost(w, userID, postID)
+	if post == nil {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error adding reaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO post_reactions (post_id, user_id, emoji)
+		SELECT $1, $2, $3
+		WHERE (SELECT COUNT(*) FROM post_reactions WHERE post_id = $1 AND user_id = $2) < $4
+		ON CONFLICT DO NOTHING
+	`, postID, userID, emoji, reactionsPerPost)
+	if err != nil {
+		log.Printf("Error adding reaction: %v", err)
+		http.Error(w, `{"error":"Error adding reaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var reacted bool
+		err := tx.Get(&reacted, `
+			SELECT EXISTS (SELECT 1 FROM post_reactions WHERE post_id = $1 AND user_id = $2 AND emoji = $3)
+		`, postID, userID, emoji)
+		if err != nil {
+			http.Error(w, `{"error":"Error adding reaction"}`, http.StatusInternalServerError)
+			return
+		}
+		if !reacted {
+			http.Error(w, fmt.Sprintf(`{"error":"You can react to a post with at most %d emoji"}`, reactionsPerPost), http.StatusConflict)
+			return
+		}
+	} else if post.AuthorID != userID {
+		if err := emitNotificationAbout(tx, post.AuthorID, userID, NotificationPostReaction, postID); err != nil {
+			log.Printf("Error creating notification: %v", err)
+			http.Error(w, `{"error":"Error adding reaction"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error adding reaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if post := visiblePost(w, userID, postID); post != nil {
+		writePost(w, post, http.StatusOK)
+	}
+}
+
+func removeReactionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	vars := mux.Vars(r)
+	postID, _ := strconv.Atoi(vars["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM post_reactions WHERE post_id = $1 AND user_id = $2 AND emoji = $3
+	`, postID, userID, vars["emoji"])
+	if err != nil {
+		log.Printf("Error removing reaction: %v", err)
+		http.Error(w, `{"error":"Error removing reaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if post := visiblePost(w, userID, postID); post != nil {
+		writePost(w, post, http.StatusOK)
+	}
+}
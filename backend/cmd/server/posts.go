@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Post audiences
+const (
+	PostAudiencePublic    = "public"
+	PostAudienceFollowers = "followers"
+	PostAudienceParty     = "party"
+)
+
+const (
+	postMaxLength             = 500
+	postMaxAttachments        = 4
+	postMaxPendingAttachments = 20
+	postDefaultLimit          = 20
+	postMaxLimit              = 50
+	postCursorSort            = "posts"
+	attachmentSweepInterval   = time.Hour
+	// Attachments uploaded but never posted are dropped after a day
+	attachmentRetention = 24 * time.Hour
+)
+
+// postImage variants keep the whole picture rather than cropping it.
+var postImage = imageKind{
+	Name: "posts",
+	Variants: []imageVariant{
+		{Name: "640", Width: 640, Height: 640, Fit: true},
+		{Name: "1280", Width: 1280, Height: 1280, Fit: true},
+	},
+}
+
+// PostAttachment is an image uploaded for a post. Width and Height are
+// those of the largest variant, for laying out before it loads.
+type PostAttachment struct {
+	ID     int               `json:"id" db:"id"`
+	PostID *int              `json:"-" db:"post_id"`
+	Hash   string            `json:"-" db:"hash"`
+	Width  int               `json:"width" db:"width"`
+	Height int               `json:"height" db:"height"`
+	URLs   map[string]string `json:"urls" db:"-"`
+}
+
+// ReactionCount is how many people reacted to a post with an emoji, and
+// whether the viewer is one of them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji" db:"emoji"`
+	Count   int    `json:"count" db:"count"`
+	Reacted bool   `json:"reacted" db:"reacted"`
+}
+
+type Post struct {
+	ID           int               `json:"id" db:"id"`
+	AuthorID     int               `json:"-" db:"author_id"`
+	Author       string            `json:"author" db:"author"`
+	Body         string            `json:"body" db:"body"`
+	Audience     string            `json:"audience" db:"audience"`
+	PartyID      *int              `json:"partyId,omitempty" db:"party_id"`
+	Attachments  []*PostAttachment `json:"attachments" db:"-"`
+	Reactions    []*ReactionCount  `json:"reactions" db:"-"`
+	CommentCount int               `json:"commentCount" db:"comment_count"`
+	CreatedAt    time.Time         `json:"createdAt" db:"created_at"`
+	EditedAt     *time.Time        `json:"editedAt,omitempty" db:"edited_at"`
+}
+
+// Revision is an earlier version of an edited post or comment, with when
+// it was written.
+type Revision struct {
+	Body      string    `json:"body" db:"body"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+const postColumns = `p.id, p.author_id, u.username AS author, p.body, p.audience, p.party_id,
+	(SELECT COUNT(*) FROM post_comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) AS comment_count,
+	p.created_at, p.edited_at`
+
+// postVisibleSQL keeps posts p by authors u that the viewer bound to
+// viewerArg may see: their own, and otherwise posts of unblocked authors
+// whose audience includes them. Public posts of private accounts are only
+// for their followers, and party posts stay visible to everyone who was in
+// the party after it breaks up.
+func postVisibleSQL(viewerArg string) string {
+	return fmt.Sprintf(`(p.author_id = %[1]s OR (%[2]s AND CASE p.audience
+		WHEN 'public' THEN %[3]s
+		WHEN 'followers' THEN EXISTS (
+			SELECT 1 FROM followers f WHERE f.follower_id = %[1]s AND f.following_id = p.author_id
+		)
+		WHEN 'party' THEN EXISTS (
+			SELECT 1 FROM party_members pm WHERE pm.party_id = p.party_id AND pm.user_id = %[1]s
+		)
+		ELSE false END))`, viewerArg, notBlockedSQL(viewerArg), visibleToViewerSQL(viewerArg))
+}
+
+// attachPostDetails loads the attachments and reaction counts of posts.
+func attachPostDetails(viewer int, posts []*Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	ids := make([]int, len(posts))
+	byID := make(map[int]*Post, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+		byID[post.ID] = post
+		post.Attachments = []*PostAttachment{}
+		post.Reactions = []*ReactionCount{}
+	}
+
+	var attachments []*PostAttachment
+	err := db.Select(&attachments, `
+		SELECT id, post_id, hash, width, height FROM post_attachments
+		WHERE post_id = ANY($1)
+		ORDER BY position
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		attachment.URLs = postImage.imageURLs(&attachment.Hash)
+		post := byID[*attachment.PostID]
+		post.Attachments = append(post.Attachments, attachment)
+	}
+
+	var reactions []struct {
+		PostID int `db:"post_id"`
+		ReactionCount
+	}
+	err = db.Select(&reactions, `
+		SELECT post_id, emoji, COUNT(*) AS count, bool_or(user_id = $2) AS reacted
+		FROM post_reactions
+		WHERE post_id = ANY($1)
+		GROUP BY post_id, emoji
+		ORDER BY post_id, COUNT(*) DESC, MIN(created_at)
+	`, pq.Array(ids), viewer)
+	if err != nil {
+		return err
+	}
+	for _, reaction := range reactions {
+		count := reaction.ReactionCount
+		post := byID[reaction.PostID]
+		post.Reactions = append(post.Reactions, &count)
+	}
+	return nil
+}
+
+// fetchPosts loads the posts among ids that the viewer may see, by ID.
+func fetchPosts(viewer int, ids []int) (map[int]*Post, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var posts []*Post
+	err := db.Select(&posts, `
+		SELECT `+postColumns+`
+		FROM posts p
+		JOIN users u ON u.id = p.author_id
+		WHERE p.id = ANY($1) AND `+postVisibleSQL("$2"),
+		pq.Array(ids), viewer)
+	if err != nil {
+		return nil, err
+	}
+	if err := attachPostDetails(viewer, posts); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*Post, len(posts))
+	for _, post := range posts {
+		byID[post.ID] = post
+	}
+	return byID, nil
+}
+
+// visiblePost fetches a post the viewer may see, writing the error
+// response and returning nil if there's no such post.
+func visiblePost(w http.ResponseWriter, viewer, postID int) *Post {
+	posts, err := fetchPosts(viewer, []int{postID})
+	if err != nil {
+		log.Printf("Error fetching post: %v", err)
+		http.Error(w, `{"error":"Failed to fetch post"}`, http.StatusInternalServerError)
+		return nil
+	}
+	post := posts[postID]
+	if post == nil {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+	}
+	return post
+}
+
+func writePost(w http.ResponseWriter, post *Post, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(post)
+}
+
+// validPostBody trims a post or comment body, returning an error to show
+// against the field if it's too long or has control characters.
+func validPostBody(body string) (string, string) {
+	body = strings.TrimSpace(body)
+	if utf8.RuneCountInString(body) > postMaxLength {
+		return body, fmt.Sprintf("must be at most %d characters", postMaxLength)
+	}
+	if hasControlChars(body, true) {
+		return body, "must not contain control characters"
+	}
+	return body, ""
+}
+
+// uploadPostAttachmentHandler stores an image for a post the user is about
+// to write. The returned ID is passed as one of the post's attachmentIds.
+func uploadPostAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var pending int
+	err = db.Get(&pending, `
+		SELECT COUNT(*) FROM post_attachments WHERE owner_id = $1 AND post_id IS NULL
+	`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error storing image"}`, http.StatusInternalServerError)
+		return
+	}
+	if pending >= postMaxPendingAttachments {
+		http.Error(w, `{"error":"You have too many images waiting to be posted"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	data, ok := readImageUpload(w, r)
+	if !ok {
+		return
+	}
+	variants, ok := processUpload(w, data, postImage.Variants)
+	if !ok {
+		return
+	}
+	largest := postImage.Variants[len(postImage.Variants)-1].Name
+	config, err := jpeg.DecodeConfig(bytes.NewReader(variants[largest]))
+	if err != nil {
+		log.Printf("Error reading processed image: %v", err)
+		http.Error(w, `{"error":"Error storing image"}`, http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	for name, variant := range variants {
+		if err := blobStore.Put(r.Context(), mediaKey(postImage.Name, hash, name), variant, "image/jpeg"); err != nil {
+			log.Printf("Error storing image: %v", err)
+			http.Error(w, `{"error":"Error storing image"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var attachment PostAttachment
+	err = db.Get(&attachment, `
+		INSERT INTO post_attachments (owner_id, hash, width, height)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, post_id, hash, width, height
+	`, userID, hash, config.Width, config.Height)
+	if err != nil {
+		log.Printf("Error saving attachment: %v", err)
+		http.Error(w, `{"error":"Error storing image"}`, http.StatusInternalServerError)
+		return
+	}
+	attachment.URLs = postImage.imageURLs(&attachment.Hash)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// createPostHandler publishes a post to its audience and the timelines of
+// the author's followers.
+func createPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Body          string `json:"body"`
+		Audience      string `json:"audience"`
+		PartyID       *int   `json:"partyId"`
+		AttachmentIDs []int  `json:"attachmentIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Audience == "" {
+		req.Audience = PostAudiencePublic
+	}
+
+	fieldErrors := map[string]string{}
+	body, bodyErr := validPostBody(req.Body)
+	if bodyErr != "" {
+		fieldErrors["body"] = bodyErr
+	} else if body == "" && len(req.AttachmentIDs) == 0 {
+		fieldErrors["body"] = "is required unless the post has attachments"
+	}
+	switch req.Audience {
+	case PostAudiencePublic, PostAudienceFollowers:
+		if req.PartyID != nil {
+			fieldErrors["partyId"] = "is only allowed for party posts"
+		}
+	case PostAudienceParty:
+		if req.PartyID == nil {
+			fieldErrors["partyId"] = "is required for party posts"
+		}
+	default:
+		fieldErrors["audience"] = "must be public, followers or party"
+	}
+	seen := map[int]bool{}
+	for _, id := range req.AttachmentIDs {
+		if seen[id] {
+			fieldErrors["attachmentIds"] = "must not repeat an attachment"
+		}
+		seen[id] = true
+	}
+	if len(req.AttachmentIDs) > postMaxAttachments {
+		fieldErrors["attachmentIds"] = fmt.Sprintf("must have at most %d attachments", postMaxAttachments)
+	}
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid post",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Audience == PostAudienceParty {
+		var member bool
+		err := tx.Get(&member, `
+			SELECT EXISTS (
+				SELECT 1 FROM party_members pm
+				JOIN parties p ON p.id = pm.party_id
+				WHERE pm.party_id = $1 AND pm.user_id = $2
+				AND pm.left_at IS NULL AND p.disbanded_at IS NULL
+			)
+		`, *req.PartyID, userID)
+		if err != nil {
+			http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, `{"error":"You can only post to a party you're in"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	var postID int
+	err = tx.Get(&postID, `
+		INSERT INTO posts (author_id, body, audience, party_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, body, req.Audience, req.PartyID)
+	if err != nil {
+		log.Printf("Error creating post: %v", err)
+		http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if len(req.AttachmentIDs) > 0 {
+		// Attachments keep the order they were listed in
+		result, err := tx.Exec(`
+			UPDATE post_attachments SET post_id = $1, position = array_position($3::int[], id)
+			WHERE id = ANY($3) AND owner_id = $2 AND post_id IS NULL
+		`, postID, userID, pq.Array(req.AttachmentIDs))
+		if err != nil {
+			log.Printf("Error attaching images: %v", err)
+			http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+			return
+		}
+		if rows, _ := result.RowsAffected(); int(rows) != len(req.AttachmentIDs) {
+			http.Error(w, `{"error":"Attachments must be your own images that haven't been posted yet"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := recordActivity(tx, userID, ActivityPosted, nil, postID, ""); err != nil {
+		log.Printf("Error recording activity: %v", err)
+		http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if post := visiblePost(w, userID, postID); post != nil {
+		writePost(w, post, http.StatusCreated)
+	}
+}
+
+func getPostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	if post := visiblePost(w, viewer, postID); post != nil {
+		writePost(w, post, http.StatusOK)
+	}
+}
+
+// getUserPostsHandler lists the posts of a user the viewer may see, newest
+// first.
+func getUserPostsHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	query := r.URL.Query()
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	limit := postDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > postMaxLimit {
+			limit = postMaxLimit
+		}
+	}
+
+	args := []interface{}{username, viewer}
+	cursorCondition := "true"
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != postCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		args = append(args, cursor.Value, cursor.ID)
+		cursorCondition = "(p.created_at, p.id) < ($3::timestamp, $4)"
+	}
+
+	var posts []*Post
+	err = db.Select(&posts, fmt.Sprintf(`
+		SELECT %s
+		FROM posts p
+		JOIN users u ON u.id = p.author_id
+		WHERE u.username = $1 AND %s AND %s
+		ORDER BY p.created_at DESC, p.id DESC
+		LIMIT %d
+	`, postColumns, postVisibleSQL("$2"), cursorCondition, limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching posts: %v", err)
+		http.Error(w, `{"error":"Failed to fetch posts"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if len(posts) > limit {
+		posts = posts[:limit]
+		last := posts[limit-1]
+		response["nextCursor"] = encodeCursor(pageCursor{
+			Sort:  postCursorSort,
+			Value: last.CreatedAt.Format(cursorTimeValue),
+			ID:    last.ID,
+		})
+	}
+	if err := attachPostDetails(viewer, posts); err != nil {
+		log.Printf("Error fetching post details: %v", err)
+		http.Error(w, `{"error":"Failed to fetch posts"}`, http.StatusInternalServerError)
+		return
+	}
+	if posts == nil {
+		posts = []*Post{}
+	}
+	response["posts"] = posts
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// updatePostHandler edits a post's text, keeping the text it replaces in
+// the post's history. Attachments and audience are fixed once posted.
+func updatePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error editing post"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current struct {
+		Body           string `db:"body"`
+		HasAttachments bool   `db:"has_attachments"`
+	}
+	err = tx.Get(&current, `
+		SELECT p.body, EXISTS (SELECT 1 FROM post_attachments a WHERE a.post_id = p.id) AS has_attachments
+		FROM posts p
+		WHERE p.id = $1 AND p.author_id = $2
+		FOR UPDATE
+	`, postID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching post: %v", err)
+		http.Error(w, `{"error":"Error editing post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	body, bodyErr := validPostBody(req.Body)
+	if bodyErr == "" && body == "" && !current.HasAttachments {
+		bodyErr = "is required unless the post has attachments"
+	}
+	if bodyErr != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid post",
+			"fields": map[string]string{"body": bodyErr},
+		})
+		return
+	}
+
+	if body != current.Body {
+		_, err = tx.Exec(`
+			INSERT INTO post_revisions (post_id, body, created_at)
+			SELECT id, body, COALESCE(edited_at, created_at) FROM posts WHERE id = $1
+		`, postID)
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE posts SET body = $2, edited_at = CURRENT_TIMESTAMP WHERE id = $1
+			`, postID, body)
+		}
+		if err != nil {
+			log.Printf("Error editing post: %v", err)
+			http.Error(w, `{"error":"Error editing post"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error editing post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if post := visiblePost(w, userID, postID); post != nil {
+		writePost(w, post, http.StatusOK)
+	}
+}
+
+// deletePostHandler removes a post along with its images, comments and
+// reactions, and takes it out of timelines and notifications.
+func deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var hashes []string
+	err = tx.Select(&hashes, `
+		SELECT a.hash FROM post_attachments a
+		JOIN posts p ON p.id = a.post_id
+		WHERE p.id = $1 AND p.author_id = $2
+	`, postID, userID)
+	if err != nil {
+		log.Printf("Error fetching attachments: %v", err)
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(`DELETE FROM posts WHERE id = $1 AND author_id = $2`, postID, userID)
+	if err != nil {
+		log.Printf("Error deleting post: %v", err)
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM activities WHERE verb = $1 AND subject_id = $2
+	`, ActivityPosted, postID)
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM notifications WHERE subject_id = $1 AND type = ANY($2)
+		`, postID, pq.Array(postNotificationTypes))
+	}
+	if err != nil {
+		log.Printf("Error cleaning up after post: %v", err)
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	deleteUnusedPostImages(r.Context(), hashes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Post deleted"})
+}
+
+// getPostHistoryHandler lists the earlier versions of an edited post,
+// newest first.
+func getPostHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+	if post := visiblePost(w, viewer, postID); post == nil {
+		return
+	}
+
+	revisions := []Revision{}
+	err = db.Select(&revisions, `
+		SELECT body, created_at FROM post_revisions
+		WHERE post_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, postID)
+	if err != nil {
+		log.Printf("Error fetching post history: %v", err)
+		http.Error(w, `{"error":"Failed to fetch post history"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revisions": revisions})
+}
+
+// deleteUnusedPostImages removes the stored images of deleted attachments,
+// unless another attachment was the same picture.
+func deleteUnusedPostImages(ctx context.Context, hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+	var inUse []string
+	err := db.Select(&inUse, `
+		SELECT DISTINCT hash FROM post_attachments WHERE hash = ANY($1)
+	`, pq.Array(hashes))
+	if err != nil {
+		log.Printf("Error checking attachment images: %v", err)
+		return
+	}
+	keep := map[string]bool{}
+	for _, hash := range inUse {
+		keep[hash] = true
+	}
+	for _, hash := range hashes {
+		if !keep[hash] {
+			keep[hash] = true
+			postImage.deleteImage(ctx, hash)
+		}
+	}
+}
+
+// expireAttachments drops images that were uploaded but never posted.
+func expireAttachments() (int, error) {
+	var hashes []string
+	err := db.Select(&hashes, `
+		DELETE FROM post_attachments
+		WHERE post_id IS NULL AND created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		RETURNING hash
+	`, attachmentRetention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	deleteUnusedPostImages(context.Background(), hashes)
+	return len(hashes), nil
+}
+
+func runAttachmentSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := expireAttachments()
+		if err != nil {
+			log.Printf("Error expiring attachments: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d unposted attachments", expired)
+		}
+	}
+}
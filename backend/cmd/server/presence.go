@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Presence statuses. A user is online while any of their gateway sockets is
+// active, idle while all of them are idle, and offline otherwise.
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+// Who can see a user's presence: all their followers, or only followers
+// they follow back
+const (
+	PresenceVisibleFollowers = "followers"
+	PresenceVisibleMutuals   = "mutuals"
+)
+
+const (
+	presenceSweepInterval = 30 * time.Second
+	// Connections whose instance stops refreshing them are considered gone
+	// after this long, so a crashed instance doesn't leave people online
+	presenceStaleAfter = 2 * time.Minute
+)
+
+// Presence is what a user's followers see of them. Game is set while they
+// say they're playing something, and LobbyJoinable while friends can jump
+// in.
+type Presence struct {
+	Username      string     `json:"username" db:"username"`
+	Status        string     `json:"status" db:"status"`
+	LastSeenAt    *time.Time `json:"lastSeenAt,omitempty" db:"last_seen_at"`
+	Game          *string    `json:"game,omitempty" db:"playing_game"`
+	LobbyJoinable bool       `json:"lobbyJoinable" db:"lobby_joinable"`
+	PlayingSince  *time.Time `json:"playingSince,omitempty" db:"playing_since"`
+}
+
+// presenceColumns selects a Presence for users u.
+const presenceColumns = `
+	u.username, COALESCE(p.status, 'offline') AS status, p.last_seen_at,
+	p.playing_game, COALESCE(p.lobby_joinable, false) AS lobby_joinable, p.playing_since`
+
+const presenceFrom = `
+	FROM users u
+	LEFT JOIN user_presence p ON p.user_id = u.id`
+
+// presenceVisibleSQL restricts users u to those whose presence the viewer
+// bound to viewerArg may see.
+func presenceVisibleSQL(viewerArg string) string {
+	return fmt.Sprintf(`(u.id = %[1]s OR (
+		EXISTS (SELECT 1 FROM followers f WHERE f.follower_id = %[1]s AND f.following_id = u.id)
+		AND (u.presence_visibility = 'followers' OR EXISTS (
+			SELECT 1 FROM followers f WHERE f.follower_id = u.id AND f.following_id = %[1]s
+		))
+	))`, viewerArg) + " AND " + notBlockedSQL(viewerArg)
+}
+
+// presenceAudienceSQL selects the IDs of followers u who may see the
+// presence of the user bound to $1.
+var presenceAudienceSQL = `
+	SELECT u.id FROM followers f
+	JOIN users u ON u.id = f.follower_id
+	JOIN users me ON me.id = $1
+	WHERE f.following_id = $1
+	AND (me.presence_visibility = 'followers' OR EXISTS (
+		SELECT 1 FROM followers back WHERE back.follower_id = $1 AND back.following_id = u.id
+	))
+	AND ` + notBlockedSQL("$1")
+
+// presenceTracker holds the presence connections open on this instance,
+// which it keeps fresh.
+type presenceTracker struct {
+	mu    sync.Mutex
+	conns map[int]bool
+}
+
+var presenceConns = &presenceTracker{conns: map[int]bool{}}
+
+func (pt *presenceTracker) ids() []int {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	ids := make([]int, 0, len(pt.conns))
+	for id := range pt.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// presenceConnect records a new gateway socket for userID and returns its
+// connection ID.
+func presenceConnect(userID int) (int, error) {
+	var connID int
+	err := db.QueryRow(`
+		INSERT INTO presence_connections (user_id) VALUES ($1) RETURNING id
+	`, userID).Scan(&connID)
+	if err != nil {
+		return 0, err
+	}
+
+	presenceConns.mu.Lock()
+	presenceConns.conns[connID] = true
+	presenceConns.mu.Unlock()
+
+	return connID, refreshPresence(userID)
+}
+
+func presenceDisconnect(connID, userID int) {
+	presenceConns.mu.Lock()
+	delete(presenceConns.conns, connID)
+	presenceConns.mu.Unlock()
+
+	if _, err := db.Exec(`DELETE FROM presence_connections WHERE id = $1`, connID); err != nil {
+		log.Printf("Error removing presence connection: %v", err)
+		return
+	}
+	if err := refreshPresence(userID); err != nil {
+		log.Printf("Error updating presence: %v", err)
+	}
+}
+
+// setPresenceIdle marks one of the user's sockets idle or active again.
+func setPresenceIdle(connID, userID int, idle bool) error {
+	_, err := db.Exec(`
+		UPDATE presence_connections SET idle = $2, heartbeat_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, connID, idle)
+	if err != nil {
+		return err
+	}
+	return refreshPresence(userID)
+}
+
+// refreshPresence works out userID's status from their live connections
+// and, if it changed, tells whoever can see it. Going offline ends any
+// playing status.
+func refreshPresence(userID int) error {
+	var status string
+	err := db.QueryRow(`
+		INSERT INTO user_presence (user_id, status, last_seen_at)
+		SELECT $1,
+			CASE WHEN COUNT(*) = 0 THEN 'offline' WHEN bool_and(idle) THEN 'idle' ELSE 'online' END,
+			CURRENT_TIMESTAMP
+		FROM presence_connections
+		WHERE user_id = $1 AND heartbeat_at > CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+		ON CONFLICT (user_id) DO UPDATE
+		SET status = EXCLUDED.status, last_seen_at = CURRENT_TIMESTAMP,
+			playing_game = CASE WHEN EXCLUDED.status = 'offline' THEN NULL ELSE user_presence.playing_game END,
+			lobby_joinable = EXCLUDED.status <> 'offline' AND user_presence.lobby_joinable,
+			playing_since = CASE WHEN EXCLUDED.status = 'offline' THEN NULL ELSE user_presence.playing_since END
+		WHERE user_presence.status <> EXCLUDED.status
+		RETURNING status
+	`, userID, presenceStaleAfter.Seconds()).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return publishPresence(userID)
+}
+
+// publishPresence pushes userID's presence to the followers who can see it
+// and to the user's own sockets.
+func publishPresence(userID int) error {
+	var presence Presence
+	err := db.Get(&presence, `SELECT `+presenceColumns+presenceFrom+` WHERE u.id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	var audience []int
+	err = db.Select(&audience, `SELECT $1::int UNION `+presenceAudienceSQL, userID)
+	if err != nil {
+		return err
+	}
+
+	gateway.Publish(audience, GatewayEventPresence, presence)
+	return nil
+}
+
+// sweepPresence keeps this instance's connections fresh and clears out
+// those nobody is keeping fresh any more.
+func sweepPresence() error {
+	if ids := presenceConns.ids(); len(ids) > 0 {
+		_, err := db.Exec(`
+			UPDATE presence_connections SET heartbeat_at = CURRENT_TIMESTAMP WHERE id = ANY($1)
+		`, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+	}
+
+	var userIDs []int
+	err := db.Select(&userIDs, `
+		WITH stale AS (
+			DELETE FROM presence_connections
+			WHERE heartbeat_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+			RETURNING user_id
+		)
+		SELECT DISTINCT user_id FROM stale
+	`, presenceStaleAfter.Seconds())
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := refreshPresence(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPresenceSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sweepPresence(); err != nil {
+			log.Printf("Error sweeping presence: %v", err)
+		}
+	}
+}
+
+// getFriendsPresenceHandler lists the people the user follows who are
+// online or idle and let the user see it, those playing something first.
+func getFriendsPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	friends := []Presence{}
+	err = db.Select(&friends, `
+		SELECT `+presenceColumns+presenceFrom+`
+		JOIN followers following ON following.following_id = u.id AND following.follower_id = $1
+		WHERE p.status IN ('online', 'idle') AND `+presenceVisibleSQL("$1")+`
+		ORDER BY p.playing_game IS NULL, p.status = 'idle', u.username
+	`, userID)
+	if err != nil {
+		log.Printf("Error fetching presence: %v", err)
+		http.Error(w, `{"error":"Failed to fetch presence"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(friends)
+}
+
+// getUserPresenceHandler returns one user's presence, as long as the viewer
+// may see it.
+func getUserPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var presence Presence
+	err = db.Get(&presence, `
+		SELECT `+presenceColumns+presenceFrom+`
+		WHERE u.username = $2 AND `+presenceVisibleSQL("$1"),
+		userID, mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Presence not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching presence: %v", err)
+		http.Error(w, `{"error":"Failed to fetch presence"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presence)
+}
+
+// setPlayingHandler sets what the user is playing.
+func setPlayingHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Game          string `json:"game"`
+		LobbyJoinable bool   `json:"lobbyJoinable"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	game, ok := catalogGame(req.Game)
+	if !ok {
+		http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Switching lobbies in the same game doesn't restart the clock
+	var started bool
+	err = db.QueryRow(`
+		WITH previous AS (SELECT playing_game FROM user_presence WHERE user_id = $1)
+		INSERT INTO user_presence (user_id, playing_game, lobby_joinable, playing_since)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE
+		SET playing_game = $2, lobby_joinable = $3,
+			playing_since = CASE
+				WHEN user_presence.playing_game = $2 THEN user_presence.playing_since
+				ELSE CURRENT_TIMESTAMP
+			END
+		RETURNING (SELECT playing_game FROM previous) IS DISTINCT FROM $2
+	`, userID, game, req.LobbyJoinable).Scan(&started)
+	if err != nil {
+		log.Printf("Error setting playing status: %v", err)
+		http.Error(w, `{"error":"Error setting playing status"}`, http.StatusInternalServerError)
+		return
+	}
+	if started {
+		if err := recordActivity(db, userID, ActivityWentLive, nil, nil, game); err != nil {
+			log.Printf("Error recording activity: %v", err)
+		}
+		go pushFriendLive(userID, claims.Username, game, req.LobbyJoinable)
+	}
+
+	writePresence(w, userID)
+}
+
+func clearPlayingHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`
+		UPDATE user_presence SET playing_game = NULL, lobby_joinable = false, playing_since = NULL
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		log.Printf("Error clearing playing status: %v", err)
+		http.Error(w, `{"error":"Error clearing playing status"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writePresence(w, userID)
+}
+
+// writePresence tells the user's audience about a change they made and
+// returns their presence.
+func writePresence(w http.ResponseWriter, userID int) {
+	if err := publishPresence(userID); err != nil {
+		log.Printf("Error publishing presence: %v", err)
+	}
+
+	var presence Presence
+	err := db.Get(&presence, `SELECT `+presenceColumns+presenceFrom+` WHERE u.id = $1`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to fetch presence"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presence)
+}
+
+// updatePresenceSettingsHandler chooses who can see the user's presence.
+func updatePresenceSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Visibility != PresenceVisibleFollowers && req.Visibility != PresenceVisibleMutuals {
+		http.Error(w, `{"error":"visibility must be followers or mutuals"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`
+		UPDATE users SET presence_visibility = $2 WHERE username = $1
+	`, claims.Username, req.Visibility)
+	if err != nil {
+		log.Printf("Error updating presence settings: %v", err)
+		http.Error(w, `{"error":"Error updating presence settings"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"visibility": req.Visibility})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 280
+	maxPronounsLength    = 32
+	maxRegionLength      = 64
+	maxHandleLength      = 255
+	maxLanguages         = 10
+)
+
+var (
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownHTMLTag    = regexp.MustCompile(`<[^>]*>`)
+	markdownLinePrefix = regexp.MustCompile(`(?m)^[ \t]*(#{1,6}[ \t]+|>+[ \t]?|[-*+][ \t]+|\d+\.[ \t]+)`)
+	markdownRule       = regexp.MustCompile(`(?m)^[ \t]*([-*_][ \t]*){3,}$`)
+	markdownEmphasis   = regexp.MustCompile("(\\*{1,3}|~~|`+)")
+	markdownUnderline  = regexp.MustCompile(`(^|\W)_{1,3}([^_\n]+?)_{1,3}(\W|$)`)
+	blankLines         = regexp.MustCompile(`\n{3,}`)
+	countryCode        = regexp.MustCompile(`^[A-Z]{2}$`)
+	languageCode       = regexp.MustCompile(`^[a-z]{2,3}$`)
+)
+
+// stripMarkdown reduces markdown to the plain text a reader would see.
+func stripMarkdown(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = markdownImage.ReplaceAllString(s, "$1")
+	s = markdownLink.ReplaceAllString(s, "$1")
+	s = markdownHTMLTag.ReplaceAllString(s, "")
+	s = markdownRule.ReplaceAllString(s, "")
+	s = markdownLinePrefix.ReplaceAllString(s, "")
+	s = markdownEmphasis.ReplaceAllString(s, "")
+	s = markdownUnderline.ReplaceAllString(s, "$1$2$3")
+	s = blankLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+// hasControlChars reports whether s contains control characters, optionally
+// allowing newlines.
+func hasControlChars(s string, allowNewlines bool) bool {
+	for _, r := range s {
+		if r == '\n' && allowNewlines {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// profileField validates one PATCH /profile field. It returns the value to
+// store, where nil clears the column.
+type profileField struct {
+	column   string
+	validate func(raw json.RawMessage) (interface{}, error)
+}
+
+// textField accepts a string of at most maxLength characters. Multiline
+// fields may hold markdown, which is stripped before the length check. Empty
+// strings and null both clear the field.
+func textField(maxLength int, multiline bool) func(json.RawMessage) (interface{}, error) {
+	return func(raw json.RawMessage) (interface{}, error) {
+		var value *string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if value == nil {
+			return nil, nil
+		}
+
+		s := strings.TrimSpace(*value)
+		if multiline {
+			s = stripMarkdown(s)
+		}
+		if s == "" {
+			return nil, nil
+		}
+		if hasControlChars(s, multiline) {
+			return nil, fmt.Errorf("must not contain control characters")
+		}
+		if utf8.RuneCountInString(s) > maxLength {
+			return nil, fmt.Errorf("must be at most %d characters", maxLength)
+		}
+		return s, nil
+	}
+}
+
+func validateCountry(raw json.RawMessage) (interface{}, error) {
+	var value *string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("must be a string")
+	}
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return nil, nil
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(*value))
+	if !countryCode.MatchString(code) {
+		return nil, fmt.Errorf("must be an ISO 3166-1 alpha-2 country code")
+	}
+	return code, nil
+}
+
+func validateLanguages(raw json.RawMessage) (interface{}, error) {
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, fmt.Errorf("must be a list of language codes")
+	}
+
+	seen := map[string]bool{}
+	languages := StringArray{}
+	for _, value := range values {
+		code := strings.ToLower(strings.TrimSpace(value))
+		if !languageCode.MatchString(code) {
+			return nil, fmt.Errorf("%q is not an ISO 639 language code", value)
+		}
+		if !seen[code] {
+			seen[code] = true
+			languages = append(languages, code)
+		}
+	}
+	if len(languages) > maxLanguages {
+		return nil, fmt.Errorf("must list at most %d languages", maxLanguages)
+	}
+	return languages, nil
+}
+
+func validateTimezone(raw json.RawMessage) (interface{}, error) {
+	var value *string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("must be a string")
+	}
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return nil, nil
+	}
+
+	name := strings.TrimSpace(*value)
+	// LoadLocation also accepts "Local", which means nothing to other users
+	if name == "Local" {
+		return nil, fmt.Errorf("must be an IANA time zone name")
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return nil, fmt.Errorf("must be an IANA time zone name")
+	}
+	return name, nil
+}
+
+var profileFields = map[string]profileField{
+	"displayName":     {"display_name", textField(maxDisplayNameLength, false)},
+	"bio":             {"bio", textField(maxBioLength, true)},
+	"pronouns":        {"pronouns", textField(maxPronounsLength, false)},
+	"country":         {"country", validateCountry},
+	"region":          {"region", textField(maxRegionLength, false)},
+	"languages":       {"languages", validateLanguages},
+	"timezone":        {"timezone", validateTimezone},
+	"twitchUsername":  {"twitch_username", textField(maxHandleLength, false)},
+	"discordUsername": {"discord_username", textField(maxHandleLength, false)},
+	"instagramHandle": {"instagram_handle", textField(maxHandleLength, false)},
+	"youtubeChannel":  {"youtube_channel", textField(maxHandleLength, false)},
+}
+
+// patchProfileHandler updates only the fields present in the request body.
+// A null value clears a field.
+func patchProfileHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Apply fields in a stable order so the generated SQL is deterministic
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var assignments []string
+	var args []interface{}
+	fieldErrors := map[string]string{}
+	for _, name := range names {
+		field, ok := profileFields[name]
+		if !ok {
+			fieldErrors[name] = "unknown field"
+			continue
+		}
+
+		value, err := field.validate(patch[name])
+		if err != nil {
+			fieldErrors[name] = err.Error()
+			continue
+		}
+
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", field.column, len(args)))
+	}
+
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid profile fields",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	if len(assignments) > 0 {
+		args = append(args, claims.Username)
+		_, err := db.Exec(fmt.Sprintf(
+			"UPDATE users SET %s WHERE username = $%d",
+			strings.Join(assignments, ", "), len(args),
+		), args...)
+		if err != nil {
+			log.Printf("Error updating profile: %v", err)
+			http.Error(w, `{"error":"Error updating profile"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	getProfileHandler(w, r)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more; bigger ones
+	// are stored in pubsub_payloads and the notification carries their ID
+	pgNotifyMaxPayload     = 7900
+	pgSpilledPrefix        = "@"
+	pgSpilledRetention     = 5 * time.Minute
+	pgListenerMinReconnect = 1 * time.Second
+	pgListenerMaxReconnect = 30 * time.Second
+)
+
+// PubSub carries messages between server instances. Every subscriber to a
+// topic receives every message published to it, on any instance, in no
+// particular order. Handlers run on the delivery path and must not block.
+type PubSub interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string, handler func(payload []byte)) error
+	Close() error
+}
+
+// newPubSubFromEnv picks the implementation named by PUBSUB, defaulting to
+// in-process delivery, which only works with a single server instance.
+func newPubSubFromEnv(dbURL string) (PubSub, error) {
+	switch os.Getenv("PUBSUB") {
+	case "", "memory":
+		return NewMemoryPubSub(), nil
+	case "postgres":
+		return NewPostgresPubSub(dbURL), nil
+	default:
+		return nil, fmt.Errorf("unknown PUBSUB %q", os.Getenv("PUBSUB"))
+	}
+}
+
+// MemoryPubSub delivers messages to subscribers in the same process.
+type MemoryPubSub struct {
+	mu       sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{handlers: map[string][]func([]byte){}}
+}
+
+func (ps *MemoryPubSub) Publish(topic string, payload []byte) error {
+	ps.mu.RLock()
+	handlers := ps.handlers[topic]
+	ps.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (ps *MemoryPubSub) Subscribe(topic string, handler func([]byte)) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.handlers[topic] = append(ps.handlers[topic], handler)
+	return nil
+}
+
+func (ps *MemoryPubSub) Close() error {
+	return nil
+}
+
+// PostgresPubSub delivers messages through LISTEN/NOTIFY, so every instance
+// connected to the database sees them, including the one that published.
+// Topics must be valid Postgres identifiers. Messages sent while an
+// instance's listener is reconnecting are lost to it.
+type PostgresPubSub struct {
+	listener *pq.Listener
+
+	mu       sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+func NewPostgresPubSub(dbURL string) *PostgresPubSub {
+	ps := &PostgresPubSub{handlers: map[string][]func([]byte){}}
+	ps.listener = pq.NewListener(dbURL, pgListenerMinReconnect, pgListenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Pub/sub listener: %v", err)
+			}
+		})
+	go ps.run()
+	return ps
+}
+
+func (ps *PostgresPubSub) Publish(topic string, payload []byte) error {
+	message := string(payload)
+	if len(payload) > pgNotifyMaxPayload {
+		var id int
+		err := db.QueryRow(`
+			INSERT INTO pubsub_payloads (payload) VALUES ($1) RETURNING id
+		`, payload).Scan(&id)
+		if err != nil {
+			return err
+		}
+		message = pgSpilledPrefix + strconv.Itoa(id)
+
+		_, err = db.Exec(`
+			DELETE FROM pubsub_payloads
+			WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		`, pgSpilledRetention.Seconds())
+		if err != nil {
+			log.Printf("Error pruning pub/sub payloads: %v", err)
+		}
+	}
+
+	_, err := db.Exec(`SELECT pg_notify($1, $2)`, topic, message)
+	return err
+}
+
+func (ps *PostgresPubSub) Subscribe(topic string, handler func([]byte)) error {
+	ps.mu.Lock()
+	first := len(ps.handlers[topic]) == 0
+	ps.handlers[topic] = append(ps.handlers[topic], handler)
+	ps.mu.Unlock()
+
+	if !first {
+		return nil
+	}
+	return ps.listener.Listen(topic)
+}
+
+func (ps *PostgresPubSub) Close() error {
+	return ps.listener.Close()
+}
+
+func (ps *PostgresPubSub) run() {
+	for notification := range ps.listener.Notify {
+		// A nil notification means the connection was re-established
+		if notification == nil {
+			continue
+		}
+
+		payload := []byte(notification.Extra)
+		if idText, ok := strings.CutPrefix(notification.Extra, pgSpilledPrefix); ok {
+			id, _ := strconv.Atoi(idText)
+			if err := db.QueryRow(`SELECT payload FROM pubsub_payloads WHERE id = $1`, id).Scan(&payload); err != nil {
+				log.Printf("Error loading pub/sub payload %d: %v", id, err)
+				continue
+			}
+		}
+
+		ps.mu.RLock()
+		handlers := ps.handlers[notification.Channel]
+		ps.mu.RUnlock()
+
+		for _, handler := range handlers {
+			handler(payload)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	maxPushSubscriptions   = 10
+	maxPushEndpointLength  = 2048
+	pushFriendLiveTTL      = 15 * time.Minute
+	pushMatchFoundFallback = 30 * time.Second
+)
+
+// quietHoursExempt types are pushed even in quiet hours: a found match is
+// something the user is queued up and waiting for.
+var quietHoursExempt = map[string]bool{
+	NotificationMatchFound: true,
+}
+
+// PushPayload is the JSON a service worker receives.
+type PushPayload struct {
+	Type  string      `json:"type"`
+	Title string      `json:"title"`
+	Body  string      `json:"body,omitempty"`
+	URL   string      `json:"url,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// pushToUsers sends a payload to the devices of every one of userIDs who
+// wants this type of notification pushed and isn't in their quiet hours.
+func pushToUsers(userIDs []int, payload PushPayload, ttl time.Duration, urgency, topic string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	subscriptions, err := loadPushSubscriptions(userIDs, payload.Type, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	webPush.Send(subscriptions, PushMessage{Payload: encoded, TTL: ttl, Urgency: urgency, Topic: topic})
+	return nil
+}
+
+// matchPushDelivery pushes found matches to players' phones as well as
+// delivering every match event to their sockets.
+type matchPushDelivery struct {
+	MatchDelivery
+}
+
+func (d matchPushDelivery) DeliverMatchEvent(userID int, event MatchEvent) {
+	d.MatchDelivery.DeliverMatchEvent(userID, event)
+	if event.Type == MatchEventFound {
+		go pushMatchFound(userID, event)
+	}
+}
+
+// pushMatchFound tells a player their match is ready. The message is only
+// worth delivering until the match has to be accepted.
+func pushMatchFound(userID int, event MatchEvent) {
+	ttl := pushMatchFoundFallback
+	if event.Deadline != nil {
+		ttl = time.Until(*event.Deadline)
+	}
+
+	payload := PushPayload{
+		Type:  NotificationMatchFound,
+		Title: "Match found",
+		Body:  fmt.Sprintf("Your %s match is ready. Accept it before it expires.", event.Game),
+		URL:   "/matchmaking",
+		Data:  event,
+	}
+	if err := pushToUsers([]int{userID}, payload, ttl, PushUrgencyHigh, "match"); err != nil {
+		log.Printf("Error pushing match to user %d: %v", userID, err)
+	}
+}
+
+// pushFriendLive tells the followers who can see userID's presence that
+// they've started playing, unless they've muted them. A newer game replaces
+// one still waiting on a device.
+func pushFriendLive(userID int, username, game string, lobbyJoinable bool) {
+	var followerIDs []int
+	err := db.Select(&followerIDs, presenceAudienceSQL+`
+		AND NOT EXISTS (SELECT 1 FROM user_mutes m WHERE m.muter_id = u.id AND m.muted_id = $1)
+	`, userID)
+	if err != nil {
+		log.Printf("Error finding followers to push to: %v", err)
+		return
+	}
+
+	payload := PushPayload{
+		Type:  NotificationFriendLive,
+		Title: username + " is playing " + game,
+		URL:   "/profile/" + url.PathEscape(username),
+		Data:  map[string]interface{}{"username": username, "game": game, "lobbyJoinable": lobbyJoinable},
+	}
+	if lobbyJoinable {
+		payload.Body = "Their lobby is open. Jump in!"
+	}
+	topic := fmt.Sprintf("live-%d", userID)
+	if err := pushToUsers(followerIDs, payload, pushFriendLiveTTL, PushUrgencyNormal, topic); err != nil {
+		log.Printf("Error pushing live status of user %d: %v", userID, err)
+	}
+}
+
+// getVAPIDPublicKeyHandler returns the key browsers subscribe with.
+func getVAPIDPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"publicKey": b64.EncodeToString(webPush.Keys.Public)})
+}
+
+// registerPushSubscriptionHandler saves a browser's PushSubscription, as
+// serialized by its toJSON(). A subscription registered again, even by
+// another user signing in on the same browser, moves to the current user.
+// Only the most recent few subscriptions per user are kept.
+func registerPushSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if len(req.Endpoint) > maxPushEndpointLength {
+		fieldErrors["endpoint"] = fmt.Sprintf("must be at most %d characters", maxPushEndpointLength)
+	} else if !knownPushService(req.Endpoint) {
+		fieldErrors["endpoint"] = "must be an https URL of a browser push service"
+	}
+	if err := validPushKeys(req.Keys.P256dh, req.Keys.Auth); err != nil {
+		fieldErrors["keys"] = err.Error()
+	}
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid push subscription",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Error saving push subscription"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var subscription PushSubscription
+	err = tx.Get(&subscription, `
+		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint) DO UPDATE
+		SET user_id = $1, p256dh = $3, auth = $4, created_at = CURRENT_TIMESTAMP
+		RETURNING id, user_id, endpoint, p256dh, auth
+	`, userID, req.Endpoint, strings.TrimRight(req.Keys.P256dh, "="), strings.TrimRight(req.Keys.Auth, "="))
+	if err != nil {
+		log.Printf("Error saving push subscription: %v", err)
+		http.Error(w, `{"error":"Error saving push subscription"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM push_subscriptions
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM push_subscriptions WHERE user_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		)
+	`, userID, maxPushSubscriptions)
+	if err != nil {
+		log.Printf("Error trimming push subscriptions: %v", err)
+		http.Error(w, `{"error":"Error saving push subscription"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error saving push subscription"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// deletePushSubscriptionHandler removes a subscription, by endpoint since
+// that is what the browser knows, when the user signs out or turns off
+// push on a device.
+func deletePushSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		http.Error(w, `{"error":"endpoint is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		DELETE FROM push_subscriptions
+		WHERE endpoint = $1 AND user_id = (SELECT id FROM users WHERE username = $2)
+	`, req.Endpoint, claims.Username)
+	if err != nil {
+		log.Printf("Error deleting push subscription: %v", err)
+		http.Error(w, `{"error":"Error deleting push subscription"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Push subscription not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Push subscription deleted"})
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Party session outcomes
+const (
+	OutcomeWin  = "win"
+	OutcomeLoss = "loss"
+	OutcomeDraw = "draw"
+)
+
+const (
+	glickoScale             = 173.7178
+	glickoDefaultRating     = 1500.0
+	glickoDefaultDeviation  = 350.0
+	glickoDefaultVolatility = 0.06
+	// tau limits how fast volatility can move; 0.5 is the middle of the
+	// range Glickman recommends
+	glickoTau     = 0.5
+	glickoEpsilon = 0.000001
+
+	// Deviation grows as if one rating period passed for every
+	// ratingPeriod a player goes without a rated session
+	ratingPeriod = 7 * 24 * time.Hour
+	// Ratings with a deviation above this are still provisional: too
+	// uncertain to drive matchmaking or LFG filters
+	provisionalDeviation = 110.0
+
+	// Members have this long after a party disbands to report on it
+	ratingReportWindow  = 24 * time.Hour
+	ratingSweepInterval = 10 * time.Minute
+	minPeerScore        = 1
+	maxPeerScore        = 5
+)
+
+// GlickoRating is a player's rating in the public (1500-centred) scale.
+type GlickoRating struct {
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+}
+
+// glickoResult is one game against an opponent, with a score between 0
+// (loss) and 1 (win).
+type glickoResult struct {
+	Opponent GlickoRating
+	Score    float64
+}
+
+// decayed returns the rating after periods rating periods without play.
+func (g GlickoRating) decayed(periods float64) GlickoRating {
+	if periods <= 0 {
+		return g
+	}
+	phi := g.Deviation / glickoScale
+	phi = math.Sqrt(phi*phi + periods*g.Volatility*g.Volatility)
+	g.Deviation = math.Min(phi*glickoScale, glickoDefaultDeviation)
+	return g
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func glickoE(mu, muJ, phiJ float64) float64 {
+	return 1 / (1 + math.Exp(-glickoG(phiJ)*(mu-muJ)))
+}
+
+// updateGlicko applies one rating period of results to a player, following
+// Glickman's "Example of the Glicko-2 system".
+func updateGlicko(player GlickoRating, results []glickoResult) GlickoRating {
+	if len(results) == 0 {
+		return player.decayed(1)
+	}
+
+	mu := (player.Rating - glickoDefaultRating) / glickoScale
+	phi := player.Deviation / glickoScale
+	sigma := player.Volatility
+
+	var vInv, deltaSum float64
+	for _, result := range results {
+		muJ := (result.Opponent.Rating - glickoDefaultRating) / glickoScale
+		phiJ := result.Opponent.Deviation / glickoScale
+		g := glickoG(phiJ)
+		e := glickoE(mu, muJ, phiJ)
+		vInv += g * g * e * (1 - e)
+		deltaSum += g * (result.Score - e)
+	}
+	v := 1 / vInv
+	delta := v * deltaSum
+
+	// New volatility by the Illinois algorithm
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		num := ex * (delta*delta - phi*phi - v - ex)
+		den := 2 * (phi*phi + v + ex) * (phi*phi + v + ex)
+		return num/den - (x-a)/(glickoTau*glickoTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	newSigma := math.Exp(A / 2)
+
+	phiStar := math.Sqrt(phi*phi + newSigma*newSigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*deltaSum
+
+	return GlickoRating{
+		Rating:     newMu*glickoScale + glickoDefaultRating,
+		Deviation:  math.Min(newPhi*glickoScale, glickoDefaultDeviation),
+		Volatility: newSigma,
+	}
+}
+
+// storedRating is a player_ratings row.
+type storedRating struct {
+	UserID         int        `db:"user_id"`
+	Game           string     `db:"game"`
+	Rating         float64    `db:"rating"`
+	Deviation      float64    `db:"deviation"`
+	Volatility     float64    `db:"volatility"`
+	SessionsPlayed int        `db:"sessions_played"`
+	RatedAt        *time.Time `db:"rated_at"`
+}
+
+// current returns the rating with deviation decayed for inactivity up to now.
+func (s storedRating) current(now time.Time) GlickoRating {
+	rating := GlickoRating{s.Rating, s.Deviation, s.Volatility}
+	if s.RatedAt == nil {
+		return rating
+	}
+	return rating.decayed(float64(now.Sub(*s.RatedAt)) / float64(ratingPeriod))
+}
+
+// GameRating is a player's rating in one game as shown on profiles.
+type GameRating struct {
+	Game           string `json:"game"`
+	Rating         int    `json:"rating"`
+	Deviation      int    `json:"deviation"`
+	Provisional    bool   `json:"provisional"`
+	SessionsPlayed int    `json:"sessionsPlayed"`
+}
+
+// loadGameRatings returns a user's ratings, most played game first.
+func loadGameRatings(userID int) ([]GameRating, error) {
+	var rows []storedRating
+	err := db.Select(&rows, `
+		SELECT user_id, game, rating, deviation, volatility, sessions_played, rated_at
+		FROM player_ratings
+		WHERE user_id = $1
+		ORDER BY sessions_played DESC, game
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ratings := make([]GameRating, 0, len(rows))
+	for _, row := range rows {
+		current := row.current(now)
+		ratings = append(ratings, GameRating{
+			Game:           row.Game,
+			Rating:         int(math.Round(current.Rating)),
+			Deviation:      int(math.Round(current.Deviation)),
+			Provisional:    current.Deviation > provisionalDeviation,
+			SessionsPlayed: row.SessionsPlayed,
+		})
+	}
+	return ratings, nil
+}
+
+// establishedRating returns a user's rating in a game, or nil while it is
+// still provisional.
+func establishedRating(userID int, game string) (*float64, error) {
+	var row storedRating
+	err := db.Get(&row, `
+		SELECT user_id, game, rating, deviation, volatility, sessions_played, rated_at
+		FROM player_ratings
+		WHERE user_id = $1 AND game = $2
+	`, userID, game)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	current := row.current(time.Now())
+	if current.Deviation > provisionalDeviation {
+		return nil, nil
+	}
+	return &current.Rating, nil
+}
+
+type PartyReportRequest struct {
+	Outcome     string         `json:"outcome"`
+	PeerRatings map[string]int `json:"peerRatings"`
+}
+
+// reportPartySessionHandler records a member's report on a disbanded party:
+// the session outcome and/or 1-5 ratings of their teammates. Reports can be
+// revised until the party's ratings are processed.
+func reportPartySessionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	partyID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req PartyReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.Outcome != "" && req.Outcome != OutcomeWin && req.Outcome != OutcomeLoss && req.Outcome != OutcomeDraw {
+		http.Error(w, `{"error":"Outcome must be win, loss or draw"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Outcome == "" && len(req.PeerRatings) == 0 {
+		http.Error(w, `{"error":"Report an outcome or rate your teammates"}`, http.StatusBadRequest)
+		return
+	}
+
+	reporterID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var disbandedAt sql.NullTime
+	var ratedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT p.disbanded_at, p.rated_at
+		FROM parties p
+		JOIN party_members pm ON pm.party_id = p.id
+		WHERE p.id = $1 AND pm.user_id = $2
+		FOR UPDATE OF p
+	`, partyID, reporterID).Scan(&disbandedAt, &ratedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Party not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading party: %v", err)
+		http.Error(w, `{"error":"Error saving report"}`, http.StatusInternalServerError)
+		return
+	}
+	if !disbandedAt.Valid {
+		http.Error(w, `{"error":"Sessions can be reported once the party disbands"}`, http.StatusConflict)
+		return
+	}
+	if ratedAt.Valid || time.Since(disbandedAt.Time) > ratingReportWindow {
+		http.Error(w, `{"error":"Reporting for this session has closed"}`, http.StatusConflict)
+		return
+	}
+
+	// Resolve teammates by username; only fellow members can be rated
+	rows, err := tx.Query(`
+		SELECT u.id, u.username FROM party_members pm
+		JOIN users u ON u.id = pm.user_id
+		WHERE pm.party_id = $1 AND pm.user_id <> $2
+	`, partyID, reporterID)
+	if err != nil {
+		log.Printf("Error loading party members: %v", err)
+		http.Error(w, `{"error":"Error saving report"}`, http.StatusInternalServerError)
+		return
+	}
+	teammates := map[string]int{}
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"Error saving report"}`, http.StatusInternalServerError)
+			return
+		}
+		teammates[strings.ToLower(username)] = id
+	}
+	rows.Close()
+
+	fieldErrors := map[string]string{}
+	peerScores := map[int]int{}
+	for username, score := range req.PeerRatings {
+		id, ok := teammates[strings.ToLower(username)]
+		if !ok {
+			fieldErrors[username] = "is not one of your teammates in this party"
+			continue
+		}
+		if score < minPeerScore || score > maxPeerScore {
+			fieldErrors[username] = fmt.Sprintf("must be rated from %d to %d", minPeerScore, maxPeerScore)
+			continue
+		}
+		peerScores[id] = score
+	}
+	if len(fieldErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid peer ratings",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO party_reports (party_id, reporter_id, outcome)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (party_id, reporter_id)
+		DO UPDATE SET outcome = COALESCE($3, party_reports.outcome), created_at = CURRENT_TIMESTAMP
+	`, partyID, reporterID, nullIfEmpty(req.Outcome))
+	if err != nil {
+		log.Printf("Error saving party report: %v", err)
+		http.Error(w, `{"error":"Error saving report"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for rateeID, score := range peerScores {
+		_, err = tx.Exec(`
+			INSERT INTO party_peer_ratings (party_id, rater_id, ratee_id, score)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (party_id, rater_id, ratee_id) DO UPDATE SET score = $4
+		`, partyID, reporterID, rateeID, score)
+		if err != nil {
+			log.Printf("Error saving peer rating: %v", err)
+			http.Error(w, `{"error":"Error saving report"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error completing report"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// No need to wait out the window once everyone has reported
+	var outstanding int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM party_members pm
+		WHERE pm.party_id = $1
+		AND NOT EXISTS (
+			SELECT 1 FROM party_reports pr
+			WHERE pr.party_id = pm.party_id AND pr.reporter_id = pm.user_id
+		)
+	`, partyID).Scan(&outstanding)
+	if err == nil && outstanding == 0 {
+		err = rateParty(partyID)
+	}
+	if err != nil {
+		log.Printf("Error rating party %d: %v", partyID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Report saved"})
+}
+
+// rateParty turns a disbanded party's reports into rating updates. The
+// agreed outcome counts as a game against an opponent as strong as the
+// team's average, and every pair of teammates plays a game decided by how
+// their peers rated them.
+func rateParty(partyID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var game string
+	err = tx.QueryRow(`
+		UPDATE parties SET rated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND disbanded_at IS NOT NULL AND rated_at IS NULL
+		RETURNING game
+	`, partyID).Scan(&game)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Already rated
+			return nil
+		}
+		return err
+	}
+
+	var members []storedRating
+	err = tx.Select(&members, `
+		SELECT pm.user_id, $2::text as game,
+			COALESCE(pr.rating, $3) as rating,
+			COALESCE(pr.deviation, $4) as deviation,
+			COALESCE(pr.volatility, $5) as volatility,
+			COALESCE(pr.sessions_played, 0) as sessions_played,
+			pr.rated_at
+		FROM party_members pm
+		LEFT JOIN player_ratings pr ON pr.user_id = pm.user_id AND pr.game = $2
+		WHERE pm.party_id = $1
+		ORDER BY pm.user_id
+	`, partyID, game, glickoDefaultRating, glickoDefaultDeviation, glickoDefaultVolatility)
+	if err != nil {
+		return err
+	}
+	if len(members) < 2 {
+		return tx.Commit()
+	}
+
+	now := time.Now()
+	current := make(map[int]GlickoRating, len(members))
+	var teamRating, teamDeviation float64
+	for _, member := range members {
+		current[member.UserID] = member.current(now)
+		teamRating += current[member.UserID].Rating
+		teamDeviation += current[member.UserID].Deviation
+	}
+	team := GlickoRating{
+		Rating:    teamRating / float64(len(members)),
+		Deviation: teamDeviation / float64(len(members)),
+	}
+
+	outcome, err := partyOutcome(tx.Tx, partyID)
+	if err != nil {
+		return err
+	}
+	peerScores, err := partyPeerScores(tx.Tx, partyID)
+	if err != nil {
+		return err
+	}
+
+	results := map[int][]glickoResult{}
+	if score, ok := outcomeScores[outcome]; ok {
+		for _, member := range members {
+			results[member.UserID] = append(results[member.UserID], glickoResult{team, score})
+		}
+	}
+	for _, a := range members {
+		for _, b := range members {
+			scoreA, okA := peerScores[a.UserID]
+			scoreB, okB := peerScores[b.UserID]
+			if a.UserID == b.UserID || !okA || !okB {
+				continue
+			}
+			// Map the gap in average peer score (at most 4) onto 0..1
+			score := 0.5 + (scoreA-scoreB)/float64(2*(maxPeerScore-minPeerScore))
+			results[a.UserID] = append(results[a.UserID], glickoResult{current[b.UserID], score})
+		}
+	}
+
+	for _, member := range members {
+		memberResults := results[member.UserID]
+		if len(memberResults) == 0 {
+			continue
+		}
+		updated := updateGlicko(current[member.UserID], memberResults)
+		_, err := tx.Exec(`
+			INSERT INTO player_ratings (user_id, game, rating, deviation, volatility, sessions_played, rated_at)
+			VALUES ($1, $2, $3, $4, $5, 1, $6)
+			ON CONFLICT (user_id, game) DO UPDATE SET
+				rating = $3, deviation = $4, volatility = $5,
+				sessions_played = player_ratings.sessions_played + 1, rated_at = $6
+		`, member.UserID, game, updated.Rating, updated.Deviation, updated.Volatility, now.UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+var outcomeScores = map[string]float64{
+	OutcomeWin:  1,
+	OutcomeDraw: 0.5,
+	OutcomeLoss: 0,
+}
+
+// partyOutcome returns the outcome most members reported, or "" when
+// nobody reported one or the reports are tied.
+func partyOutcome(tx *sql.Tx, partyID int) (string, error) {
+	rows, err := tx.Query(`
+		SELECT outcome, COUNT(*) FROM party_reports
+		WHERE party_id = $1 AND outcome IS NOT NULL
+		GROUP BY outcome
+		ORDER BY COUNT(*) DESC
+		LIMIT 2
+	`, partyID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var outcomes []string
+	var counts []int
+	for rows.Next() {
+		var outcome string
+		var count int
+		if err := rows.Scan(&outcome, &count); err != nil {
+			return "", err
+		}
+		outcomes = append(outcomes, outcome)
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if len(outcomes) == 0 || (len(outcomes) == 2 && counts[0] == counts[1]) {
+		return "", nil
+	}
+	return outcomes[0], nil
+}
+
+// partyPeerScores returns each member's average score from their teammates.
+func partyPeerScores(tx *sql.Tx, partyID int) (map[int]float64, error) {
+	rows, err := tx.Query(`
+		SELECT ratee_id, AVG(score)::float8 FROM party_peer_ratings
+		WHERE party_id = $1
+		GROUP BY ratee_id
+	`, partyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := map[int]float64{}
+	for rows.Next() {
+		var id int
+		var score float64
+		if err := rows.Scan(&id, &score); err != nil {
+			return nil, err
+		}
+		scores[id] = score
+	}
+	return scores, rows.Err()
+}
+
+// runRatingSweeper rates parties whose report window has closed.
+func runRatingSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var partyIDs []int
+		err := db.Select(&partyIDs, `
+			SELECT id FROM parties
+			WHERE rated_at IS NULL AND disbanded_at <= $1
+		`, time.Now().Add(-ratingReportWindow).UTC())
+		if err != nil {
+			log.Printf("Error finding parties to rate: %v", err)
+			continue
+		}
+		for _, partyID := range partyIDs {
+			if err := rateParty(partyID); err != nil {
+				log.Printf("Error rating party %d: %v", partyID, err)
+			}
+		}
+	}
+}
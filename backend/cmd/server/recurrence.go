@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported recurrence frequencies
+const (
+	RecurDaily  = "DAILY"
+	RecurWeekly = "WEEKLY"
+)
+
+const (
+	recurrenceMaxInterval   = 99
+	recurrenceMaxCount      = 500
+	recurrenceMaxSpan       = 2 * 365 * 24 * time.Hour
+	recurrenceMaxIterations = 10000
+)
+
+var icsWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// Recurrence is the subset of an RFC 5545 RRULE that sessions use: daily or
+// weekly, every Interval days or weeks, optionally on several weekdays, ending
+// after Count occurrences, at Until, or never. Weeks start on Monday.
+type Recurrence struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    *time.Time
+}
+
+// parseRecurrence reads an RRULE value, with or without the "RRULE:" prefix.
+func parseRecurrence(s string) (*Recurrence, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	rec := &Recurrence{Interval: 1}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a KEY=VALUE rule part", part)
+		}
+
+		switch key {
+		case "FREQ":
+			if value != RecurDaily && value != RecurWeekly {
+				return nil, fmt.Errorf("FREQ must be DAILY or WEEKLY")
+			}
+			rec.Freq = value
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > recurrenceMaxInterval {
+				return nil, fmt.Errorf("INTERVAL must be between 1 and %d", recurrenceMaxInterval)
+			}
+			rec.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > recurrenceMaxCount {
+				return nil, fmt.Errorf("COUNT must be between 1 and %d", recurrenceMaxCount)
+			}
+			rec.Count = n
+		case "UNTIL":
+			until, err := time.Parse(icsTimeFormat, value)
+			if err != nil {
+				// A bare date includes the whole of that day
+				day, dateErr := time.Parse(icsDateFormat, value)
+				if dateErr != nil {
+					return nil, fmt.Errorf("UNTIL must be a UTC date-time like 20260131T235959Z or a date")
+				}
+				until = day.Add(24*time.Hour - time.Second)
+			}
+			rec.Until = &until
+		case "BYDAY":
+			for _, name := range strings.Split(value, ",") {
+				day := -1
+				for i, wd := range icsWeekdays {
+					if name == wd {
+						day = i
+					}
+				}
+				if day < 0 {
+					return nil, fmt.Errorf("BYDAY takes weekdays like MO,WE,FR")
+				}
+				rec.ByDay = append(rec.ByDay, time.Weekday(day))
+			}
+		case "WKST":
+			if value != "MO" {
+				return nil, fmt.Errorf("only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
+	}
+
+	if rec.Freq == "" {
+		return nil, fmt.Errorf("FREQ is required")
+	}
+	if rec.Count > 0 && rec.Until != nil {
+		return nil, fmt.Errorf("COUNT and UNTIL can't be combined")
+	}
+	if len(rec.ByDay) > 0 && rec.Freq != RecurWeekly {
+		return nil, fmt.Errorf("BYDAY needs FREQ=WEEKLY")
+	}
+
+	sort.Slice(rec.ByDay, func(i, j int) bool { return mondayOffset(rec.ByDay[i]) < mondayOffset(rec.ByDay[j]) })
+	return rec, nil
+}
+
+// String renders the rule in canonical RRULE form, without the prefix.
+func (rec *Recurrence) String() string {
+	parts := []string{"FREQ=" + rec.Freq}
+	if rec.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", rec.Interval))
+	}
+	if len(rec.ByDay) > 0 {
+		days := make([]string, len(rec.ByDay))
+		for i, wd := range rec.ByDay {
+			days[i] = icsWeekdays[wd]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if rec.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", rec.Count))
+	}
+	if rec.Until != nil {
+		parts = append(parts, "UNTIL="+rec.Until.UTC().Format(icsTimeFormat))
+	}
+	return strings.Join(parts, ";")
+}
+
+func mondayOffset(wd time.Weekday) int {
+	return (int(wd) + 6) % 7
+}
+
+// between returns the starts of occurrences in [from, to) for a series
+// whose first occurrence starts at start. Occurrences are laid out on local
+// calendar days in loc, so a weekly 20:00 session stays at 20:00 across DST
+// changes even though its UTC time moves.
+func (rec *Recurrence) between(start time.Time, loc *time.Location, from, to time.Time) []time.Time {
+	local := start.In(loc)
+	hour, minute, second := local.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, loc)
+	}
+
+	var out []time.Time
+	emitted := 0
+	// emit handles one candidate, returning false once the series is over
+	// or past the window
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if rec.Until != nil && t.After(*rec.Until) {
+			return false
+		}
+		if rec.Count > 0 && emitted >= rec.Count {
+			return false
+		}
+		emitted++
+		if !t.Before(to) {
+			return false
+		}
+		if !t.Before(from) {
+			out = append(out, t)
+		}
+		return true
+	}
+
+	year, month, day := local.Date()
+	switch rec.Freq {
+	case RecurDaily:
+		for k := 0; k < recurrenceMaxIterations; k++ {
+			if !emit(at(year, month, day+k*rec.Interval)) {
+				break
+			}
+		}
+	case RecurWeekly:
+		days := rec.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{local.Weekday()}
+		}
+		weekStart := day - mondayOffset(local.Weekday())
+		for k := 0; k < recurrenceMaxIterations; k += rec.Interval {
+			for _, wd := range days {
+				if !emit(at(year, month, weekStart+k*7+mondayOffset(wd))) {
+					return out
+				}
+			}
+		}
+	}
+	return out
+}
+
+// includes reports whether an occurrence of the series starts exactly at t.
+func (rec *Recurrence) includes(start time.Time, loc *time.Location, t time.Time) bool {
+	starts := rec.between(start, loc, t, t.Add(time.Second))
+	return len(starts) == 1 && starts[0].Equal(t)
+}
+
+// last returns the start of the final occurrence, or nil for a series that
+// never ends.
+func (rec *Recurrence) last(start time.Time, loc *time.Location) *time.Time {
+	if rec.Count == 0 && rec.Until == nil {
+		return nil
+	}
+	starts := rec.between(start, loc, start, start.Add(recurrenceMaxSpan+time.Second))
+	if len(starts) == 0 {
+		return &start
+	}
+	return &starts[len(starts)-1]
+}
+
+// occurrenceID names an occurrence by its original start, in the same form
+// calendar clients see in RECURRENCE-ID.
+func occurrenceID(t time.Time) string {
+	return t.UTC().Format(icsTimeFormat)
+}
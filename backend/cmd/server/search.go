@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 50
+	searchMaxQuery     = 64
+	// Candidates are cut down by text relevance before the more expensive
+	// social ranking runs
+	searchCandidateLimit = 200
+)
+
+type UserSearchResult struct {
+	UserCard
+	MutualConnections int     `json:"mutualConnections" db:"mutual_connections"`
+	Score             float64 `json:"-" db:"score"`
+}
+
+// prefixTSQuery turns free text into a prefix-matching tsquery, so
+// "ace sh" becomes "ace:* & sh:*".
+func prefixTSQuery(q string) string {
+	var terms []string
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	for _, word := range words {
+		terms = append(terms, word+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// escapeLike escapes LIKE wildcards in user input.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	viewer, err := viewerID(r)
+	if err != nil {
+		log.Printf("Error getting viewer ID: %v", err)
+	}
+
+	query := r.URL.Query()
+
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, `{"error":"Search query is required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(q) > searchMaxQuery {
+		http.Error(w, `{"error":"Search query is too long"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := searchDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > searchMaxLimit {
+			limit = searchMaxLimit
+		}
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	viewerArg := arg(viewer)
+	qArg := arg(q)
+	prefixArg := arg(escapeLike(strings.ToLower(q)) + "%")
+	tsQuery := fmt.Sprintf("to_tsquery('simple', NULLIF(%s, ''))", arg(prefixTSQuery(q)))
+	visible := visibleToViewerSQL(viewerArg)
+
+	// Linked handles only match for profiles the viewer can see; private
+	// profiles are found by username and display name alone
+	conditions := []string{
+		notBlockedSQL(viewerArg),
+		fmt.Sprintf(`(
+			LOWER(u.username) LIKE %[1]s
+			OR LOWER(u.display_name) LIKE %[1]s
+			OR u.username %% %[2]s
+			OR u.display_name %% %[2]s
+			OR (u.search_vector @@ %[3]s AND (%[4]s OR ts_filter(u.search_vector, '{a}') @@ %[3]s))
+		)`, prefixArg, qArg, tsQuery, visible),
+	}
+
+	// Filters only apply to profiles the viewer can see
+	filtered := false
+	if game := strings.TrimSpace(query.Get("game")); game != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY(u.connected_games)", arg(game)))
+		filtered = true
+	}
+	if region := strings.TrimSpace(query.Get("region")); region != "" {
+		conditions = append(conditions, fmt.Sprintf("LOWER(u.region) = LOWER(%s)", arg(region)))
+		filtered = true
+	}
+	if filtered {
+		conditions = append(conditions, visible)
+	}
+
+	// Rank by text relevance, then mutual connections and follower count
+	results := []UserSearchResult{}
+	err = db.Select(&results, fmt.Sprintf(`
+		WITH candidates AS (
+			SELECT * FROM (
+				SELECT u.*, %[1]s as visible,
+					COALESCE(ts_rank_cd(u.search_vector, %[2]s), 0) as text_rank,
+					GREATEST(similarity(u.username, %[3]s), similarity(COALESCE(u.display_name, ''), %[3]s)) as name_similarity,
+					(LOWER(u.username) LIKE %[4]s) as username_prefix
+				FROM users u
+				WHERE %[5]s
+			) matched
+			ORDER BY username_prefix DESC, text_rank + name_similarity DESC
+			LIMIT %[6]d
+		), ranked AS (
+			SELECT c.*,
+				(
+					SELECT COUNT(*) FROM followers theirs
+					JOIN followers mine ON mine.following_id = theirs.follower_id
+					WHERE theirs.following_id = c.id AND mine.follower_id = %[7]s
+				) as mutual_connections
+			FROM candidates c
+		)
+		SELECT id, username, display_name, is_private, twitch_username, discord_username,
+			   youtube_channel, connected_games, region, languages,
+			   followers_count, last_active_at, avatar_hash, visible, mutual_connections,
+			   text_rank * 2 + name_similarity * 2
+			   + CASE WHEN username_prefix THEN 1 ELSE 0 END
+			   + LN(1 + mutual_connections) * 0.5
+			   + LN(1 + followers_count) * 0.1 as score
+		FROM ranked
+		ORDER BY score DESC, id DESC
+		LIMIT %[8]d
+	`, visible, tsQuery, qArg, prefixArg, strings.Join(conditions, " AND "),
+		searchCandidateLimit, viewerArg, limit), args...)
+
+	if err != nil {
+		log.Printf("Error searching users: %v", err)
+		http.Error(w, `{"error":"Failed to search users"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for i := range results {
+		results[i].setAvatarURL()
+		if !results[i].Visible {
+			results[i].redact()
+			results[i].MutualConnections = 0
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": results,
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Activity types
+const (
+	ActivityConnectedGame = "connected_game"
+	ActivityFollowed      = "followed"
+	ActivityLFGPost       = "lfg_post"
+	ActivityWentLive      = "went_live"
+	ActivityEarnedBadge   = "earned_badge"
+	ActivityPosted        = "posted"
+)
+
+const (
+	// Activities of accounts with more followers than this aren't copied
+	// into every follower's timeline; timelines pull them in when read
+	timelineFanoutLimit   = 5000
+	timelineDefaultLimit  = 20
+	timelineMaxLimit      = 50
+	timelineCursorSort    = "timeline"
+	timelineSweepInterval = time.Hour
+	timelineRetention     = 30 * 24 * time.Hour
+)
+
+// Activity is one entry in a home timeline. Target is the account followed,
+// SubjectID the LFG post or post created, Game the game connected, played
+// or posted about, Badge the badge earned and Post the post itself.
+type Activity struct {
+	ID        int       `json:"id" db:"id"`
+	Type      string    `json:"type" db:"verb"`
+	Actor     string    `json:"actor" db:"actor"`
+	Target    *string   `json:"target,omitempty" db:"target"`
+	SubjectID *int      `json:"subjectId,omitempty" db:"subject_id"`
+	Detail    *string   `json:"-" db:"detail"`
+	Game      *string   `json:"game,omitempty" db:"-"`
+	Badge     *string   `json:"badge,omitempty" db:"-"`
+	Post      *Post     `json:"post,omitempty" db:"-"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// recordActivity adds something actorID did to their own timeline and,
+// unless they have too many followers for that, to each follower's.
+// targetID and subjectID may be nil; detail is the game or badge, if any.
+func recordActivity(ex execer, actorID int, verb string, targetID, subjectID interface{}, detail string) error {
+	_, err := ex.Exec(`
+		WITH activity AS (
+			INSERT INTO activities (actor_id, verb, target_id, subject_id, detail, fanned_out)
+			SELECT id, $2, $3, $4, $5, followers_count <= $6 FROM users WHERE id = $1
+			RETURNING id, actor_id, fanned_out, created_at
+		)
+		INSERT INTO timeline_entries (user_id, activity_id, created_at)
+		SELECT actor_id, id, created_at FROM activity
+		UNION ALL
+		SELECT f.follower_id, a.id, a.created_at FROM activity a
+		JOIN followers f ON f.following_id = a.actor_id
+		WHERE a.fanned_out
+	`, actorID, verb, targetID, subjectID, nullIfEmpty(detail), timelineFanoutLimit)
+	return err
+}
+
+// timelineVisibleSQL keeps activities a by actors u that the viewer bound
+// to $1 still follows and hasn't muted or blocked, leaving out follows of
+// accounts t the viewer can't see and live status the actor hides from
+// them, as well as posts p outside their audience. Timeline entries are
+// written once, so these are checked on read.
+var timelineVisibleSQL = `
+	(a.actor_id = $1 OR EXISTS (
+		SELECT 1 FROM followers f WHERE f.follower_id = $1 AND f.following_id = a.actor_id
+	))
+	AND ` + notBlockedSQL("$1") + `
+	AND NOT EXISTS (SELECT 1 FROM user_mutes m WHERE m.muter_id = $1 AND m.muted_id = a.actor_id)
+	AND (a.target_id IS NULL OR (
+		(NOT t.is_private OR t.id = $1 OR EXISTS (
+			SELECT 1 FROM followers f WHERE f.follower_id = $1 AND f.following_id = t.id
+		))
+		AND NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = t.id AND b.blocked_id = $1) OR (b.blocker_id = $1 AND b.blocked_id = t.id)
+		)
+		AND NOT EXISTS (SELECT 1 FROM user_mutes m WHERE m.muter_id = $1 AND m.muted_id = t.id)
+	))
+	AND (a.verb <> '` + ActivityWentLive + `' OR ` + presenceVisibleSQL("$1") + `)
+	AND (a.verb <> '` + ActivityPosted + `' OR (p.id IS NOT NULL AND ` + postVisibleSQL("$1") + `))`
+
+// getTimelineHandler lists what the accounts the user follows have been
+// up to, newest first, merging the activities fanned out to the user with
+// those of big accounts they follow.
+func getTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	query := r.URL.Query()
+
+	limit := timelineDefaultLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			http.Error(w, `{"error":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if limit > timelineMaxLimit {
+			limit = timelineMaxLimit
+		}
+	}
+
+	userID, err := getUserID(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	args := []interface{}{userID}
+	entryCondition, pullCondition := "true", "true"
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != timelineCursorSort {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		args = append(args, cursor.Value, cursor.ID)
+		entryCondition = "(te.created_at, te.activity_id) < ($2::timestamp, $3)"
+		pullCondition = "(pulled.created_at, pulled.id) < ($2::timestamp, $3)"
+	}
+
+	var activities []*Activity
+	err = db.Select(&activities, fmt.Sprintf(`
+		SELECT a.id, a.verb, u.username AS actor, t.username AS target,
+			a.subject_id, a.detail, a.created_at
+		FROM activities a
+		JOIN users u ON u.id = a.actor_id
+		LEFT JOIN users t ON t.id = a.target_id
+		LEFT JOIN posts p ON a.verb = '`+ActivityPosted+`' AND p.id = a.subject_id
+		WHERE a.id IN (
+			SELECT te.activity_id FROM timeline_entries te
+			WHERE te.user_id = $1 AND %[1]s
+			UNION
+			SELECT pulled.id FROM activities pulled
+			JOIN followers f ON f.following_id = pulled.actor_id AND f.follower_id = $1
+			WHERE NOT pulled.fanned_out AND %[2]s
+		)
+		AND %[3]s
+		ORDER BY a.created_at DESC, a.id DESC
+		LIMIT %[4]d
+	`, entryCondition, pullCondition, timelineVisibleSQL, limit+1), args...)
+	if err != nil {
+		log.Printf("Error fetching timeline: %v", err)
+		http.Error(w, `{"error":"Failed to fetch timeline"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if len(activities) > limit {
+		activities = activities[:limit]
+		last := activities[limit-1]
+		response["nextCursor"] = encodeCursor(pageCursor{
+			Sort:  timelineCursorSort,
+			Value: last.CreatedAt.Format(cursorTimeValue),
+			ID:    last.ID,
+		})
+	}
+	var postIDs []int
+	for _, a := range activities {
+		switch a.Type {
+		case ActivityEarnedBadge:
+			a.Badge = a.Detail
+		case ActivityPosted:
+			postIDs = append(postIDs, *a.SubjectID)
+		default:
+			a.Game = a.Detail
+		}
+	}
+	posts, err := fetchPosts(userID, postIDs)
+	if err != nil {
+		log.Printf("Error fetching timeline posts: %v", err)
+		http.Error(w, `{"error":"Failed to fetch timeline"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, a := range activities {
+		if a.Type == ActivityPosted {
+			a.Post = posts[*a.SubjectID]
+		}
+	}
+	if activities == nil {
+		activities = []*Activity{}
+	}
+	response["activities"] = activities
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// expireTimelines drops activities past their retention, taking their
+// timeline entries with them.
+func expireTimelines() (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM activities WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+	`, timelineRetention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func runTimelineSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := expireTimelines()
+		if err != nil {
+			log.Printf("Error expiring timelines: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d activities", expired)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxUploadBytes = 8 << 20
+	// Content-hash keys never change meaning, so media can be cached forever
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// imageKind describes one kind of uploaded image and the variants
+// generated for it. Column is the users column profile images are kept in.
+type imageKind struct {
+	Name     string
+	Column   string
+	Variants []imageVariant
+}
+
+var (
+	avatarImage = imageKind{
+		Name:   "avatars",
+		Column: "avatar_hash",
+		Variants: []imageVariant{
+			{Name: "64", Width: 64, Height: 64},
+			{Name: "128", Width: 128, Height: 128},
+			{Name: "256", Width: 256, Height: 256},
+			{Name: "512", Width: 512, Height: 512},
+		},
+	}
+	bannerImage = imageKind{
+		Name:   "banners",
+		Column: "banner_hash",
+		Variants: []imageVariant{
+			{Name: "750", Width: 750, Height: 250},
+			{Name: "1500", Width: 1500, Height: 500},
+		},
+	}
+)
+
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var mediaKeyPattern = regexp.MustCompile(`^(avatars|banners|posts)/[0-9a-f]{64}/[0-9]+\.jpg$`)
+
+func mediaKey(kind, hash, variant string) string {
+	return fmt.Sprintf("%s/%s/%s.jpg", kind, hash, variant)
+}
+
+// imageURLs maps each variant of a stored image to its URL, or returns nil
+// when there is no image.
+func (k imageKind) imageURLs(hash *string) map[string]string {
+	if hash == nil || *hash == "" {
+		return nil
+	}
+	urls := make(map[string]string, len(k.Variants))
+	for _, variant := range k.Variants {
+		urls[variant.Name] = "/media/" + mediaKey(k.Name, *hash, variant.Name)
+	}
+	return urls
+}
+
+// deleteImage removes every variant of an image, logging rather than failing
+// since an orphaned blob is harmless. Images are keyed by content, so callers
+// must make sure nothing else still shows the same picture.
+func (k imageKind) deleteImage(ctx context.Context, hash string) {
+	for _, variant := range k.Variants {
+		if err := blobStore.Delete(ctx, mediaKey(k.Name, hash, variant.Name)); err != nil {
+			log.Printf("Error deleting %s: %v", mediaKey(k.Name, hash, variant.Name), err)
+		}
+	}
+}
+
+// deleteUnusedProfileImage removes a replaced or removed profile image,
+// unless another user has uploaded the same picture.
+func (k imageKind) deleteUnusedProfileImage(ctx context.Context, hash string) {
+	var inUse bool
+	err := db.Get(&inUse, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM users WHERE %s = $1)`, k.Column), hash)
+	if err != nil {
+		log.Printf("Error checking profile image: %v", err)
+		return
+	}
+	if !inUse {
+		k.deleteImage(ctx, hash)
+	}
+}
+
+func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	uploadProfileImage(w, r, avatarImage)
+}
+
+func uploadBannerHandler(w http.ResponseWriter, r *http.Request) {
+	uploadProfileImage(w, r, bannerImage)
+}
+
+func deleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	deleteProfileImage(w, r, avatarImage)
+}
+
+func deleteBannerHandler(w http.ResponseWriter, r *http.Request) {
+	deleteProfileImage(w, r, bannerImage)
+}
+
+// readImageUpload reads the image in a multipart upload's "image" field,
+// checking its size and type. It writes the error response and returns
+// false if the upload is unusable.
+func readImageUpload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	// Leave room for the multipart framing around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes+64<<10)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, `{"error":"Image is too large"}`, http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, `{"error":"An image file is required in the 'image' field"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadBytes+1))
+	if err != nil {
+		http.Error(w, `{"error":"Error reading upload"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	if len(data) > maxUploadBytes {
+		http.Error(w, `{"error":"Image is too large"}`, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	// Trust the bytes, not the client-supplied content type
+	if !allowedImageTypes[http.DetectContentType(data)] {
+		http.Error(w, `{"error":"Image must be a JPEG, PNG or GIF"}`, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	return data, true
+}
+
+// processUpload generates an upload's variants, writing the error response
+// and returning false if the image can't be processed.
+func processUpload(w http.ResponseWriter, data []byte, variants []imageVariant) (map[string][]byte, bool) {
+	outputs, err := processImage(data, variants)
+	if err != nil {
+		if err == errUnsupportedImage {
+			http.Error(w, `{"error":"Image could not be decoded"}`, http.StatusUnsupportedMediaType)
+		} else {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return outputs, true
+}
+
+func uploadProfileImage(w http.ResponseWriter, r *http.Request, kind imageKind) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	data, ok := readImageUpload(w, r)
+	if !ok {
+		return
+	}
+	variants, ok := processUpload(w, data, kind.Variants)
+	if !ok {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	for name, variant := range variants {
+		if err := blobStore.Put(r.Context(), mediaKey(kind.Name, hash, name), variant, "image/jpeg"); err != nil {
+			log.Printf("Error storing image: %v", err)
+			http.Error(w, `{"error":"Error storing image"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Swap in the new image and fetch the old one in a single statement
+	var previous sql.NullString
+	err := db.QueryRow(fmt.Sprintf(`
+		UPDATE users u SET %[1]s = $1
+		FROM (SELECT id, %[1]s FROM users WHERE username = $2 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING old.%[1]s
+	`, kind.Column), hash, claims.Username).Scan(&previous)
+	if err != nil {
+		log.Printf("Error saving image: %v", err)
+		http.Error(w, `{"error":"Error saving image"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if previous.Valid && previous.String != hash {
+		kind.deleteUnusedProfileImage(r.Context(), previous.String)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Image uploaded successfully",
+		"urls":    kind.imageURLs(&hash),
+	})
+}
+
+func deleteProfileImage(w http.ResponseWriter, r *http.Request, kind imageKind) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var previous sql.NullString
+	err := db.QueryRow(fmt.Sprintf(`
+		UPDATE users u SET %[1]s = NULL
+		FROM (SELECT id, %[1]s FROM users WHERE username = $1 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING old.%[1]s
+	`, kind.Column), claims.Username).Scan(&previous)
+	if err != nil {
+		log.Printf("Error removing image: %v", err)
+		http.Error(w, `{"error":"Error removing image"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if previous.Valid {
+		kind.deleteUnusedProfileImage(r.Context(), previous.String)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Image removed successfully"})
+}
+
+// serveMediaHandler streams a stored image. Keys embed the content hash, so
+// responses are cached as immutable.
+func serveMediaHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if !mediaKeyPattern.MatchString(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := `"` + key + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	blob, err := blobStore.Get(r.Context(), key)
+	if err != nil {
+		if err == ErrBlobNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error reading %s: %v", key, err)
+		http.Error(w, "Error reading image", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, blob)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+const (
+	// Push services accept at most 4096 bytes of encrypted body, which
+	// after the aes128gcm header, the tag and the padding delimiter leaves
+	// this much for the payload
+	pushRecordSize     = 4096
+	pushHeaderSize     = 16 + 4 + 1 + 65
+	pushMaxPayload     = pushRecordSize - pushHeaderSize - 16 - 1
+	pushVAPIDExpiry    = 12 * time.Hour
+	pushRequestTimeout = 10 * time.Second
+	pushWorkers        = 4
+	pushQueueSize      = 256
+	pushMaxAttempts    = 5
+	pushRetryBase      = 2 * time.Second
+)
+
+// Push urgencies, which let phones on low battery hold back unimportant
+// messages
+const (
+	PushUrgencyNormal = "normal"
+	PushUrgencyHigh   = "high"
+)
+
+var errPushPayloadTooLarge = errors.New("push payload too large")
+
+// pushServiceHosts are the push services browsers subscribe with: Chrome's
+// FCM, Firefox's autopush, Safari's and Edge's. Subscriptions pointing
+// anywhere else are refused, so the server can't be made to send requests
+// to hosts of a user's choosing.
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+// knownPushService reports whether endpoint is an https URL on one of the
+// pushServiceHosts or a subdomain of one, on the default port.
+func knownPushService(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, known := range pushServiceHosts {
+		if host == known || strings.HasSuffix(host, "."+known) {
+			return true
+		}
+	}
+	return false
+}
+
+// b64 is how Web Push encodes keys: URL-safe base64 without padding.
+var b64 = base64.RawURLEncoding
+
+// decodeB64 also accepts padded input, which some clients send.
+func decodeB64(s string) ([]byte, error) {
+	return b64.DecodeString(strings.TrimRight(s, "="))
+}
+
+// VAPIDKeys identify this server to push services (RFC 8292), which only
+// deliver to a subscription messages signed by the key it was created with.
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+	// Public is the uncompressed P-256 point browsers pass to subscribe()
+	// as the applicationServerKey
+	Public []byte
+}
+
+func vapidKeysFromScalar(d []byte) (*VAPIDKeys, error) {
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.P256().ScalarBaseMult(d)
+	return &VAPIDKeys{
+		private: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			D:         new(big.Int).SetBytes(d),
+		},
+		Public: key.PublicKey().Bytes(),
+	}, nil
+}
+
+// loadVAPIDKeys reads the key pair from VAPID_PRIVATE_KEY if set. Otherwise
+// the first instance to start generates one and stores it, so every
+// instance signs with the same key; changing it invalidates every
+// subscription.
+func loadVAPIDKeys() (*VAPIDKeys, error) {
+	if encoded := os.Getenv("VAPID_PRIVATE_KEY"); encoded != "" {
+		d, err := decodeB64(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("VAPID_PRIVATE_KEY: %v", err)
+		}
+		return vapidKeysFromScalar(d)
+	}
+
+	generated, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		INSERT INTO vapid_keys (id, private_key) VALUES (1, $1)
+		ON CONFLICT (id) DO NOTHING
+	`, b64.EncodeToString(generated.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded string
+	if err := db.Get(&encoded, `SELECT private_key FROM vapid_keys WHERE id = 1`); err != nil {
+		return nil, err
+	}
+	d, err := decodeB64(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return vapidKeysFromScalar(d)
+}
+
+// authorization signs a VAPID token for the push service at endpoint.
+func (k *VAPIDKeys) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(pushVAPIDExpiry).Unix(),
+		"sub": subject,
+	}).SignedString(k.private)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + token + ", k=" + b64.EncodeToString(k.Public), nil
+}
+
+// hkdfExtract and hkdfExpand are HKDF with SHA-256 (RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// pushContentKeys derives the content encryption key and nonce for a
+// message between the application server key asPublic and the user agent
+// key uaPublic (RFC 8291 section 3.4).
+func pushContentKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cek, nonce []byte) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, ecdhSecret), keyInfo, 32)
+
+	prk := hkdfExtract(salt, ikm)
+	cek = hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce = hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+	return cek, nonce
+}
+
+// encryptPushPayload encrypts a message for a subscription as a single
+// aes128gcm record (RFC 8188), under a fresh key pair and salt.
+func encryptPushPayload(plaintext, uaPublic, authSecret []byte) ([]byte, error) {
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushPayloadWith(plaintext, uaPublic, authSecret, asPrivate, salt)
+}
+
+func encryptPushPayloadWith(plaintext, uaPublic, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext) > pushMaxPayload {
+		return nil, errPushPayloadTooLarge
+	}
+	ua, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := asPrivate.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	cek, nonce := pushContentKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, pushHeaderSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// 0x02 marks the last record; there's no padding after it
+	record := append(append([]byte{}, plaintext...), 0x02)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// PushSubscription is where a browser asked for its messages to go.
+type PushSubscription struct {
+	ID       int    `json:"id" db:"id"`
+	UserID   int    `json:"-" db:"user_id"`
+	Endpoint string `json:"endpoint" db:"endpoint"`
+	P256dh   string `json:"-" db:"p256dh"`
+	Auth     string `json:"-" db:"auth"`
+}
+
+// PushMessage is a message for a user's devices. The push service holds it
+// for up to TTL while a device is offline; a message still undelivered
+// then is dropped, and retries stop at the same point. A newer message
+// with the same Topic replaces one still waiting.
+type PushMessage struct {
+	Payload []byte
+	TTL     time.Duration
+	Urgency string
+	Topic   string
+}
+
+type pushJob struct {
+	subscription PushSubscription
+	message      PushMessage
+	body         []byte
+	expires      time.Time
+	attempt      int
+}
+
+// PushSubscriptionStore records what delivering to subscriptions shows:
+// that one is still in use, or that its push service no longer knows it.
+type PushSubscriptionStore interface {
+	Used(id int) error
+	Delete(id int) error
+}
+
+// dbPushSubscriptions keeps subscriptions in the push_subscriptions table.
+type dbPushSubscriptions struct{}
+
+func (dbPushSubscriptions) Used(id int) error {
+	_, err := db.Exec(`UPDATE push_subscriptions SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	return err
+}
+
+func (dbPushSubscriptions) Delete(id int) error {
+	_, err := db.Exec(`DELETE FROM push_subscriptions WHERE id = $1`, id)
+	return err
+}
+
+// WebPushSender delivers push messages from a queue, retrying those the
+// push service couldn't take until they expire.
+type WebPushSender struct {
+	Keys    *VAPIDKeys
+	Subject string
+	Client  *http.Client
+	// AllowEndpoint vets each endpoint again before anything is sent to it
+	AllowEndpoint func(endpoint string) bool
+	Store         PushSubscriptionStore
+	// RetryBase is the first retry's delay, doubling with each attempt
+	RetryBase time.Duration
+
+	queue chan *pushJob
+}
+
+var webPush *WebPushSender
+
+// NewWebPushSender loads the VAPID keys and starts the delivery workers.
+// VAPID_SUBJECT is a mailto: or https: contact push services can use to
+// reach whoever runs this server.
+func NewWebPushSender() (*WebPushSender, error) {
+	keys, err := loadVAPIDKeys()
+	if err != nil {
+		return nil, err
+	}
+	subject := os.Getenv("VAPID_SUBJECT")
+	if subject == "" {
+		subject = "mailto:admin@pixelandchill.local"
+	}
+
+	s := &WebPushSender{
+		Keys:    keys,
+		Subject: subject,
+		Client: &http.Client{
+			Timeout: pushRequestTimeout,
+			// Push services answer directly; following a redirect would
+			// send the request somewhere the endpoint check never saw
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		AllowEndpoint: knownPushService,
+		Store:         dbPushSubscriptions{},
+		RetryBase:     pushRetryBase,
+		queue:         make(chan *pushJob, pushQueueSize),
+	}
+	for i := 0; i < pushWorkers; i++ {
+		go s.run()
+	}
+	return s, nil
+}
+
+// Send queues a message for each subscription.
+func (s *WebPushSender) Send(subscriptions []PushSubscription, message PushMessage) {
+	expires := time.Now().Add(message.TTL)
+	for _, sub := range subscriptions {
+		if !s.AllowEndpoint(sub.Endpoint) {
+			log.Printf("Skipping push subscription %d: not a known push service", sub.ID)
+			continue
+		}
+		uaPublic, err := decodeB64(sub.P256dh)
+		if err != nil {
+			log.Printf("Invalid key for push subscription %d: %v", sub.ID, err)
+			continue
+		}
+		authSecret, err := decodeB64(sub.Auth)
+		if err != nil {
+			log.Printf("Invalid auth secret for push subscription %d: %v", sub.ID, err)
+			continue
+		}
+		body, err := encryptPushPayload(message.Payload, uaPublic, authSecret)
+		if err != nil {
+			log.Printf("Error encrypting push message for subscription %d: %v", sub.ID, err)
+			continue
+		}
+		s.enqueue(&pushJob{subscription: sub, message: message, body: body, expires: expires})
+	}
+}
+
+func (s *WebPushSender) enqueue(job *pushJob) {
+	select {
+	case s.queue <- job:
+	default:
+		log.Printf("Dropping push message for subscription %d: queue full", job.subscription.ID)
+	}
+}
+
+func (s *WebPushSender) run() {
+	for job := range s.queue {
+		if backoff, retry := s.deliver(job); retry {
+			job := job
+			time.AfterFunc(backoff, func() { s.enqueue(job) })
+		}
+	}
+}
+
+// deliver makes one attempt at a job. If the push service was unavailable
+// and the message won't have expired by then, it returns how long to wait
+// before the next attempt. Subscriptions the push service no longer knows
+// are deleted.
+func (s *WebPushSender) deliver(job *pushJob) (time.Duration, bool) {
+	remaining := time.Until(job.expires)
+	// A zero TTL means deliver now or never, so it gets one attempt
+	if remaining <= 0 && job.attempt > 0 {
+		return 0, false
+	}
+	job.attempt++
+
+	status, retryAfter, err := s.post(job, remaining)
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		if err := s.Store.Used(job.subscription.ID); err != nil {
+			log.Printf("Error recording push delivery: %v", err)
+		}
+		return 0, false
+	case status == http.StatusNotFound || status == http.StatusGone:
+		if err := s.Store.Delete(job.subscription.ID); err != nil {
+			log.Printf("Error pruning push subscription: %v", err)
+		}
+		return 0, false
+	case err == nil && status != http.StatusTooManyRequests && status < 500:
+		log.Printf("Push service rejected message for subscription %d: %d", job.subscription.ID, status)
+		return 0, false
+	}
+
+	backoff := s.RetryBase << (job.attempt - 1)
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	if job.attempt >= pushMaxAttempts || time.Now().Add(backoff).After(job.expires) {
+		log.Printf("Giving up on push message for subscription %d after %d attempts (status %d, %v)",
+			job.subscription.ID, job.attempt, status, err)
+		return 0, false
+	}
+	return backoff, true
+}
+
+// post sends a job to its push service, with a TTL of what's left of its
+// lifetime. It returns the status and any Retry-After delay.
+func (s *WebPushSender) post(job *pushJob, remaining time.Duration) (int, time.Duration, error) {
+	authorization, err := s.Keys.authorization(job.subscription.Endpoint, s.Subject, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req, err := http.NewRequest("POST", job.subscription.Endpoint, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl := int(remaining / time.Second)
+	if ttl < 0 {
+		ttl = 0
+	}
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", authorization)
+	if job.message.Urgency != "" {
+		req.Header.Set("Urgency", job.message.Urgency)
+	}
+	if job.message.Topic != "" {
+		req.Header.Set("Topic", job.message.Topic)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Until(at)
+	}
+	return resp.StatusCode, retryAfter, nil
+}
+
+// validPushKeys checks a subscription's keys before anything is sent with
+// them.
+func validPushKeys(p256dh, auth string) error {
+	uaPublic, err := decodeB64(p256dh)
+	if err != nil {
+		return fmt.Errorf("p256dh must be base64url")
+	}
+	if _, err := ecdh.P256().NewPublicKey(uaPublic); err != nil {
+		return fmt.Errorf("p256dh must be an uncompressed P-256 public key")
+	}
+	authSecret, err := decodeB64(auth)
+	if err != nil || len(authSecret) != 16 {
+		return fmt.Errorf("auth must be 16 bytes of base64url")
+	}
+	return nil
+}
+
+// loadPushSubscriptions fetches the subscriptions of whichever of userIDs
+// haven't turned off push for the notification type.
+func loadPushSubscriptions(userIDs []int, notificationType string, now time.Time) ([]PushSubscription, error) {
+	var rows []struct {
+		PushSubscription
+		Timezone        *string `db:"timezone"`
+		QuietHoursStart *int    `db:"quiet_hours_start"`
+		QuietHoursEnd   *int    `db:"quiet_hours_end"`
+	}
+	err := db.Select(&rows, `
+		SELECT s.id, s.user_id, s.endpoint, s.p256dh, s.auth,
+			u.timezone, u.quiet_hours_start, u.quiet_hours_end
+		FROM push_subscriptions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.user_id = ANY($1) AND `+notificationChannelEnabledSQL("s.user_id", "$2", NotificationChannelPush),
+		pq.Array(userIDs), notificationType)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var subscriptions []PushSubscription
+	for _, row := range rows {
+		if !quietHoursExempt[notificationType] &&
+			inQuietHours(row.QuietHoursStart, row.QuietHoursEnd, userLocation(row.Timezone), now) {
+			continue
+		}
+		subscriptions = append(subscriptions, row.PushSubscription)
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// FakePushService stands in for both a push service and the browsers
+// subscribed to it, so push delivery can be exercised end to end without
+// leaving the machine. Serve it over TLS (for example with
+// httptest.NewTLSServer) and point WebPushSender.Client at a client that
+// trusts it. It checks each message's VAPID signature and decrypts it with
+// the subscription's keys before recording it.
+type FakePushService struct {
+	// VAPIDPublicKey is the application server key subscriptions were
+	// created with; messages signed by any other key are refused
+	VAPIDPublicKey []byte
+
+	mu            sync.Mutex
+	subscriptions map[string]*fakePushSubscription
+	received      []FakePushMessage
+}
+
+type fakePushSubscription struct {
+	private    *ecdh.PrivateKey
+	authSecret []byte
+	gone       bool
+	// Statuses to answer the next requests with instead of accepting them
+	failures []int
+}
+
+// FakePushMessage is a message the fake service accepted.
+type FakePushMessage struct {
+	Token   string
+	TTL     int
+	Urgency string
+	Topic   string
+	Payload []byte
+}
+
+func NewFakePushService(vapidPublicKey []byte) *FakePushService {
+	return &FakePushService{
+		VAPIDPublicKey: vapidPublicKey,
+		subscriptions:  map[string]*fakePushSubscription{},
+	}
+}
+
+// Subscribe creates a subscription as a browser would, returning its token
+// and the endpoint and keys to register with the server. baseURL is where
+// the service is being served.
+func (f *FakePushService) Subscribe(baseURL string) (token, endpoint, p256dh, auth string, err error) {
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	authSecret := make([]byte, 16)
+	if _, err := rand.Read(authSecret); err != nil {
+		return "", "", "", "", err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", "", err
+	}
+	token = hex.EncodeToString(b)
+
+	f.mu.Lock()
+	f.subscriptions[token] = &fakePushSubscription{private: private, authSecret: authSecret}
+	f.mu.Unlock()
+
+	endpoint = strings.TrimSuffix(baseURL, "/") + "/push/" + token
+	return token, endpoint, b64.EncodeToString(private.PublicKey().Bytes()), b64.EncodeToString(authSecret), nil
+}
+
+// Expire makes the subscription answer 410 Gone from now on, as one the
+// user has revoked does.
+func (f *FakePushService) Expire(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sub := f.subscriptions[token]; sub != nil {
+		sub.gone = true
+	}
+}
+
+// Fail answers the subscription's next requests with the given statuses,
+// such as 429 or 503, before accepting messages again.
+func (f *FakePushService) Fail(token string, statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sub := f.subscriptions[token]; sub != nil {
+		sub.failures = append(sub.failures, statuses...)
+	}
+}
+
+// Received returns the messages accepted so far.
+func (f *FakePushService) Received() []FakePushMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakePushMessage(nil), f.received...)
+}
+
+func (f *FakePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, "/push/")
+	if !ok || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub := f.subscriptions[token]
+	if sub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if sub.gone {
+		http.Error(w, "subscription expired", http.StatusGone)
+		return
+	}
+	if len(sub.failures) > 0 {
+		status := sub.failures[0]
+		sub.failures = sub.failures[1:]
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if err := f.checkVAPID(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ttl, err := strconv.Atoi(r.Header.Get("TTL"))
+	if err != nil || ttl < 0 {
+		http.Error(w, "missing TTL", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" {
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, pushRecordSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > pushRecordSize {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	payload, err := decryptPushPayload(body, sub.private, sub.authSecret)
+	if err != nil {
+		http.Error(w, "undecryptable payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.received = append(f.received, FakePushMessage{
+		Token:   token,
+		TTL:     ttl,
+		Urgency: r.Header.Get("Urgency"),
+		Topic:   r.Header.Get("Topic"),
+		Payload: payload,
+	})
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkVAPID verifies a request's VAPID authorization the way a push
+// service does.
+func (f *FakePushService) checkVAPID(r *http.Request) error {
+	params, ok := strings.CutPrefix(r.Header.Get("Authorization"), "vapid ")
+	if !ok {
+		return fmt.Errorf("missing vapid authorization")
+	}
+	var tokenString, key string
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "t":
+			tokenString = value
+		case "k":
+			key = value
+		}
+	}
+	if key != b64.EncodeToString(f.VAPIDPublicKey) {
+		return fmt.Errorf("unexpected application server key")
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), f.VAPIDPublicKey)
+	if x == nil {
+		return fmt.Errorf("invalid application server key")
+	}
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return public, nil
+	})
+	if err != nil || !token.Valid {
+		return fmt.Errorf("invalid vapid token: %v", err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	if claims["aud"] != scheme+"://"+r.Host {
+		return fmt.Errorf("vapid token is for %v", claims["aud"])
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Unix(int64(exp), 0).After(time.Now().Add(24 * time.Hour)) {
+		return fmt.Errorf("vapid token expires more than a day out")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return fmt.Errorf("vapid token has no subject")
+	}
+	return nil
+}
+
+// decryptPushPayload reverses encryptPushPayload, as a browser would.
+func decryptPushPayload(body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("truncated aes128gcm header")
+	}
+	salt := body[:16]
+	idLen := int(body[20])
+	if len(body) < 21+idLen {
+		return nil, errors.New("truncated aes128gcm header")
+	}
+	asPublic := body[21 : 21+idLen]
+
+	as, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := uaPrivate.ECDH(as)
+	if err != nil {
+		return nil, err
+	}
+	cek, nonce := pushContentKeys(ecdhSecret, authSecret, uaPrivate.PublicKey().Bytes(), asPublic, salt)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		return nil, errors.New("missing last record delimiter")
+	}
+	return record[:len(record)-1], nil
+}
+
+type memoryPushSubscriptions struct {
+	mu      sync.Mutex
+	used    map[int]int
+	deleted map[int]bool
+}
+
+func (m *memoryPushSubscriptions) Used(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used[id]++
+	return nil
+}
+
+func (m *memoryPushSubscriptions) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted[id] = true
+	return nil
+}
+
+// newTestPushSender serves a fake push service and returns a sender for
+// it. No workers run, so tests drive deliveries one attempt at a time.
+func newTestPushSender(t *testing.T) (*WebPushSender, *FakePushService, *memoryPushSubscriptions, string) {
+	t.Helper()
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := vapidKeysFromScalar(private.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := NewFakePushService(keys.Public)
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	store := &memoryPushSubscriptions{used: map[int]int{}, deleted: map[int]bool{}}
+	sender := &WebPushSender{
+		Keys:          keys,
+		Subject:       "mailto:test@example.com",
+		Client:        server.Client(),
+		AllowEndpoint: func(string) bool { return true },
+		Store:         store,
+		RetryBase:     pushRetryBase,
+		queue:         make(chan *pushJob, pushQueueSize),
+	}
+	return sender, fake, store, server.URL
+}
+
+func subscribeFake(t *testing.T, fake *FakePushService, baseURL string, id int) (string, PushSubscription) {
+	t.Helper()
+	token, endpoint, p256dh, auth, err := fake.Subscribe(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validPushKeys(p256dh, auth); err != nil {
+		t.Fatal(err)
+	}
+	return token, PushSubscription{ID: id, UserID: 1, Endpoint: endpoint, P256dh: p256dh, Auth: auth}
+}
+
+func queuedJob(t *testing.T, sender *WebPushSender) *pushJob {
+	t.Helper()
+	select {
+	case job := <-sender.queue:
+		return job
+	default:
+		t.Fatal("no push message queued")
+		return nil
+	}
+}
+
+// The example from RFC 8291 Appendix A
+func TestEncryptPushPayloadMatchesRFC8291(t *testing.T) {
+	asPrivate, _ := decodeB64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	uaPrivate, _ := decodeB64("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")
+	authSecret, _ := decodeB64("BTBZMqHH6r4Tts7J_aSIgg")
+	salt, _ := decodeB64("DGv6ra1nlYgDCS1FRnbzlw")
+	as, err := ecdh.P256().NewPrivateKey(asPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ua, err := ecdh.P256().NewPrivateKey(uaPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	body, err := encryptPushPayloadWith(plaintext, ua.PublicKey().Bytes(), authSecret, as, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := b64.EncodeToString(body); got != want {
+		t.Errorf("encrypted body = %s, want %s", got, want)
+	}
+
+	decrypted, err := decryptPushPayload(body, ua, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestWebPushDeliversEncryptedMessage(t *testing.T) {
+	sender, fake, store, baseURL := newTestPushSender(t)
+	token, sub := subscribeFake(t, fake, baseURL, 1)
+
+	payload := []byte(`{"type":"match_found","title":"Match found"}`)
+	sender.Send([]PushSubscription{sub}, PushMessage{
+		Payload: payload,
+		TTL:     time.Minute,
+		Urgency: PushUrgencyHigh,
+		Topic:   "match",
+	})
+	if _, retry := sender.deliver(queuedJob(t, sender)); retry {
+		t.Fatal("delivery was retried")
+	}
+
+	received := fake.Received()
+	if len(received) != 1 {
+		t.Fatalf("received %d messages, want 1", len(received))
+	}
+	msg := received[0]
+	if msg.Token != token || !bytes.Equal(msg.Payload, payload) {
+		t.Errorf("received %q for %s, want %q for %s", msg.Payload, msg.Token, payload, token)
+	}
+	if msg.TTL < 55 || msg.TTL > 60 {
+		t.Errorf("TTL = %d, want about 60", msg.TTL)
+	}
+	if msg.Urgency != PushUrgencyHigh || msg.Topic != "match" {
+		t.Errorf("urgency %q, topic %q", msg.Urgency, msg.Topic)
+	}
+	if store.used[sub.ID] != 1 {
+		t.Errorf("subscription marked used %d times, want 1", store.used[sub.ID])
+	}
+}
+
+func TestWebPushSkipsUnknownPushServices(t *testing.T) {
+	sender, fake, _, baseURL := newTestPushSender(t)
+	_, sub := subscribeFake(t, fake, baseURL, 1)
+	sender.AllowEndpoint = knownPushService
+
+	sender.Send([]PushSubscription{sub}, PushMessage{Payload: []byte(`{}`), TTL: time.Minute})
+	if len(sender.queue) != 0 {
+		t.Errorf("queued a message for %s", sub.Endpoint)
+	}
+}
+
+func TestWebPushRetriesWithBackoff(t *testing.T) {
+	sender, fake, _, baseURL := newTestPushSender(t)
+	token, sub := subscribeFake(t, fake, baseURL, 1)
+	fake.Fail(token, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	sender.Send([]PushSubscription{sub}, PushMessage{Payload: []byte(`{}`), TTL: 30 * time.Second})
+	job := queuedJob(t, sender)
+
+	for _, want := range []time.Duration{pushRetryBase, 2 * pushRetryBase} {
+		backoff, retry := sender.deliver(job)
+		if !retry || backoff != want {
+			t.Fatalf("deliver = %v, %v; want retry after %v", backoff, retry, want)
+		}
+	}
+	if _, retry := sender.deliver(job); retry {
+		t.Fatal("delivered message was retried")
+	}
+
+	received := fake.Received()
+	if len(received) != 1 {
+		t.Fatalf("received %d messages, want 1", len(received))
+	}
+	if received[0].TTL > 30 {
+		t.Errorf("retry sent TTL %d, more than the message had left", received[0].TTL)
+	}
+}
+
+func TestWebPushHonoursRetryAfter(t *testing.T) {
+	sender, fake, _, baseURL := newTestPushSender(t)
+	sender.RetryBase = 100 * time.Millisecond
+	token, sub := subscribeFake(t, fake, baseURL, 1)
+	// The fake asks for a second's wait
+	fake.Fail(token, http.StatusTooManyRequests)
+
+	sender.Send([]PushSubscription{sub}, PushMessage{Payload: []byte(`{}`), TTL: time.Minute})
+	backoff, retry := sender.deliver(queuedJob(t, sender))
+	if !retry || backoff != time.Second {
+		t.Errorf("deliver = %v, %v; want retry after 1s", backoff, retry)
+	}
+}
+
+func TestWebPushGivesUpWhenTTLRunsOut(t *testing.T) {
+	sender, fake, _, baseURL := newTestPushSender(t)
+	token, sub := subscribeFake(t, fake, baseURL, 1)
+	fake.Fail(token, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	// The first retry fits in the TTL, the second wouldn't
+	sender.Send([]PushSubscription{sub}, PushMessage{Payload: []byte(`{}`), TTL: pushRetryBase + time.Second})
+	job := queuedJob(t, sender)
+	if _, retry := sender.deliver(job); !retry {
+		t.Fatal("first failure wasn't retried")
+	}
+	if _, retry := sender.deliver(job); retry {
+		t.Fatal("retried past the message's TTL")
+	}
+	if received := fake.Received(); len(received) != 0 {
+		t.Errorf("received %d messages, want none", len(received))
+	}
+}
+
+func TestWebPushPrunesGoneSubscriptions(t *testing.T) {
+	sender, fake, store, baseURL := newTestPushSender(t)
+	token, expired := subscribeFake(t, fake, baseURL, 1)
+	fake.Expire(token)
+	unknown := PushSubscription{ID: 2, Endpoint: baseURL + "/push/unknown", P256dh: expired.P256dh, Auth: expired.Auth}
+
+	sender.Send([]PushSubscription{expired, unknown}, PushMessage{Payload: []byte(`{}`), TTL: time.Minute})
+	for range []int{1, 2} {
+		if _, retry := sender.deliver(queuedJob(t, sender)); retry {
+			t.Error("message to a gone subscription was retried")
+		}
+	}
+	if !store.deleted[expired.ID] {
+		t.Error("subscription answering 410 wasn't deleted")
+	}
+	if !store.deleted[unknown.ID] {
+		t.Error("subscription answering 404 wasn't deleted")
+	}
+}
+
+func TestKnownPushService(t *testing.T) {
+	tests := map[string]bool{
+		"https://fcm.googleapis.com/fcm/send/abc":                  true,
+		"https://updates.push.services.mozilla.com/wpush/v2/abc":   true,
+		"https://web.push.apple.com/abc":                           true,
+		"https://wns2-par02p.notify.windows.com/w/?token=abc":      true,
+		"https://fcm.googleapis.com:443/fcm/send/abc":              true,
+		"http://fcm.googleapis.com/fcm/send/abc":                   false,
+		"https://fcm.googleapis.com:8443/fcm/send/abc":             false,
+		"https://fcm.googleapis.com.attacker.example/fcm/send/abc": false,
+		"https://evilpush.apple.com.example/abc":                   false,
+		"https://notpush.apple.com/abc":                            false,
+		"https://user@fcm.googleapis.com/fcm/send/abc":             false,
+		"https://127.0.0.1/push/abc":                               false,
+		"https://169.254.169.254/latest/meta-data":                 false,
+		"https://localhost/push/abc":                               false,
+	}
+	for endpoint, want := range tests {
+		if got := knownPushService(endpoint); got != want {
+			t.Errorf("knownPushService(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 server: enough for the JSON text messages the gateway
+// sends, without extensions or subprotocols.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxMessageBytes = 64 << 10
+	wsWriteTimeout    = 10 * time.Second
+	wsAcceptGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// wsAllowedOrigins mirrors the CORS configuration; browsers don't apply CORS
+// to WebSocket handshakes, so the server has to check Origin itself.
+var wsAllowedOrigins = map[string]bool{
+	"http://localhost:3000": true,
+}
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	closed  bool
+	// OnPong, if set, is called from ReadMessage for each pong received
+	OnPong func()
+}
+
+// headerContainsToken reports whether a comma-separated header contains token.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. On failure it has already written an HTTP error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !wsAllowedOrigins[origin] {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q not allowed", origin)
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer cannot hijack")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// reassembling fragments along the way. It returns errWebSocketClosed once
+// the peer has closed the connection.
+func (c *wsConn) ReadMessage() (opcode byte, payload []byte, err error) {
+	var message []byte
+	messageOpcode := byte(0)
+
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			if c.OnPong != nil {
+				c.OnPong()
+			}
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, data)
+			c.Close()
+			return 0, nil, errWebSocketClosed
+		case wsOpText, wsOpBinary:
+			if messageOpcode != 0 {
+				return 0, nil, c.fail(1002, "expected continuation frame")
+			}
+			messageOpcode = op
+		case wsOpContinuation:
+			if messageOpcode == 0 {
+				return 0, nil, c.fail(1002, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(1002, "unknown opcode")
+		}
+
+		if len(message)+len(data) > wsMaxMessageBytes {
+			return 0, nil, c.fail(1009, "message too large")
+		}
+		message = append(message, data...)
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(1002, "reserved bits set")
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// Control frames must be short and unfragmented
+	if opcode >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, c.fail(1002, "invalid control frame")
+	}
+	// Clients must mask everything they send
+	if !masked {
+		return false, 0, nil, c.fail(1002, "unmasked client frame")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageBytes {
+		return false, 0, nil, c.fail(1009, "message too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return errWebSocketClosed
+	}
+
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) <= 125:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteJSON sends v as a single text message.
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteText(data)
+}
+
+// WriteText sends data, which must be valid UTF-8, as a single text message.
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+// SetReadDeadline bounds how long ReadMessage may wait; once it passes,
+// ReadMessage fails with a timeout.
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Ping sends a ping control frame.
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// fail sends a close frame with a protocol error and closes the connection.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.CloseWithCode(code, reason)
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+// CloseWithCode sends a close frame before closing the connection.
+func (c *wsConn) CloseWithCode(code uint16, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+	c.writeFrame(wsOpClose, payload)
+	c.Close()
+}
+
+func (c *wsConn) Close() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a frame the way a browser would send it: masked,
+// unless mask is nil.
+func clientFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame decodes one frame sent by the server, which must not be
+// masked.
+func readServerFrame(r io.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	if header[1]&0x80 != 0 {
+		return false, 0, nil, errors.New("server frame is masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	return header[0]&0x80 != 0, header[0] & 0x0F, payload, nil
+}
+
+// newPipeConn returns a server connection and the client end of its pipe.
+func newPipeConn(t *testing.T) (*wsConn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return &wsConn{conn: server, reader: bufio.NewReader(server)}, client
+}
+
+var testMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+func TestWebSocketReadsMaskedText(t *testing.T) {
+	conn, client := newPipeConn(t)
+	go client.Write(clientFrame(true, wsOpText, []byte("Hello"), testMask))
+
+	opcode, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpText || string(payload) != "Hello" {
+		t.Errorf("read opcode %d %q, want text %q", opcode, payload, "Hello")
+	}
+}
+
+func TestWebSocketUnmasksRFCExample(t *testing.T) {
+	conn, client := newPipeConn(t)
+	// The masked "Hello" frame from RFC 6455 section 5.7
+	frame := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	go client.Write(frame)
+
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "Hello" {
+		t.Errorf("unmasked %q, want %q", payload, "Hello")
+	}
+}
+
+func TestWebSocketReadsExtendedLengths(t *testing.T) {
+	for _, size := range []int{125, 126, 0xFFFF, 0x10000} {
+		if size > wsMaxMessageBytes {
+			continue
+		}
+		conn, client := newPipeConn(t)
+		payload := bytes.Repeat([]byte("x"), size)
+		go client.Write(clientFrame(true, wsOpBinary, payload, testMask))
+
+		opcode, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if opcode != wsOpBinary || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: read %d bytes with opcode %d", size, len(got), opcode)
+		}
+	}
+}
+
+func TestWebSocketReassemblesFragments(t *testing.T) {
+	conn, client := newPipeConn(t)
+	go func() {
+		client.Write(clientFrame(false, wsOpText, []byte("Hel"), testMask))
+		// Control frames may arrive between fragments
+		client.Write(clientFrame(true, wsOpPong, nil, testMask))
+		client.Write(clientFrame(true, wsOpContinuation, []byte("lo"), testMask))
+	}()
+
+	pongs := 0
+	conn.OnPong = func() { pongs++ }
+	opcode, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpText || string(payload) != "Hello" {
+		t.Errorf("read opcode %d %q, want text %q", opcode, payload, "Hello")
+	}
+	if pongs != 1 {
+		t.Errorf("OnPong called %d times, want 1", pongs)
+	}
+}
+
+func TestWebSocketAnswersPing(t *testing.T) {
+	conn, client := newPipeConn(t)
+	pong := make(chan []byte, 1)
+	go func() {
+		client.Write(clientFrame(true, wsOpPing, []byte("are you there"), testMask))
+		_, opcode, payload, err := readServerFrame(client)
+		if err != nil || opcode != wsOpPong {
+			payload = nil
+		}
+		pong <- payload
+		client.Write(clientFrame(true, wsOpText, []byte("done"), testMask))
+	}()
+
+	if _, payload, err := conn.ReadMessage(); err != nil || string(payload) != "done" {
+		t.Fatalf("read %q, %v", payload, err)
+	}
+	if got := <-pong; string(got) != "are you there" {
+		t.Errorf("pong payload %q, want the ping's", got)
+	}
+}
+
+func TestWebSocketRejectsProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   uint16
+	}{
+		{"unmasked", [][]byte{clientFrame(true, wsOpText, []byte("hi"), nil)}, 1002},
+		{"reserved bits", [][]byte{append([]byte{0xC1}, clientFrame(true, wsOpText, nil, testMask)[1:]...)}, 1002},
+		{"fragmented control", [][]byte{clientFrame(false, wsOpPing, nil, testMask)}, 1002},
+		{"long control", [][]byte{clientFrame(true, wsOpPing, make([]byte, 126), testMask)}, 1002},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil, testMask)}, 1002},
+		{"stray continuation", [][]byte{clientFrame(true, wsOpContinuation, []byte("x"), testMask)}, 1002},
+		{"interleaved message", [][]byte{
+			clientFrame(false, wsOpText, []byte("a"), testMask),
+			clientFrame(true, wsOpText, []byte("b"), testMask),
+		}, 1002},
+		{"too large", [][]byte{clientFrame(true, wsOpBinary, make([]byte, wsMaxMessageBytes+1), testMask)}, 1009},
+		{"too large in fragments", [][]byte{
+			clientFrame(false, wsOpBinary, make([]byte, wsMaxMessageBytes), testMask),
+			clientFrame(true, wsOpContinuation, []byte("x"), testMask),
+		}, 1009},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := newPipeConn(t)
+			closed := make(chan uint16, 1)
+			go func() {
+				for _, frame := range tt.frames {
+					client.Write(frame)
+				}
+			}()
+			go func() {
+				_, opcode, payload, err := readServerFrame(client)
+				if err != nil || opcode != wsOpClose || len(payload) < 2 {
+					closed <- 0
+					return
+				}
+				closed <- binary.BigEndian.Uint16(payload)
+			}()
+
+			if _, _, err := conn.ReadMessage(); err == nil {
+				t.Fatal("read succeeded")
+			}
+			if code := <-closed; code != tt.code {
+				t.Errorf("closed with code %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebSocketEchoesClose(t *testing.T) {
+	conn, client := newPipeConn(t)
+	closePayload := []byte{0x03, 0xE8}
+	echoed := make(chan byte, 1)
+	go func() {
+		client.Write(clientFrame(true, wsOpClose, closePayload, testMask))
+		_, opcode, _, _ := readServerFrame(client)
+		echoed <- opcode
+	}()
+
+	if _, _, err := conn.ReadMessage(); err != errWebSocketClosed {
+		t.Fatalf("read error %v, want %v", err, errWebSocketClosed)
+	}
+	if opcode := <-echoed; opcode != wsOpClose {
+		t.Errorf("answered close with opcode %d", opcode)
+	}
+	if err := conn.writeFrame(wsOpText, []byte("late")); err != errWebSocketClosed {
+		t.Errorf("write after close: %v, want %v", err, errWebSocketClosed)
+	}
+}
+
+func TestWebSocketWritesUnmaskedFrames(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		conn, client := newPipeConn(t)
+		payload := bytes.Repeat([]byte("y"), size)
+		go conn.writeFrame(wsOpText, payload)
+
+		fin, opcode, got, err := readServerFrame(client)
+		if err != nil || !fin || opcode != wsOpText || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: got fin %v opcode %d and %d bytes", size, fin, opcode, len(got))
+		}
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.writeFrame(wsOpText, []byte("welcome"))
+	}))
+	defer server.Close()
+
+	handshake := func(headers map[string]string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		request := "GET / HTTP/1.1\r\nHost: example.com\r\n"
+		for name, value := range headers {
+			request += name + ": " + value + "\r\n"
+		}
+		c.Write([]byte(request + "\r\n"))
+
+		reader := bufio.NewReader(c)
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, reader
+	}
+	valid := func() map[string]string {
+		return map[string]string{
+			"Connection":            "keep-alive, Upgrade",
+			"Upgrade":               "websocket",
+			"Sec-WebSocket-Version": "13",
+			// The sample nonce from RFC 6455 section 1.3
+			"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==",
+			"Origin":            "http://localhost:3000",
+		}
+	}
+
+	response, reader := handshake(valid())
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", response.StatusCode)
+	}
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", accept)
+	}
+	if _, _, payload, err := readServerFrame(reader); err != nil || string(payload) != "welcome" {
+		t.Errorf("first message %q, want %q", payload, "welcome")
+	}
+
+	rejected := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"foreign origin", "Origin", "https://evil.example", http.StatusForbidden},
+		{"old version", "Sec-WebSocket-Version", "8", http.StatusUpgradeRequired},
+		{"short key", "Sec-WebSocket-Key", "c2hvcnQ=", http.StatusBadRequest},
+		{"no upgrade", "Upgrade", "h2c", http.StatusBadRequest},
+	}
+	for _, tt := range rejected {
+		headers := valid()
+		headers[tt.header] = tt.value
+		if response, _ := handshake(headers); response.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, response.StatusCode, tt.status)
+		}
+	}
+}
@@ -1,21 +1,47 @@
+"use client";
 import { NavBar } from "@/components/NavBar";
+import { HomeTimeline } from "@/components/HomeTimeline";
 import { UserFeed } from "@/components/UserFeed";
-import React from "react";
+import { auth } from "@/services/auth";
+import React, { useEffect, useState } from "react";
 
 export default function AllUsersFeed() {
+  const [isAuthenticated, setIsAuthenticated] = useState<boolean | null>(null);
+
+  useEffect(() => {
+    setIsAuthenticated(auth.isAuthenticated());
+  }, []);
+
   return (
     <section className="max-w-7xl mx-auto">
       <div className="p-4">
         <NavBar />
-        <div className="my-8">
-          <div className="text-3xl font-semibold">
-            All <span className="font-serifItalic">Users</span>
-          </div>
-          <p className="text-sm mt-1">
-            Currently , you are viewing the feed of all users in the airdate.
-          </p>
-        </div>
-        <UserFeed position="feed" />
+        {isAuthenticated && (
+          <>
+            <div className="my-8">
+              <div className="text-3xl font-semibold">
+                Your <span className="font-serifItalic">Feed</span>
+              </div>
+              <p className="text-sm mt-1">
+                What the players you follow have been up to.
+              </p>
+            </div>
+            <HomeTimeline />
+          </>
+        )}
+        {isAuthenticated === false && (
+          <>
+            <div className="my-8">
+              <div className="text-3xl font-semibold">
+                All <span className="font-serifItalic">Users</span>
+              </div>
+              <p className="text-sm mt-1">
+                Sign in to see what the players you follow are up to.
+              </p>
+            </div>
+            <UserFeed position="feed" />
+          </>
+        )}
       </div>
     </section>
   );
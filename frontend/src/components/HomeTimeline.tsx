@@ -0,0 +1,176 @@
+"use client";
+import React, { useState, useEffect, useCallback } from "react";
+import Link from "next/link";
+import { api } from "../services/api";
+import { ApiError } from "../types/errors";
+import { Button } from "./ui/button";
+
+interface Activity {
+  id: number;
+  type:
+    | "connected_game"
+    | "followed"
+    | "lfg_post"
+    | "went_live"
+    | "earned_badge"
+    | "posted";
+  actor: string;
+  target?: string;
+  subjectId?: number;
+  game?: string;
+  badge?: string;
+  post?: Post;
+  createdAt: string;
+}
+
+interface Post {
+  id: number;
+  body: string;
+  attachments: { id: number }[];
+  reactions: { emoji: string; count: number; reacted: boolean }[];
+  commentCount: number;
+  editedAt?: string;
+}
+
+const badgeNames: Record<string, string> = {
+  trusted_teammate: "Trusted Teammate",
+  field_general: "Field General",
+  friendly_face: "Friendly Face",
+};
+
+function describe(activity: Activity) {
+  switch (activity.type) {
+    case "connected_game":
+      return <>connected {activity.game}</>;
+    case "followed":
+      return (
+        <>
+          followed{" "}
+          <Link href={`/profile/${activity.target}`} className="font-semibold">
+            {activity.target}
+          </Link>
+        </>
+      );
+    case "lfg_post":
+      return <>is looking for a group in {activity.game}</>;
+    case "went_live":
+      return <>started playing {activity.game}</>;
+    case "earned_badge":
+      return (
+        <>
+          earned the{" "}
+          {badgeNames[activity.badge ?? ""] ?? activity.badge} badge
+        </>
+      );
+    case "posted":
+      return <>posted{activity.post?.editedAt && " (edited)"}</>;
+  }
+}
+
+function PostSummary({ post }: { post: Post }) {
+  const photos = post.attachments.length;
+  return (
+    <div className="mt-2 space-y-1">
+      {post.body && <p className="whitespace-pre-wrap">{post.body}</p>}
+      <p className="text-sm text-gray-500 flex flex-wrap gap-3">
+        {photos > 0 && (
+          <span>{photos === 1 ? "1 photo" : `${photos} photos`}</span>
+        )}
+        {post.reactions.map((reaction) => (
+          <span
+            key={reaction.emoji}
+            className={reaction.reacted ? "font-semibold" : undefined}
+          >
+            {reaction.emoji} {reaction.count}
+          </span>
+        ))}
+        {post.commentCount > 0 && (
+          <span>
+            {post.commentCount === 1
+              ? "1 comment"
+              : `${post.commentCount} comments`}
+          </span>
+        )}
+      </p>
+    </div>
+  );
+}
+
+export function HomeTimeline() {
+  const [activities, setActivities] = useState<Activity[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | undefined>();
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState<string | null>(null);
+
+  const load = useCallback(async (cursor?: string) => {
+    setLoading(true);
+    try {
+      const response = await api.getTimeline(cursor);
+      setActivities((current) =>
+        cursor ? [...current, ...response.activities] : response.activities
+      );
+      setNextCursor(response.nextCursor);
+      setError(null);
+    } catch (error) {
+      const apiError = error as ApiError;
+      setError(apiError.message || "Failed to load your timeline");
+    } finally {
+      setLoading(false);
+    }
+  }, []);
+
+  useEffect(() => {
+    load();
+  }, [load]);
+
+  if (error) {
+    return <div className="text-red-500 text-center p-4">{error}</div>;
+  }
+
+  if (!loading && activities.length === 0) {
+    return (
+      <div className="text-center p-4 text-gray-500">
+        Nothing here yet. Follow some players to see what they&apos;re up to.
+      </div>
+    );
+  }
+
+  return (
+    <section className="space-y-4 max-w-2xl">
+      <ul className="divide-y divide-border">
+        {activities.map((activity) => (
+          <li key={activity.id} className="py-4 flex justify-between gap-4">
+            <div>
+              <p>
+                <Link
+                  href={`/profile/${activity.actor}`}
+                  className="font-semibold"
+                >
+                  {activity.actor}
+                </Link>{" "}
+                {describe(activity)}
+              </p>
+              {activity.post && <PostSummary post={activity.post} />}
+            </div>
+            <time
+              dateTime={activity.createdAt}
+              className="text-sm text-gray-500 shrink-0"
+            >
+              {new Date(activity.createdAt).toLocaleString()}
+            </time>
+          </li>
+        ))}
+      </ul>
+      {loading && (
+        <div className="flex justify-center items-center min-h-[100px]">
+          <div className="animate-spin rounded-full h-8 w-8 border-t-2 border-b-2 border-blue-500"></div>
+        </div>
+      )}
+      {!loading && nextCursor && (
+        <Button variant="outline" onClick={() => load(nextCursor)}>
+          Load more
+        </Button>
+      )}
+    </section>
+  );
+}
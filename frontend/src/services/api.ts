@@ -85,7 +85,7 @@ export const api = {
       }
 
       const data = await response.json();
-      return data || [];
+      return data?.users || [];
     } catch (error) {
       console.error('Error fetching users:', error);
       throw error;
@@ -308,6 +308,11 @@ export const api = {
     }
   },
 
+  getTimeline: async (cursor?: string) => {
+    const query = cursor ? `?cursor=${encodeURIComponent(cursor)}` : '';
+    return fetchWithAuth(`/timeline${query}`);
+  },
+
   checkApiHealth: async () => {
     try {
       const response = await fetch(`${API_BASE_URL}/health`);